@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const auditFileName = "audit.log"
+const auditQueryDefaultLimit = 100
+const auditQueryMaxLimit = 1000
+
+const (
+	outcomeOK     = "ok"
+	outcomeError  = "error"
+	outcomeDenied = "denied"
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"` // e.g. "session.spawn", "file.write", "auth.denied"
+	Outcome string    `json:"outcome"`
+	Key     string    `json:"key,omitempty"`
+	Origin  string    `json:"origin,omitempty"`
+	Remote  string    `json:"remote,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Session int32     `json:"session,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Count   int       `json:"count,omitempty"` // like events this entry stands for, if more than one
+}
+
+// from fills in who performed the action.
+func (e auditEntry) from(who principal) auditEntry {
+	e.Key = who.KeyName
+	e.Origin = who.Origin
+	e.Remote = who.RemoteAddr
+	return e
+}
+
+// withError sets the outcome from err.
+func (e auditEntry) withError(err error) auditEntry {
+	if err != nil {
+		e.Outcome = outcomeError
+		e.Error = err.Error()
+	} else if e.Outcome == "" {
+		e.Outcome = outcomeOK
+	}
+	return e
+}
+
+// auditSettings configures the audit log in config.json.
+type auditSettings struct {
+	Enabled      bool   `json:"enabled"`
+	Path         string `json:"path,omitempty"` // defaults to audit.log in the config directory
+	MaxSizeBytes int64  `json:"maxSizeBytes"`   // rotate once the file reaches this size
+	MaxFiles     int    `json:"maxFiles"`       // rotated files to keep (audit.log.1 ... audit.log.N)
+}
+
+// auditLogger appends JSON lines to the audit file, rotating it by size.
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+	path string
+	size int64
+}
+
+// Global audit logger.
+var audit = &auditLogger{}
+
+// auditFilePath returns the configured audit log path.
+func auditFilePath(settings auditSettings) (string, error) {
+	if settings.Path != "" {
+		return expandHome(settings.Path), nil
+	}
+	dir, err := conduitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, auditFileName), nil
+}
+
+// record appends an entry to the audit log. Failures are logged but never
+// block the operation being audited.
+func (al *auditLogger) record(e auditEntry) {
+	settings := currentConfig().Audit
+	if !settings.Enabled {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Outcome == "" {
+		e.Outcome = outcomeOK
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if err := al.open(settings); err != nil {
+		log.Printf("Audit log unavailable: %v", err)
+		return
+	}
+	if settings.MaxSizeBytes > 0 && al.size > 0 && al.size+int64(len(line)) > settings.MaxSizeBytes {
+		if err := al.rotate(settings.MaxFiles); err != nil {
+			log.Printf("Audit log rotation failed: %v", err)
+		} else if err := al.open(settings); err != nil {
+			log.Printf("Audit log unavailable: %v", err)
+			return
+		}
+	}
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		log.Printf("Audit log write failed: %v", err)
+	}
+}
+
+// open opens the audit file for appending if it isn't already open at the
+// configured path. The caller holds al.mu.
+func (al *auditLogger) open(settings auditSettings) error {
+	path, err := auditFilePath(settings)
+	if err != nil {
+		return err
+	}
+	if al.file != nil && al.path == path {
+		return nil
+	}
+	if al.file != nil {
+		al.file.Close()
+		al.file = nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	al.file, al.path, al.size = f, path, stat.Size()
+	return nil
+}
+
+// rotate shifts audit.log.N-1 to audit.log.N and so on, then moves the
+// current file to audit.log.1. The caller holds al.mu.
+func (al *auditLogger) rotate(keep int) error {
+	al.file.Close()
+	al.file = nil
+	if keep < 1 {
+		return os.Remove(al.path)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", al.path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", al.path, i), fmt.Sprintf("%s.%d", al.path, i+1))
+	}
+	return os.Rename(al.path, al.path+".1")
+}
+
+// close closes the audit file; the next record reopens it.
+func (al *auditLogger) close() {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.file != nil {
+		al.file.Close()
+		al.file = nil
+	}
+}
+
+// auditCLIAction records an administrative action run from the command line.
+func auditCLIAction(action string, err error) {
+	audit.record(auditEntry{Action: action, Remote: "cli"}.withError(err))
+}
+
+// --- Query Endpoint ---
+
+// auditQuery filters entries read back from the audit log.
+type auditQuery struct {
+	since, until time.Time
+	action       string // prefix match, e.g. "file." or "session.spawn"
+	key          string
+	remote       string
+	outcome      string
+	limit        int
+}
+
+func (q auditQuery) matches(e auditEntry) bool {
+	if !q.since.IsZero() && e.Time.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && e.Time.After(q.until) {
+		return false
+	}
+	if q.action != "" && !strings.HasPrefix(e.Action, q.action) {
+		return false
+	}
+	if q.key != "" && e.Key != q.key {
+		return false
+	}
+	if q.remote != "" && !strings.HasPrefix(e.Remote, q.remote) {
+		return false
+	}
+	return q.outcome == "" || e.Outcome == q.outcome
+}
+
+// auditHandler serves GET /audit, returning the most recent matching entries,
+// oldest first. It requires admin scope.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	q := auditQuery{
+		action:  params.Get("action"),
+		key:     params.Get("key"),
+		remote:  params.Get("remote"),
+		outcome: params.Get("outcome"),
+		limit:   auditQueryDefaultLimit,
+	}
+	var err error
+	if v := params.Get("since"); v != "" {
+		if q.since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "until must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.limit, err = strconv.Atoi(v); err != nil || q.limit < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if q.limit > auditQueryMaxLimit {
+			q.limit = auditQueryMaxLimit
+		}
+	}
+
+	entries, err := readAuditEntries(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// readAuditEntries scans the rotated files from oldest to newest and keeps the
+// last q.limit matches.
+func readAuditEntries(q auditQuery) ([]auditEntry, error) {
+	settings := currentConfig().Audit
+	path, err := auditFilePath(settings)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for i := settings.MaxFiles; i >= 1; i-- {
+		names = append(names, fmt.Sprintf("%s.%d", path, i))
+	}
+	names = append(names, path)
+
+	// Open the files under the lock, so a rotation can't move them between
+	// opens, but scan them without it: a rotation during the scan leaves the
+	// open files as they were, and audited operations aren't held up.
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	audit.mu.Lock()
+	for _, name := range names {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			audit.mu.Unlock()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	audit.mu.Unlock()
+
+	// Keep the newest q.limit matches in a ring.
+	ring := make([]auditEntry, 0, q.limit)
+	next := 0
+	for _, f := range files {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e auditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) != nil || !q.matches(e) {
+				continue
+			}
+			if len(ring) < q.limit {
+				ring = append(ring, e)
+			} else {
+				ring[next] = e
+				next = (next + 1) % q.limit
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return append(append([]auditEntry{}, ring[next:]...), ring[:next]...), nil
+}
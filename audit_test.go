@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNoteDenial(t *testing.T) {
+	denials.Lock()
+	saved := denials.seen
+	denials.seen = make(map[string]*denialCount)
+	denials.Unlock()
+	defer func() {
+		denials.Lock()
+		denials.seen = saved
+		denials.Unlock()
+	}()
+	withConfig(t, nil)
+
+	start := time.Now()
+	tests := []struct {
+		remote string
+		reason string
+		after  time.Duration
+		count  int
+		write  bool
+	}{
+		{"192.0.2.1:1000", "missing_key", 0, 1, true},
+		{"192.0.2.1:1001", "missing_key", time.Second, 0, false},
+		{"192.0.2.1:1002", "missing_key", 2 * time.Second, 0, false},
+		{"192.0.2.1:1003", "invalid_key", 3 * time.Second, 1, true},
+		{"192.0.2.2:1000", "missing_key", 4 * time.Second, 1, true},
+		{"192.0.2.1:1004", "missing_key", time.Minute, 3, true},
+		{"192.0.2.1:1005", "missing_key", 2 * time.Minute, 1, true},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		count, write := noteDenial(r, tt.reason, start.Add(tt.after))
+		if count != tt.count || write != tt.write {
+			t.Errorf("denial %d (%s %s): count %d, write %v; want %d, %v", i, tt.remote, tt.reason, count, write, tt.count, tt.write)
+		}
+	}
+}
+
+func TestReadAuditEntries(t *testing.T) {
+	dir := t.TempDir()
+	withConfig(t, func(cfg *conduitConfig) {
+		cfg.Audit = auditSettings{Enabled: true, Path: filepath.Join(dir, "audit.log"), MaxSizeBytes: 400, MaxFiles: 3}
+	})
+	defer audit.close()
+
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		action := "file.read"
+		if i%2 == 1 {
+			action = "session.spawn"
+		}
+		audit.record(auditEntry{Time: start.Add(time.Duration(i) * time.Minute), Action: action, Remote: "127.0.0.1:1", Detail: fmt.Sprint(i)})
+	}
+	// A few entries fit in each file, so the oldest have been rotated away.
+	details := func(q auditQuery) []string {
+		entries, err := readAuditEntries(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, e := range entries {
+			got = append(got, e.Detail)
+		}
+		return got
+	}
+	all := details(auditQuery{limit: 1000})
+	if len(all) == 0 || len(all) >= 20 || all[len(all)-1] != "19" {
+		t.Fatalf("read %q; want the newest entries, ending with 19", all)
+	}
+	for i := 1; i < len(all); i++ {
+		prev, _ := strconv.Atoi(all[i-1])
+		if n, _ := strconv.Atoi(all[i]); n != prev+1 {
+			t.Errorf("read %q; want them in order, oldest first", all)
+			break
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    auditQuery
+		want []string
+	}{
+		{"limit keeps the newest", auditQuery{limit: 2}, []string{"18", "19"}},
+		{"action prefix", auditQuery{action: "session.", limit: 2}, []string{"17", "19"}},
+		{"since", auditQuery{since: start.Add(18 * time.Minute), limit: 10}, []string{"18", "19"}},
+		{"until", auditQuery{until: start.Add(17 * time.Minute), action: "file.", limit: 2}, []string{"14", "16"}},
+		{"remote", auditQuery{remote: "192.0.2.", limit: 10}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := details(tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: read %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
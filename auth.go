@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Client Address Resolution ---
+
+// forwardingHeaders are headers a reverse proxy adds when relaying a request.
+// Their presence on a request from an untrusted peer means we cannot know who
+// the real client is.
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded"}
+
+// parseTrustedProxies parses a comma-separated list of IPs and CIDR ranges.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %w", entry, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy reports whether ip belongs to one of the configured trusted
+// proxy ranges. Requests arriving from one of these networks may supply the
+// real client address via X-Forwarded-For; requests from anywhere else may not.
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range currentConfig().trustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP address of the directly connected peer.
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// isForwarded reports whether the request carries any reverse proxy headers.
+func isForwarded(r *http.Request) bool {
+	for _, h := range forwardingHeaders {
+		if r.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP determines the address of the client that originated the request.
+// X-Forwarded-For is only honoured when the direct peer is a trusted proxy, and
+// is walked right to left so a client cannot prepend a spoofed address. It
+// returns nil when the real client cannot be determined.
+func clientIP(r *http.Request) net.IP {
+	ip := peerIP(r)
+	if ip == nil {
+		return nil
+	}
+	if !isTrustedProxy(ip) {
+		if isForwarded(r) {
+			// An untrusted peer relaying someone else's request. This is the
+			// "local reverse proxy" case: the peer looks like loopback, but the
+			// client is not.
+			return nil
+		}
+		return ip
+	}
+	if len(r.Header.Values("X-Forwarded-For")) == 0 {
+		if isForwarded(r) {
+			// Relayed with only headers we don't read.
+			return nil
+		}
+		// The proxy's own request.
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// A malformed entry means the chain can't be trusted past this point.
+			return nil
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		ip = hop
+	}
+	// Every hop was a trusted proxy; the left-most is the best we know.
+	return ip
+}
+
+// isLoopbackRequest reports whether the request originated on this machine,
+// taking trusted proxies into account.
+func isLoopbackRequest(r *http.Request) bool {
+	ip := clientIP(r)
+	return ip != nil && ip.IsLoopback()
+}
+
+// loopbackHost reports whether the request's Host header names this machine
+// as a local client would: localhost, a loopback address, or the name Conduit
+// was told to listen on. A page that rebinds its own DNS name to 127.0.0.1
+// still sends that name, so this keeps it from passing as a local client.
+func loopbackHost(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return host != "" && strings.EqualFold(host, listenFlag)
+}
+
+// describeClient formats the request's peer and resolved client for logging.
+func describeClient(r *http.Request) string {
+	ip := clientIP(r)
+	if ip == nil {
+		return fmt.Sprintf("%s (forwarded, client unknown)", r.RemoteAddr)
+	}
+	if peer := peerIP(r); peer != nil && !peer.Equal(ip) {
+		return fmt.Sprintf("%s (via %s)", ip, r.RemoteAddr)
+	}
+	return r.RemoteAddr
+}
+
+// checkListenAddress warns when the server is about to accept connections from
+// beyond this machine without an API key to protect it.
+func checkListenAddress(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() || host == "localhost" {
+		return
+	}
+	if requiredAPIKey == "" {
+		log.Printf("[SECURITY] Warning: listening on %s with no API key configured. Only browser clients from allowed origins will be able to connect remotely. Run with --key to create one.", addr)
+	} else {
+		log.Printf("[SECURITY] Listening on non-loopback address %s. No-origin clients must present the API key.", addr)
+	}
+}
+
+// --- Principals ---
+
+// defaultKeyName is the name recorded for requests made with the API key
+// created by --key.
+const defaultKeyName = "default"
+
+// principal describes who made an authorized request, for the audit log and
+// scope checks.
+type principal struct {
+	KeyName    string // set when authorized by an API key
+	Origin     string // browser origin, if any
+	RemoteAddr string // client address, resolved through trusted proxies
+	Admin      bool   // may use admin endpoints such as /audit
+}
+
+// Denials are written to the audit log at most once per deniedAuditInterval
+// for each client and reason, and at most maxTrackedDenials clients are
+// remembered for that, so a flood of bad requests can't rotate other entries
+// out of the log.
+const (
+	deniedAuditInterval = time.Minute
+	maxTrackedDenials   = 1000
+)
+
+// denialCount is the denials of one client for one reason since the last
+// entry written for them.
+type denialCount struct {
+	written    time.Time
+	suppressed int
+}
+
+var denials = struct {
+	sync.Mutex
+	seen map[string]*denialCount
+}{seen: make(map[string]*denialCount)}
+
+// noteDenial counts a denial and reports whether to write an entry for it,
+// and how many denials the entry stands for.
+func noteDenial(r *http.Request, reason string, now time.Time) (int, bool) {
+	ip := clientIP(r)
+	if ip == nil {
+		ip = peerIP(r)
+	}
+	key := ip.String() + " " + reason
+	denials.Lock()
+	defer denials.Unlock()
+	if d, ok := denials.seen[key]; ok {
+		if now.Sub(d.written) < deniedAuditInterval {
+			d.suppressed++
+			return 0, false
+		}
+		count := d.suppressed + 1
+		d.written, d.suppressed = now, 0
+		return count, true
+	}
+	if len(denials.seen) >= maxTrackedDenials {
+		oldest := ""
+		for k, d := range denials.seen {
+			if oldest == "" || d.written.Before(denials.seen[oldest].written) {
+				oldest = k
+			}
+		}
+		delete(denials.seen, oldest)
+	}
+	denials.seen[key] = &denialCount{written: now}
+	return 1, true
+}
+
+// denyRequest records an authorization failure and returns false, so callers
+// can `return who, denyRequest(...)`.
+func denyRequest(r *http.Request, who principal, reason string) bool {
+	metricAuthDenied.inc(reason)
+	count, ok := noteDenial(r, reason, time.Now())
+	if !ok {
+		return false
+	}
+	if count == 1 {
+		count = 0
+	}
+	audit.record(auditEntry{
+		Action:  "auth.denied",
+		Outcome: outcomeDenied,
+		Detail:  reason,
+		Path:    r.URL.Path,
+		Count:   count,
+	}.from(who))
+	return false
+}
+
+// requireAdmin authorizes a REST request and checks it has admin scope,
+// writing the error response if not.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (principal, bool) {
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return who, false
+	}
+	if !who.Admin {
+		log.Printf("[SECURITY] Denied: %s requires admin scope (request from %s)", r.URL.Path, who.RemoteAddr)
+		denyRequest(r, who, "admin_scope_required")
+		http.Error(w, "Forbidden: admin scope required", http.StatusForbidden)
+		return who, false
+	}
+	return who, true
+}
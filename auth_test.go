@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withConfig publishes the default configuration, changed by change, for the
+// rest of the test. The audit log is off.
+func withConfig(t *testing.T, change func(cfg *conduitConfig)) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Audit.Enabled = false
+	if change != nil {
+		change(cfg)
+	}
+	saved := activeConfig.Load()
+	activeConfig.Store(cfg)
+	t.Cleanup(func() { activeConfig.Store(saved) })
+}
+
+func TestLoopbackHost(t *testing.T) {
+	withConfig(t, nil)
+	savedKey, savedListen := requiredAPIKey, listenFlag
+	defer func() { requiredAPIKey, listenFlag = savedKey, savedListen }()
+	listenFlag = "devbox"
+
+	tests := []struct {
+		host  string
+		key   string // the key configured, and sent
+		ok    bool
+		admin bool
+	}{
+		{"localhost:3022", "", true, true},
+		{"LOCALHOST.:3022", "", true, true},
+		{"app.localhost:3022", "", true, true},
+		{"127.0.0.1:3022", "", true, true},
+		{"127.0.0.2", "", true, true},
+		{"[::1]:3022", "", true, true},
+		{"[::1]", "", true, true},
+		{"devbox:3022", "", true, true},
+		{"evil.example:3022", "", false, false},
+		{"127.0.0.1.nip.io:3022", "", false, false},
+		{"localhost.evil.example", "", false, false},
+		{"10.0.0.5:3022", "", false, false},
+		{"", "", false, false},
+		{"evil.example:3022", "secret", true, true},
+	}
+	for _, tt := range tests {
+		requiredAPIKey = tt.key
+		r := httptest.NewRequest("GET", "/files?path=.ssh/id_rsa", nil)
+		r.RemoteAddr = "127.0.0.1:50000"
+		r.Host = tt.host
+		if tt.key != "" {
+			r.Header.Set("X-Conduit-Key", tt.key)
+		}
+		who, ok := authorizeRequest(r)
+		if ok != tt.ok || who.Admin != tt.admin {
+			t.Errorf("Host %q, key %q: ok %v, admin %v; want %v, %v", tt.host, tt.key, ok, who.Admin, tt.ok, tt.admin)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"10.0.0.1", []string{"10.0.0.1/32"}, true},
+		{" 10.0.0.1 , 192.168.0.0/16,,::1", []string{"10.0.0.1/32", "192.168.0.0/16", "::1/128"}, true},
+		{"::ffff:10.0.0.1", []string{"10.0.0.1/32"}, true},
+		{"fd00::/8", []string{"fd00::/8"}, true},
+		{"proxy.example", nil, false},
+		{"10.0.0.0/33", nil, false},
+	}
+	for _, tt := range tests {
+		nets, err := parseTrustedProxies(tt.list)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseTrustedProxies(%q) error %v; want ok %v", tt.list, err, tt.ok)
+			continue
+		}
+		var got []string
+		for _, n := range nets {
+			got = append(got, n.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTrustedProxies(%q) = %q; want %q", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	withConfig(t, func(cfg *conduitConfig) {
+		cfg.trustedNets, _ = parseTrustedProxies("10.0.0.0/8")
+	})
+	tests := []struct {
+		name    string
+		remote  string
+		xff     []string
+		headers map[string]string
+		want    string // "" for unknown
+	}{
+		{"direct client", "192.0.2.1:5000", nil, nil, "192.0.2.1"},
+		{"direct loopback", "127.0.0.1:5000", nil, nil, "127.0.0.1"},
+		{"direct IPv6 loopback", "[::1]:5000", nil, nil, "::1"},
+		{"address without port", "192.0.2.1", nil, nil, "192.0.2.1"},
+		{"bad address", "nonsense", nil, nil, ""},
+		{"untrusted loopback peer relaying", "127.0.0.1:5000", []string{"203.0.113.5"}, nil, ""},
+		{"untrusted loopback peer relaying loopback", "127.0.0.1:5000", []string{"127.0.0.1"}, nil, ""},
+		{"untrusted peer with X-Real-Ip", "127.0.0.1:5000", nil, map[string]string{"X-Real-Ip": "127.0.0.1"}, ""},
+		{"untrusted peer with Forwarded", "192.0.2.1:5000", nil, map[string]string{"Forwarded": "for=127.0.0.1"}, ""},
+		{"trusted proxy's own request", "10.0.0.1:5000", nil, nil, "10.0.0.1"},
+		{"trusted proxy with only Forwarded", "10.0.0.1:5000", nil, map[string]string{"Forwarded": "for=127.0.0.1"}, ""},
+		{"trusted proxy", "10.0.0.1:5000", []string{"203.0.113.5"}, nil, "203.0.113.5"},
+		{"spoofed hop on the left ignored", "10.0.0.1:5000", []string{"127.0.0.1, 203.0.113.5"}, nil, "203.0.113.5"},
+		{"trusted hops skipped", "10.0.0.1:5000", []string{"203.0.113.5, 10.0.0.2 , 10.0.0.3"}, nil, "203.0.113.5"},
+		{"headers joined in order", "10.0.0.1:5000", []string{"127.0.0.1", "203.0.113.5"}, nil, "203.0.113.5"},
+		{"loopback client via trusted proxy", "10.0.0.1:5000", []string{"127.0.0.1"}, nil, "127.0.0.1"},
+		{"all hops trusted", "10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, nil, "10.0.0.3"},
+		{"malformed hop past the client ignored", "10.0.0.1:5000", []string{"garbage, 203.0.113.5"}, nil, "203.0.113.5"},
+		{"malformed hop stops the chain", "10.0.0.1:5000", []string{"203.0.113.5, garbage"}, nil, ""},
+		{"empty hop stops the chain", "10.0.0.1:5000", []string{""}, nil, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		got := ""
+		if ip := clientIP(r); ip != nil {
+			got = ip.String()
+		}
+		if got != tt.want {
+			t.Errorf("%s: clientIP = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizeWithoutOrigin(t *testing.T) {
+	savedKey := requiredAPIKey
+	defer func() { requiredAPIKey = savedKey }()
+	tests := []struct {
+		name   string
+		strict bool
+		key    string // the key configured
+		remote string
+		xff    string
+		sent   string // the key sent, in the header or as ?key= if it starts with ?
+		ok     bool
+		admin  bool
+	}{
+		{"loopback", false, "", "127.0.0.1:5000", "", "", true, true},
+		{"loopback with a key configured", false, "secret", "127.0.0.1:5000", "", "", true, true},
+		{"strict loopback without a key configured", true, "", "127.0.0.1:5000", "", "", false, false},
+		{"strict loopback without the key", true, "secret", "127.0.0.1:5000", "", "", false, false},
+		{"strict loopback with a wrong key", true, "secret", "127.0.0.1:5000", "", "wrong", false, false},
+		{"strict loopback with the key", true, "secret", "127.0.0.1:5000", "", "secret", true, true},
+		{"remote without a key configured", false, "", "192.0.2.1:5000", "", "", false, false},
+		{"remote without the key", false, "secret", "192.0.2.1:5000", "", "", false, false},
+		{"remote with the key", false, "secret", "192.0.2.1:5000", "", "secret", true, true},
+		{"remote with the key as a parameter", false, "secret", "192.0.2.1:5000", "", "?secret", true, true},
+		{"loopback peer relayed by an untrusted proxy", false, "", "127.0.0.1:5000", "203.0.113.5", "", false, false},
+		{"loopback peer relaying a spoofed loopback", false, "secret", "127.0.0.1:5000", "127.0.0.1", "", false, false},
+		{"untrusted proxy with the key", false, "secret", "127.0.0.1:5000", "203.0.113.5", "secret", true, true},
+		{"loopback client via a trusted proxy", false, "", "10.0.0.1:5000", "127.0.0.1", "", true, true},
+		{"remote client via a trusted proxy", false, "", "10.0.0.1:5000", "203.0.113.5", "", false, false},
+	}
+	for _, tt := range tests {
+		withConfig(t, func(cfg *conduitConfig) {
+			cfg.StrictAuth = tt.strict
+			cfg.trustedNets, _ = parseTrustedProxies("10.0.0.0/8")
+		})
+		requiredAPIKey = tt.key
+		target := "/sessions"
+		if strings.HasPrefix(tt.sent, "?") {
+			target += "?key=" + tt.sent[1:]
+		}
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = tt.remote
+		r.Host = "localhost:3022"
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.sent != "" && !strings.HasPrefix(tt.sent, "?") {
+			r.Header.Set("X-Conduit-Key", tt.sent)
+		}
+		who, ok := authorizeRequest(r)
+		if ok != tt.ok || who.Admin != tt.admin {
+			t.Errorf("%s: ok %v, admin %v; want %v, %v", tt.name, ok, who.Admin, tt.ok, tt.admin)
+		}
+	}
+}
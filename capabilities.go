@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Protocol versions change only for incompatible changes. Additions are
+// announced through serverFeatures instead, so clients can test for exactly
+// what they need without parsing the server version.
+const terminalProtocolVersion = 1
+const filesProtocolVersion = 1
+
+// serverFeatures lists optional protocol features this build supports.
+// Names are never reused or removed while the protocol version stays the same.
+var serverFeatures = []string{
+	"terminal.info",            // terminalInfo message on connect
+	"terminal.shutdownNotice",  // serverShutdown message
+	"terminal.recording",       // record message, ?record=, /recordings
+	"terminal.replay",          // /recordings/<name>/replay
+	"terminal.sharedSessions",  // ?session=&mode=, presence messages, /sessions
+	"terminal.sizeNegotiation", // server-sent resize messages
+	"terminal.closeSession",    // DELETE /sessions/<id>
+	"terminal.scrollback",      // replay on attach, search message, /sessions/<id>/search and /export
+	"terminal.paste",           // paste and confirmPaste messages
+	"files.rest",               // GET/POST /files
+	"files.websocket",          // /files websocket actions
+	"files.watch",              // watch action and notify messages
+	"files.namedRoots",         // root field and ?root=
+	"files.shutdownNotice",     // serverShutdown file message
+	"audit",                    // /audit
+	"metrics",                  // /metrics
+	"exec",                     // /exec websocket and REST
+	"tasks",                    // /tasks, runTask and pushed diagnostics
+	"git",                      // /git and the watchGit file action
+	"lsp",                      // /lsp language server proxy
+	"dap",                      // /dap debug adapter bridge
+	"forwarding",               // /proxy/<port>/, /tunnel and /ports
+}
+
+// terminalClientMessages and terminalServerMessages are the message types of
+// the /terminal protocol.
+var terminalClientMessages = []string{"data", "resize", "record", "setInputPolicy", "setDriver", "requestDriver", "search", "paste", "confirmPaste"}
+var terminalServerMessages = []string{"terminalInfo", "serverShutdown", "recordingState", "resize", "clientJoined", "clientLeft", "sessionState", "error", "portOpened", "portClosed", "titleChanged", "processChanged", "commandStarted", "commandFinished", "searchResults", "pasteConfirm", "driverRequested"}
+
+// capabilitiesResponse is returned by /capabilities.
+type capabilitiesResponse struct {
+	Service  string   `json:"service"`
+	Version  string   `json:"version"`
+	Features []string `json:"features"`
+	Platform struct {
+		OS   string `json:"os"`
+		Arch string `json:"arch"`
+	} `json:"platform"`
+	Terminal struct {
+		ProtocolVersion int      `json:"protocolVersion"`
+		BinaryFrames    bool     `json:"binaryFrames"` // output is sent as text frames only
+		ClientMessages  []string `json:"clientMessages"`
+		ServerMessages  []string `json:"serverMessages"`
+		Shells          []string `json:"shells"`
+		DefaultShell    string   `json:"defaultShell"`
+		MaxSessions     int      `json:"maxSessions"` // 0 is unlimited
+	} `json:"terminal"`
+	Files struct {
+		ProtocolVersion  int      `json:"protocolVersion"`
+		Actions          []string `json:"actions"`
+		Roots            []string `json:"roots"` // named roots; "" is the default root
+		MaxFileSizeBytes int64    `json:"maxFileSizeBytes"`
+	} `json:"files"`
+	LSP struct {
+		Languages []string `json:"languages"` // with a configured or built-in server; it may not be installed
+	} `json:"lsp"`
+	DAP struct {
+		Adapters []string `json:"adapters"` // configured or built-in; they may not be installed
+	} `json:"dap"`
+	Forwarding struct {
+		AllowedPorts []string `json:"allowedPorts"`
+	} `json:"forwarding"`
+	Auth struct {
+		// KeyRequired reports whether a request without an Origin header from
+		// this client must carry the API key.
+		KeyRequired bool `json:"keyRequired"`
+		StrictAuth  bool `json:"strictAuth"`
+		TLS         bool `json:"tls"`
+	} `json:"auth"`
+}
+
+// capabilitiesHandler serves GET /capabilities. Like /up it needs no
+// authorization, so it reports names rather than paths.
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	var resp capabilitiesResponse
+	resp.Service = probeServiceName
+	resp.Version = version
+	resp.Features = serverFeatures
+	resp.Platform.OS = runtime.GOOS
+	resp.Platform.Arch = runtime.GOARCH
+
+	resp.Terminal.ProtocolVersion = terminalProtocolVersion
+	resp.Terminal.ClientMessages = terminalClientMessages
+	resp.Terminal.ServerMessages = terminalServerMessages
+	resp.Terminal.Shells = availableShells()
+	resp.Terminal.DefaultShell = filepath.Base(defaultShell(cfg))
+	resp.Terminal.MaxSessions = cfg.Limits.MaxSessions
+
+	resp.Files.ProtocolVersion = filesProtocolVersion
+	resp.Files.Actions = fileActions
+	resp.Files.Roots = []string{""}
+	for name := range cfg.Roots {
+		resp.Files.Roots = append(resp.Files.Roots, name)
+	}
+	sort.Strings(resp.Files.Roots)
+	resp.Files.MaxFileSizeBytes = cfg.Limits.MaxFileSizeBytes
+
+	resp.LSP.Languages = cfg.LSP.languages()
+	resp.DAP.Adapters = cfg.DAP.adapters()
+	resp.Forwarding.AllowedPorts = cfg.Forwarding.AllowedPorts
+
+	resp.Auth.StrictAuth = cfg.StrictAuth
+	resp.Auth.KeyRequired = cfg.StrictAuth || !isLoopbackRequest(r) || !loopbackHost(r)
+	resp.Auth.TLS = r.TLS != nil
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// defaultShell returns the shell new terminal sessions start.
+func defaultShell(cfg *conduitConfig) string {
+	if cfg.Shell.Program != "" {
+		return cfg.Shell.Program
+	}
+	if os.Getenv("OS") == "Windows_NT" {
+		return "powershell.exe"
+	}
+	return "bash"
+}
+
+// availableShells lists the names of the shells installed on this machine:
+// those in /etc/shells on Unix, or the usual candidates found on PATH.
+func availableShells() []string {
+	candidates := []string{"bash", "zsh", "fish", "sh"}
+	if runtime.GOOS == "windows" {
+		candidates = []string{"powershell.exe", "pwsh.exe", "cmd.exe"}
+	} else if f, err := os.Open("/etc/shells"); err == nil {
+		candidates = nil
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				candidates = append(candidates, line)
+			}
+		}
+		f.Close()
+	}
+
+	seen := make(map[string]bool)
+	shells := []string{}
+	for _, candidate := range candidates {
+		if _, err := exec.LookPath(candidate); err != nil {
+			continue
+		}
+		name := filepath.Base(candidate)
+		if !seen[name] {
+			seen[name] = true
+			shells = append(shells, name)
+		}
+	}
+	sort.Strings(shells)
+	return shells
+}
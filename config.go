@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const configFileName = "config.json"
+
+// conduitConfig is the effective server configuration. It is built from the
+// defaults, then config.json, then any flags given on the command line, and is
+// treated as immutable once published with setConfig.
+type conduitConfig struct {
+	Listen               string             `json:"listen"`
+	Port                 int                `json:"port"`
+	PortFallback         int                `json:"portFallback"` // extra ports to try above Port if it is taken
+	Root                 string             `json:"root"`
+	Roots                map[string]string  `json:"roots,omitempty"`
+	AllowedOrigins       []string           `json:"allowedOrigins,omitempty"`
+	StrictAuth           bool               `json:"strictAuth"`
+	TrustedProxies       []string           `json:"trustedProxies,omitempty"`
+	TLS                  tlsSettings        `json:"tls"`
+	Shell                shellSettings      `json:"shell"`
+	IdleTimeoutMinutes   int                `json:"idleTimeoutMinutes"` // 0 disables idle shutdown
+	LogLevel             string             `json:"logLevel"`           // "info" or "debug"
+	Limits               limitSettings      `json:"limits"`
+	Audit                auditSettings      `json:"audit"`
+	Recording            recordingSettings  `json:"recording"`
+	LSP                  lspSettings        `json:"lsp"`
+	DAP                  dapSettings        `json:"dap"`
+	Forwarding           forwardingSettings `json:"forwarding"`
+	ShutdownGraceSeconds int                `json:"shutdownGraceSeconds"` // time shells get to exit after SIGHUP
+	DetachGraceSeconds   int                `json:"detachGraceSeconds"`   // time a session outlives its last client
+	Scrollback           scrollbackSettings `json:"scrollback"`
+	Paste                pasteSettings      `json:"paste"`
+
+	trustedNets []*net.IPNet // parsed TrustedProxies
+}
+
+type tlsSettings struct {
+	Cert       string `json:"cert,omitempty"`
+	Key        string `json:"key,omitempty"`
+	SelfSigned bool   `json:"selfSigned"`
+}
+
+// shellSettings controls the program started for each terminal session.
+// An empty Program picks bash, or powershell.exe on Windows.
+type shellSettings struct {
+	Program     string            `json:"program,omitempty"`
+	Args        []string          `json:"args,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Integration bool              `json:"integration"` // load Conduit's shell integration script
+}
+
+// envList returns the configured environment as sorted "NAME=value" pairs.
+func (s shellSettings) envList() []string {
+	env := make([]string, 0, len(s.Env))
+	for name, value := range s.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// limitSettings caps resource use. Zero means unlimited.
+type limitSettings struct {
+	MaxSessions      int   `json:"maxSessions"`
+	MaxFileSizeBytes int64 `json:"maxFileSizeBytes"`
+}
+
+// defaultConfig returns the settings used when neither config.json nor a flag
+// says otherwise.
+func defaultConfig() *conduitConfig {
+	root, err := os.UserHomeDir()
+	if err != nil {
+		root = "."
+	}
+	return &conduitConfig{
+		Listen:               "127.0.0.1",
+		Port:                 3022,
+		PortFallback:         10,
+		Root:                 root,
+		IdleTimeoutMinutes:   60,
+		LogLevel:             "info",
+		ShutdownGraceSeconds: 5,
+		Shell:                shellSettings{Integration: true},
+		DetachGraceSeconds:   30,
+		Scrollback:           scrollbackSettings{MaxBytes: 1 << 20},
+		Paste:                pasteSettings{MaxBytes: 1 << 20, ChunkBytes: 1024, ChunkDelayMs: 5, Confirm: pasteConfirmNever},
+		Audit:                auditSettings{Enabled: true, MaxSizeBytes: 10 << 20, MaxFiles: 5},
+		Recording:            recordingSettings{MaxBytes: 100 << 20, MaxTotalBytes: 1 << 30},
+		LSP:                  lspSettings{IdleTimeoutSeconds: 300},
+		Forwarding:           forwardingSettings{AllowedPorts: []string{}},
+	}
+}
+
+var activeConfig atomic.Pointer[conduitConfig]
+
+// currentConfig returns the effective configuration. Callers must not modify it.
+func currentConfig() *conduitConfig {
+	if cfg := activeConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return defaultConfig()
+}
+
+// setConfig publishes a new effective configuration.
+func setConfig(cfg *conduitConfig) {
+	activeConfig.Store(cfg)
+	origins.load(cfg.AllowedOrigins)
+}
+
+// debugEnabled reports whether debug logging is on.
+func debugEnabled() bool {
+	return currentConfig().LogLevel == "debug"
+}
+
+func configFilePath() (string, error) {
+	dir, err := conduitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, configFileName), nil
+}
+
+// loadConfig builds the effective configuration from defaults, config.json and
+// the flags that were explicitly set on the command line.
+func loadConfig() (*conduitConfig, error) {
+	cfg := defaultConfig()
+	path, err := configFilePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	}
+	applyFlagOverrides(cfg)
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// applyFlagOverrides copies the value of every flag that was given on the
+// command line over the corresponding config file setting.
+func applyFlagOverrides(cfg *conduitConfig) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = listenFlag
+		case "port":
+			cfg.Port = portFlag
+		case "port-fallback":
+			cfg.PortFallback = portFallbackFlag
+		case "root":
+			cfg.Root = rootFlag
+		case "strict-auth":
+			cfg.StrictAuth = strictAuthFlag
+		case "trusted-proxies":
+			cfg.TrustedProxies = strings.Split(trustedProxiesFlag, ",")
+		case "allow-origin":
+			cfg.AllowedOrigins = append(append([]string{}, cfg.AllowedOrigins...), allowOriginFlags...)
+		case "no-idle-shutdown":
+			if noIdleShutdownFlag {
+				cfg.IdleTimeoutMinutes = 0
+			}
+		case "debug":
+			if debugLogging {
+				cfg.LogLevel = "debug"
+			}
+		case "tls-cert":
+			cfg.TLS.Cert = tlsCertFlag
+		case "tls-key":
+			cfg.TLS.Key = tlsKeyFlag
+		case "tls-self-signed":
+			cfg.TLS.SelfSigned = tlsSelfSignedFlag
+		}
+	})
+}
+
+// validate checks the settings and fills in derived fields.
+func (cfg *conduitConfig) validate() error {
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", cfg.Port)
+	}
+	if cfg.PortFallback < 0 {
+		return fmt.Errorf("portFallback must not be negative")
+	}
+	switch cfg.LogLevel {
+	case "info", "debug":
+	default:
+		return fmt.Errorf("logLevel must be \"info\" or \"debug\", not %q", cfg.LogLevel)
+	}
+	if cfg.IdleTimeoutMinutes < 0 {
+		return fmt.Errorf("idleTimeoutMinutes must not be negative")
+	}
+	if cfg.Audit.MaxSizeBytes < 0 || cfg.Audit.MaxFiles < 0 {
+		return fmt.Errorf("audit.maxSizeBytes and audit.maxFiles must not be negative")
+	}
+	if err := cfg.LSP.validate(); err != nil {
+		return err
+	}
+	if err := cfg.DAP.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Forwarding.validate(); err != nil {
+		return err
+	}
+	if cfg.ShutdownGraceSeconds < 0 {
+		return fmt.Errorf("shutdownGraceSeconds must not be negative")
+	}
+	if cfg.DetachGraceSeconds < 0 {
+		return fmt.Errorf("detachGraceSeconds must not be negative")
+	}
+	if cfg.Scrollback.MaxBytes < 0 {
+		return fmt.Errorf("scrollback.maxBytes must not be negative")
+	}
+	if err := cfg.Paste.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Recording.validate(); err != nil {
+		return err
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key must be given together")
+	}
+	nets, err := parseTrustedProxies(strings.Join(cfg.TrustedProxies, ","))
+	if err != nil {
+		return err
+	}
+	cfg.trustedNets = nets
+	cfg.Root = expandHome(cfg.Root)
+	cfg.Recording.Dir = expandHome(cfg.Recording.Dir)
+	for name, path := range cfg.Roots {
+		if name == "" || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("root name %q is invalid", name)
+		}
+		if path == "" {
+			return fmt.Errorf("root %q has no path", name)
+		}
+		cfg.Roots[name] = expandHome(path)
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		if _, err := parseOriginPattern(origin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandHome replaces a leading "~" with the user's home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, `~\`) {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// applyStartupConfig copies settings that are only read at startup into the
+// globals the rest of the server uses.
+func applyStartupConfig(cfg *conduitConfig) {
+	listenFlag = cfg.Listen
+	port = fmt.Sprint(cfg.Port)
+	fileAPIRoot = cfg.Root
+	noIdleShutdownFlag = cfg.IdleTimeoutMinutes == 0
+	tlsCertFlag = cfg.TLS.Cert
+	tlsKeyFlag = cfg.TLS.Key
+	tlsSelfSignedFlag = cfg.TLS.SelfSigned
+}
+
+// printConfig handles --print-config.
+func printConfig(cfg *conduitConfig) {
+	data, _ := json.MarshalIndent(cfg, "", "  ")
+	path, _ := configFilePath()
+	fmt.Printf("# Effective configuration (file: %s)\n%s\n", path, data)
+}
+
+// --- Hot Reload ---
+
+// reloadConfig rereads config.json and applies the settings that can change
+// while running: origins, auth, log level, idle timeout, shell and limits.
+// Settings that need a restart are reported and left unchanged.
+func reloadConfig(reason string) {
+	next, err := loadConfig()
+	if err != nil {
+		log.Printf("Config reload (%s) failed, keeping current settings: %v", reason, err)
+		return
+	}
+	prev := currentConfig()
+	var restart []string
+	if next.Listen != prev.Listen || next.Port != prev.Port || next.PortFallback != prev.PortFallback {
+		restart = append(restart, "listen/port")
+		next.Listen, next.Port, next.PortFallback = prev.Listen, prev.Port, prev.PortFallback
+	}
+	if next.TLS != prev.TLS {
+		restart = append(restart, "tls")
+		next.TLS = prev.TLS
+	}
+	if next.Root != prev.Root {
+		restart = append(restart, "root")
+		next.Root = prev.Root
+	}
+	if next.Forwarding.ProxyPort != prev.Forwarding.ProxyPort {
+		restart = append(restart, "forwarding.proxyPort")
+		next.Forwarding.ProxyPort = prev.Forwarding.ProxyPort
+	}
+	setConfig(next)
+	log.Printf("Configuration reloaded (%s)", reason)
+	if len(restart) > 0 {
+		sort.Strings(restart)
+		log.Printf("Changes to %s take effect after a restart.", strings.Join(restart, ", "))
+	}
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever config.json
+// changes on disk.
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	path, err := configFilePath()
+	if err == nil {
+		if w, err := fsnotify.NewWatcher(); err != nil {
+			log.Printf("Config file watching unavailable: %v", err)
+		} else if err := w.Add(filepath.Dir(path)); err != nil {
+			log.Printf("Config file watching unavailable: %v", err)
+			w.Close()
+		} else {
+			events, errs = w.Events, w.Errors
+		}
+	}
+
+	// Editors often write a file in several steps, so wait for events to
+	// settle before rereading it.
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-hup:
+			reloadConfig("SIGHUP")
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Base(event.Name) == configFileName {
+				debounce = time.After(250 * time.Millisecond)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			// An overflow loses events, so reread the file in case one was
+			// for it.
+			log.Printf("Config file watcher error: %v", err)
+			debounce = time.After(250 * time.Millisecond)
+		case <-debounce:
+			debounce = nil
+			reloadConfig("file changed")
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dapConnectTimeout is how long an adapter started with a {port} argument
+// gets to connect back to Conduit.
+const dapConnectTimeout = 10 * time.Second
+
+// dapSettings is the "dap" section of the config file.
+type dapSettings struct {
+	Adapters map[string]commandSettings `json:"adapters,omitempty"` // by name; added to or replacing the built-in ones
+}
+
+// defaultDebugAdapters are used for adapters the config doesn't mention. An
+// argument containing {port} makes Conduit listen on a loopback port and
+// wait for the adapter to connect to it, for adapters such as Delve that
+// don't speak DAP on stdio.
+var defaultDebugAdapters = map[string]commandSettings{
+	"go":     {Command: []string{"dlv", "dap", "--client-addr=127.0.0.1:{port}"}},
+	"python": {Command: []string{"python3", "-m", "debugpy.adapter"}},
+}
+
+func (s dapSettings) validate() error {
+	return validateCommands("dap.adapters", s.Adapters)
+}
+
+// adapter returns the settings for an adapter.
+func (s dapSettings) adapter(name string) (commandSettings, bool) {
+	return lookupCommand(s.Adapters, defaultDebugAdapters, name)
+}
+
+// adapters lists the configured and built-in adapters.
+func (s dapSettings) adapters() []string {
+	return commandNames(s.Adapters, defaultDebugAdapters)
+}
+
+// dapPathKeys are the DAP fields holding file paths: Source.path, and the
+// program and cwd of launch requests. Adapter-specific launch arguments
+// with other names pass through unchanged.
+var dapPathKeys = map[string]bool{"path": true, "program": true, "cwd": true}
+
+// rewriteDAPPaths replaces the value of every path field in v with fn's
+// result.
+func rewriteDAPPaths(v interface{}, fn func(string) (string, error)) error {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, elem := range v {
+			if err := rewriteDAPPaths(elem, fn); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for key, elem := range v {
+			if s, ok := elem.(string); ok && dapPathKeys[key] {
+				rewritten, err := fn(s)
+				if err != nil {
+					return err
+				}
+				v[key] = rewritten
+			} else if err := rewriteDAPPaths(elem, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// --- Bridge ---
+
+// dapBridge is one /dap websocket and the adapter it started. Unlike
+// language servers, adapters aren't shared: each debug session gets its own.
+type dapBridge struct {
+	ws      *wsConn
+	who     principal
+	name    string
+	paths   rootPaths
+	cmd     *exec.Cmd
+	conn    io.ReadWriteCloser // the adapter's stdio, or its socket
+	writeMu sync.Mutex
+	exited  chan struct{}
+}
+
+// debugAdapters holds the running bridges so shutdown can stop them.
+var debugAdapters = struct {
+	sync.Mutex
+	bridges map[*dapBridge]bool
+}{bridges: make(map[*dapBridge]bool)}
+
+// stdioConn joins a process's stdout and stdin.
+type stdioConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// startDebugAdapter starts an adapter in dir and connects to it.
+func startDebugAdapter(name string, settings commandSettings, dir string) (*exec.Cmd, io.ReadWriteCloser, error) {
+	args := append([]string(nil), settings.Command...)
+	var listener net.Listener
+	for i, arg := range args {
+		if !strings.Contains(arg, "{port}") {
+			continue
+		}
+		if listener == nil {
+			var err error
+			if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				return nil, nil, err
+			}
+			defer listener.Close()
+		}
+		args[i] = strings.ReplaceAll(arg, "{port}", fmt.Sprint(listener.Addr().(*net.TCPAddr).Port))
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), currentConfig().Shell.envList()...)
+	for name, value := range settings.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	if debugEnabled() {
+		logger := &lineLogWriter{prefix: "[DEBUG] [dap " + name + "] "}
+		cmd.Stderr = logger
+		if listener != nil {
+			cmd.Stdout = logger
+		}
+	}
+	setProcessGroup(cmd)
+
+	var conn io.ReadWriteCloser
+	if listener == nil {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		conn = stdioConn{Reader: stdout, WriteCloser: stdin}
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("starting %s debug adapter: %w", name, err)
+	}
+	if listener != nil {
+		// Accept only the first connection, and give up if the adapter
+		// exits or never connects.
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(dapConnectTimeout))
+		c, err := listener.Accept()
+		if err != nil {
+			killProcessTree(cmd)
+			cmd.Wait()
+			return nil, nil, fmt.Errorf("%s debug adapter did not connect: %w", name, err)
+		}
+		conn = c
+	}
+	return cmd, conn, nil
+}
+
+// send writes a message to the adapter.
+func (b *dapBridge) send(msg map[string]interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	b.writeMu.Lock()
+	defer b.writeMu.Unlock()
+	return writeFramedMessage(b.conn, body)
+}
+
+// readAdapter relays the adapter's messages to the client until it exits.
+func (b *dapBridge) readAdapter() {
+	defer func() {
+		b.cmd.Wait()
+		close(b.exited)
+		b.ws.closeWithReason(websocket.CloseNormalClosure, "adapterExited")
+	}()
+	r := bufio.NewReaderSize(b.conn, 64<<10)
+	for {
+		data, err := readFramedMessage(r)
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "closed") {
+				log.Printf("Reading from %s debug adapter: %v", b.name, err)
+			}
+			return
+		}
+		msg, err := decodeJSONObject(data)
+		if err != nil {
+			log.Printf("Dropping message from %s debug adapter: %v", b.name, err)
+			continue
+		}
+		if msg["type"] == "request" && msg["command"] == "runInTerminal" {
+			b.runInTerminal(msg)
+			continue
+		}
+		rewriteDAPPaths(msg, func(p string) (string, error) {
+			if !filepath.IsAbs(p) {
+				return p, nil
+			}
+			if clientPath, ok := b.paths.toClient(p); ok {
+				return clientPath, nil
+			}
+			return p, nil
+		})
+		b.ws.WriteJSON(msg)
+	}
+}
+
+// fromClient forwards a client message to the adapter, translating paths.
+// Relative paths are left for the adapter to resolve against its cwd.
+func (b *dapBridge) fromClient(msg map[string]interface{}) {
+	err := rewriteDAPPaths(msg, func(p string) (string, error) {
+		if !strings.HasPrefix(p, "/") {
+			return p, nil
+		}
+		abs, err := b.paths.toLocal(p)
+		if err != nil {
+			return "", fmt.Errorf("%s is outside the file root", p)
+		}
+		return abs, nil
+	})
+	if err != nil {
+		if msg["type"] == "request" {
+			b.ws.WriteJSON(map[string]interface{}{"type": "response", "seq": 0, "request_seq": msg["seq"],
+				"command": msg["command"], "success": false, "message": err.Error()})
+		}
+		return
+	}
+	b.send(msg)
+}
+
+// runInTerminal answers the adapter's request to start the debuggee in a
+// terminal by starting a Conduit terminal session. The client is told the
+// session's ID with a "conduitTerminal" event, and attaches to it with
+// /terminal?session=<id>.
+func (b *dapBridge) runInTerminal(req map[string]interface{}) {
+	var args struct {
+		Title string             `json:"title"`
+		Cwd   string             `json:"cwd"`
+		Args  []string           `json:"args"`
+		Env   map[string]*string `json:"env"`
+	}
+	raw, _ := json.Marshal(req["arguments"])
+	json.Unmarshal(raw, &args)
+	reply := map[string]interface{}{"type": "response", "seq": 0, "request_seq": req["seq"], "command": "runInTerminal"}
+
+	var sess *terminalSession
+	err := fmt.Errorf("runInTerminal needs args")
+	if len(args.Args) > 0 {
+		command := &sessionCommand{argv: args.Args, cwd: args.Cwd, env: currentConfig().Shell.envList()}
+		if _, inRoot := b.paths.toClient(args.Cwd); !inRoot || !filepath.IsAbs(args.Cwd) {
+			command.cwd = b.cmd.Dir
+		}
+		names := make([]string, 0, len(args.Env))
+		for name := range args.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			// A null value asks for the variable to be unset; it is
+			// left as it is instead.
+			if value := args.Env[name]; value != nil {
+				command.env = append(command.env, name+"="+*value)
+			}
+		}
+		sess, err = startTerminalSession(b.who, command)
+	}
+	if err != nil {
+		reply["success"], reply["message"] = false, err.Error()
+		b.send(reply)
+		return
+	}
+	go writePump(sess)
+	body := map[string]interface{}{}
+	if pid := sess.pid(); pid > 0 {
+		body["processId"] = pid
+	}
+	reply["success"], reply["body"] = true, body
+	b.send(reply)
+	log.Printf("Session #%d started for %s debug adapter: %s", sess.id, b.name, strings.Join(args.Args, " "))
+	b.ws.WriteJSON(map[string]interface{}{"type": "event", "seq": 0, "event": "conduitTerminal",
+		"body": map[string]interface{}{"session": sess.id, "title": args.Title}})
+}
+
+// stop ends the adapter: its input is closed, and it is killed if it hasn't
+// exited within execKillGrace.
+func (b *dapBridge) stop() {
+	b.conn.Close()
+	select {
+	case <-b.exited:
+	case <-time.After(execKillGrace):
+		killProcessTree(b.cmd)
+	}
+}
+
+// stopDebugAdapters stops every debug adapter, for shutdown.
+func stopDebugAdapters() {
+	debugAdapters.Lock()
+	defer debugAdapters.Unlock()
+	for b := range debugAdapters.bridges {
+		killProcessTree(b.cmd)
+	}
+}
+
+// runningDebugAdapters counts the running adapters, for /metrics.
+func runningDebugAdapters() int {
+	debugAdapters.Lock()
+	defer debugAdapters.Unlock()
+	return len(debugAdapters.bridges)
+}
+
+// --- Handler ---
+
+// dapHandler serves the /dap websocket: ?adapter=go&cwd=<dir>&root=<name>.
+// Each text message is one DAP message.
+func dapHandler(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// Authorize before looking at the filesystem, so the errors below don't
+	// tell an unauthorized caller which directories exist.
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	name := q.Get("adapter")
+	settings, ok := currentConfig().DAP.adapter(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No debug adapter is configured for %q", name), http.StatusNotFound)
+		return
+	}
+	paths, err := newRootPaths(q.Get("root"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir, err := paths.toLocal(q.Get("cwd"))
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		http.Error(w, "cwd is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	ws, err := upgradeAuthorized(w, r, "dap")
+	if err != nil {
+		log.Printf("DAP WS upgrade failed: %v", err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(lspMaxMessage)
+
+	cmd, conn, err := startDebugAdapter(name, settings, dir)
+	entry := auditEntry{Action: "dap.start", Detail: name + ": " + strings.Join(settings.Command, " ")}
+	entry.Path, _ = paths.toClient(dir)
+	audit.record(entry.from(who).withError(err))
+	if err != nil {
+		log.Printf("DAP: %v", err)
+		ws.closeWithReason(websocket.CloseInternalServerErr, "adapterFailed")
+		return
+	}
+	log.Printf("Started %s debug adapter (PID: %d) for %s", name, cmd.Process.Pid, who.RemoteAddr)
+	b := &dapBridge{ws: ws, who: who, name: name, paths: paths, cmd: cmd, conn: conn, exited: make(chan struct{})}
+	debugAdapters.Lock()
+	debugAdapters.bridges[b] = true
+	debugAdapters.Unlock()
+	defer func() {
+		b.stop()
+		debugAdapters.Lock()
+		delete(debugAdapters.bridges, b)
+		debugAdapters.Unlock()
+	}()
+	go b.readAdapter()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("DAP WS read error: %v", err)
+			}
+			return
+		}
+		msg, err := decodeJSONObject(data)
+		if err != nil {
+			continue // DAP has no way to report an unparseable message
+		}
+		b.fromClient(msg)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRewriteDAPPaths(t *testing.T) {
+	upper := func(p string) (string, error) {
+		if p == "bad" {
+			return "", errors.New("bad path")
+		}
+		return strings.ToUpper(p), nil
+	}
+	tests := []struct {
+		name string
+		msg  string
+		want string // "" if rewriting fails
+	}{
+		{"source path", `{"arguments":{"source":{"name":"a.go","path":"/a.go"}}}`, `{"arguments":{"source":{"name":"a.go","path":"/A.GO"}}}`},
+		{"launch program and cwd", `{"arguments":{"program":"/cmd","cwd":"/","args":["/x"]}}`, `{"arguments":{"args":["/x"],"cwd":"/","program":"/CMD"}}`},
+		{"stack frames", `{"body":{"stackFrames":[{"source":{"path":"/a"}},{"source":{"path":"/b"}},{"name":"path"}]}}`, `{"body":{"stackFrames":[{"source":{"path":"/A"}},{"source":{"path":"/B"}},{"name":"path"}]}}`},
+		{"breakpoints", `{"arguments":{"source":{"path":"/c"},"breakpoints":[{"line":3}]}}`, `{"arguments":{"breakpoints":[{"line":3}],"source":{"path":"/C"}}}`},
+		{"non-string path left alone", `{"path":3,"cwd":null}`, `{"cwd":null,"path":3}`},
+		{"other names left alone", `{"dlvCwd":"/x","output":"path /y"}`, `{"dlvCwd":"/x","output":"path /y"}`},
+		{"error stops rewriting", `{"arguments":{"program":"bad"}}`, ``},
+		{"error in a list", `{"breakpoints":[{"source":{"path":"bad"}}]}`, ``},
+	}
+	for _, tt := range tests {
+		msg, err := decodeJSONObject([]byte(tt.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rewriteDAPPaths(msg, upper)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: no error", tt.name)
+			}
+			continue
+		}
+		got, _ := json.Marshal(msg)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s: %s, %v; want %s", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// dapConn records what the bridge sends the adapter.
+type dapConn struct {
+	bytes.Buffer
+}
+
+func (c *dapConn) Close() error { return nil }
+
+func TestDAPBridgePaths(t *testing.T) {
+	root := t.TempDir()
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	saved := fileAPIRoot
+	fileAPIRoot = root
+	defer func() { fileAPIRoot = saved }()
+	paths, err := newRootPaths("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.ToSlash(root)
+
+	missing := rootPaths{rootName: "missing"} // an unknown root, so no path resolves
+	tests := []struct {
+		paths   rootPaths
+		msg     string
+		adapter string // what the adapter is sent; "" if nothing
+		reply   string // the error response the client gets
+	}{
+		{paths, `{"type":"request","seq":1,"command":"launch","arguments":{"program":"/cmd/app","cwd":"/"}}`,
+			`{"arguments":{"cwd":"` + local + `","program":"` + local + `/cmd/app"},"command":"launch","seq":1,"type":"request"}`, ""},
+		{paths, `{"type":"request","seq":2,"command":"setBreakpoints","arguments":{"source":{"path":"main.go"}}}`,
+			`{"arguments":{"source":{"path":"main.go"}},"command":"setBreakpoints","seq":2,"type":"request"}`, ""},
+		{paths, `{"type":"request","seq":3,"command":"setBreakpoints","arguments":{"source":{"path":"/../../etc/passwd"}}}`,
+			`{"arguments":{"source":{"path":"` + local + `/etc/passwd"}},"command":"setBreakpoints","seq":3,"type":"request"}`, ""},
+		{missing, `{"type":"request","seq":4,"command":"launch","arguments":{"program":"/cmd/app"}}`, "",
+			`{"command":"launch","message":"/cmd/app is outside the file root","request_seq":4,"seq":0,"success":false,"type":"response"}`},
+		{missing, `{"type":"event","seq":5,"event":"x","body":{"path":"/a"}}`, "", ""},
+	}
+	for _, tt := range tests {
+		conn := &dapConn{}
+		ws, next := wsPair(t)
+		b := &dapBridge{ws: ws, name: "test", paths: tt.paths, conn: conn}
+		msg, err := decodeJSONObject([]byte(tt.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.fromClient(msg)
+		got := ""
+		if conn.Len() > 0 {
+			data, err := readFramedMessage(bufio.NewReader(conn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = string(data)
+		}
+		if got != tt.adapter {
+			t.Errorf("%s: adapter got %s; want %s", tt.msg, got, tt.adapter)
+		}
+		if reply := next(); reply != tt.reply {
+			t.Errorf("%s: client got %s; want %s", tt.msg, reply, tt.reply)
+		}
+	}
+
+	// Absolute paths from the adapter become client paths when they are in
+	// the root.
+	ws, next := wsPair(t)
+	b := &dapBridge{ws: ws, name: "test", paths: paths}
+	r, w := io.Pipe()
+	go func() {
+		writeFramedMessage(w, []byte(`{"type":"event","event":"stopped","body":{"source":{"path":"`+local+`/cmd/main.go"},"other":{"path":"/usr/lib/go/src/fmt/print.go"},"rel":{"path":"x.go"}}}`))
+		w.Close()
+	}()
+	b.conn = stdioConn{Reader: r, WriteCloser: w}
+	b.exited = make(chan struct{})
+	// readAdapter waits for the adapter process; this one runs no tests.
+	b.cmd = exec.Command(os.Args[0], "-test.run=^$")
+	if err := b.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go b.readAdapter()
+	want := `{"body":{"other":{"path":"/usr/lib/go/src/fmt/print.go"},"rel":{"path":"x.go"},"source":{"path":"/cmd/main.go"}},"event":"stopped","type":"event"}`
+	if got := next(); got != want {
+		t.Errorf("client got %s; want %s", got, want)
+	}
+	<-b.exited
+}
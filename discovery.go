@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const discoveryFileName = "discovery.json"
+const launchScheme = "conduit"
+
+// probeServiceName identifies Conduit in /up responses, so a browser probing a range
+// of localhost ports can tell it apart from other local servers.
+const probeServiceName = "conduit"
+
+// discoveryInfo is written to the discovery file once the server is listening.
+type discoveryInfo struct {
+	PID       int       `json:"pid"`
+	Port      int       `json:"port"`
+	Listen    string    `json:"listen"`
+	Scheme    string    `json:"scheme"` // "http" or "https"
+	URL       string    `json:"url"`
+	Version   string    `json:"version"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// discoveryFilePath returns where the discovery file lives: the per-user
+// runtime directory when there is one, otherwise the config directory.
+func discoveryFilePath() (string, error) {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		dir := filepath.Join(runtimeDir, appName)
+		if err := os.MkdirAll(dir, 0700); err == nil {
+			return filepath.Join(dir, discoveryFileName), nil
+		}
+	}
+	dir, err := conduitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, discoveryFileName), nil
+}
+
+// writeDiscoveryFile records the port the server actually bound to.
+func writeDiscoveryFile(listen string, port int, scheme string) {
+	path, err := discoveryFilePath()
+	if err != nil {
+		log.Printf("Could not write discovery file: %v", err)
+		return
+	}
+	host := listen
+	if ip := net.ParseIP(listen); listen == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	info := discoveryInfo{
+		PID:       os.Getpid(),
+		Port:      port,
+		Listen:    listen,
+		Scheme:    scheme,
+		URL:       fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(port))),
+		Version:   version,
+		StartedAt: time.Now().UTC(),
+	}
+	data, _ := json.MarshalIndent(info, "", "  ")
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		log.Printf("Could not write discovery file: %v", err)
+		return
+	}
+	log.Printf("Discovery file: %s", path)
+}
+
+// removeDiscoveryFile deletes the discovery file if it still describes this process.
+func removeDiscoveryFile() {
+	path, err := discoveryFilePath()
+	if err != nil {
+		return
+	}
+	var info discoveryInfo
+	if data, err := ioutil.ReadFile(path); err == nil && json.Unmarshal(data, &info) == nil && info.PID == os.Getpid() {
+		os.Remove(path)
+	}
+}
+
+// applyLaunchURL reads settings from a conduit:// URL passed as the first
+// argument by the OS protocol handler, e.g. conduit://start?port=4022.
+func applyLaunchURL(cfg *conduitConfig, args []string) {
+	if len(args) == 0 {
+		return
+	}
+	u, err := url.Parse(args[0])
+	if err != nil || u.Scheme != launchScheme {
+		return
+	}
+	if p := u.Query().Get("port"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			log.Printf("Ignoring invalid port %q in launch URL", p)
+			return
+		}
+		log.Printf("Using port %d from launch URL", n)
+		cfg.Port = n
+	}
+}
+
+// listenWithFallback binds the configured port, moving up through the fallback
+// range if it can't be bound. If one of those ports is already held by another
+// Conduit, errAlreadyRunning is returned along with that port.
+func listenWithFallback(host string, port, fallback int, scheme string) (net.Listener, int, error) {
+	var lastErr error
+	for p := port; p <= port+fallback && p <= 65535; p++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p)))
+		if err == nil {
+			if p != port {
+				log.Printf("Port %d is in use; using fallback port %d", port, p)
+			}
+			return ln, p, nil
+		}
+		// Errors for a port in use differ between platforms, so rather than
+		// inspect the error, ask whoever holds the port who they are.
+		if probeConduit(host, p, scheme) {
+			return nil, p, errAlreadyRunning
+		}
+		lastErr = err
+	}
+	return nil, 0, fmt.Errorf("no free port in %d-%d: %w", port, port+fallback, lastErr)
+}
+
+var errAlreadyRunning = errors.New("conduit is already running")
+
+// probeConduit checks whether the server on a local port is a Conduit instance,
+// using the same /up probe the browser client uses. The other instance may
+// have been started with or without TLS, so both schemes are tried.
+func probeConduit(host string, port int, scheme string) bool {
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	client := &http.Client{
+		Timeout: time.Second,
+		// Only identifying the service; the local CA may not be trusted here.
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	schemes := []string{scheme, "https"}
+	if scheme == "https" {
+		schemes[1] = "http"
+	}
+	for _, s := range schemes {
+		resp, err := client.Get(fmt.Sprintf("%s://%s/up", s, net.JoinHostPort(host, strconv.Itoa(port))))
+		if err != nil {
+			continue
+		}
+		var status statusResponse
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err == nil && status.Service == probeServiceName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// execKillGrace is how long a canceled or timed-out process gets to exit after
+// being interrupted before it is killed.
+const execKillGrace = 3 * time.Second
+
+// execMaxCapture caps the stdout and stderr a REST /exec call collects.
+const execMaxCapture = 16 << 20
+
+// execRequest starts a command (REST body, or a websocket "start" message), or
+// sends stdin to or cancels one that is running.
+type execRequest struct {
+	Type           string            `json:"type,omitempty"` // websocket only: "start", "stdin", "cancel", "listTasks", "runTask", "subscribeDiagnostics"
+	ID             string            `json:"id,omitempty"`   // websocket only: chosen by the client
+	Argv           []string          `json:"argv,omitempty"`
+	Cwd            string            `json:"cwd,omitempty"` // relative to the file root
+	Root           string            `json:"root,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+	TimeoutSeconds float64           `json:"timeoutSeconds,omitempty"` // 0 means no timeout
+	Stdin          string            `json:"stdin,omitempty"`          // written to stdin at start
+	OpenStdin      bool              `json:"openStdin,omitempty"`      // websocket only: keep stdin open for "stdin" messages
+	Data           string            `json:"data,omitempty"`           // "stdin" message data
+	EOF            bool              `json:"eof,omitempty"`            // "stdin" message: close stdin after data
+	Task           string            `json:"task,omitempty"`           // "runTask": task name from tasks.json
+}
+
+// execResult describes how a command ended.
+type execResult struct {
+	ExitCode   int    `json:"exitCode"`         // -1 if the command didn't start or was killed by a signal
+	Signal     string `json:"signal,omitempty"` // signal that ended the process (Unix)
+	TimedOut   bool   `json:"timedOut,omitempty"`
+	Canceled   bool   `json:"canceled,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+	Stdout     string `json:"stdout,omitempty"` // REST only
+	Stderr     string `json:"stderr,omitempty"` // REST only
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+// execMessage is sent to /exec websocket clients.
+type execMessage struct {
+	Type   string      `json:"type"` // "started", "stdout", "stderr", "exit", "error", "tasks"
+	ID     string      `json:"id"`
+	PID    int         `json:"pid,omitempty"`    // "started"
+	Data   string      `json:"data,omitempty"`   // "stdout" and "stderr"
+	Result *execResult `json:"result,omitempty"` // "exit"
+	Error  string      `json:"error,omitempty"`  // "error"
+	Tasks  *tasksFile  `json:"tasks,omitempty"`  // "tasks"
+}
+
+// execProcess is a running command.
+type execProcess struct {
+	cmd      *exec.Cmd
+	stdin    chan stdinChunk // nil unless started with openStdin
+	started  time.Time
+	canceled atomic.Bool
+	timedOut atomic.Bool
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// stdinChunk is data queued for a command's stdin.
+type stdinChunk struct {
+	data string
+	eof  bool
+}
+
+// execStdinQueue is how many "stdin" messages may wait for a command that
+// isn't reading its input.
+const execStdinQueue = 64
+
+// runningExecs tracks every running command so shutdown can stop them.
+var runningExecs = struct {
+	sync.Mutex
+	procs map[*execProcess]bool
+}{procs: make(map[*execProcess]bool)}
+
+// startExec validates a request and starts the command without a PTY.
+// stdout and stderr receive output as it is produced.
+func startExec(req execRequest, stdout, stderr io.Writer) (*execProcess, error) {
+	if len(req.Argv) == 0 || req.Argv[0] == "" {
+		return nil, fmt.Errorf("argv must name a program")
+	}
+	if req.TimeoutSeconds < 0 {
+		return nil, fmt.Errorf("timeoutSeconds must not be negative")
+	}
+	dir, err := securePathIn(req.Root, req.Cwd)
+	if err != nil {
+		return nil, fmt.Errorf("cwd is outside the file root")
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("cwd %q is not a directory", req.Cwd)
+	}
+
+	cmd := exec.Command(req.Argv[0], req.Argv[1:]...)
+	cmd.Dir = dir
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, currentConfig().Shell.envList()...)
+	names := make([]string, 0, len(req.Env))
+	for name := range req.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd.Env = append(cmd.Env, name+"="+req.Env[name])
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Background jobs that keep the output pipes open shouldn't keep the
+	// command "running" forever after it exits.
+	cmd.WaitDelay = execKillGrace
+	setProcessGroup(cmd)
+
+	p := &execProcess{cmd: cmd, done: make(chan struct{})}
+	var stdinPipe io.WriteCloser
+	if req.OpenStdin {
+		if stdinPipe, err = cmd.StdinPipe(); err != nil {
+			return nil, err
+		}
+	} else {
+		cmd.Stdin = strings.NewReader(req.Stdin)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.started = time.Now()
+	if stdinPipe != nil {
+		// Feed stdin from a queue, so a command that isn't reading can't
+		// block the connection's other messages.
+		p.stdin = make(chan stdinChunk, execStdinQueue)
+		p.stdin <- stdinChunk{data: req.Stdin}
+		go p.feedStdin(stdinPipe)
+	}
+	metricExecRunning.Add(1)
+
+	runningExecs.Lock()
+	runningExecs.procs[p] = true
+	runningExecs.Unlock()
+	if req.TimeoutSeconds > 0 {
+		timer := time.AfterFunc(time.Duration(req.TimeoutSeconds*float64(time.Second)), func() {
+			p.timedOut.Store(true)
+			p.stop()
+		})
+		go func() {
+			<-p.done
+			timer.Stop()
+		}()
+	}
+	return p, nil
+}
+
+// wait waits for the command to exit and its output to be delivered.
+func (p *execProcess) wait() execResult {
+	err := p.cmd.Wait()
+	close(p.done)
+	metricExecRunning.Add(-1)
+	runningExecs.Lock()
+	delete(runningExecs.procs, p)
+	runningExecs.Unlock()
+
+	result := execResult{
+		ExitCode:   -1,
+		TimedOut:   p.timedOut.Load(),
+		Canceled:   p.canceled.Load(),
+		DurationMs: time.Since(p.started).Milliseconds(),
+	}
+	if state := p.cmd.ProcessState; state != nil {
+		result.ExitCode = state.ExitCode()
+		result.Signal = exitSignal(state)
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		result.Error = err.Error()
+	}
+	metricExecs.inc(result.outcome())
+	return result
+}
+
+// outcome classifies the result for metrics.
+func (r execResult) outcome() string {
+	switch {
+	case r.TimedOut:
+		return "timeout"
+	case r.Canceled:
+		return "canceled"
+	case r.ExitCode == 0:
+		return outcomeOK
+	}
+	return outcomeError
+}
+
+// cancel stops the command at the client's request.
+func (p *execProcess) cancel() {
+	p.canceled.Store(true)
+	p.stop()
+}
+
+// stop interrupts the command and everything it started, killing them if
+// they are still running after execKillGrace.
+func (p *execProcess) stop() {
+	p.stopOnce.Do(func() {
+		interruptProcessTree(p.cmd)
+		go func() {
+			select {
+			case <-p.done:
+			case <-time.After(execKillGrace):
+				killProcessTree(p.cmd)
+			}
+		}()
+	})
+}
+
+// writeStdin queues data for the command's stdin, closing it afterwards if
+// eof is set.
+func (p *execProcess) writeStdin(data string, eof bool) error {
+	if p.stdin == nil {
+		return fmt.Errorf("stdin was not opened; start with openStdin")
+	}
+	select {
+	case p.stdin <- stdinChunk{data: data, eof: eof}:
+		return nil
+	default:
+		return fmt.Errorf("stdin queue is full; the command isn't reading its input")
+	}
+}
+
+// feedStdin writes queued stdin to the command until it is closed or the
+// command exits.
+func (p *execProcess) feedStdin(pipe io.WriteCloser) {
+	for {
+		select {
+		case chunk := <-p.stdin:
+			if chunk.data != "" {
+				if _, err := io.WriteString(pipe, chunk.data); err != nil {
+					return
+				}
+			}
+			if chunk.eof {
+				pipe.Close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// stopAllExecs kills every running command, for shutdown.
+func stopAllExecs() {
+	runningExecs.Lock()
+	defer runningExecs.Unlock()
+	for p := range runningExecs.procs {
+		killProcessTree(p.cmd)
+	}
+}
+
+// auditExec records a command or task starting or failing to start.
+func auditExec(req execRequest, who principal, err error) {
+	entry := auditEntry{Action: "exec.start", Path: req.Cwd, Detail: strings.Join(req.Argv, " ")}
+	if req.Task != "" {
+		entry.Action, entry.Detail = "task.run", req.Task+": "+entry.Detail
+	}
+	audit.record(entry.from(who).withError(err))
+}
+
+// --- Handlers ---
+
+// execHandler serves /exec: a websocket that can run several commands at
+// once, or a REST POST that runs one command to completion.
+func execHandler(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		handleExecWs(w, r)
+		return
+	}
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req execRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, execMaxCapture)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.OpenStdin = false
+
+	var stdout, stderr cappedBuffer
+	p, err := startExec(req, &stdout, &stderr)
+	auditExec(req, who, err)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(execResult{ExitCode: -1, Error: err.Error()})
+		return
+	}
+	// Stop the command if the client goes away.
+	go func() {
+		select {
+		case <-r.Context().Done():
+			p.cancel()
+		case <-p.done:
+		}
+	}()
+	result := p.wait()
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	countBytes("exec", "out", len(result.Stdout)+len(result.Stderr))
+	json.NewEncoder(w).Encode(result)
+}
+
+// cappedBuffer collects output up to execMaxCapture bytes.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if room := execMaxCapture - cb.buf.Len(); len(p) > room {
+		cb.buf.Write(p[:room])
+		cb.truncated = true
+	} else {
+		cb.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (cb *cappedBuffer) String() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.buf.String()
+}
+
+// execConn is one /exec websocket and the commands it has started.
+type execConn struct {
+	ws    *wsConn
+	who   principal
+	mu    sync.Mutex
+	procs map[string]*execProcess // by client-chosen ID
+}
+
+func handleExecWs(w http.ResponseWriter, r *http.Request) {
+	ws, who, err := authorizedUpgrade(w, r, "exec")
+	if err != nil {
+		log.Printf("Exec WS upgrade failed: %v", err)
+		return
+	}
+	defer ws.Close()
+	ec := &execConn{ws: ws, who: who, procs: make(map[string]*execProcess)}
+	defer ec.killAll()
+	defer diagnostics.unsubscribe(ws)
+
+	for {
+		var req execRequest
+		if err := ws.ReadJSON(&req); err != nil {
+			if !websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("Exec WS read error: %v", err)
+			}
+			return
+		}
+		ec.mu.Lock()
+		p := ec.procs[req.ID]
+		ec.mu.Unlock()
+
+		switch req.Type {
+		case "start":
+			ec.start(req, nil, nil)
+		case "stdin":
+			if p == nil {
+				ws.WriteJSON(execMessage{Type: "error", ID: req.ID, Error: "no such process"})
+			} else if err := p.writeStdin(req.Data, req.EOF); err != nil {
+				ws.WriteJSON(execMessage{Type: "error", ID: req.ID, Error: err.Error()})
+			}
+		case "cancel":
+			if p != nil {
+				p.cancel()
+			}
+		case "listTasks":
+			ec.listTasks(req)
+		case "runTask":
+			ec.runTask(req)
+		case "subscribeDiagnostics":
+			diagnostics.subscribe(ws, who)
+		default:
+			ws.WriteJSON(execMessage{Type: "error", ID: req.ID, Error: "unknown message type"})
+		}
+	}
+}
+
+// start runs a command, streaming its output to the websocket and, if tap is
+// set, also to the writer tap returns for each stream. finished, if set, is
+// called after the exit message has been sent.
+func (ec *execConn) start(req execRequest, tap func(stream string) io.Writer, finished func(execResult)) {
+	ec.mu.Lock()
+	_, running := ec.procs[req.ID]
+	ec.mu.Unlock()
+	if req.ID == "" || running {
+		ec.ws.WriteJSON(execMessage{Type: "error", ID: req.ID, Error: "id must be set and not already running"})
+		return
+	}
+	stdout, stderr := execStream(ec.ws, req.ID, "stdout"), execStream(ec.ws, req.ID, "stderr")
+	var out, errOut io.Writer = stdout, stderr
+	if tap != nil {
+		out, errOut = io.MultiWriter(stdout, tap("stdout")), io.MultiWriter(stderr, tap("stderr"))
+	}
+	p, err := startExec(req, out, errOut)
+	auditExec(req, ec.who, err)
+	if err != nil {
+		result := execResult{ExitCode: -1, Error: err.Error()}
+		ec.ws.WriteJSON(execMessage{Type: "exit", ID: req.ID, Result: &result})
+		if finished != nil {
+			finished(result)
+		}
+		return
+	}
+	ec.mu.Lock()
+	ec.procs[req.ID] = p
+	ec.mu.Unlock()
+	ec.ws.WriteJSON(execMessage{Type: "started", ID: req.ID, PID: p.cmd.Process.Pid})
+	go func() {
+		result := p.wait()
+		ec.mu.Lock()
+		delete(ec.procs, req.ID)
+		ec.mu.Unlock()
+		stdout.flush()
+		stderr.flush()
+		ec.ws.WriteJSON(execMessage{Type: "exit", ID: req.ID, Result: &result})
+		if finished != nil {
+			finished(result)
+		}
+	}()
+}
+
+// killAll kills the connection's commands; they don't outlive the
+// connection that started them.
+func (ec *execConn) killAll() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	for _, p := range ec.procs {
+		p.canceled.Store(true)
+		killProcessTree(p.cmd)
+	}
+}
+
+// execStreamWriter forwards one output stream of a command to the websocket,
+// holding back incomplete UTF-8 sequences so each message is a valid string.
+type execStreamWriter struct {
+	ws      *wsConn
+	id      string
+	stream  string // "stdout" or "stderr"
+	mu      sync.Mutex
+	pending []byte
+}
+
+func execStream(ws *wsConn, id, stream string) *execStreamWriter {
+	return &execStreamWriter{ws: ws, id: id, stream: stream}
+}
+
+func (sw *execStreamWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	data := append(sw.pending, p...)
+	cut := completeUTF8Len(data)
+	sw.pending = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		sw.ws.WriteJSON(execMessage{Type: sw.stream, ID: sw.id, Data: string(data[:cut])})
+	}
+	return len(p), nil
+}
+
+// flush sends any bytes held back at the end of the output.
+func (sw *execStreamWriter) flush() {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if len(sw.pending) > 0 {
+		sw.ws.WriteJSON(execMessage{Type: sw.stream, ID: sw.id, Data: string(sw.pending)})
+		sw.pending = nil
+	}
+}
@@ -0,0 +1,34 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// setProcessGroup is a no-op on Windows; killProcessTree uses taskkill /T
+// to reach child processes instead.
+func setProcessGroup(c *exec.Cmd) {}
+
+// interruptProcessTree ends the command and its children. Windows has no
+// SIGTERM equivalent for console programs started without a console.
+func interruptProcessTree(c *exec.Cmd) {
+	killProcessTree(c)
+}
+
+// killProcessTree forcibly ends the command and every process it started.
+func killProcessTree(c *exec.Cmd) {
+	if c.Process == nil {
+		return
+	}
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(c.Process.Pid)).Run(); err != nil {
+		c.Process.Kill()
+	}
+}
+
+// exitSignal always returns "" on Windows, which has no signals.
+func exitSignal(state *os.ProcessState) string {
+	return ""
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// The file index keeps the file paths under a directory in memory for
+// quick-open. It is built by the first "find" in that directory, with the
+// same ignore rules as "tree", and kept current by the file watcher.
+
+const (
+	indexMaxFiles   = 200000 // files per index; beyond this the index is truncated
+	indexMaxDirs    = 20000  // directories watched per index
+	indexMaxCount   = 8      // indexes kept; the least recently used is dropped
+	indexStaleAfter = 30 * time.Second
+	findMaxQuery    = 64 // characters of a query that are matched
+	findDefaultMax  = 50
+	findMaxResults  = 1000
+
+	indexEventDelay = 100 * time.Millisecond // file events are gathered this long and applied together
+	indexMaxPending = 10000                  // events waiting; beyond this the index is rebuilt instead
+)
+
+type indexKey struct {
+	dir    string // absolute
+	hidden bool
+}
+
+// fileIndex is the set of files under one directory.
+type fileIndex struct {
+	key      indexKey
+	rootName string
+	rootDir  string // the file root, where ignore rules start
+
+	mu        sync.RWMutex
+	paths     []string        // files, slash-separated and relative to key.dir
+	lower     []string        // paths in lower case, for matching
+	pos       map[string]int  // index of each path in paths
+	dirs      map[string]bool // directories holding indexed files, relative to key.dir; "" is the top
+	built     time.Time
+	truncated bool     // hit indexMaxFiles
+	unwatched bool     // hit indexMaxDirs or a watch failed, so changes may be missed
+	stale     bool     // a .gitignore changed; rebuild before the next find
+	evicted   bool     // dropped from fileIndexes; stop watching for it
+	toWatch   []string // directories added since the last watchDirs, absolute
+	lastUsed  time.Time
+
+	eventsMu  sync.Mutex
+	events    []fsnotify.Event // waiting for applyEvents
+	scheduled bool             // applyEvents is due to run
+	overflow  bool             // more than indexMaxPending events arrived
+}
+
+// fileIndexes holds the indexes by directory.
+var fileIndexes = struct {
+	sync.Mutex
+	byKey map[indexKey]*fileIndex
+}{byKey: make(map[indexKey]*fileIndex)}
+
+// indexFor returns the index of dir, building or rebuilding it if needed.
+func indexFor(rootName, dir string, hidden bool) (*fileIndex, error) {
+	rootDir, err := securePathIn(rootName, "")
+	if err != nil {
+		return nil, err
+	}
+	key := indexKey{dir: dir, hidden: hidden}
+	var evicted *fileIndex
+	fileIndexes.Lock()
+	idx := fileIndexes.byKey[key]
+	if idx == nil {
+		if len(fileIndexes.byKey) >= indexMaxCount {
+			for _, other := range fileIndexes.byKey {
+				if evicted == nil || other.lastUsed.Before(evicted.lastUsed) {
+					evicted = other
+				}
+			}
+			delete(fileIndexes.byKey, evicted.key)
+		}
+		idx = &fileIndex{key: key, rootName: rootName, rootDir: rootDir, stale: true}
+		fileIndexes.byKey[key] = idx
+	}
+	idx.lastUsed = time.Now()
+	fileIndexes.Unlock()
+	if evicted != nil {
+		evicted.unwatch()
+	}
+
+	idx.mu.Lock()
+	if idx.stale || (idx.unwatched && time.Since(idx.built) > indexStaleAfter) {
+		err = idx.build()
+	}
+	dirs := idx.toWatch
+	idx.toWatch = nil
+	idx.mu.Unlock()
+	idx.watchDirs(dirs)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// build walks the directory. The caller holds idx.mu.
+func (idx *fileIndex) build() error {
+	if info, err := os.Stat(idx.key.dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return os.ErrInvalid
+	}
+	idx.paths, idx.lower, idx.pos = nil, nil, make(map[string]int)
+	idx.dirs = map[string]bool{"": true}
+	idx.truncated, idx.unwatched = false, false
+	idx.toWatch = append(idx.toWatch, idx.key.dir)
+	err := walkTree(idx.rootName, idx.key.dir, treeOptions{Hidden: idx.key.hidden}, func(info fileInfo) bool {
+		idx.add(info)
+		return !idx.truncated
+	})
+	idx.built, idx.stale = time.Now(), false
+	return err
+}
+
+// add indexes one walked entry, queueing a new directory for watchDirs. The
+// caller holds idx.mu.
+func (idx *fileIndex) add(info fileInfo) {
+	switch {
+	case info.IsDir && info.IsSymlink:
+		// Not entered by walks, so not indexed.
+	case info.IsDir:
+		if len(idx.dirs) >= indexMaxDirs {
+			idx.unwatched = true
+			return
+		}
+		idx.dirs[info.Path] = true
+		idx.toWatch = append(idx.toWatch, filepath.Join(idx.key.dir, filepath.FromSlash(info.Path)))
+	case len(idx.paths) >= indexMaxFiles:
+		idx.truncated = true
+	default:
+		if _, ok := idx.pos[info.Path]; !ok {
+			idx.pos[info.Path] = len(idx.paths)
+			idx.paths = append(idx.paths, info.Path)
+			idx.lower = append(idx.lower, strings.ToLower(info.Path))
+		}
+	}
+}
+
+// watchDirs adds watches for directories the index has queued. It must not
+// be called holding idx.mu or on the watcher's event goroutine: fsnotify's
+// Add can wait for that goroutine to take an event, and it may be waiting for
+// idx.mu in apply. A directory that can't be watched leaves the index
+// unwatched, so it is rebuilt rather than going stale unnoticed.
+func (idx *fileIndex) watchDirs(dirs []string) {
+	for _, dir := range dirs {
+		idx.mu.RLock()
+		evicted := idx.evicted
+		idx.mu.RUnlock()
+		if evicted {
+			return
+		}
+		if err := fileWatcher.watcher.Add(dir); err != nil {
+			if debugEnabled() {
+				log.Printf("[DEBUG] File index of %s: can't watch %s: %v", idx.key.dir, dir, err)
+			}
+			idx.mu.Lock()
+			idx.unwatched = true
+			idx.mu.Unlock()
+		}
+	}
+}
+
+// unwatch removes the watches of an evicted index's directories, except those
+// another index or a /files client still needs.
+func (idx *fileIndex) unwatch() {
+	idx.mu.Lock()
+	idx.evicted = true
+	dirs := make([]string, 0, len(idx.dirs))
+	for rel := range idx.dirs {
+		dirs = append(dirs, filepath.Join(idx.key.dir, filepath.FromSlash(rel)))
+	}
+	idx.mu.Unlock()
+	unwatchDirs(dirs)
+}
+
+// unwatchDirs removes the watches of directories that no file index or
+// /files client needs any more.
+func unwatchDirs(dirs []string) {
+	fileIndexes.Lock()
+	var others []string
+	for key := range fileIndexes.byKey {
+		others = append(others, key.dir)
+	}
+	fileIndexes.Unlock()
+	for _, dir := range dirs {
+		needed := fileWatcher.needs(dir)
+		for _, other := range others {
+			needed = needed || isWithin(dir, other)
+		}
+		if !needed {
+			fileWatcher.watcher.Remove(dir)
+		}
+	}
+}
+
+// remove drops a file by moving the last one into its place. The caller
+// holds idx.mu.
+func (idx *fileIndex) remove(path string) {
+	i, ok := idx.pos[path]
+	if !ok {
+		return
+	}
+	last := len(idx.paths) - 1
+	idx.paths[i], idx.lower[i] = idx.paths[last], idx.lower[last]
+	idx.pos[idx.paths[i]] = i
+	idx.paths, idx.lower = idx.paths[:last], idx.lower[:last]
+	delete(idx.pos, path)
+}
+
+// indexEvent queues a file event for the indexes containing it. It runs on
+// the watcher's event goroutine, so the work of applying events, which may
+// walk a new directory, is left to applyEvents.
+func indexEvent(event fsnotify.Event) {
+	fileIndexes.Lock()
+	var affected []*fileIndex
+	for key, idx := range fileIndexes.byKey {
+		if event.Name != key.dir && isWithin(event.Name, key.dir) {
+			affected = append(affected, idx)
+		}
+	}
+	fileIndexes.Unlock()
+	for _, idx := range affected {
+		idx.queueEvent(event)
+	}
+}
+
+// queueEvent adds an event to those applyEvents will apply after
+// indexEventDelay. Past indexMaxPending the events are dropped and the index
+// rebuilt before the next find.
+func (idx *fileIndex) queueEvent(event fsnotify.Event) {
+	idx.eventsMu.Lock()
+	defer idx.eventsMu.Unlock()
+	if len(idx.events) >= indexMaxPending {
+		idx.events, idx.overflow = nil, true
+	}
+	if !idx.overflow {
+		idx.events = append(idx.events, event)
+	}
+	if !idx.scheduled {
+		idx.scheduled = true
+		time.AfterFunc(indexEventDelay, idx.applyEvents)
+	}
+}
+
+// applyEvents applies the queued events in order. Events arriving meanwhile
+// are applied by another run after indexEventDelay, so runs never overlap.
+func (idx *fileIndex) applyEvents() {
+	idx.eventsMu.Lock()
+	events, overflow := idx.events, idx.overflow
+	idx.events, idx.overflow = nil, false
+	idx.eventsMu.Unlock()
+
+	if overflow {
+		idx.mu.Lock()
+		idx.stale = true
+		idx.mu.Unlock()
+	} else {
+		idx.apply(events...)
+	}
+
+	idx.eventsMu.Lock()
+	defer idx.eventsMu.Unlock()
+	if len(idx.events) > 0 || idx.overflow {
+		time.AfterFunc(indexEventDelay, idx.applyEvents)
+	} else {
+		idx.scheduled = false
+	}
+}
+
+// apply updates the index for events in it, then watches the directories
+// they added.
+func (idx *fileIndex) apply(events ...fsnotify.Event) {
+	rules := make(map[string]*ignoreRules) // by directory, for the events' new entries
+	idx.mu.Lock()
+	for _, event := range events {
+		rel, err := filepath.Rel(idx.key.dir, event.Name)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		parent, name := "", rel
+		if i := strings.LastIndex(rel, "/"); i >= 0 {
+			parent, name = rel[:i], rel[i+1:]
+		}
+		idx.applyLocked(event, rel, parent, name, rules)
+	}
+	dirs := idx.toWatch
+	idx.toWatch = nil
+	idx.mu.Unlock()
+	if len(dirs) > 0 {
+		idx.watchDirs(dirs)
+	}
+}
+
+// applyLocked updates the index for an event in it, looking up and keeping
+// ignore rules in rules. The caller holds idx.mu.
+func (idx *fileIndex) applyLocked(event fsnotify.Event, rel, parent, name string, rules map[string]*ignoreRules) {
+	if idx.stale || idx.evicted || !idx.dirs[parent] {
+		return
+	}
+	if name == ".gitignore" {
+		idx.stale = true
+		return
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		idx.remove(rel)
+		if idx.dirs[rel] {
+			var under []string
+			for _, path := range idx.paths {
+				if strings.HasPrefix(path, rel+"/") {
+					under = append(under, path)
+				}
+			}
+			for _, path := range under {
+				idx.remove(path)
+			}
+			for dir := range idx.dirs {
+				if dir == rel || strings.HasPrefix(dir, rel+"/") {
+					delete(idx.dirs, dir)
+				}
+			}
+		}
+	}
+	if event.Op&fsnotify.Create == 0 {
+		return
+	}
+
+	// A new entry is indexed if a walk would have included it.
+	if !idx.key.hidden && strings.HasPrefix(name, ".") {
+		return
+	}
+	fi, err := os.Lstat(event.Name)
+	if err != nil {
+		return
+	}
+	parentDir := filepath.Dir(event.Name)
+	if name == ".git" {
+		return
+	}
+	if rules[parentDir] == nil {
+		rules[parentDir] = ignoreRulesFor(idx.rootDir, parentDir)
+	}
+	if rules[parentDir].ignored(name, fi.IsDir()) {
+		return
+	}
+	info := newFileInfo(parentDir, fi)
+	info.Path = rel
+	idx.add(info)
+	if fi.IsDir() {
+		// Whatever was created inside before the watch was added.
+		walkTree(idx.rootName, event.Name, treeOptions{Hidden: idx.key.hidden}, func(sub fileInfo) bool {
+			sub.Path = rel + "/" + sub.Path
+			idx.add(sub)
+			return !idx.truncated
+		})
+	}
+}
+
+// indexedFileCount returns the number of files in all indexes, for /metrics.
+func indexedFileCount() int {
+	fileIndexes.Lock()
+	indexes := make([]*fileIndex, 0, len(fileIndexes.byKey))
+	for _, idx := range fileIndexes.byKey {
+		indexes = append(indexes, idx)
+	}
+	fileIndexes.Unlock()
+	n := 0
+	for _, idx := range indexes {
+		idx.mu.RLock()
+		n += len(idx.paths)
+		idx.mu.RUnlock()
+	}
+	return n
+}
+
+// handleRestFind serves GET /files?action=find&query=.
+func handleRestFind(w http.ResponseWriter, r *http.Request, fullPath, reqPath string) {
+	q := r.URL.Query()
+	idx, err := indexFor(q.Get("root"), fullPath, q.Get("hidden") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileResponse{Action: "find", Path: reqPath, Data: idx.find(q.Get("query"), limit)})
+}
+
+// --- Fuzzy Matching ---
+
+// findResult is one match of a "find" query.
+type findResult struct {
+	Path      string `json:"path"`
+	Score     int    `json:"score"`
+	Positions []int  `json:"positions"` // matched characters, as code point offsets into path
+}
+
+// findResponse is the data of a "find" response.
+type findResponse struct {
+	Results   []findResult `json:"results"`
+	Matched   int          `json:"matched"` // files matching, of which the best limit are returned
+	Indexed   int          `json:"indexed"`
+	Truncated bool         `json:"truncated,omitempty"` // the index hit its size limit
+	Ms        int64        `json:"ms"`
+}
+
+// find ranks the indexed files against a query. Every file is scored, the
+// best limit are kept in a heap, and match positions are worked out only for
+// those.
+func (idx *fileIndex) find(query string, limit int) findResponse {
+	started := time.Now()
+	if limit <= 0 {
+		limit = findDefaultMax
+	}
+	limit = min(limit, findMaxResults)
+	m := newFuzzyMatcher(query)
+
+	idx.mu.RLock()
+	resp := findResponse{Results: []findResult{}, Indexed: len(idx.paths), Truncated: idx.truncated}
+	best := &findHeap{}
+	for i, lower := range idx.lower {
+		if !m.contains(lower) {
+			continue
+		}
+		resp.Matched++
+		r := findResult{Path: idx.paths[i], Score: m.match(lower, idx.paths[i], false)}
+		if best.Len() < limit {
+			heap.Push(best, r)
+		} else if worse((*best)[0], r) {
+			(*best)[0] = r
+			heap.Fix(best, 0)
+		}
+	}
+	idx.mu.RUnlock()
+
+	for best.Len() > 0 {
+		resp.Results = append(resp.Results, heap.Pop(best).(findResult))
+	}
+	// Popped worst first.
+	for i, j := 0, len(resp.Results)-1; i < j; i, j = i+1, j-1 {
+		resp.Results[i], resp.Results[j] = resp.Results[j], resp.Results[i]
+	}
+	for i := range resp.Results {
+		r := &resp.Results[i]
+		r.Positions = m.positions(strings.ToLower(r.Path), r.Path)
+	}
+	resp.Ms = time.Since(started).Milliseconds()
+	return resp
+}
+
+// worse orders results: lower scores, then longer paths, then later names.
+func worse(a, b findResult) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	if len(a.Path) != len(b.Path) {
+		return len(a.Path) > len(b.Path)
+	}
+	return a.Path > b.Path
+}
+
+// findHeap is a min-heap of results, worst at the top.
+type findHeap []findResult
+
+func (h findHeap) Len() int            { return len(h) }
+func (h findHeap) Less(i, j int) bool  { return worse(h[i], h[j]) }
+func (h findHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *findHeap) Push(x interface{}) { *h = append(*h, x.(findResult)) }
+func (h *findHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// Scores for fuzzy matching, in the spirit of fzf: every matched character
+// scores, more at word starts, in runs and in the right case, and gaps cost
+// a little.
+const (
+	scoreMatch       = 16
+	scoreGap         = -1
+	bonusConsecutive = 12
+	bonusPathStart   = 12 // after a / or at the start
+	bonusWordStart   = 8  // after _ - . or space, or a lower-to-upper case change
+	bonusBasename    = 4  // in the last path element
+	bonusCase        = 1  // same case as the query
+)
+
+// fuzzyMatcher matches one query against many paths, case-insensitively.
+// It reuses buffers, so it isn't safe for concurrent use.
+type fuzzyMatcher struct {
+	query, lowerQuery []rune
+	text, lowerText   []rune
+	score, from       []int32
+}
+
+func newFuzzyMatcher(query string) *fuzzyMatcher {
+	m := &fuzzyMatcher{}
+	for _, r := range query {
+		if !unicode.IsSpace(r) && len(m.query) < findMaxQuery {
+			m.query = append(m.query, r)
+			m.lowerQuery = append(m.lowerQuery, unicode.ToLower(r))
+		}
+	}
+	return m
+}
+
+// contains reports whether the query's characters all appear in order in a
+// lower-cased path. Most paths fail this cheap test.
+func (m *fuzzyMatcher) contains(lower string) bool {
+	for _, r := range m.lowerQuery {
+		i := strings.IndexRune(lower, r)
+		if i < 0 {
+			return false
+		}
+		lower = lower[i+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+// positions returns the matched characters of the best alignment.
+func (m *fuzzyMatcher) positions(lower, path string) []int {
+	m.match(lower, path, true)
+	positions := make([]int, len(m.query))
+	if len(m.query) == 0 {
+		return positions
+	}
+	n := len(m.text)
+	end, total := -1, int32(math.MinInt32)
+	for j := 0; j < n; j++ {
+		if s := m.score[(len(m.query)-1)*n+j]; s > total {
+			end, total = j, s
+		}
+	}
+	for i, j := len(m.query)-1, int32(end); i >= 0 && j >= 0; i-- {
+		positions[i] = int(j)
+		j = m.from[i*n+int(j)]
+	}
+	return positions
+}
+
+// match scores a path the query is known to be contained in, finding the
+// best alignment by dynamic programming over query and path characters.
+// With track set it also records where each cell's best score came from.
+func (m *fuzzyMatcher) match(lower, path string, track bool) int {
+	q := len(m.query)
+	if q == 0 {
+		return 0
+	}
+	m.text, m.lowerText = m.text[:0], m.lowerText[:0]
+	for _, r := range path {
+		m.text = append(m.text, r)
+	}
+	for _, r := range lower {
+		m.lowerText = append(m.lowerText, r)
+	}
+	text, lowerText := m.text, m.lowerText
+	n := len(text)
+	baseRunes := utf8.RuneCountInString(path[:strings.LastIndex(path, "/")+1])
+	if cap(m.score) < n*q {
+		m.score, m.from = make([]int32, n*q), make([]int32, n*q)
+	}
+	score, from := m.score[:n*q], m.from[:n*q]
+	const none = math.MinInt32 / 2
+
+	for i := 0; i < q; i++ {
+		// best is the best score[i-1][k] + (j-k-1)*scoreGap over k < j-1,
+		// kept as the maximum of score[i-1][k] - k*scoreGap so far.
+		best, bestAt := int32(none), int32(-1)
+		for j := 0; j < n; j++ {
+			cell := i*n + j
+			score[cell] = none
+			if track {
+				from[cell] = -1
+			}
+			if i > 0 && j >= 2 {
+				if prev := score[(i-1)*n+j-2]; prev > none && prev-int32(j-2)*scoreGap > best {
+					best, bestAt = prev-int32(j-2)*scoreGap, int32(j-2)
+				}
+			}
+			if lowerText[j] != m.lowerQuery[i] {
+				continue
+			}
+			bonus := int32(scoreMatch + charBonus(text, j))
+			if j >= baseRunes {
+				bonus += bonusBasename
+			}
+			if text[j] == m.query[i] {
+				bonus += bonusCase
+			}
+			if i == 0 {
+				score[cell] = bonus + int32(j)*scoreGap/2 // a little for where the match starts
+				continue
+			}
+			if j > 0 {
+				if prev := score[(i-1)*n+j-1]; prev > none {
+					score[cell] = prev + bonus + bonusConsecutive
+					if track {
+						from[cell] = int32(j - 1)
+					}
+				}
+			}
+			if best > none {
+				if s := best + int32(j-1)*scoreGap + bonus; s > score[cell] {
+					score[cell] = s
+					if track {
+						from[cell] = bestAt
+					}
+				}
+			}
+		}
+	}
+
+	total := int32(none)
+	for j := 0; j < n; j++ {
+		total = max(total, score[(q-1)*n+j])
+	}
+	return int(total)
+}
+
+// charBonus scores where a character sits: the start of a path element or
+// of a word within one.
+func charBonus(text []rune, j int) int {
+	if j == 0 {
+		return bonusPathStart
+	}
+	prev, r := text[j-1], text[j]
+	switch {
+	case prev == '/':
+		return bonusPathStart
+	case prev == '_' || prev == '-' || prev == '.' || prev == ' ':
+		return bonusWordStart
+	case unicode.IsLower(prev) && unicode.IsUpper(r):
+		return bonusWordStart
+	case !unicode.IsDigit(prev) && unicode.IsDigit(r):
+		return bonusWordStart / 2
+	}
+	return 0
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestFuzzyContains(t *testing.T) {
+	tests := []struct {
+		query, path string
+		want        bool
+	}{
+		{"", "anything", true},
+		{"smg", "server/main.go", true},
+		{"SMG", "server/main.go", true},
+		{"s m g", "server/main.go", true},
+		{"gms", "server/main.go", false},
+		{"mainx", "server/main.go", false},
+		{"ü", "src/Über.go", true},
+	}
+	for _, tt := range tests {
+		if got := newFuzzyMatcher(tt.query).contains(strings.ToLower(tt.path)); got != tt.want {
+			t.Errorf("contains(%q, %q) = %v; want %v", tt.query, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyPositions(t *testing.T) {
+	tests := []struct {
+		query, path string
+		want        []int
+	}{
+		{"", "main.go", []int{}},
+		{"main", "main.go", []int{0, 1, 2, 3}},
+		{"srvmain", "server/main.go", []int{0, 2, 3, 7, 8, 9, 10}},
+		// The start of the file name beats an earlier match in a directory.
+		{"m", "cmd/main.go", []int{4}},
+		// Word starts beat letters in the middle of a word.
+		{"fb", "fooxbar/foo_bar.go", []int{8, 12}},
+		{"fb", "fooBar.go", []int{0, 3}},
+		// A run beats scattered letters.
+		{"abc", "a_b_c/abc", []int{6, 7, 8}},
+		// Positions count code points, not bytes.
+		{"üg", "src/Über.go", []int{4, 9}},
+		{"MG", "server/main.go", []int{7, 12}},
+	}
+	for _, tt := range tests {
+		m := newFuzzyMatcher(tt.query)
+		if !m.contains(strings.ToLower(tt.path)) {
+			t.Errorf("positions(%q, %q): query not contained", tt.query, tt.path)
+			continue
+		}
+		if got := m.positions(strings.ToLower(tt.path), tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("positions(%q, %q) = %v; want %v", tt.query, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyRanking(t *testing.T) {
+	tests := []struct {
+		query         string
+		better, worse string
+	}{
+		{"main", "main.go", "domain.go"},
+		{"main", "cmd/main.go", "main/cmd.go"},
+		{"fb", "foo_bar.go", "fabric.go"},
+		{"fb", "FooBar.go", "fabric.go"},
+		{"abc", "abc.go", "a/b/c.go"},
+		{"Readme", "Readme.md", "readme.md"},
+		{"conf", "config.json", "src/deep/nested/config.json"},
+	}
+	for _, tt := range tests {
+		m := newFuzzyMatcher(tt.query)
+		b := findResult{Path: tt.better, Score: m.match(strings.ToLower(tt.better), tt.better, false)}
+		w := findResult{Path: tt.worse, Score: m.match(strings.ToLower(tt.worse), tt.worse, false)}
+		if !worse(w, b) {
+			t.Errorf("query %q: %s scored %d, %s scored %d; want the first ranked higher", tt.query, b.Path, b.Score, w.Path, w.Score)
+		}
+	}
+}
+
+func TestFindLimit(t *testing.T) {
+	idx := &fileIndex{}
+	for _, path := range []string{"a/x.go", "b/xy.go", "xyz.go", "nomatch.txt", "c/d/x_y.go"} {
+		idx.paths = append(idx.paths, path)
+		idx.lower = append(idx.lower, strings.ToLower(path))
+	}
+	resp := idx.find("xgo", 2)
+	if resp.Matched != 4 || resp.Indexed != 5 {
+		t.Errorf("matched %d of %d; want 4 of 5", resp.Matched, resp.Indexed)
+	}
+	if len(resp.Results) != 2 || worse(resp.Results[0], resp.Results[1]) {
+		t.Errorf("results %+v; want the best 2, best first", resp.Results)
+	}
+}
+
+func TestIndexApply(t *testing.T) {
+	root := t.TempDir()
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	saved := fileAPIRoot
+	fileAPIRoot = root
+	defer func() { fileAPIRoot = saved }()
+	writeFiles(t, root, map[string]string{
+		".gitignore": "*.o\n",
+		"a.go":       "",
+		"sub/b.go":   "",
+	})
+
+	idx, err := indexFor("", root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.unwatch()
+	paths := func() []string {
+		idx.mu.RLock()
+		defer idx.mu.RUnlock()
+		var paths []string
+		for path := range idx.pos {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	if got, want := paths(), []string{"a.go", "sub/b.go"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("indexed %q; want %q", got, want)
+	}
+
+	// A directory created with files already in it, as by a move or an
+	// unpacked archive, is walked.
+	writeFiles(t, root, map[string]string{"new/c.go": "", "new/d.o": "", "e.o": ""})
+	idx.apply(fsnotify.Event{Name: filepath.Join(root, "new"), Op: fsnotify.Create})
+	idx.apply(fsnotify.Event{Name: filepath.Join(root, "e.o"), Op: fsnotify.Create})
+	if got, want := paths(), []string{"a.go", "new/c.go", "sub/b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after create, indexed %q; want %q", got, want)
+	}
+
+	os.RemoveAll(filepath.Join(root, "sub"))
+	idx.apply(fsnotify.Event{Name: filepath.Join(root, "sub"), Op: fsnotify.Remove})
+	if got, want := paths(), []string{"a.go", "new/c.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after remove, indexed %q; want %q", got, want)
+	}
+
+	idx.apply(fsnotify.Event{Name: filepath.Join(root, ".gitignore"), Op: fsnotify.Write})
+	idx.mu.RLock()
+	stale := idx.stale
+	idx.mu.RUnlock()
+	if !stale {
+		t.Error("changing .gitignore didn't mark the index stale")
+	}
+}
+
+func TestIndexEventQueue(t *testing.T) {
+	root := t.TempDir()
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	saved := fileAPIRoot
+	fileAPIRoot = root
+	defer func() { fileAPIRoot = saved }()
+	writeFiles(t, root, map[string]string{"a.go": ""})
+
+	idx, err := indexFor("", root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.unwatch()
+	indexed := func(path string) bool {
+		idx.mu.RLock()
+		defer idx.mu.RUnlock()
+		_, ok := idx.pos[path]
+		return ok
+	}
+
+	// Events are applied in order, after the watcher's goroutine has moved on.
+	writeFiles(t, root, map[string]string{"new/b.go": "", "c.go": ""})
+	idx.queueEvent(fsnotify.Event{Name: filepath.Join(root, "new"), Op: fsnotify.Create})
+	idx.queueEvent(fsnotify.Event{Name: filepath.Join(root, "c.go"), Op: fsnotify.Create})
+	os.Remove(filepath.Join(root, "a.go"))
+	idx.queueEvent(fsnotify.Event{Name: filepath.Join(root, "a.go"), Op: fsnotify.Remove})
+	waitFor(t, "the events", func() bool { return indexed("new/b.go") && indexed("c.go") && !indexed("a.go") })
+
+	// Too many events at once make the index rebuild instead.
+	for i := 0; i <= indexMaxPending; i++ {
+		idx.queueEvent(fsnotify.Event{Name: filepath.Join(root, "c.go"), Op: fsnotify.Write})
+	}
+	waitFor(t, "the index to go stale", func() bool {
+		idx.mu.RLock()
+		defer idx.mu.RUnlock()
+		return idx.stale
+	})
+	waitFor(t, "the queue to drain", func() bool {
+		idx.eventsMu.Lock()
+		defer idx.eventsMu.Unlock()
+		return !idx.scheduled
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"log"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
@@ -22,11 +24,17 @@ import (
 // --- File API message structs ---
 
 type fileRequest struct {
-	Action  string `json:"action"` // "list", "read", "write", "watch"
+	Action  string `json:"action"` // "list", "tree", "find", "read", "write", "watch", "watchGit"
 	Path    string `json:"path"`
+	Root    string `json:"root,omitempty"`    // Named root from the config; empty for the default root
 	Content string `json:"content,omitempty"` // Base64 encoded content for "write"
+	Query   string `json:"query,omitempty"`   // "find"
+	treeOptions
 }
 
+// fileActions lists the actions handleWsRequest understands, for /capabilities.
+var fileActions = []string{"list", "tree", "find", "read", "write", "watch", "watchGit"}
+
 type fileResponse struct {
 	Action string      `json:"action"`
 	Path   string      `json:"path"`
@@ -35,10 +43,15 @@ type fileResponse struct {
 }
 
 type fileInfo struct {
-	Name    string `json:"name"`
-	IsDir   bool   `json:"isDir"`
-	Size    int64  `json:"size"`
-	ModTime int64  `json:"modTime"` // Unix timestamp
+	Path          string `json:"path,omitempty"` // "tree" only: relative to the requested directory
+	Name          string `json:"name"`
+	IsDir         bool   `json:"isDir"` // for a symlink, whether its target is a directory
+	Size          int64  `json:"size"`
+	ModTime       int64  `json:"modTime"` // Unix timestamp
+	Mode          string `json:"mode"`    // permission bits in octal, e.g. "0644"
+	IsSymlink     bool   `json:"isSymlink,omitempty"`
+	SymlinkTarget string `json:"symlinkTarget,omitempty"`
+	IsExecutable  bool   `json:"isExecutable,omitempty"`
 }
 
 // --- File Watcher ---
@@ -46,7 +59,8 @@ type fileInfo struct {
 // watcherManager manages fsnotify watchers and WebSocket subscribers.
 type watcherManager struct {
 	watcher     *fsnotify.Watcher
-	subscribers map[*websocket.Conn]map[string]bool // map[client]map[path]bool
+	subscribers map[*wsConn]map[string]bool // map[client]map[path]bool
+	gitRepos    map[string]*gitRepoWatch    // by repository top level
 	mu          sync.Mutex
 }
 
@@ -60,7 +74,8 @@ func init() {
 	}
 	fileWatcher = &watcherManager{
 		watcher:     watcher,
-		subscribers: make(map[*websocket.Conn]map[string]bool),
+		subscribers: make(map[*wsConn]map[string]bool),
+		gitRepos:    make(map[string]*gitRepoWatch),
 	}
 }
 
@@ -73,6 +88,8 @@ func (wm *watcherManager) run() {
 				return
 			}
 			wm.broadcastEvent(event)
+			wm.gitEvent(event)
+			indexEvent(event)
 		case err, ok := <-wm.watcher.Errors:
 			if !ok {
 				return
@@ -82,7 +99,7 @@ func (wm *watcherManager) run() {
 	}
 }
 
-func (wm *watcherManager) addSubscription(client *websocket.Conn, path string) {
+func (wm *watcherManager) addSubscription(client *wsConn, path string) {
 	wm.mu.Lock()
 	defer wm.mu.Unlock()
 
@@ -95,12 +112,45 @@ func (wm *watcherManager) addSubscription(client *websocket.Conn, path string) {
 	}
 }
 
-func (wm *watcherManager) removeClient(client *websocket.Conn) {
+// needs reports whether a /files client's subscription or repository watch
+// depends on a directory's watch.
+func (wm *watcherManager) needs(dir string) bool {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for _, paths := range wm.subscribers {
+		if paths[dir] {
+			return true
+		}
+	}
+	for repoDir, w := range wm.gitRepos {
+		if isWithin(dir, repoDir) || isWithin(dir, w.repo.gitDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchedCount returns how many distinct paths are being watched.
+func (wm *watcherManager) watchedCount() int {
 	wm.mu.Lock()
 	defer wm.mu.Unlock()
+	paths := make(map[string]bool)
+	for _, subscribed := range wm.subscribers {
+		for path := range subscribed {
+			paths[path] = true
+		}
+	}
+	return len(paths)
+}
+
+func (wm *watcherManager) removeClient(client *wsConn) {
+	wm.mu.Lock()
 	// In a real app, you might want to check if a path has no more subscribers
 	// and remove it from the underlying fsnotify watcher to save resources.
 	delete(wm.subscribers, client)
+	unwatched := wm.removeGitClient(client)
+	wm.mu.Unlock()
+	unwatchDirs(unwatched)
 }
 
 func (wm *watcherManager) broadcastEvent(event fsnotify.Event) {
@@ -120,35 +170,78 @@ func (wm *watcherManager) broadcastEvent(event fsnotify.Event) {
 	}
 }
 
+// close stops the underlying fsnotify watcher, ending run().
+func (wm *watcherManager) close() {
+	wm.watcher.Close()
+}
+
+// fileClients tracks open file API websockets so they can be told about shutdown.
+var fileClients = newConnSet()
+
 // --- Main Handler ---
 
 // filesApiHandler routes requests to either REST or WebSocket handlers.
 func filesApiHandler(w http.ResponseWriter, r *http.Request) {
-	// The upgrader's CheckOrigin function handles WebSocket connections.
-	// For consistency, update it to use our new shared authorization function.
-	upgrader.CheckOrigin = func(req *http.Request) bool {
-		return checkRequestAuthorization(req)
-	}
+	// WebSocket connections are authorized during the upgrade.
 	if websocket.IsWebSocketUpgrade(r) {
 		handleFileWs(w, r)
 		return
 	}
 
 	// For REST calls, use the shared authorization logic.
-	if !checkRequestAuthorization(r) {
-		// checkRequestAuthorization logs the reason for denial internally.
+	who, ok := authorizeRequest(r)
+	if !ok {
+		// authorizeRequest logs the reason for denial internally.
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	handleFileRest(w, r)
+	handleFileRest(w, r, who)
+}
+
+// auditFileAction records a file operation in the audit log. Listing and
+// watching aren't recorded; reads and writes are.
+func auditFileAction(who principal, action, path, errMsg string) {
+	switch action {
+	case "read", "write":
+	default:
+		return
+	}
+	e := auditEntry{Action: "file." + action, Path: path}.from(who)
+	if errMsg == "Forbidden" {
+		e.Outcome, e.Detail = outcomeDenied, "path outside root"
+	} else if errMsg != "" {
+		e.Outcome, e.Error = outcomeError, errMsg
+	}
+	audit.record(e)
 }
 
 // --- Security Helper ---
 
-// securePath cleans and validates a path against the root directory.
+// securePath cleans and validates a path against the default root directory.
 func securePath(path string) (string, error) {
+	return securePathIn("", path)
+}
+
+// resolveRoot returns the directory for a named root. The empty name is the
+// default root set with --root or "root" in the config file.
+func resolveRoot(name string) (string, error) {
+	if name == "" {
+		return fileAPIRoot, nil
+	}
+	if dir, ok := currentConfig().Roots[name]; ok {
+		return dir, nil
+	}
+	return "", fmt.Errorf("unknown root %q", name)
+}
+
+// securePathIn cleans and validates a path against a named root directory.
+func securePathIn(rootName, path string) (string, error) {
+	root, err := resolveRoot(rootName)
+	if err != nil {
+		return "", err
+	}
 	// 1. Get absolute path of the root
-	absRoot, err := filepath.Abs(fileAPIRoot)
+	absRoot, err := filepath.Abs(root)
 	if err != nil {
 		return "", err
 	}
@@ -165,27 +258,105 @@ func securePath(path string) (string, error) {
 	return absPath, nil
 }
 
+// checkFileSize enforces the configured maxFileSizeBytes limit.
+func checkFileSize(size int64) error {
+	if max := currentConfig().Limits.MaxFileSizeBytes; max > 0 && size > max {
+		return fmt.Errorf("file size %d exceeds the limit of %d bytes", size, max)
+	}
+	return nil
+}
+
 // --- REST Implementation ---
 
-func handleFileRest(w http.ResponseWriter, r *http.Request) {
+// statusRecorder captures the status and size of a REST response for metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += n
+	return n, err
+}
+
+func handleFileRest(w http.ResponseWriter, r *http.Request, who principal) {
+	started := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	defer func() {
+		switch r.Method {
+		case http.MethodGet, http.MethodPost:
+		default:
+			return
+		}
+		errMsg := ""
+		if rec.status == http.StatusForbidden {
+			errMsg = "Forbidden"
+		} else if rec.status >= 400 {
+			errMsg = http.StatusText(rec.status)
+		}
+		observeFileOp(restAction(r), errMsg, started)
+		countBytes("files", "in", int(r.ContentLength))
+		countBytes("files", "out", rec.bytes)
+	}()
 	path := r.URL.Query().Get("path")
-	fullPath, err := securePath(path)
+	fullPath, err := securePathIn(r.URL.Query().Get("root"), path)
 	if err != nil {
+		auditFileAction(who, restAction(r), path, "Forbidden")
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		handleRestGet(w, fullPath, path)
+		switch r.URL.Query().Get("action") {
+		case "tree":
+			handleRestTree(w, r, fullPath, path)
+			return
+		case "find":
+			handleRestFind(w, r, fullPath, path)
+			return
+		}
+		handleRestGet(w, fullPath, path, who)
 	case http.MethodPost:
-		handleRestPost(w, r, fullPath)
+		handleRestPost(w, r, fullPath, path, who)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func handleRestGet(w http.ResponseWriter, fullPath, reqPath string) {
+// restAction maps a REST request to the equivalent WebSocket action name.
+func restAction(r *http.Request) string {
+	switch r.Method {
+	case http.MethodPost:
+		return "write"
+	}
+	switch action := r.URL.Query().Get("action"); action {
+	case "tree", "find":
+		return action
+	}
+	return "read"
+}
+
+// errorString returns err's message, or "" for a nil error.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func handleRestGet(w http.ResponseWriter, fullPath, reqPath string, who principal) {
 	stat, err := os.Stat(fullPath)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -203,14 +374,17 @@ func handleRestGet(w http.ResponseWriter, fullPath, reqPath string) {
 		}
 		fileList := make([]fileInfo, 0, len(files))
 		for _, f := range files {
-			fileList = append(fileList, fileInfo{
-				Name: f.Name(), IsDir: f.IsDir(), Size: f.Size(), ModTime: f.ModTime().Unix(),
-			})
+			fileList = append(fileList, newFileInfo(fullPath, f))
 		}
 		respData = fileList
 	} else {
 		// Read file
+		if err := checkFileSize(stat.Size()); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
 		content, err := ioutil.ReadFile(fullPath)
+		auditFileAction(who, "read", reqPath, errorString(err))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -223,7 +397,10 @@ func handleRestGet(w http.ResponseWriter, fullPath, reqPath string) {
 	json.NewEncoder(w).Encode(resp)
 }
 
-func handleRestPost(w http.ResponseWriter, r *http.Request, fullPath string) {
+func handleRestPost(w http.ResponseWriter, r *http.Request, fullPath, reqPath string, who principal) {
+	if max := currentConfig().Limits.MaxFileSizeBytes; max > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Cannot read body", http.StatusBadRequest)
@@ -232,6 +409,7 @@ func handleRestPost(w http.ResponseWriter, r *http.Request, fullPath string) {
 	// Assumes raw binary content in POST body for simplicity.
 	// A JSON-based approach might wrap it: {"content": "base64data"}
 	err = ioutil.WriteFile(fullPath, body, 0644)
+	auditFileAction(who, "write", reqPath, errorString(err))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -242,26 +420,31 @@ func handleRestPost(w http.ResponseWriter, r *http.Request, fullPath string) {
 // --- WebSocket Implementation ---
 
 func handleFileWs(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, who, err := authorizedUpgrade(w, r, "files")
 	if err != nil {
 		log.Printf("File WS upgrade failed: %v", err)
 		return
 	}
 	defer ws.Close()
 	defer fileWatcher.removeClient(ws)
+	fileClients.add(ws)
+	defer fileClients.remove(ws)
 
 	for {
 		var req fileRequest
 		if err := ws.ReadJSON(&req); err != nil {
 			break
 		}
-		handleWsRequest(ws, req)
+		handleWsRequest(ws, req, who)
 	}
 }
 
-func handleWsRequest(ws *websocket.Conn, req fileRequest) {
-	fullPath, err := securePath(req.Path)
+func handleWsRequest(ws *wsConn, req fileRequest, who principal) {
+	started := time.Now()
+	fullPath, err := securePathIn(req.Root, req.Path)
 	if err != nil {
+		auditFileAction(who, req.Action, req.Path, "Forbidden")
+		observeFileOp(req.Action, "Forbidden", started)
 		ws.WriteJSON(fileResponse{Action: req.Action, Path: req.Path, Error: "Forbidden"})
 		return
 	}
@@ -278,11 +461,43 @@ func handleWsRequest(ws *websocket.Conn, req fileRequest) {
 		} else {
 			fileList := make([]fileInfo, len(files))
 			for i, f := range files {
-				fileList[i] = fileInfo{Name: f.Name(), IsDir: f.IsDir(), Size: f.Size(), ModTime: f.ModTime().Unix()}
+				fileList[i] = newFileInfo(fullPath, f)
 			}
 			resp.Data = fileList
 		}
+	case "tree":
+		pageSize := req.PageSize
+		if pageSize <= 0 {
+			pageSize = treeDefaultPageSize
+		}
+		// Every page but the last is sent here; the last goes out as the
+		// action's response.
+		var last treePage
+		err := walkTreePages(req.Root, fullPath, req.treeOptions, pageSize, func(page treePage) {
+			if page.Done {
+				last = page
+			} else {
+				ws.WriteJSON(fileResponse{Action: "tree", Path: req.Path, Data: page})
+			}
+		})
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Data = last
+		}
+	case "find":
+		if idx, err := indexFor(req.Root, fullPath, req.Hidden); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Data = idx.find(req.Query, req.Limit)
+		}
 	case "read":
+		if stat, err := os.Stat(fullPath); err == nil {
+			if err := checkFileSize(stat.Size()); err != nil {
+				resp.Error = err.Error()
+				break
+			}
+		}
 		content, err := ioutil.ReadFile(fullPath)
 		if err != nil {
 			resp.Error = err.Error()
@@ -293,6 +508,8 @@ func handleWsRequest(ws *websocket.Conn, req fileRequest) {
 		data, err := base64.StdEncoding.DecodeString(req.Content)
 		if err != nil {
 			resp.Error = "Invalid base64 content"
+		} else if err := checkFileSize(int64(len(data))); err != nil {
+			resp.Error = err.Error()
 		} else if err := ioutil.WriteFile(fullPath, data, fs.FileMode(0644)); err != nil {
 			resp.Error = err.Error()
 		}
@@ -300,9 +517,20 @@ func handleWsRequest(ws *websocket.Conn, req fileRequest) {
 		fileWatcher.addSubscription(ws, fullPath)
 		// No immediate response needed for watch, confirmations are implicit
 		return
+	case "watchGit":
+		// The current status is sent at once, then again whenever it changes.
+		if err := fileWatcher.watchGit(ws, req.Root, req.Path); err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		return
 	default:
 		resp.Error = "Unknown action"
 	}
 
+	auditFileAction(who, req.Action, req.Path, resp.Error)
+	if req.Action != "watch" {
+		observeFileOp(req.Action, resp.Error, started)
+	}
 	ws.WriteJSON(resp)
 }
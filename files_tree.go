@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Tree defaults and limits. A walk stops after limit entries; WebSocket
+// walks send them in pages of pageSize.
+const (
+	treeDefaultLimit    = 10000
+	treeMaxLimit        = 100000
+	treeDefaultPageSize = 500
+)
+
+// treeOptions are the fields of a "tree" request. Include and exclude globs
+// match paths relative to the requested directory; a glob without a / matches
+// names at any depth.
+type treeOptions struct {
+	MaxDepth int      `json:"maxDepth,omitempty"` // 1 lists the directory itself; 0 is unlimited
+	Include  []string `json:"include,omitempty"`  // if set, entries must match one of these; all directories are still entered
+	Exclude  []string `json:"exclude,omitempty"`  // files and directories matching any are skipped
+	Hidden   bool     `json:"hidden,omitempty"`   // include names starting with "."
+	NoIgnore bool     `json:"noIgnore,omitempty"` // don't apply .gitignore files
+	Offset   int      `json:"offset,omitempty"`   // entries to skip, to resume a walk
+	Limit    int      `json:"limit,omitempty"`
+	PageSize int      `json:"pageSize,omitempty"` // websocket only
+}
+
+// treePage is the data of a "tree" response.
+type treePage struct {
+	Entries   []fileInfo `json:"entries"`
+	Offset    int        `json:"offset"`    // of the first entry in the walk
+	Done      bool       `json:"done"`      // no more pages follow for this request
+	Truncated bool       `json:"truncated"` // the walk stopped at the limit; resume at offset+len(entries)
+}
+
+// newFileInfo describes a directory entry from its Lstat info.
+func newFileInfo(dir string, fi os.FileInfo) fileInfo {
+	info := fileInfo{
+		Name:    fi.Name(),
+		IsDir:   fi.IsDir(),
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().Unix(),
+		Mode:    fmt.Sprintf("%04o", fi.Mode().Perm()),
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		info.IsSymlink = true
+		info.SymlinkTarget, _ = os.Readlink(filepath.Join(dir, fi.Name()))
+		// Report the kind of what the link points at, so clients can tell
+		// linked directories from files.
+		if target, err := os.Stat(filepath.Join(dir, fi.Name())); err == nil {
+			info.IsDir = target.IsDir()
+		}
+	}
+	if fi.Mode().IsRegular() {
+		if runtime.GOOS == "windows" {
+			switch strings.ToLower(filepath.Ext(fi.Name())) {
+			case ".exe", ".bat", ".cmd", ".com", ".ps1":
+				info.IsExecutable = true
+			}
+		} else {
+			info.IsExecutable = fi.Mode().Perm()&0111 != 0
+		}
+	}
+	return info
+}
+
+// walkTree walks dir depth-first in name order, calling emit for each entry
+// that passes the filters, until emit returns false. Symlinked directories
+// are listed but not entered, so a walk can't leave the root or loop.
+func walkTree(rootName, dir string, opts treeOptions, emit func(fileInfo) bool) error {
+	for _, glob := range append(append([]string(nil), opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(glob, "**", "*"), ""); err != nil {
+			return fmt.Errorf("invalid glob %q", glob)
+		}
+	}
+	var rules *ignoreRules
+	if !opts.NoIgnore {
+		rootDir, err := securePathIn(rootName, "")
+		if err != nil {
+			return err
+		}
+		rules = ignoreRulesFor(rootDir, dir)
+	}
+
+	var walk func(abs, rel string, depth int, rules *ignoreRules) bool
+	walk = func(abs, rel string, depth int, rules *ignoreRules) bool {
+		entries, err := os.ReadDir(abs)
+		if err != nil {
+			return true // unreadable directories are listed but empty
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			entryRel := name
+			if rel != "" {
+				entryRel = rel + "/" + name
+			}
+			isDir := entry.IsDir()
+			if !opts.Hidden && strings.HasPrefix(name, ".") {
+				continue
+			}
+			if rules != nil && (name == ".git" || rules.ignored(entryRel, isDir)) {
+				continue
+			}
+			if matchesAnyGlob(opts.Exclude, entryRel) {
+				continue
+			}
+			fi, err := entry.Info()
+			if err != nil {
+				continue // removed while walking
+			}
+			info := newFileInfo(abs, fi)
+			info.Path = entryRel
+			if (len(opts.Include) == 0 || matchesAnyGlob(opts.Include, entryRel)) && !emit(info) {
+				return false
+			}
+			if isDir && (opts.MaxDepth == 0 || depth < opts.MaxDepth) {
+				sub := filepath.Join(abs, name)
+				subRules := rules
+				if rules != nil {
+					subRules = rules.withDir(sub, entryRel)
+				}
+				if !walk(sub, entryRel, depth+1, subRules) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	walk(dir, "", 1, rules)
+	return nil
+}
+
+func matchesAnyGlob(globs []string, rel string) bool {
+	for _, glob := range globs {
+		if matchGlob(glob, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkTreePages walks a directory for a "tree" request, skipping the first
+// opts.Offset entries, and passes each page to send. The last page has Done
+// set.
+func walkTreePages(rootName, dir string, opts treeOptions, pageSize int, send func(treePage)) error {
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Base(dir))
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = treeDefaultLimit
+	}
+	limit = min(limit, treeMaxLimit)
+	offset := max(opts.Offset, 0)
+	page := treePage{Entries: []fileInfo{}, Offset: offset}
+	seen, sent := 0, 0
+	err := walkTree(rootName, dir, opts, func(info fileInfo) bool {
+		seen++
+		if seen <= offset {
+			return true
+		}
+		if sent == limit {
+			page.Truncated = true
+			return false
+		}
+		page.Entries = append(page.Entries, info)
+		sent++
+		if len(page.Entries) == pageSize {
+			send(page)
+			page = treePage{Entries: []fileInfo{}, Offset: offset + sent}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	page.Done = true
+	send(page)
+	return nil
+}
+
+// handleRestTree serves GET /files?action=tree: one page of up to limit
+// entries. Options are query parameters named like the websocket fields;
+// include and exclude can be repeated.
+func handleRestTree(w http.ResponseWriter, r *http.Request, fullPath, reqPath string) {
+	q := r.URL.Query()
+	opts := treeOptions{
+		Include:  q["include"],
+		Exclude:  q["exclude"],
+		Hidden:   q.Get("hidden") == "true",
+		NoIgnore: q.Get("noIgnore") == "true",
+	}
+	opts.MaxDepth, _ = strconv.Atoi(q.Get("maxDepth"))
+	opts.Offset, _ = strconv.Atoi(q.Get("offset"))
+	opts.Limit, _ = strconv.Atoi(q.Get("limit"))
+
+	var result treePage
+	err := walkTreePages(q.Get("root"), fullPath, opts, treeMaxLimit+1, func(page treePage) {
+		result = page
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileResponse{Action: "tree", Path: reqPath, Data: result})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkTree(t *testing.T) {
+	root := t.TempDir()
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	saved := fileAPIRoot
+	fileAPIRoot = root
+	defer func() { fileAPIRoot = saved }()
+
+	writeFiles(t, root, map[string]string{
+		".gitignore":       "*.o\nbuild/\n",
+		".hidden":          "",
+		"a.go":             "",
+		"a.o":              "",
+		"b/c.go":           "",
+		"b/d/e.go":         "",
+		"b/d/e_test.go":    "",
+		"b/.gitignore":     "/d/e_test.go\n",
+		"build/out":        "",
+		"empty/":           "",
+		".git/config":      "",
+		"vendor/x/y.go":    "",
+		"vendor/x/y.o":     "",
+		"vendor/x/y.proto": "",
+	})
+
+	tests := []struct {
+		name string
+		dir  string
+		opts treeOptions
+		want []string
+	}{
+		{
+			name: "ignore files apply at every level",
+			opts: treeOptions{},
+			want: []string{"a.go", "b", "b/c.go", "b/d", "b/d/e.go", "empty", "vendor", "vendor/x", "vendor/x/y.go", "vendor/x/y.proto"},
+		},
+		{
+			name: "no ignore",
+			opts: treeOptions{NoIgnore: true},
+			want: []string{"a.go", "a.o", "b", "b/c.go", "b/d", "b/d/e.go", "b/d/e_test.go", "build", "build/out", "empty", "vendor", "vendor/x", "vendor/x/y.go", "vendor/x/y.o", "vendor/x/y.proto"},
+		},
+		{
+			name: "hidden names, but never .git",
+			opts: treeOptions{Hidden: true, MaxDepth: 1},
+			want: []string{".gitignore", ".hidden", "a.go", "b", "empty", "vendor"},
+		},
+		{
+			name: "max depth",
+			opts: treeOptions{MaxDepth: 2},
+			want: []string{"a.go", "b", "b/c.go", "b/d", "empty", "vendor", "vendor/x"},
+		},
+		{
+			name: "include keeps entering directories",
+			opts: treeOptions{Include: []string{"*.go"}},
+			want: []string{"a.go", "b/c.go", "b/d/e.go", "vendor/x/y.go"},
+		},
+		{
+			name: "exclude prunes directories",
+			opts: treeOptions{Exclude: []string{"vendor", "b/d"}},
+			want: []string{"a.go", "b", "b/c.go", "empty"},
+		},
+		{
+			name: "double star glob",
+			opts: treeOptions{Include: []string{"vendor/**/*.proto"}},
+			want: []string{"vendor/x/y.proto"},
+		},
+		{
+			name: "subdirectory inherits rules from above",
+			dir:  "b",
+			opts: treeOptions{},
+			want: []string{"c.go", "d", "d/e.go"},
+		},
+		{
+			name: "subdirectory of an ignored directory is walked",
+			dir:  "build",
+			opts: treeOptions{},
+			want: []string{"out"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := walkTree("", filepath.Join(root, tt.dir), tt.opts, func(info fileInfo) bool {
+			got = append(got, info.Path)
+			return true
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: walked %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWalkTreeStopsAndRejects(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a": "", "b": "", "c/d": ""})
+
+	var got []string
+	walkTree("", root, treeOptions{NoIgnore: true}, func(info fileInfo) bool {
+		got = append(got, info.Path)
+		return len(got) < 2
+	})
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("walk stopped after %q; want %q", got, want)
+	}
+
+	if err := walkTree("", root, treeOptions{NoIgnore: true, Include: []string{"[a"}}, func(fileInfo) bool { return true }); err == nil {
+		t.Error("walkTree accepted an invalid glob")
+	}
+}
+
+func TestWalkTreeSymlinkedDirectory(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"real/f": ""})
+	if err := os.Symlink(filepath.Join(root, "real"), filepath.Join(root, "link")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	var got []string
+	walkTree("", root, treeOptions{NoIgnore: true}, func(info fileInfo) bool {
+		got = append(got, info.Path)
+		if info.Path == "link" && (!info.IsDir || !info.IsSymlink) {
+			t.Errorf("link: IsDir %v, IsSymlink %v; want both", info.IsDir, info.IsSymlink)
+		}
+		return true
+	})
+	if want := []string{"link", "real", "real/f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("walked %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// foregroundScanInterval is how often each session's foreground process is
+// checked.
+const foregroundScanInterval = 500 * time.Millisecond
+
+// foregroundProcess is the process in the foreground of a session's
+// terminal: the shell at its prompt, or the program it is running.
+type foregroundProcess struct {
+	PID     int      `json:"pid"`               // the foreground process group
+	Name    string   `json:"name"`              // e.g. "vim"
+	Command []string `json:"command,omitempty"` // its arguments, when readable
+	Busy    bool     `json:"busy"`              // a program other than the shell is running
+}
+
+// watchForegroundProcesses sends processChanged messages when the program in
+// the foreground of a session changes. Where the foreground process group
+// can't be read (Windows), no messages are sent.
+func watchForegroundProcesses() {
+	ticker := time.NewTicker(foregroundScanInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if isShuttingDown() {
+			return
+		}
+		for _, sess := range terminalSessions.list() {
+			sess.checkForeground()
+		}
+	}
+}
+
+// checkForeground looks up the foreground process group and announces it if
+// it changed.
+func (s *terminalSession) checkForeground() {
+	pgid := foregroundPGID(s.ptmx)
+	if pgid <= 0 {
+		return
+	}
+	s.mu.Lock()
+	unchanged := s.process != nil && s.process.PID == pgid
+	s.mu.Unlock()
+	if unchanged {
+		return
+	}
+	proc := &foregroundProcess{PID: pgid, Busy: pgid != s.pid()}
+	proc.Name, proc.Command = processCommand(pgid)
+	if proc.Name == "" && len(proc.Command) > 0 {
+		proc.Name = filepath.Base(proc.Command[0])
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.process = proc
+	s.mu.Unlock()
+	if debugEnabled() {
+		log.Printf("[DEBUG] Session #%d: foreground is %s (PID: %d)", s.id, proc.Name, pgid)
+	}
+	s.broadcastJSON(wsMessage{Type: "processChanged", Session: s.id, Process: proc})
+}
+
+// busyProcess returns the program running in the foreground, or nil if the
+// shell is idle or the foreground isn't known.
+func (s *terminalSession) busyProcess() *foregroundProcess {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.process != nil && s.process.Busy {
+		return s.process
+	}
+	return nil
+}
+
+// closeSession hangs up a session on request and disconnects its clients
+// with the reason "sessionClosed".
+func (s *terminalSession) closeSession() {
+	s.mu.Lock()
+	clients := s.clientList()
+	s.mu.Unlock()
+	s.hangup()
+	closeClients(clients, websocket.CloseNormalClosure, "sessionClosed")
+	s.end()
+}
+
+// closeSessionHandler serves DELETE /sessions/<id>. A session with a program
+// running in the foreground is only closed with ?force=true; otherwise the
+// reply is 409 naming the program, so the client can ask the user first.
+func closeSessionHandler(w http.ResponseWriter, r *http.Request, idParam string) {
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sess := sessionFromPath(w, idParam)
+	if sess == nil {
+		return
+	}
+	sess.checkForeground()
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	busy := sess.busyProcess()
+	if busy != nil && !force {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   busy.Name + " is still running",
+			"process": busy,
+		})
+		return
+	}
+	detail := ""
+	if busy != nil {
+		detail = "forced: " + busy.Name
+	}
+	audit.record(auditEntry{Action: "session.close", Session: sess.id, Detail: detail}.from(who))
+	log.Printf("Session #%d closed by %s", sess.id, who.RemoteAddr)
+	sess.closeSession()
+	w.WriteHeader(http.StatusNoContent)
+}
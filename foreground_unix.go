@@ -0,0 +1,62 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// foregroundPGID returns the foreground process group of the terminal, as
+// tcgetpgrp(3) would, or 0 if it can't be read.
+func foregroundPGID(ptmx io.ReadWriteCloser) int {
+	f, ok := ptmx.(*os.File)
+	if !ok {
+		return 0
+	}
+	// Fd() would switch the file to blocking mode, so the ioctl goes through
+	// the raw connection instead.
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var pgid int32
+	var errno syscall.Errno
+	rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgid)))
+	})
+	if errno != 0 {
+		return 0
+	}
+	return int(pgid)
+}
+
+// processCommand returns a process's name and arguments, from /proc where
+// there is one and from ps(1) otherwise.
+func processCommand(pid int) (string, []string) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if len(args) == 1 && args[0] == "" {
+			args = nil // a kernel thread, or a zombie
+		}
+		return strings.TrimSpace(string(comm)), args
+	}
+	out, err := exec.Command("ps", "-o", "args=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", nil
+	}
+	// ps can't tell where arguments containing spaces begin and end.
+	args := strings.Fields(string(out))
+	if len(args) == 0 {
+		return "", nil
+	}
+	return filepath.Base(args[0]), args
+}
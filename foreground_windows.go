@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "io"
+
+// foregroundPGID isn't available through ConPTY, so foreground processes
+// aren't tracked on Windows.
+func foregroundPGID(ptmx io.ReadWriteCloser) int {
+	return 0
+}
+
+func processCommand(pid int) (string, []string) {
+	return "", nil
+}
@@ -0,0 +1,773 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// forwardDialTimeout bounds connecting to a forwarded port.
+const forwardDialTimeout = 5 * time.Second
+
+// portScanInterval is how often terminal sessions are checked for new
+// listening ports.
+const portScanInterval = 2 * time.Second
+
+// forwardingSettings is the "forwarding" section of the config file.
+type forwardingSettings struct {
+	AllowedPorts []string `json:"allowedPorts"` // ports and ranges such as "3000" or "8000-8999"
+	ProxyPort    int      `json:"proxyPort"`    // first port forwarded apps are served on; 0 picks free ports
+
+	ranges [][2]int // parsed AllowedPorts
+}
+
+func (s *forwardingSettings) validate() error {
+	if s.ProxyPort < 0 || s.ProxyPort > 65535 {
+		return fmt.Errorf("forwarding.proxyPort must be a port number or 0")
+	}
+	s.ranges = nil
+	for _, spec := range s.AllowedPorts {
+		lo, hi, isRange := strings.Cut(spec, "-")
+		if !isRange {
+			hi = lo
+		}
+		first, err1 := strconv.Atoi(strings.TrimSpace(lo))
+		last, err2 := strconv.Atoi(strings.TrimSpace(hi))
+		if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+			return fmt.Errorf("forwarding.allowedPorts: %q is not a port or range", spec)
+		}
+		s.ranges = append(s.ranges, [2]int{first, last})
+	}
+	return nil
+}
+
+// allows reports whether port may be forwarded. Conduit's own ports never
+// may, so forwarding can't be used to reach Conduit as a loopback client.
+func (s *forwardingSettings) allows(port int) bool {
+	if port == boundPort || forwards.isListener(port) {
+		return false
+	}
+	for _, r := range s.ranges {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// dialLocalPort connects to a port on this machine over IPv4 loopback, or
+// IPv6 if nothing listens there: dev servers often bind only to "localhost",
+// which may resolve to either.
+func dialLocalPort(ctx context.Context, port int) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: forwardDialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err == nil {
+		return conn, nil
+	}
+	if conn6, err6 := dialer.DialContext(ctx, "tcp", net.JoinHostPort("::1", strconv.Itoa(port))); err6 == nil {
+		return conn6, nil
+	}
+	return nil, err
+}
+
+// forwardTransport carries proxied HTTP requests. Requests are addressed to
+// localhost:<port>, and the dialer picks the loopback address.
+var forwardTransport = &http.Transport{
+	DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, err
+		}
+		return dialLocalPort(ctx, port)
+	},
+	MaxIdleConnsPerHost:   8,
+	IdleConnTimeout:       90 * time.Second,
+	ResponseHeaderTimeout: 5 * time.Minute,
+}
+
+// metricTunnelsOpen counts open /tunnel connections.
+var metricTunnelsOpen atomic.Int32
+
+// --- HTTP Reverse Proxy ---
+
+// forwardMaxListeners bounds how many apps are forwarded at once, each on a
+// listener of its own.
+const forwardMaxListeners = 64
+
+// forwardTokenParam is the query parameter Conduit's redirect passes a
+// forwarded app's access token in.
+const forwardTokenParam = "conduitToken"
+
+// forwardSecret signs forwarding tokens. It is new on every start, so tokens
+// don't outlive the server.
+var forwardSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// forwardToken returns the token that gives a browser access to one forwarded
+// port, and to no other.
+func forwardToken(port int) string {
+	mac := hmac.New(sha256.New, forwardSecret)
+	fmt.Fprintf(mac, "forward:%d", port)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validForwardToken(port int, token string) bool {
+	return hmac.Equal([]byte(token), []byte(forwardToken(port)))
+}
+
+// forwardCookie names the cookie holding a port's token. Cookies are shared by
+// all ports of a host, so the name includes the forwarded port.
+func forwardCookie(port int) string {
+	return "conduit_forward_" + strconv.Itoa(port)
+}
+
+// forwardListener serves one forwarded port on a port of its own, so each
+// forwarded app has an origin of its own: its pages can read neither another
+// app's responses nor Conduit's.
+type forwardListener struct {
+	target int // the forwarded port
+	port   int // the port it is served on
+	tls    bool
+	server *http.Server
+}
+
+func (l *forwardListener) scheme() string {
+	if l.tls {
+		return "https"
+	}
+	return "http"
+}
+
+// forwardListenerSet holds the listeners of forwarded apps. One is started the
+// first time its port is opened through /proxy/ on Conduit's own port, and
+// kept until shutdown.
+type forwardListenerSet struct {
+	mu                      sync.Mutex
+	host, certFile, keyFile string
+	byTarget                map[int]*forwardListener
+	byPort                  map[int]*forwardListener
+}
+
+var forwards = &forwardListenerSet{
+	byTarget: make(map[int]*forwardListener),
+	byPort:   make(map[int]*forwardListener),
+}
+
+// configureForwarding sets the address and TLS settings of forwarded apps'
+// listeners, the same as Conduit's own.
+func configureForwarding(host, certFile, keyFile string) {
+	forwards.mu.Lock()
+	defer forwards.mu.Unlock()
+	forwards.host, forwards.certFile, forwards.keyFile = host, certFile, keyFile
+}
+
+// listenerFor returns the listener of a forwarded port, starting it if need be.
+func (f *forwardListenerSet) listenerFor(target int) (*forwardListener, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if l := f.byTarget[target]; l != nil {
+		return l, nil
+	}
+	if len(f.byTarget) >= forwardMaxListeners {
+		return nil, fmt.Errorf("%d apps are forwarded already", len(f.byTarget))
+	}
+	listener, err := f.listen()
+	if err != nil {
+		return nil, err
+	}
+	l := &forwardListener{target: target, port: listener.Addr().(*net.TCPAddr).Port, tls: f.certFile != ""}
+	l.server = &http.Server{Handler: activityMiddleware(l)}
+	go func() {
+		var err error
+		if l.tls {
+			err = l.server.ServeTLS(listener, f.certFile, f.keyFile)
+		} else {
+			err = l.server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			log.Printf("Forwarding server for port %d error: %v", target, err)
+		}
+	}()
+	f.byTarget[target], f.byPort[l.port] = l, l
+	log.Printf("Port %d is forwarded on port %d", target, l.port)
+	return l, nil
+}
+
+// listen opens a listener for another forwarded app: on the first free port
+// from forwarding.proxyPort on, or on any free port if that is 0. The caller
+// holds f.mu.
+func (f *forwardListenerSet) listen() (net.Listener, error) {
+	first := currentConfig().Forwarding.ProxyPort
+	if first == 0 {
+		return net.Listen("tcp", net.JoinHostPort(f.host, "0"))
+	}
+	err := fmt.Errorf("no free port from %d", first)
+	for port := first; port <= 65535 && port < first+2*forwardMaxListeners; port++ {
+		if port == boundPort || f.byPort[port] != nil {
+			continue
+		}
+		listener, lerr := net.Listen("tcp", net.JoinHostPort(f.host, strconv.Itoa(port)))
+		if lerr == nil {
+			return listener, nil
+		}
+		err = lerr
+	}
+	return nil, err
+}
+
+// isListener reports whether port is one forwarded apps are served on.
+func (f *forwardListenerSet) isListener(port int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.byPort[port] != nil
+}
+
+// byOrigin returns the listener an Origin is one of: its scheme is the
+// listener's, its host one the listener answers to, and its port the
+// listener's.
+func (f *forwardListenerSet) byOrigin(origin string) *forwardListener {
+	u, err := url.Parse(origin)
+	if origin == "" || err != nil || !forwardHost(u.Hostname()) {
+		return nil
+	}
+	portStr := u.Port()
+	if portStr == "" {
+		portStr = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil
+	}
+	f.mu.Lock()
+	l := f.byPort[port]
+	f.mu.Unlock()
+	if l == nil || u.Scheme != l.scheme() {
+		return nil
+	}
+	return l
+}
+
+// shutdown stops every forwarded app's listener.
+func (f *forwardListenerSet) shutdown(ctx context.Context) {
+	f.mu.Lock()
+	listeners := make([]*forwardListener, 0, len(f.byTarget))
+	for _, l := range f.byTarget {
+		listeners = append(listeners, l)
+	}
+	f.mu.Unlock()
+	for _, l := range listeners {
+		l.server.Shutdown(ctx)
+	}
+}
+
+// forwardedOrigin reports whether an Origin is a forwarded app's, as it is
+// for requests made by a forwarded page.
+func forwardedOrigin(origin string) bool {
+	return forwards.byOrigin(origin) != nil
+}
+
+// forwardHost reports whether forwarded apps are served for a Host: one that
+// names this machine, as for loopbackHost, or this machine's host name, or any
+// IP address. A page on another DNS name that is rebound to this machine is
+// refused.
+func forwardHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || net.ParseIP(host) != nil {
+		return true
+	}
+	if name, err := os.Hostname(); err == nil && strings.EqualFold(host, name) {
+		return true
+	}
+	return host != "" && strings.EqualFold(host, listenFlag)
+}
+
+// parseProxyPath splits an escaped /proxy/<port>/<path> into the port and the
+// path after it, reporting whether there is a slash between them.
+func parseProxyPath(escaped string) (port int, subPath string, hasSlash, ok bool) {
+	rest := strings.TrimPrefix(escaped, "/proxy/")
+	portStr, subPath, hasSlash := strings.Cut(rest, "/")
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 || strconv.Itoa(port) != portStr {
+		return 0, "", false, false
+	}
+	return port, subPath, hasSlash, true
+}
+
+// proxyRedirectHandler serves /proxy/<port>/<path> on Conduit's own port. An
+// authorized request is redirected to the same path on the port's own
+// listener, with a token that lets the browser in there.
+func proxyRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	port, _, _, ok := parseProxyPath(r.URL.EscapedPath())
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := authorizeRequest(r); !ok {
+		metricForwards.inc("http", outcomeDenied)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !currentConfig().Forwarding.allows(port) {
+		metricForwards.inc("http", outcomeDenied)
+		http.Error(w, fmt.Sprintf("Port %d is not allowed for forwarding", port), http.StatusForbidden)
+		return
+	}
+	l, err := forwards.listenerFor(port)
+	if err != nil {
+		log.Printf("HTTP forwarding of port %d unavailable: %v", port, err)
+		metricForwards.inc("http", outcomeError)
+		http.Error(w, "HTTP forwarding unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	q := r.URL.Query()
+	q.Del("key")
+	q.Set(forwardTokenParam, forwardToken(port))
+	target := url.URL{Scheme: l.scheme(), Host: net.JoinHostPort(host, strconv.Itoa(l.port)), Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: q.Encode()}
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// ServeHTTP serves /proxy/<port>/<path> for the listener's port, forwarding
+// the request, including websocket upgrades, to http://localhost:<port>/<path>.
+func (l *forwardListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if !forwardHost(host) {
+		log.Printf("[SECURITY] Denied: forwarded request for host %q from %s", r.Host, describeClient(r))
+		metricForwards.inc("http", outcomeDenied)
+		http.Error(w, "Misdirected request", http.StatusMisdirectedRequest)
+		return
+	}
+	port, subPath, hasSlash, ok := parseProxyPath(r.URL.EscapedPath())
+	if !ok || port != l.target {
+		http.NotFound(w, r)
+		return
+	}
+	if token := r.URL.Query().Get(forwardTokenParam); token != "" {
+		l.acceptToken(w, r, token)
+		return
+	}
+	prefix := "/proxy/" + strconv.Itoa(port)
+	if !hasSlash {
+		// Relative links in the app only resolve under the trailing slash.
+		target := prefix + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	if !l.authorized(r) {
+		log.Printf("[SECURITY] Denied: forwarded request to port %d without access from %s", port, describeClient(r))
+		metricForwards.inc("http", outcomeDenied)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !currentConfig().Forwarding.allows(port) {
+		metricForwards.inc("http", outcomeDenied)
+		http.Error(w, fmt.Sprintf("Port %d is not allowed for forwarding", port), http.StatusForbidden)
+		return
+	}
+
+	failed := false
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "http"
+			pr.Out.URL.Host = net.JoinHostPort("localhost", strconv.Itoa(port))
+			pr.Out.URL.RawPath = "/" + subPath
+			pr.Out.URL.Path, _ = url.PathUnescape(pr.Out.URL.RawPath)
+			pr.Out.Host = ""
+			// Don't pass Conduit's credentials on to the app.
+			pr.Out.Header.Del("X-Conduit-Key")
+			if q := pr.Out.URL.Query(); q.Has("key") {
+				q.Del("key")
+				pr.Out.URL.RawQuery = q.Encode()
+			}
+			cookies := withoutCookie(pr.Out.Header.Values("Cookie"), forwardCookie(port))
+			pr.Out.Header.Del("Cookie")
+			if cookies != "" {
+				pr.Out.Header.Set("Cookie", cookies)
+			}
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+		},
+		Transport: forwardTransport,
+		ModifyResponse: func(resp *http.Response) error {
+			if loc := resp.Header.Get("Location"); loc != "" {
+				resp.Header.Set("Location", rewriteForwardedLocation(loc, port, prefix))
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			failed = true
+			if debugEnabled() {
+				log.Printf("[DEBUG] Proxy to port %d: %v", port, err)
+			}
+			http.Error(w, fmt.Sprintf("Nothing answered on port %d", port), http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	if failed {
+		metricForwards.inc("http", outcomeError)
+	} else {
+		metricForwards.inc("http", outcomeOK)
+	}
+}
+
+// acceptToken exchanges the token from Conduit's redirect for a cookie, then
+// redirects to the same URL without it, so it neither stays in the address
+// bar nor reaches the app.
+func (l *forwardListener) acceptToken(w http.ResponseWriter, r *http.Request, token string) {
+	if !validForwardToken(l.target, token) {
+		log.Printf("[SECURITY] Denied: invalid forwarding token for port %d from %s", l.target, describeClient(r))
+		metricForwards.inc("http", outcomeDenied)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     forwardCookie(l.target),
+		Value:    token,
+		Path:     "/proxy/" + strconv.Itoa(l.target),
+		HttpOnly: true,
+		Secure:   l.tls,
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := r.URL.Query()
+	q.Del(forwardTokenParam)
+	target := url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: q.Encode()}
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// authorized reports whether a request may reach the forwarded app: with the
+// API key, or with the app's cookie. The browser sends the cookie to every
+// port of the host, so it only counts on navigations and on requests from
+// the app's own pages.
+func (l *forwardListener) authorized(r *http.Request) bool {
+	if requiredAPIKey != "" {
+		providedKey := r.Header.Get("X-Conduit-Key")
+		if providedKey == "" {
+			providedKey = r.URL.Query().Get("key")
+		}
+		if providedKey != "" {
+			return providedKey == requiredAPIKey
+		}
+	}
+	cookie, err := r.Cookie(forwardCookie(l.target))
+	if err != nil || !validForwardToken(l.target, cookie.Value) {
+		return false
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		if r.Header.Get("Sec-Fetch-Mode") != "navigate" {
+			return false
+		}
+	}
+	origin := r.Header.Get("Origin")
+	return origin == "" || forwards.byOrigin(origin) == l
+}
+
+// withoutCookie joins Cookie header values, leaving out the named cookie.
+func withoutCookie(values []string, name string) string {
+	var kept []string
+	for _, v := range values {
+		for _, c := range strings.Split(v, ";") {
+			c = strings.TrimSpace(c)
+			if n, _, _ := strings.Cut(c, "="); c != "" && n != name {
+				kept = append(kept, c)
+			}
+		}
+	}
+	return strings.Join(kept, "; ")
+}
+
+// rewriteForwardedLocation maps a redirect from the app back under its
+// /proxy/<port> prefix: absolute paths, and URLs pointing at the app itself.
+func rewriteForwardedLocation(loc string, port int, prefix string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+	if u.Host != "" {
+		host, p, _ := net.SplitHostPort(u.Host)
+		local := host == "localhost" || host == "127.0.0.1" || host == "::1"
+		if !local || p != strconv.Itoa(port) {
+			return loc
+		}
+		u.Scheme, u.Host = "", ""
+	}
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(loc, "//") {
+		return loc // relative to the current page, or another host
+	}
+	u.Path = prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = prefix + u.RawPath
+	}
+	return u.String()
+}
+
+// --- TCP Tunnel ---
+
+// tunnelHandler serves the /tunnel?port=<port> websocket, relaying binary
+// messages to and from a TCP connection to localhost:<port>.
+func tunnelHandler(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || port < 1 || port > 65535 {
+		http.Error(w, "port must be a port number", http.StatusBadRequest)
+		return
+	}
+	if !currentConfig().Forwarding.allows(port) {
+		metricForwards.inc("tunnel", outcomeDenied)
+		http.Error(w, fmt.Sprintf("Port %d is not allowed for forwarding", port), http.StatusForbidden)
+		return
+	}
+	ws, who, err := authorizedUpgrade(w, r, "tunnel")
+	if err != nil {
+		log.Printf("Tunnel WS upgrade failed: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	conn, err := dialLocalPort(r.Context(), port)
+	audit.record(auditEntry{Action: "tunnel.open", Detail: strconv.Itoa(port)}.from(who).withError(err))
+	if err != nil {
+		metricForwards.inc("tunnel", outcomeError)
+		ws.closeWithReason(websocket.CloseTryAgainLater, "connectFailed")
+		return
+	}
+	defer conn.Close()
+	metricForwards.inc("tunnel", outcomeOK)
+	metricTunnelsOpen.Add(1)
+	defer metricTunnelsOpen.Add(-1)
+	log.Printf("Tunnel to port %d opened by %s", port, who.RemoteAddr)
+
+	// TCP to websocket. When the app closes the connection, the websocket
+	// is closed normally.
+	go func() {
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				if werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					conn.Close()
+					return
+				}
+			}
+			if err != nil {
+				reason := "closed"
+				if err != io.EOF {
+					reason = "connectionError"
+				}
+				ws.closeWithReason(websocket.CloseNormalClosure, reason)
+				return
+			}
+		}
+	}()
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// --- Listening Ports ---
+
+// listeningPort is a TCP port something on this machine accepts
+// connections on through loopback.
+type listeningPort struct {
+	Port      int      `json:"port"`
+	Addresses []string `json:"addresses"`           // bound addresses, e.g. "127.0.0.1" or "::"
+	PID       int      `json:"pid,omitempty"`       // when the owning process is visible to Conduit
+	Process   string   `json:"process,omitempty"`   // its command name
+	ProxyPath string   `json:"proxyPath,omitempty"` // "/proxy/<port>/" if the port may be forwarded
+}
+
+// portsResponse is returned by GET /ports.
+type portsResponse struct {
+	Supported bool            `json:"supported"` // false where ports can't be detected
+	Ports     []listeningPort `json:"ports"`
+}
+
+// forwardablePorts returns the listening ports that may be forwarded.
+func forwardablePorts() ([]listeningPort, bool, error) {
+	ports, supported, err := listeningPorts()
+	if err != nil {
+		return nil, supported, err
+	}
+	fwd := currentConfig().Forwarding
+	allowed := ports[:0]
+	for _, p := range ports {
+		if fwd.allows(p.Port) {
+			p.ProxyPath = proxyPath(p.Port)
+			allowed = append(allowed, p)
+		}
+	}
+	return allowed, supported, nil
+}
+
+func proxyPath(port int) string {
+	return "/proxy/" + strconv.Itoa(port) + "/"
+}
+
+// portsHandler serves GET /ports.
+func portsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorizeRequest(r); !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ports, supported, err := forwardablePorts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(portsResponse{Supported: supported, Ports: append([]listeningPort{}, ports...)})
+}
+
+// --- Session Ports ---
+
+// watchSessionPorts announces ports that processes started in a terminal
+// session begin or stop listening on, so an editor can offer to open a dev
+// server as soon as it is up. A port belongs to the session whose shell is
+// its owner or one of the owner's ancestors.
+func watchSessionPorts() {
+	if _, supported, _ := listeningPorts(); !supported {
+		return
+	}
+	ticker := time.NewTicker(portScanInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if isShuttingDown() {
+			return
+		}
+		sessions := terminalSessions.list()
+		if len(sessions) == 0 {
+			continue
+		}
+		ports, _, err := listeningPorts()
+		if err != nil {
+			if debugEnabled() {
+				log.Printf("[DEBUG] Listing ports: %v", err)
+			}
+			continue
+		}
+		byShell := make(map[int]*terminalSession, len(sessions))
+		for _, sess := range sessions {
+			if pid := sess.pid(); pid > 0 {
+				byShell[pid] = sess
+			}
+		}
+		found := make(map[*terminalSession]map[int]listeningPort)
+		fwd := currentConfig().Forwarding
+		for _, p := range ports {
+			sess := sessionOfProcess(p.PID, byShell)
+			if sess == nil {
+				continue
+			}
+			if fwd.allows(p.Port) {
+				p.ProxyPath = proxyPath(p.Port)
+			}
+			if found[sess] == nil {
+				found[sess] = make(map[int]listeningPort)
+			}
+			found[sess][p.Port] = p
+		}
+		for _, sess := range sessions {
+			sess.updatePorts(found[sess])
+		}
+	}
+}
+
+// sessionOfProcess walks up from pid to the shell of a session, if any.
+func sessionOfProcess(pid int, byShell map[int]*terminalSession) *terminalSession {
+	for depth := 0; pid > 1 && depth < 64; depth++ {
+		if sess := byShell[pid]; sess != nil {
+			return sess
+		}
+		pid = parentPID(pid)
+	}
+	return nil
+}
+
+// updatePorts replaces the session's listening ports, sending portOpened and
+// portClosed messages for the differences.
+func (s *terminalSession) updatePorts(ports map[int]listeningPort) {
+	s.mu.Lock()
+	var changes []wsMessage
+	for port, p := range ports {
+		if _, known := s.ports[port]; !known {
+			p := p
+			changes = append(changes, wsMessage{Type: "portOpened", Session: s.id, Port: &p})
+		}
+	}
+	for port, p := range s.ports {
+		if _, open := ports[port]; !open {
+			p := p
+			changes = append(changes, wsMessage{Type: "portClosed", Session: s.id, Port: &p})
+		}
+	}
+	s.ports = ports
+	s.mu.Unlock()
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Port.Port < changes[j].Port.Port })
+	for _, msg := range changes {
+		if debugEnabled() {
+			log.Printf("[DEBUG] Session #%d: %s %d", s.id, msg.Type, msg.Port.Port)
+		}
+		s.broadcastJSON(msg)
+	}
+}
+
+// portList returns the session's listening ports in order. The caller holds
+// s.mu.
+func (s *terminalSession) portList() []listeningPort {
+	var list []listeningPort
+	for _, p := range s.ports {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Port < list[j].Port })
+	return list
+}
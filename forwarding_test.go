@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestForwardListener(t *testing.T) {
+	var appCookies string
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		appCookies = r.Header.Get("Cookie")
+		w.Write([]byte("app " + r.URL.Path))
+	}))
+	defer app.Close()
+	target := app.Listener.Addr().(*net.TCPAddr).Port
+	withConfig(t, func(cfg *conduitConfig) {
+		cfg.Forwarding.AllowedPorts = []string{strconv.Itoa(target)}
+		if err := cfg.Forwarding.validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	savedKey := requiredAPIKey
+	requiredAPIKey = "secret"
+	configureForwarding("127.0.0.1", "", "")
+	defer func() {
+		requiredAPIKey = savedKey
+		forwards.shutdown(context.Background())
+		forwards.mu.Lock()
+		forwards.byTarget = make(map[int]*forwardListener)
+		forwards.byPort = make(map[int]*forwardListener)
+		forwards.mu.Unlock()
+	}()
+
+	// Conduit's own port redirects an authorized request to the app's
+	// listener, with a token.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://localhost:8081/proxy/"+strconv.Itoa(target)+"/page?key=secret&a=1", nil)
+	req.RemoteAddr = "203.0.113.5:4000"
+	proxyRedirectHandler(rec, req)
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusFound || err != nil {
+		t.Fatalf("redirect: %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	l := forwards.byTarget[target]
+	if loc.Port() != strconv.Itoa(l.port) || loc.Query().Get("key") != "" || loc.Query().Get(forwardTokenParam) != forwardToken(target) {
+		t.Fatalf("redirected to %s", loc)
+	}
+	if !forwards.isListener(l.port) || currentConfig().Forwarding.allows(l.port) {
+		t.Error("the listener's own port may be forwarded")
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(path string, header map[string]string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://127.0.0.1:"+strconv.Itoa(l.port)+path, nil)
+		for k, v := range header {
+			if k == "Host" {
+				req.Host = v
+			} else {
+				req.Header.Set(k, v)
+			}
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// The token is exchanged for a cookie, and taken out of the URL.
+	resp := get(loc.RequestURI(), nil)
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == forwardCookie(target) {
+			cookie = c
+		}
+	}
+	if resp.StatusCode != http.StatusFound || cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("token exchange: %d, cookie %v", resp.StatusCode, cookie)
+	}
+	if got := resp.Header.Get("Location"); strings.Contains(got, forwardTokenParam) || !strings.HasSuffix(got, "/page?a=1") {
+		t.Errorf("after the exchange, redirected to %q", got)
+	}
+
+	self := "http://127.0.0.1:" + strconv.Itoa(l.port)
+	withCookie := forwardCookie(target) + "=" + cookie.Value + "; theme=dark"
+	path := "/proxy/" + strconv.Itoa(target) + "/page"
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		want   int
+	}{
+		{"no cookie", path, nil, http.StatusUnauthorized},
+		{"cookie", path, map[string]string{"Cookie": withCookie}, http.StatusOK},
+		{"API key", path, map[string]string{"X-Conduit-Key": "secret"}, http.StatusOK},
+		{"wrong API key with cookie", path, map[string]string{"X-Conduit-Key": "wrong", "Cookie": withCookie}, http.StatusUnauthorized},
+		{"another port's token", path, map[string]string{"Cookie": forwardCookie(target) + "=" + forwardToken(target+1)}, http.StatusUnauthorized},
+		{"invalid token", "/proxy/" + strconv.Itoa(target) + "/?" + forwardTokenParam + "=x", nil, http.StatusUnauthorized},
+		{"own origin", path, map[string]string{"Cookie": withCookie, "Origin": self}, http.StatusOK},
+		{"own origin by name", path, map[string]string{"Cookie": withCookie, "Origin": "http://localhost:" + strconv.Itoa(l.port), "Host": "localhost:" + strconv.Itoa(l.port)}, http.StatusOK},
+		{"other origin", path, map[string]string{"Cookie": withCookie, "Origin": "http://localhost:3000"}, http.StatusUnauthorized},
+		{"own port, other scheme", path, map[string]string{"Cookie": withCookie, "Origin": "https://127.0.0.1:" + strconv.Itoa(l.port)}, http.StatusUnauthorized},
+		{"same-site subresource", path, map[string]string{"Cookie": withCookie, "Sec-Fetch-Site": "same-site", "Sec-Fetch-Mode": "no-cors"}, http.StatusUnauthorized},
+		{"cross-site navigation", path, map[string]string{"Cookie": withCookie, "Sec-Fetch-Site": "cross-site", "Sec-Fetch-Mode": "navigate"}, http.StatusOK},
+		{"rebound DNS name", path, map[string]string{"Cookie": withCookie, "Host": "attacker.example:" + strconv.Itoa(l.port)}, http.StatusMisdirectedRequest},
+		{"another port's path", "/proxy/" + strconv.Itoa(target+1) + "/", map[string]string{"X-Conduit-Key": "secret"}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if resp := get(tt.path, tt.header); resp.StatusCode != tt.want {
+			t.Errorf("%s: %d; want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	get(path, map[string]string{"Cookie": withCookie})
+	if appCookies != "theme=dark" {
+		t.Errorf("the app got cookies %q", appCookies)
+	}
+}
+
+func TestForwardedOrigin(t *testing.T) {
+	savedListen := listenFlag
+	listenFlag = "127.0.0.1"
+	forwards.mu.Lock()
+	l := &forwardListener{target: 3000, port: 41207}
+	forwards.byPort[l.port] = l
+	forwards.mu.Unlock()
+	defer func() {
+		listenFlag = savedListen
+		forwards.mu.Lock()
+		delete(forwards.byPort, l.port)
+		forwards.mu.Unlock()
+	}()
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"http://localhost:41207", true},
+		{"http://127.0.0.1:41207", true},
+		{"http://[::1]:41207", true},
+		{"http://3000.localhost:41207", true},
+		{"https://localhost:41207", false},
+		{"http://localhost:41208", false},
+		{"http://localhost", false},
+		{"http://attacker.example:41207", false},
+		{"null", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := forwardedOrigin(tt.origin); got != tt.want {
+			t.Errorf("forwardedOrigin(%q) = %v; want %v", tt.origin, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// The /git API runs the local git binary against a repository under a file
+// root, so editors get structured status, diffs, history and blame without
+// scraping a terminal.
+
+// gitTimeout bounds read-only git commands; gitCommitTimeout allows for
+// commit hooks.
+const gitTimeout = 60 * time.Second
+const gitCommitTimeout = 10 * time.Minute
+
+// gitLogMaxLimit caps the commits returned by one /git/log call.
+const gitLogMaxLimit = 500
+
+// gitStatusDebounce is how long file events must settle before watchers are
+// sent a new status.
+const gitStatusDebounce = 250 * time.Millisecond
+
+// gitMaxWatchedDirs caps the working tree directories watched per repository.
+const gitMaxWatchedDirs = 1000
+
+var errNotGitRepo = errors.New("not a git repository")
+
+// gitRepo is a repository whose top level is inside a file root.
+type gitRepo struct {
+	root   string // file root name
+	rel    string // top level, relative to the file root and slash-separated; "" is the root itself
+	dir    string // absolute top level
+	gitDir string // absolute .git directory, which can be elsewhere for worktrees
+}
+
+// openGitRepo finds the repository containing path. Its top level must be
+// inside the file root.
+func openGitRepo(root, path string) (*gitRepo, error) {
+	dir, err := securePathIn(root, path)
+	if err != nil {
+		return nil, os.ErrPermission
+	}
+	rootDir, err := securePathIn(root, "")
+	if err != nil {
+		return nil, err
+	}
+	out, err := runGit(dir, gitTimeout, "rev-parse", "--show-toplevel", "--absolute-git-dir")
+	if err != nil {
+		return nil, errNotGitRepo
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		return nil, errNotGitRepo
+	}
+	repo := &gitRepo{root: root, dir: filepath.Clean(lines[0]), gitDir: filepath.Clean(lines[1])}
+	rel, err := filepath.Rel(rootDir, repo.dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, os.ErrPermission
+	}
+	if rel != "." {
+		repo.rel = filepath.ToSlash(rel)
+	}
+	return repo, nil
+}
+
+// runGit runs git in dir and returns its stdout, or stderr as the error.
+func runGit(dir string, timeout time.Duration, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "core.quotepath=off", "-c", "color.ui=false"}, args...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_OPTIONAL_LOCKS=0", // status mustn't rewrite the index, or watchers would see their own refreshes
+		"GIT_LITERAL_PATHSPECS=1",
+		"GIT_PAGER=cat",
+		"GIT_EDITOR=true",
+		"LC_ALL=C",
+	)
+	var stdout, stderr cappedBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("git %s timed out", args[0])
+	}
+	if err != nil {
+		// Some failures, like "nothing to commit", are reported on stdout.
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return stdout.String(), errors.New(msg)
+		} else if msg := strings.TrimSpace(stdout.String()); msg != "" {
+			return stdout.String(), errors.New(msg)
+		}
+		return stdout.String(), err
+	}
+	if stdout.truncated {
+		return "", fmt.Errorf("git %s output exceeds %d bytes", args[0], execMaxCapture)
+	}
+	return stdout.String(), nil
+}
+
+func (repo *gitRepo) git(args ...string) (string, error) {
+	return runGit(repo.dir, gitTimeout, args...)
+}
+
+// path checks a path relative to the top level and returns it slash-separated.
+func (repo *gitRepo) path(p string) (string, error) {
+	abs := filepath.Join(repo.dir, filepath.Clean(filepath.FromSlash(p)))
+	rel, err := filepath.Rel(repo.dir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", os.ErrPermission
+	}
+	if rel == ".git" || strings.HasPrefix(rel, ".git"+string(filepath.Separator)) {
+		return "", os.ErrPermission
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (repo *gitRepo) paths(ps []string) ([]string, error) {
+	out := make([]string, 0, len(ps))
+	for _, p := range ps {
+		rel, err := repo.path(p)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rel)
+	}
+	return out, nil
+}
+
+// validRev rejects revisions git could mistake for options.
+func validRev(rev string) bool {
+	return rev != "" && len(rev) < 256 && !strings.HasPrefix(rev, "-") && !strings.ContainsAny(rev, " \t\r\n\x00")
+}
+
+// hasCommits reports whether HEAD points at a commit.
+func (repo *gitRepo) hasCommits() bool {
+	_, err := repo.git("rev-parse", "--verify", "--quiet", "HEAD")
+	return err == nil
+}
+
+// --- Status ---
+
+type gitStatus struct {
+	Repo    string           `json:"repo"`
+	Branch  gitBranchStatus  `json:"branch"`
+	Entries []gitStatusEntry `json:"entries"`
+}
+
+type gitBranchStatus struct {
+	Head     string `json:"head,omitempty"` // branch name; empty when detached
+	Detached bool   `json:"detached,omitempty"`
+	Commit   string `json:"commit,omitempty"` // empty before the first commit
+	Upstream string `json:"upstream,omitempty"`
+	Ahead    int    `json:"ahead"`
+	Behind   int    `json:"behind"`
+}
+
+type gitStatusEntry struct {
+	Path      string `json:"path"`               // relative to the top level
+	OrigPath  string `json:"origPath,omitempty"` // source of a rename or copy
+	Kind      string `json:"kind"`               // "changed", "renamed", "unmerged" or "untracked"
+	Index     string `json:"index"`              // staged change: ".", "M", "T", "A", "D", "R", "C" or "U"
+	Worktree  string `json:"worktree"`           // unstaged change, same codes
+	Submodule bool   `json:"submodule,omitempty"`
+}
+
+func (repo *gitRepo) status() (*gitStatus, error) {
+	out, err := repo.git("status", "--porcelain=v2", "--branch", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+	st, err := parseGitStatus(out)
+	if err != nil {
+		return nil, err
+	}
+	st.Repo = repo.rel
+	return st, nil
+}
+
+// parseGitStatus parses `git status --porcelain=v2 --branch -z`.
+func parseGitStatus(out string) (*gitStatus, error) {
+	st := &gitStatus{Entries: []gitStatusEntry{}}
+	records := strings.Split(out, "\x00")
+	for i := 0; i < len(records); i++ {
+		rec := records[i]
+		if len(rec) < 2 {
+			continue
+		}
+		entry := gitStatusEntry{Kind: "changed"}
+		var fields []string
+		switch rec[0] {
+		case '#':
+			key, value, _ := strings.Cut(rec[2:], " ")
+			switch key {
+			case "branch.oid":
+				if value != "(initial)" {
+					st.Branch.Commit = value
+				}
+			case "branch.head":
+				if value == "(detached)" {
+					st.Branch.Detached = true
+				} else {
+					st.Branch.Head = value
+				}
+			case "branch.upstream":
+				st.Branch.Upstream = value
+			case "branch.ab":
+				fmt.Sscanf(value, "+%d -%d", &st.Branch.Ahead, &st.Branch.Behind)
+			}
+			continue
+		case '?':
+			st.Entries = append(st.Entries, gitStatusEntry{Path: rec[2:], Kind: "untracked", Index: ".", Worktree: "?"})
+			continue
+		case '!':
+			continue
+		case '1':
+			fields = strings.SplitN(rec, " ", 9)
+		case '2':
+			entry.Kind = "renamed"
+			if fields = strings.SplitN(rec, " ", 10); len(fields) == 10 && i+1 < len(records) {
+				i++
+				entry.OrigPath = records[i]
+			}
+		case 'u':
+			entry.Kind = "unmerged"
+			fields = strings.SplitN(rec, " ", 11)
+		default:
+			return nil, fmt.Errorf("unexpected git status line %q", rec)
+		}
+		if len(fields) < 9 || len(fields[1]) != 2 {
+			return nil, fmt.Errorf("unexpected git status line %q", rec)
+		}
+		entry.Index, entry.Worktree = fields[1][:1], fields[1][1:]
+		entry.Submodule = fields[2] != "N..."
+		entry.Path = fields[len(fields)-1]
+		st.Entries = append(st.Entries, entry)
+	}
+	return st, nil
+}
+
+// --- History ---
+
+type gitCommit struct {
+	Hash    string   `json:"hash"`
+	Parents []string `json:"parents"`
+	Author  string   `json:"author"`
+	Email   string   `json:"email"`
+	Time    int64    `json:"time"` // author date, Unix seconds
+	Subject string   `json:"subject"`
+	Body    string   `json:"body,omitempty"`
+}
+
+type gitLog struct {
+	Commits []gitCommit `json:"commits"`
+	HasMore bool        `json:"hasMore"`
+}
+
+func (repo *gitRepo) log(rev, path string, skip, limit int) (*gitLog, error) {
+	result := &gitLog{Commits: []gitCommit{}}
+	if rev == "HEAD" && !repo.hasCommits() {
+		return result, nil
+	}
+	args := []string{"log", "--format=%H%x00%P%x00%an%x00%ae%x00%at%x00%s%x00%b%x1e",
+		"--skip=" + strconv.Itoa(skip), "--max-count=" + strconv.Itoa(limit+1), rev, "--"}
+	if path != "" {
+		args = append(args, path)
+	}
+	out, err := repo.git(args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range strings.Split(out, "\x1e") {
+		fields := strings.Split(strings.TrimLeft(rec, "\n"), "\x00")
+		if len(fields) != 7 {
+			continue
+		}
+		if len(result.Commits) == limit {
+			result.HasMore = true
+			break
+		}
+		t, _ := strconv.ParseInt(fields[4], 10, 64)
+		result.Commits = append(result.Commits, gitCommit{
+			Hash:    fields[0],
+			Parents: strings.Fields(fields[1]),
+			Author:  fields[2],
+			Email:   fields[3],
+			Time:    t,
+			Subject: fields[5],
+			Body:    strings.TrimSpace(fields[6]),
+		})
+	}
+	return result, nil
+}
+
+type gitBlameLine struct {
+	Line     int    `json:"line"`
+	OrigLine int    `json:"origLine"`
+	Commit   string `json:"commit"` // all zeros for lines not committed yet
+	Content  string `json:"content"`
+}
+
+type gitBlameCommit struct {
+	Author  string `json:"author"`
+	Email   string `json:"email"`
+	Time    int64  `json:"time"`
+	Summary string `json:"summary"`
+}
+
+type gitBlame struct {
+	Path    string                    `json:"path"`
+	Lines   []gitBlameLine            `json:"lines"`
+	Commits map[string]gitBlameCommit `json:"commits"`
+}
+
+func (repo *gitRepo) blame(rev, path string) (*gitBlame, error) {
+	args := []string{"blame", "--porcelain"}
+	if rev != "" {
+		args = append(args, rev)
+	}
+	out, err := repo.git(append(args, "--", path)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseGitBlame(path, out), nil
+}
+
+// parseGitBlame parses `git blame --porcelain`: a "<hash> <orig> <final>"
+// header per line, commit details the first time a commit appears, then the
+// line itself prefixed with a tab.
+func parseGitBlame(path, out string) *gitBlame {
+	b := &gitBlame{Path: path, Lines: []gitBlameLine{}, Commits: make(map[string]gitBlameCommit)}
+	lines := strings.Split(out, "\n")
+	for i := 0; i < len(lines); i++ {
+		header := strings.Fields(lines[i])
+		if len(header) < 3 {
+			continue
+		}
+		line := gitBlameLine{Commit: header[0]}
+		line.OrigLine, _ = strconv.Atoi(header[1])
+		line.Line, _ = strconv.Atoi(header[2])
+		commit, seen := b.Commits[line.Commit]
+		for i++; i < len(lines) && !strings.HasPrefix(lines[i], "\t"); i++ {
+			if seen {
+				continue
+			}
+			key, value, _ := strings.Cut(lines[i], " ")
+			switch key {
+			case "author":
+				commit.Author = value
+			case "author-mail":
+				commit.Email = strings.Trim(value, "<>")
+			case "author-time":
+				commit.Time, _ = strconv.ParseInt(value, 10, 64)
+			case "summary":
+				commit.Summary = value
+			}
+		}
+		if i < len(lines) {
+			line.Content = lines[i][1:]
+		}
+		b.Commits[line.Commit] = commit
+		b.Lines = append(b.Lines, line)
+	}
+	return b
+}
+
+// --- Branches ---
+
+type gitBranch struct {
+	Name     string `json:"name"` // e.g. "main", or "origin/main" for a remote branch
+	Remote   bool   `json:"remote,omitempty"`
+	Current  bool   `json:"current,omitempty"`
+	Commit   string `json:"commit"`
+	Upstream string `json:"upstream,omitempty"`
+	Time     int64  `json:"time"` // committer date of the tip, Unix seconds
+	Subject  string `json:"subject"`
+}
+
+func (repo *gitRepo) branches() ([]gitBranch, error) {
+	out, err := repo.git("for-each-ref",
+		"--format=%(refname)%00%(objectname)%00%(upstream:short)%00%(HEAD)%00%(committerdate:unix)%00%(contents:subject)",
+		"refs/heads", "refs/remotes")
+	if err != nil {
+		return nil, err
+	}
+	branches := []gitBranch{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 6 || strings.HasSuffix(fields[0], "/HEAD") {
+			continue
+		}
+		b := gitBranch{Commit: fields[1], Upstream: fields[2], Current: fields[3] == "*", Subject: fields[5]}
+		b.Time, _ = strconv.ParseInt(fields[4], 10, 64)
+		if name, ok := strings.CutPrefix(fields[0], "refs/heads/"); ok {
+			b.Name = name
+		} else {
+			b.Name, b.Remote = strings.TrimPrefix(fields[0], "refs/remotes/"), true
+		}
+		branches = append(branches, b)
+	}
+	return branches, nil
+}
+
+// --- Status Watching ---
+
+// gitRepoWatch is a repository whose status is pushed to /files clients.
+type gitRepoWatch struct {
+	repo    *gitRepo
+	clients map[*wsConn]*gitRepo // each client's view of the repository, for its root-relative path
+	timer   *time.Timer
+	last    string   // the status last sent, as JSON
+	dirs    []string // the directories watched for it
+}
+
+// watchGit subscribes a /files client to a repository's status and sends it
+// the current status. The working tree directories with tracked files and the
+// .git directory are watched.
+func (wm *watcherManager) watchGit(ws *wsConn, root, path string) error {
+	repo, err := openGitRepo(root, path)
+	if err != nil {
+		return err
+	}
+	st, err := repo.status()
+	if err != nil {
+		return err
+	}
+
+	wm.mu.Lock()
+	w := wm.gitRepos[repo.dir]
+	if w == nil {
+		data, _ := json.Marshal(st)
+		w = &gitRepoWatch{repo: repo, clients: make(map[*wsConn]*gitRepo), last: string(data), dirs: repo.watchDirs()}
+		wm.gitRepos[repo.dir] = w
+		wm.mu.Unlock()
+		for _, dir := range w.dirs {
+			wm.watcher.Add(dir)
+		}
+		wm.mu.Lock()
+	}
+	w.clients[ws] = repo
+	wm.mu.Unlock()
+
+	ws.WriteJSON(fileResponse{Action: "gitStatus", Path: repo.rel, Data: st})
+	return nil
+}
+
+// watchDirs lists the directories whose changes can change the status.
+func (repo *gitRepo) watchDirs() []string {
+	dirs := []string{repo.gitDir, filepath.Join(repo.gitDir, "refs", "heads"), repo.dir}
+	seen := map[string]bool{".": true}
+	out, _ := repo.git("ls-files", "-z")
+	for _, file := range strings.Split(out, "\x00") {
+		dir := filepath.Dir(filepath.FromSlash(file))
+		if file == "" || seen[dir] {
+			continue
+		}
+		if len(seen) > gitMaxWatchedDirs {
+			break
+		}
+		seen[dir] = true
+		dirs = append(dirs, filepath.Join(repo.dir, dir))
+	}
+	return dirs
+}
+
+// gitEvent schedules a status refresh for the repositories an event is in.
+func (wm *watcherManager) gitEvent(event fsnotify.Event) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for dir, w := range wm.gitRepos {
+		if isWithin(event.Name, dir) || isWithin(event.Name, w.repo.gitDir) {
+			wm.scheduleGitRefresh(dir, w)
+		}
+	}
+}
+
+// gitChanged schedules a refresh after the /git API changed a repository.
+func (wm *watcherManager) gitChanged(dir string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if w := wm.gitRepos[dir]; w != nil {
+		wm.scheduleGitRefresh(dir, w)
+	}
+}
+
+// scheduleGitRefresh debounces refreshes. The caller holds wm.mu.
+func (wm *watcherManager) scheduleGitRefresh(dir string, w *gitRepoWatch) {
+	if w.timer == nil {
+		w.timer = time.AfterFunc(gitStatusDebounce, func() { wm.refreshGit(dir) })
+	} else {
+		w.timer.Reset(gitStatusDebounce)
+	}
+}
+
+// refreshGit sends a repository's status to its watchers if it changed.
+func (wm *watcherManager) refreshGit(dir string) {
+	wm.mu.Lock()
+	w := wm.gitRepos[dir]
+	wm.mu.Unlock()
+	if w == nil {
+		return
+	}
+	st, err := w.repo.status()
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(st)
+
+	wm.mu.Lock()
+	if string(data) == w.last {
+		wm.mu.Unlock()
+		return
+	}
+	w.last = string(data)
+	clients := make(map[*wsConn]*gitRepo, len(w.clients))
+	for ws, repo := range w.clients {
+		clients[ws] = repo
+	}
+	wm.mu.Unlock()
+
+	for ws, repo := range clients {
+		view := *st
+		view.Repo = repo.rel
+		ws.WriteJSON(fileResponse{Action: "gitStatus", Path: repo.rel, Data: view})
+	}
+}
+
+// removeGitClient drops a client's repository subscriptions and returns the
+// directories watched for repositories nobody watches any more. The caller
+// holds wm.mu, and passes the directories to unwatchDirs once it is released.
+func (wm *watcherManager) removeGitClient(client *wsConn) []string {
+	var dirs []string
+	for dir, w := range wm.gitRepos {
+		delete(w.clients, client)
+		if len(w.clients) == 0 {
+			if w.timer != nil {
+				w.timer.Stop()
+			}
+			delete(wm.gitRepos, dir)
+			dirs = append(dirs, w.dirs...)
+		}
+	}
+	return dirs
+}
+
+// isWithin reports whether path is dir or inside it.
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// --- Handler ---
+
+// gitRequest is the body of a /git POST.
+type gitRequest struct {
+	Root       string   `json:"root,omitempty"`
+	Repo       string   `json:"repo"`
+	Paths      []string `json:"paths,omitempty"`      // stage, unstage
+	All        bool     `json:"all,omitempty"`        // stage, unstage: every change
+	Message    string   `json:"message,omitempty"`    // commit
+	Amend      bool     `json:"amend,omitempty"`      // commit
+	Branch     string   `json:"branch,omitempty"`     // switch
+	Create     bool     `json:"create,omitempty"`     // switch: create the branch
+	StartPoint string   `json:"startPoint,omitempty"` // switch with create
+}
+
+// gitHandler serves /git/<operation>. Reads are GETs taking root, repo and
+// operation-specific query parameters; changes are POSTs with a gitRequest.
+func gitHandler(w http.ResponseWriter, r *http.Request) {
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	op := strings.TrimPrefix(r.URL.Path, "/git/")
+
+	var req gitRequest
+	switch op {
+	case "status", "diff", "log", "blame", "branches":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req.Root, req.Repo = r.URL.Query().Get("root"), r.URL.Query().Get("repo")
+	case "stage", "unstage", "commit", "switch":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	started := time.Now()
+	repo, err := openGitRepo(req.Root, req.Repo)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			metricGitOps.inc(op, outcomeDenied)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		} else {
+			metricGitOps.inc(op, outcomeError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	result, detail, status, err := runGitOperation(op, repo, &req, r)
+	if op == "stage" || op == "unstage" || op == "commit" || op == "switch" {
+		audit.record(auditEntry{Action: "git." + op, Path: repo.rel, Detail: detail}.from(who).withError(err))
+		fileWatcher.gitChanged(repo.dir)
+	}
+	if err != nil {
+		metricGitOps.inc(op, outcomeError)
+		if errors.Is(err, os.ErrPermission) {
+			status, err = http.StatusForbidden, errors.New("Forbidden")
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	metricGitOps.inc(op, outcomeOK)
+	metricGitOpDuration.observe(time.Since(started), op)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// runGitOperation performs one /git operation. On failure it returns the
+// HTTP status to report; detail describes changes for the audit log.
+func runGitOperation(op string, repo *gitRepo, req *gitRequest, r *http.Request) (result interface{}, detail string, status int, err error) {
+	q := r.URL.Query()
+	bad := func(format string, args ...interface{}) (interface{}, string, int, error) {
+		return nil, detail, http.StatusBadRequest, fmt.Errorf(format, args...)
+	}
+	failed := func(err error) (interface{}, string, int, error) {
+		return nil, detail, http.StatusInternalServerError, err
+	}
+
+	switch op {
+	case "status":
+		st, err := repo.status()
+		if err != nil {
+			return failed(err)
+		}
+		return st, "", 0, nil
+
+	case "diff":
+		// The working tree against the index, the index against HEAD
+		// (staged=true), or the working tree against a revision.
+		args := []string{"diff", "--no-color", "--no-ext-diff"}
+		if q.Get("staged") == "true" {
+			args = append(args, "--cached")
+		}
+		if rev := q.Get("rev"); rev != "" {
+			if !validRev(rev) {
+				return bad("invalid rev")
+			}
+			args = append(args, rev)
+		}
+		args = append(args, "--")
+		if p := q.Get("path"); p != "" {
+			rel, err := repo.path(p)
+			if err != nil {
+				return failed(err)
+			}
+			args = append(args, rel)
+		}
+		out, err := repo.git(args...)
+		if err != nil {
+			return failed(err)
+		}
+		return map[string]string{"diff": out}, "", 0, nil
+
+	case "log":
+		rev := q.Get("rev")
+		if rev == "" {
+			rev = "HEAD"
+		}
+		if !validRev(rev) {
+			return bad("invalid rev")
+		}
+		skip, _ := strconv.Atoi(q.Get("skip"))
+		limit, _ := strconv.Atoi(q.Get("limit"))
+		if limit <= 0 {
+			limit = 50
+		}
+		limit = min(limit, gitLogMaxLimit)
+		path := ""
+		if p := q.Get("path"); p != "" {
+			if path, err = repo.path(p); err != nil {
+				return failed(err)
+			}
+		}
+		log, err := repo.log(rev, path, max(skip, 0), limit)
+		if err != nil {
+			return failed(err)
+		}
+		return log, "", 0, nil
+
+	case "blame":
+		path, err := repo.path(q.Get("path"))
+		if err != nil || path == "." {
+			return bad("path must name a file")
+		}
+		rev := q.Get("rev")
+		if rev != "" && !validRev(rev) {
+			return bad("invalid rev")
+		}
+		blame, err := repo.blame(rev, path)
+		if err != nil {
+			return failed(err)
+		}
+		return blame, "", 0, nil
+
+	case "branches":
+		branches, err := repo.branches()
+		if err != nil {
+			return failed(err)
+		}
+		return branches, "", 0, nil
+
+	case "stage", "unstage":
+		paths, err := repo.paths(req.Paths)
+		if err != nil {
+			return failed(err)
+		}
+		if len(paths) == 0 && !req.All {
+			return bad("paths must not be empty unless all is set")
+		}
+		if req.All {
+			paths, detail = nil, "all"
+		} else {
+			detail = strings.Join(paths, ", ")
+		}
+		var args []string
+		switch {
+		case op == "stage":
+			args = []string{"add", "--all", "--"}
+		case repo.hasCommits():
+			args = []string{"reset", "--quiet", "HEAD", "--"}
+		default:
+			// Before the first commit there is no HEAD to reset to.
+			args = []string{"rm", "--cached", "-r", "--quiet", "--ignore-unmatch", "--"}
+			if req.All {
+				paths = []string{"."}
+			}
+		}
+		if _, err := repo.git(append(args, paths...)...); err != nil {
+			return failed(err)
+		}
+
+	case "commit":
+		if strings.TrimSpace(req.Message) == "" && !req.Amend {
+			return bad("message must not be empty")
+		}
+		detail, _, _ = strings.Cut(req.Message, "\n")
+		args := []string{"commit", "--quiet"}
+		if req.Amend {
+			args = append(args, "--amend")
+			if req.Message == "" {
+				args = append(args, "--no-edit")
+			}
+		}
+		if req.Message != "" {
+			args = append(args, "--message="+req.Message)
+		}
+		if _, err := runGit(repo.dir, gitCommitTimeout, args...); err != nil {
+			return nil, detail, http.StatusConflict, err
+		}
+
+	case "switch":
+		detail = req.Branch
+		if !validRev(req.Branch) {
+			return bad("invalid branch")
+		}
+		args := []string{"switch", "--quiet"}
+		if req.Create {
+			if _, err := repo.git("check-ref-format", "--branch", req.Branch); err != nil {
+				return bad("invalid branch name %q", req.Branch)
+			}
+			args = append(args, "--create", req.Branch)
+			if req.StartPoint != "" {
+				if !validRev(req.StartPoint) {
+					return bad("invalid startPoint")
+				}
+				args = append(args, req.StartPoint)
+			}
+		} else {
+			args = append(args, req.Branch)
+		}
+		if _, err := repo.git(args...); err != nil {
+			return nil, detail, http.StatusConflict, err
+		}
+	}
+
+	// Changes reply with the new status.
+	st, err := repo.status()
+	if err != nil {
+		return failed(err)
+	}
+	return st, detail, 0, nil
+}
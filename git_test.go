@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRemoveGitClient(t *testing.T) {
+	repo := t.TempDir()
+	dirs := []string{filepath.Join(repo, ".git"), repo, filepath.Join(repo, "a"), filepath.Join(repo, "b")}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := fileWatcher.watcher.Add(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, second := &wsConn{}, &wsConn{}
+	fileWatcher.mu.Lock()
+	fileWatcher.gitRepos[repo] = &gitRepoWatch{
+		repo:    &gitRepo{dir: repo, gitDir: dirs[0]},
+		clients: map[*wsConn]*gitRepo{first: nil, second: nil},
+		dirs:    dirs,
+	}
+	// Another client watches one of the directories itself.
+	fileWatcher.subscribers[second] = map[string]bool{dirs[2]: true}
+	fileWatcher.mu.Unlock()
+	defer fileWatcher.removeClient(second)
+
+	watched := func() []string {
+		var got []string
+		for _, dir := range dirs {
+			if slices.Contains(fileWatcher.watcher.WatchList(), dir) {
+				got = append(got, dir)
+			}
+		}
+		return got
+	}
+	fileWatcher.removeClient(first)
+	if got := watched(); !slices.Equal(got, dirs) {
+		t.Errorf("with a client left, watching %q; want %q", got, dirs)
+	}
+
+	// The last client leaving removes the repository's watches, except the
+	// one its /files subscription needs.
+	fileWatcher.mu.Lock()
+	delete(fileWatcher.gitRepos[repo].clients, second)
+	fileWatcher.gitRepos[repo].clients[first] = nil
+	fileWatcher.mu.Unlock()
+	fileWatcher.removeClient(first)
+	if got, want := watched(), dirs[2:3]; !slices.Equal(got, want) {
+		t.Errorf("after the last client left, watching %q; want %q", got, want)
+	}
+}
@@ -11,4 +11,4 @@ require (
 
 require golang.org/x/sys v0.13.0
 
-require github.com/UserExistsError/conpty v0.1.4 // indirect
+require github.com/UserExistsError/conpty v0.1.4
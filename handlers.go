@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -26,15 +28,44 @@ type wsMessage struct {
 	Rows    int    `json:"rows,omitempty"`     // Used by client for "resize"
 	Hostname string `json:"hostname,omitempty"` // Used by server for "terminalInfo"
 	Cwd      string `json:"cwd,omitempty"`      // Used by server for "terminalInfo"
+	Reason   string `json:"reason,omitempty"`   // Used by server for "serverShutdown"
+	Enabled  bool   `json:"enabled,omitempty"`  // Used by "record" and "recordingState"
+	File     string `json:"file,omitempty"`     // Used by server for "recordingState"
+	Error    string `json:"error,omitempty"`    // Used by server for "recordingState" and "error"
+	Session     int32        `json:"session,omitempty"`     // Session the message is about
+	ClientID    int32        `json:"clientId,omitempty"`    // Used by "terminalInfo", "setDriver" and "driverRequested"
+	Mode        string       `json:"mode,omitempty"`        // Used by server for "terminalInfo"
+	InputPolicy string       `json:"inputPolicy,omitempty"` // Used by "setInputPolicy", "sessionState" and "terminalInfo"
+	Clients     []clientInfo `json:"clients,omitempty"`     // Used by server for "sessionState" and "terminalInfo"
+	Client      *clientInfo  `json:"client,omitempty"`      // Used by server for "clientJoined" and "clientLeft"
+	Port        *listeningPort  `json:"port,omitempty"`  // Used by server for "portOpened" and "portClosed"
+	Ports       []listeningPort `json:"ports,omitempty"` // Used by server for "terminalInfo"
+	Title       string             `json:"title,omitempty"`   // Used by server for "titleChanged" and "terminalInfo"
+	Process     *foregroundProcess `json:"process,omitempty"` // Used by server for "processChanged" and "terminalInfo"
+	Command     *shellCommand      `json:"command,omitempty"` // Used by server for "commandStarted" and "commandFinished"
+	Replay      string             `json:"replay,omitempty"`  // Used by server for "terminalInfo"
+	Query       string             `json:"query,omitempty"`      // Used by "search" and "searchResults"
+	Regex       bool               `json:"regex,omitempty"`      // Used by client for "search"
+	IgnoreCase  bool               `json:"ignoreCase,omitempty"` // Used by client for "search"
+	Context     int                `json:"context,omitempty"`    // Used by client for "search"
+	Matches     []searchMatch      `json:"matches,omitempty"`    // Used by server for "searchResults"
+	Truncated   bool               `json:"truncated,omitempty"`  // Used by server for "searchResults"
+	PasteID     int32              `json:"pasteId,omitempty"`    // Used by "pasteConfirm" and "confirmPaste"
+	Confirmed   bool               `json:"confirmed,omitempty"`  // Used by client for "confirmPaste"
+	Lines       int                `json:"lines,omitempty"`      // Used by server for "pasteConfirm"
+	Bytes       int                `json:"bytes,omitempty"`      // Used by server for "pasteConfirm"
+	Bracketed   bool               `json:"bracketed,omitempty"`  // Used by server for "pasteConfirm"
 }
 
 // Struct for the /up status response
 type statusResponse struct {
+	Service           string  `json:"service"`
 	Status            string  `json:"status"`
 	Version           string  `json:"version"`
 	UptimeSeconds     float64 `json:"uptime_seconds"`
 	ActiveConnections int32   `json:"active_connections"`
 	IsInstalled       bool    `json:"is_installed"`
+	Port              int     `json:"port"`
 }
 
 // Gorilla WebSocket upgrader with origin check
@@ -43,9 +74,10 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
-		if allowedOrigins[origin] {
+		if isOriginAllowed(origin) {
 			return true
 		}
+		origins.recordDenied(origin)
 		log.Printf("[SECURITY] Denied connection from invalid origin: %s", origin)
 		return false
 	},
@@ -54,29 +86,52 @@ var upgrader = websocket.Upgrader{
 // checkRequestAuthorization checks the origin or API key for a request.
 // It returns true if the request is authorized, false otherwise.
 func checkRequestAuthorization(r *http.Request) bool {
+	_, ok := authorizeRequest(r)
+	return ok
+}
+
+// authorizeRequest checks the origin or API key for a request and reports who
+// made it. Denials are logged and written to the audit log.
+func authorizeRequest(r *http.Request) (principal, bool) {
 	origin := r.Header.Get("Origin")
+	who := principal{Origin: origin, RemoteAddr: describeClient(r)}
 
-	if debugLogging {
+	if debugEnabled() {
 		log.Printf("[DEBUG] Auth check: method=%s, path=%s, origin='%s'", r.Method, r.URL.Path, origin)
 	}
 
+	// Pages from forwarded apps are on their listeners' origins. An allowed
+	// pattern such as http://localhost:* would match them, so they are
+	// refused before the origin list is consulted, and never offered for
+	// approval.
+	if forwardedOrigin(origin) {
+		log.Printf("[SECURITY] Denied: request to %s from a forwarded page (%s)", r.URL.Path, describeClient(r))
+		return who, denyRequest(r, who, "forwarded_content")
+	}
+
 	if origin != "" {
-		// If an Origin header is present, enforce CORS based on allowedOrigins.
-		if allowedOrigins[origin] {
-			return true
+		// If an Origin header is present, enforce CORS based on the allowed origins.
+		if isOriginAllowed(origin) {
+			return who, true
 		}
-		log.Printf("[SECURITY] Denied: Invalid Origin '%s' from %s", origin, r.RemoteAddr)
-		return false
+		origins.recordDenied(origin)
+		log.Printf("[SECURITY] Denied: Invalid Origin '%s' from %s", origin, describeClient(r))
+		return who, denyRequest(r, who, "invalid_origin")
 	}
 
-	// If no Origin header, check if it's a loopback address.
-	// We split RemoteAddr to get just the IP, ignoring the port.
-	remoteIP := r.RemoteAddr
-	if colon := strings.LastIndex(remoteIP, ":"); colon != -1 {
-		remoteIP = remoteIP[:colon]
-	}
-	if remoteIP == "127.0.0.1" || remoteIP == "[::1]" { // Check for IPv4 and IPv6 loopback
-		return true // Allow loopback without Origin or API key
+	// If no Origin header, check if it's a loopback address. Requests relayed by
+	// an untrusted proxy never count as loopback, and --strict-auth turns the
+	// loopback exemption off entirely. Browsers leave Origin out of same-origin
+	// GETs, so the Host must name this machine too, or a page that rebinds its
+	// DNS name to 127.0.0.1 would get in.
+	if !currentConfig().StrictAuth && isLoopbackRequest(r) {
+		if loopbackHost(r) {
+			// Allow loopback without Origin or API key. Local users can already
+			// run the installer and /kill, so they get admin scope too.
+			who.Admin = true
+			return who, true
+		}
+		log.Printf("[SECURITY] Loopback request to %s for host %q; the API key is required", r.URL.Path, r.Host)
 	}
 
 	// No Origin header: check for required API key.
@@ -87,60 +142,95 @@ func checkRequestAuthorization(r *http.Request) bool {
 		}
 
 		if providedKey == "" {
-			log.Printf("[SECURITY] Denied: Missing API key for no-origin request from %s", r.RemoteAddr)
-			return false
+			log.Printf("[SECURITY] Denied: Missing API key for no-origin request from %s", describeClient(r))
+			return who, denyRequest(r, who, "missing_key")
 		}
 		if providedKey != requiredAPIKey {
-			log.Printf("[SECURITY] Denied: Invalid API key from %s", r.RemoteAddr)
-			return false
+			log.Printf("[SECURITY] Denied: Invalid API key from %s", describeClient(r))
+			return who, denyRequest(r, who, "invalid_key")
 		}
-		if debugLogging {
+		if debugEnabled() {
 			log.Printf("[DEBUG] Authorized: API key matched for no-origin request from %s", r.RemoteAddr)
 		}
-		return true
+		who.KeyName = defaultKeyName
+		who.Admin = true
+		return who, true
 	}
 
 	// If we reach here: no Origin header, AND no API key is required/configured.
 	// Deny by default in this scenario to prevent unintended access.
-	if debugLogging {
-		log.Printf("[DEBUG] Denied: No Origin and no API key configured/provided for %s", r.RemoteAddr)
+	if currentConfig().StrictAuth {
+		log.Printf("[SECURITY] Denied: --strict-auth is set but no API key is configured (request from %s)", describeClient(r))
+	} else if debugEnabled() {
+		log.Printf("[DEBUG] Denied: No Origin and no API key configured/provided for %s", describeClient(r))
+	}
+	return who, denyRequest(r, who, "no_key_configured")
+}
+
+// authorizedUpgrade upgrades an authorized request to a websocket and reports
+// who made it. Unauthorized requests are refused by the upgrader.
+func authorizedUpgrade(w http.ResponseWriter, r *http.Request, channel string) (*wsConn, principal, error) {
+	var who principal
+	// Use a copy of the shared upgrader so concurrent requests don't race on
+	// its CheckOrigin hook.
+	up := upgrader
+	up.CheckOrigin = func(req *http.Request) bool {
+		var ok bool
+		who, ok = authorizeRequest(req)
+		return ok
+	}
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, who, err
 	}
-	return false
+	return newWSConn(conn, channel), who, nil
 }
 
-// writePump pumps messages from the PTY to the websocket connection.
-func writePump(ws *websocket.Conn, ptmx io.ReadCloser, sessionID int32) {
-	defer ws.Close()
+// upgradeAuthorized upgrades a request the handler has already passed through
+// authorizeRequest. Handlers that check their parameters against the
+// filesystem authorize first, so that unauthorized callers can't learn what
+// exists from the errors.
+func upgradeAuthorized(w http.ResponseWriter, r *http.Request, channel string) (*wsConn, error) {
+	up := upgrader
+	up.CheckOrigin = func(*http.Request) bool { return true }
+	conn, err := up.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(conn, channel), nil
+}
+
+// writePump pumps output from the PTY to every client attached to the session.
+func writePump(sess *terminalSession) {
 	buffer := make([]byte, 4096)
 	for {
-		n, err := ptmx.Read(buffer)
+		n, err := sess.ptmx.Read(buffer)
 		if err != nil {
 			// If the PTY process has exited, this read will eventually return an error like EOF.
-			// We close the websocket when that happens.
-			// This usually means the PTY process has exited.
+			// We end the session, closing every client, when that happens.
+			sess.end()
 			return
 		}
-		// Use TextMessage for compatibility with clients not expecting binary frames.
+		sess.recordOutput(buffer[:n])
+		sess.output.scan(buffer[:n])
+		// Output is sent as TextMessage for compatibility with clients not expecting binary frames.
 		// Note: PTY output can contain non-UTF8 bytes, which might cause issues for some
 		// text-only WebSocket clients if not handled. gorilla/websocket allows binary frames
 		// (websocket.BinaryMessage) for raw byte streams, which is more robust, but
 		// text messages are used here for compatibility as per user's earlier preference.
-		if err := ws.WriteMessage(websocket.TextMessage, buffer[:n]); err != nil {
-			return
-		}
+		sess.broadcastOutput(buffer[:n])
 	}
 }
 
-// readPump pumps messages from the websocket connection to the PTY.
-func readPump(ws *websocket.Conn, ptmx io.Writer, ptyCmd *exec.Cmd, sessionID int32) {
+// readPump pumps messages from one client's websocket connection to the PTY.
+// When the last client leaves, the session ends.
+func readPump(sess *terminalSession, client *sessionClient) {
+	ws := client.ws
 
 	defer func() {
 		ws.Close()
-		// On Windows, ptyCmd.Process can be nil because the conpty library
-		// doesn't expose it. The ptmx.Close() call in the calling function
-		// (terminalServer) handles killing the process correctly on all platforms.
-		if ptyCmd.Process != nil {
-			ptyCmd.Process.Kill()
+		if sess.detach(client) == 0 {
+			sess.endWhenDetached()
 		}
 	}()
 
@@ -151,45 +241,124 @@ func readPump(ws *websocket.Conn, ptmx io.Writer, ptyCmd *exec.Cmd, sessionID in
 		if err != nil {
 			// Report unexpected close errors.
 			if !websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WS read error for session #%d: %v", sessionID, err)
+				log.Printf("WS read error for session #%d: %v", sess.id, err)
 			}
 			break
 		}
 		switch msg.Type {
 		case "resize":
-			// TODO: Resizing is now platform-specific. A new cross-platform
-			// interface is needed to handle this properly.
-			if resizePty != nil {
-				resizePty(msg.Cols, msg.Rows)
-			}
+			sess.clientResized(client, msg.Cols, msg.Rows)
 		case "data":
-			ptmx.Write([]byte(msg.Content))
+			if sess.canWrite(client) {
+				sess.writeInput([]byte(msg.Content))
+			}
+		case "paste":
+			if sess.canWrite(client) {
+				if err := sess.paste(client, msg.Content); err != nil {
+					client.sendJSON(wsMessage{Type: "error", Session: sess.id, Error: err.Error()})
+				}
+			}
+		case "confirmPaste":
+			if sess.canWrite(client) {
+				if err := sess.confirmPaste(client, msg.PasteID, msg.Confirmed); err != nil {
+					client.sendJSON(wsMessage{Type: "error", Session: sess.id, Error: err.Error()})
+				}
+			}
+		case "record":
+			var err error
+			if client.mode == modeReadOnly {
+				err = errReadOnlyClient
+			} else if msg.Enabled {
+				_, err = sess.startRecording()
+			} else {
+				sess.stopRecording()
+			}
+			client.sendJSON(sess.recordingState(err))
+		case "setInputPolicy":
+			if err := sess.setInputPolicy(client, msg.InputPolicy); err != nil {
+				client.sendJSON(wsMessage{Type: "error", Session: sess.id, Error: err.Error()})
+			}
+		case "setDriver":
+			if err := sess.setDriver(client, msg.ClientID); err != nil {
+				client.sendJSON(wsMessage{Type: "error", Session: sess.id, Error: err.Error()})
+			}
+		case "requestDriver":
+			if err := sess.requestDriver(client); err != nil {
+				client.sendJSON(wsMessage{Type: "error", Session: sess.id, Error: err.Error()})
+			}
+		case "search":
+			results, err := sess.search(searchRequest{Query: msg.Query, Regex: msg.Regex, IgnoreCase: msg.IgnoreCase, Context: msg.Context})
+			if err != nil {
+				client.sendJSON(wsMessage{Type: "error", Session: sess.id, Error: err.Error()})
+			} else {
+				client.sendJSON(wsMessage{Type: "searchResults", Session: sess.id, Query: msg.Query, Matches: results.Matches, Truncated: results.Truncated})
+			}
 		}
 	}
 }
 
-// terminalServer handles websocket requests from the peer.
+var errReadOnlyClient = errors.New("read-only clients can't change recording")
+
+// terminalServer handles websocket requests from the peer. Without a
+// ?session= parameter it starts a new shell; with one it attaches to a
+// running session.
 func terminalServer(w http.ResponseWriter, r *http.Request) {
-	// Override the upgrader's CheckOrigin to use our shared authorization logic.
-	// This ensures consistency between /terminal and /files WS origins.
-	upgrader.CheckOrigin = func(req *http.Request) bool {
-		return checkRequestAuthorization(req)
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if id := r.URL.Query().Get("session"); id != "" {
+		attachToSession(w, r, id)
+		return
+	}
+	cfg := currentConfig()
+	if max := cfg.Limits.MaxSessions; max > 0 && int(atomic.LoadInt32(&activeConnections)) >= max {
+		log.Printf("Refusing terminal session from %s: limit of %d sessions reached", describeClient(r), max)
+		http.Error(w, "Too many terminal sessions", http.StatusServiceUnavailable)
+		return
 	}
-	ws, err := upgrader.Upgrade(w, r, nil)
+	// The upgrade applies the same authorization as /files, so both
+	// endpoints accept the same origins and keys.
+	ws, who, err := authorizedUpgrade(w, r, "terminal")
 	if err != nil {
 		log.Printf("ERROR: Failed to upgrade connection: %v", err)
 		return
 	}
-	defer ws.Close()
 
-	atomic.AddInt32(&activeConnections, 1)
+	sess, err := startTerminalSession(who, nil)
+	if err != nil {
+		ws.Close()
+		return
+	}
+	client := newSessionClient(ws, who, modeDriver)
+	sess.attach(client) // Sends the initial terminal info
+	if record, _ := strconv.ParseBool(r.URL.Query().Get("record")); record || cfg.Recording.AutoStart {
+		_, err := sess.startRecording()
+		if err != nil {
+			log.Printf("Session #%d: could not start recording: %v", sess.id, err)
+		}
+		client.sendJSON(sess.recordingState(err))
+	}
+	go writePump(sess)
+	readPump(sess, client)
+}
+
+// sessionCommand is a program to run in a terminal session instead of the
+// shell, for a debug adapter's runInTerminal request.
+type sessionCommand struct {
+	argv []string
+	env  []string // "NAME=value" pairs added to the server's environment
+	cwd  string
+}
+
+// startTerminalSession starts a shell, or command if it is set, in a new PTY
+// and registers the session. The session ends when the process exits or the
+// last client leaves.
+func startTerminalSession(who principal, command *sessionCommand) (*terminalSession, error) {
+	cfg := currentConfig()
 	sessionID := atomic.AddInt32(&sessionIdCounter, 1)
-	defer atomic.AddInt32(&activeConnections, -1)
 
-	shell := "bash"
-	if os.Getenv("OS") == "Windows_NT" {
-		shell = "powershell.exe"
-	}
+	shell := defaultShell(cfg)
 
 	// Set the working directory for the shell to the user's home directory
 	homeDir, err := os.UserHomeDir()
@@ -197,53 +366,140 @@ func terminalServer(w http.ResponseWriter, r *http.Request) {
 		log.Printf("ERROR: Could not get user home directory: %v, using current directory.", err)
 		homeDir = "." // Fallback to current dir if home is not found
 	}
-	// Use our new platform-agnostic function to start the PTY.
-	// This call now handles all OS-specific logic and command creation. It also returns a resize function.
+	var ptmx io.ReadWriteCloser
+	var ptyCmd *exec.Cmd
 	var resizeFunc func(cols, rows int)
-	ptmx, ptyCmd, resizeFunc, err := startPty(shell, homeDir)
+	var shellNonce string
+	if command != nil {
+		shell, homeDir = strings.Join(command.argv, " "), command.cwd
+		ptmx, ptyCmd, resizeFunc, err = startPtyCommand(command.argv, command.env, command.cwd)
+	} else {
+		// Use our new platform-agnostic function to start the PTY.
+		// This call now handles all OS-specific logic and command creation. It also returns a resize function.
+		args, env := cfg.Shell.Args, cfg.Shell.envList()
+		if cfg.Shell.Integration {
+			shellNonce = newShellNonce()
+			args, env = withShellIntegration(shell, args, env, shellNonce)
+		}
+		ptmx, ptyCmd, resizeFunc, err = startPty(shell, args, env, homeDir)
+	}
+	spawnAudit := auditEntry{Action: "session.spawn", Session: sessionID, Detail: shell}.from(who)
 	if err != nil {
 		log.Printf("ERROR: Failed to start PTY for session #%d: %v", sessionID, err)
-		return
+		audit.record(spawnAudit.withError(err))
+		metricSpawnFailures.inc()
+		return nil, err
+	}
+	audit.record(spawnAudit)
+	metricSessionsStarted.inc()
+
+	sess := &terminalSession{
+		id:          sessionID,
+		ptmx:        ptmx,
+		cmd:         ptyCmd,
+		resize:      resizeFunc, // Each session resizes its own PTY
+		started:     time.Now(),
+		owner:       who,
+		clients:     make(map[int32]*sessionClient),
+		inputPolicy: inputFromAll,
+		cwd:         homeDir,
+		shellNonce:  shellNonce,
+		cols:        80,
+		rows:        24,
 	}
-	defer ptmx.Close()
+	sess.output = &outputScanner{onOSC: sess.handleOSC, onMode: sess.setMode}
+	sess.setupHistory(cfg.Scrollback)
+	active := atomic.AddInt32(&activeConnections, 1)
+	terminalSessions.add(sess)
+	log.Printf("[%s] Session #%d (PID: %d) started by %s (active: %d)", time.Now().UTC().Format(time.RFC3339), sessionID, sess.pid(), who.RemoteAddr, active)
 
-	timestamp := time.Now().UTC().Format(time.RFC3339)
+	// Start a goroutine to wait for the PTY process to exit. When it exits,
+	// we end the session, closing every client's WebSocket. This is crucial for
+	// reliably handling the "exit" command from within the shell, especially on Windows.
+	if ptyCmd.Process != nil {
+		go func() {
+			ptyCmd.Process.Wait()
+			sess.end()
+		}()
+	}
+	return sess, nil
+}
 
+// info builds the terminalInfo message sent to a client when it connects.
+// replay says what kind of history follows it, if any. The caller holds s.mu.
+func (s *terminalSession) info(c *sessionClient, replay string) wsMessage {
 	// Get hostname
 	hostname, err := os.Hostname()
 	if err != nil {
 		log.Printf("Error getting hostname: %v", err)
 		hostname = "unknown"
 	}
+	return wsMessage{
+		Type:        "terminalInfo",
+		Hostname:    hostname,
+		Cwd:         s.cwd, // The initial working directory of the PTY process
+		Session:     s.id,
+		ClientID:    c.id,
+		Mode:        c.mode,
+		InputPolicy: s.inputPolicy,
+		Clients:     s.clientInfos(),
+		Ports:       s.portList(),
+		Title:       s.title,
+		Process:     s.process,
+		Replay:      replay,
+	}
+}
 
-	// The initial working directory of the PTY process (which was set to homeDir)
-	initialCwd := homeDir
-
-	// Send initial terminal info to the client
-	infoMsg := wsMessage{
-		Type:    "terminalInfo",
-		Hostname: hostname,
-		Cwd:     initialCwd,
+// attachToSession connects a client to a running session, e.g.
+// /terminal?session=3&mode=readonly.
+func attachToSession(w http.ResponseWriter, r *http.Request, idParam string) {
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
 	}
-	ws.WriteJSON(infoMsg) // Ignore error, best effort to send initial info
-	resizePty = resizeFunc // Assign the resize function for this session
-	pid := -1 // Default to -1 if process info is not available (e.g., on Windows)
-	if ptyCmd.Process != nil {
-		pid = ptyCmd.Process.Pid
+	id, err := strconv.ParseInt(idParam, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
 	}
-	log.Printf("[%s] Client #%d (PID: %d) connected (active: %d)", timestamp, sessionID, pid, activeConnections)
-	defer log.Printf("[%s] Client #%d (PID: %d) disconnected (active: %d)", time.Now().UTC().Format(time.RFC3339), sessionID, pid, activeConnections)
-	// Start a goroutine to wait for the PTY process to exit. When it exits,
-	// we close the WebSocket connection. This is crucial for reliably
-	// handling the "exit" command from within the shell, especially on Windows.
-	if ptyCmd.Process != nil {
-		go func() {
-			ptyCmd.Process.Wait()
-			ws.Close()
-		}()
-	}	
-	go writePump(ws, ptmx, sessionID)
-	readPump(ws, ptmx, ptyCmd, sessionID)
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = modeInteractive
+	case modeDriver, modeInteractive, modeReadOnly:
+	default:
+		http.Error(w, "mode must be readonly, interactive or driver", http.StatusBadRequest)
+		return
+	}
+	sess := terminalSessions.get(int32(id))
+	if sess == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if mode == modeDriver && !sess.mayDrive() {
+		log.Printf("[SECURITY] Refused driver attach to session #%d from %s: the session has a driver", sess.id, who.RemoteAddr)
+		http.Error(w, "The session already has a driver; attach as interactive and ask for control", http.StatusForbidden)
+		return
+	}
+	ws, err := upgradeAuthorized(w, r, "terminal")
+	if err != nil {
+		log.Printf("ERROR: Failed to upgrade connection: %v", err)
+		return
+	}
+	client := newSessionClient(ws, who, mode)
+	if !sess.attach(client) {
+		ws.closeWithReason(websocket.CloseNormalClosure, "sessionEnded")
+		return
+	}
+	audit.record(auditEntry{Action: "session.attach", Session: sess.id, Detail: mode}.from(who))
+	log.Printf("Client %d (%s) attached to session #%d as %s", client.id, who.RemoteAddr, sess.id, mode)
+	defer func() {
+		audit.record(auditEntry{Action: "session.detach", Session: sess.id}.from(who))
+		log.Printf("Client %d left session #%d", client.id, sess.id)
+	}()
+
+	readPump(sess, client)
 }
 
 // upcheckHandler provides a simple health check endpoint.
@@ -252,16 +508,16 @@ func upcheckHandler(w http.ResponseWriter, r *http.Request) {
 	connections := atomic.LoadInt32(&activeConnections)
 
 	resp := statusResponse{
+		Service:           probeServiceName,
 		Status:            "running",
 		Version:           version,
 		UptimeSeconds:     uptime,
 		ActiveConnections: connections,
 		IsInstalled:       checkIfInstalled(),
+		Port:              boundPort,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-// resizePty stores the current session's PTY resize function.
-var resizePty func(cols, rows int)
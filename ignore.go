@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Ignore rules follow .gitignore syntax
+// (https://git-scm.com/docs/gitignore): blank lines and # comments are
+// skipped, ! negates, a trailing / matches only directories, a pattern with
+// a / elsewhere is relative to the .gitignore's directory, and ** matches any
+// number of directories; a trailing /** matches everything inside a directory
+// but not the directory itself. The last matching rule wins.
+
+type ignoreRule struct {
+	base     string   // directory of the .gitignore, slash-separated and relative to the walk; "" for its top
+	segments []string // pattern split on /
+	negate   bool
+	dirOnly  bool
+	anchored bool // matched against the path from base rather than the name
+}
+
+// ignoreRules is the set of rules in effect in one directory. withDir returns
+// a new set, so a walk can keep one per directory level.
+type ignoreRules struct {
+	rules []ignoreRule
+}
+
+// withDir adds the rules of dir's .gitignore. rel is dir relative to the
+// walk, slash-separated.
+func (ir *ignoreRules) withDir(dir, rel string) *ignoreRules {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return ir
+	}
+	defer f.Close()
+	next := &ignoreRules{rules: append([]ignoreRule(nil), ir.rules...)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text(), rel); ok {
+			next.rules = append(next.rules, rule)
+		}
+	}
+	return next
+}
+
+func parseIgnoreRule(line, base string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	rule := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate, line = true, line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // \# and \! escape a leading # or !
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly, line = true, strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored, line = true, strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// ignored reports whether a path relative to the walk, slash-separated, is
+// ignored.
+func (ir *ignoreRules) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range ir.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		p := rel
+		if rule.base != "" {
+			if !strings.HasPrefix(rel, rule.base+"/") {
+				continue
+			}
+			p = rel[len(rule.base)+1:]
+		}
+		var match bool
+		if rule.anchored {
+			match = matchSegments(rule.segments, strings.Split(p, "/"))
+		} else {
+			match = matchSegments(rule.segments, []string{path.Base(p)})
+		}
+		if match {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchGlob matches a slash-separated path against a glob with ** support.
+// A pattern without a / matches the last element of the path.
+func matchGlob(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		return matchSegments([]string{pattern}, []string{path.Base(rel)})
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(rel, "/"))
+}
+
+// matchSegments matches path elements against pattern elements, where a **
+// element matches zero or more path elements, or one or more if it is last.
+func matchSegments(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return len(elems) > 0
+			}
+			for i := 0; i <= len(elems); i++ {
+				if matchSegments(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// ignoreRulesFor returns the rules in effect in dir, from the .gitignore
+// files between the file root and dir, with paths relative to dir.
+func ignoreRulesFor(rootDir, dir string) *ignoreRules {
+	rules := &ignoreRules{}
+	rel, err := filepath.Rel(rootDir, dir)
+	if err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		parent := rootDir
+		for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+			rules = rules.withDir(parent, "").descend(elem)
+			parent = filepath.Join(parent, elem)
+		}
+	}
+	return rules.withDir(dir, "")
+}
+
+// descend rebases rules relative to a directory onto its child. Anchored
+// rules that can't reach below the child are dropped, as are those matching
+// the child itself: it is being walked because it was asked for.
+func (ir *ignoreRules) descend(child string) *ignoreRules {
+	next := &ignoreRules{}
+	for _, rule := range ir.rules {
+		if rule.anchored && rule.segments[0] != "**" {
+			if ok, _ := path.Match(rule.segments[0], child); !ok || len(rule.segments) == 1 {
+				continue
+			}
+			rule.segments = rule.segments[1:]
+		}
+		next.rules = append(next.rules, rule)
+	}
+	return next
+}
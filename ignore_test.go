@@ -0,0 +1,241 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		line string
+		ok   bool
+		want ignoreRule
+	}{
+		{line: "", ok: false},
+		{line: "   ", ok: false},
+		{line: "# comment", ok: false},
+		{line: "/", ok: false},
+		{line: "!", ok: false},
+		{line: "*.o", ok: true, want: ignoreRule{segments: []string{"*.o"}}},
+		{line: "*.o  \r", ok: true, want: ignoreRule{segments: []string{"*.o"}}},
+		{line: "!keep.o", ok: true, want: ignoreRule{segments: []string{"keep.o"}, negate: true}},
+		{line: `\#name`, ok: true, want: ignoreRule{segments: []string{"#name"}}},
+		{line: `\!name`, ok: true, want: ignoreRule{segments: []string{"!name"}}},
+		{line: "build/", ok: true, want: ignoreRule{segments: []string{"build"}, dirOnly: true}},
+		{line: "/build", ok: true, want: ignoreRule{segments: []string{"build"}, anchored: true}},
+		{line: "doc/*.txt", ok: true, want: ignoreRule{segments: []string{"doc", "*.txt"}, anchored: true}},
+		{line: "**/logs/", ok: true, want: ignoreRule{segments: []string{"**", "logs"}, dirOnly: true, anchored: true}},
+		{line: "!/a/**/b", ok: true, want: ignoreRule{segments: []string{"a", "**", "b"}, negate: true, anchored: true}},
+	}
+	for _, tt := range tests {
+		got, ok := parseIgnoreRule(tt.line, "")
+		if ok != tt.ok || ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIgnoreRule(%q) = %+v, %v; want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+	if got, _ := parseIgnoreRule("*.o", "sub/dir"); got.base != "sub/dir" {
+		t.Errorf("parseIgnoreRule base = %q; want %q", got.base, "sub/dir")
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"a", "a", true},
+		{"a", "b", false},
+		{"a", "a/b", false},
+		{"a/b", "a", false},
+		{"*.go", "main.go", true},
+		{"*", "a/b", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"**", "", false},
+		{"**", "a", true},
+		{"**", "a/b/c", true},
+		{"**/b", "b", true},
+		{"**/b", "a/x/b", true},
+		{"**/b", "a/b/c", false},
+		{"a/**", "a", false},
+		{"a/**", "a/b", true},
+		{"a/**", "a/b/c", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+		{"a/**/**/b", "a/b", true},
+		{"[ab]/c", "b/c", true},
+		{"[ab]/c", "d/c", false},
+	}
+	for _, tt := range tests {
+		var elems []string
+		if tt.path != "" {
+			elems = strings.Split(tt.path, "/")
+		}
+		if got := matchSegments(strings.Split(tt.pattern, "/"), elems); got != tt.want {
+			t.Errorf("matchSegments(%q, %q) = %v; want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, rel string
+		want         bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/tool/main.go", true},
+		{"*.go", "main.go/x", false},
+		{"cmd/*.go", "cmd/main.go", true},
+		{"cmd/*.go", "x/cmd/main.go", false},
+		{"/cmd/*.go", "cmd/main.go", true},
+		{"**/testdata/**", "a/testdata/b/c", true},
+		{"**/testdata/**", "a/b/c", false},
+		{"**/testdata/**", "a/testdata", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.rel); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v; want %v", tt.pattern, tt.rel, got, tt.want)
+		}
+	}
+}
+
+// parseRules builds a rule set from .gitignore lines read in base.
+func parseRules(base string, lines ...string) *ignoreRules {
+	ir := &ignoreRules{}
+	for _, line := range lines {
+		if rule, ok := parseIgnoreRule(line, base); ok {
+			ir.rules = append(ir.rules, rule)
+		}
+	}
+	return ir
+}
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  string
+		lines []string
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"unanchored name at top", "", []string{"*.o"}, "a.o", false, true},
+		{"unanchored name at depth", "", []string{"*.o"}, "x/y/a.o", false, true},
+		{"no match", "", []string{"*.o"}, "a.c", false, false},
+		{"anchored at top", "", []string{"/build"}, "build", true, true},
+		{"anchored not at depth", "", []string{"/build"}, "x/build", true, false},
+		{"path pattern is anchored", "", []string{"doc/*.txt"}, "x/doc/a.txt", false, false},
+		{"path pattern matches from base", "", []string{"doc/*.txt"}, "doc/a.txt", false, true},
+		{"dir only skips files", "", []string{"logs/"}, "logs", false, false},
+		{"dir only matches dirs", "", []string{"logs/"}, "a/logs", true, true},
+		{"double star prefix", "", []string{"**/logs"}, "a/b/logs", true, true},
+		{"double star middle", "", []string{"a/**/z"}, "a/b/c/z", false, true},
+		{"double star suffix", "", []string{"a/**"}, "a/b/c", false, true},
+		{"double star suffix not the directory", "", []string{"a/**"}, "a", true, false},
+		{"double star suffix not a file of that name", "", []string{"a/**"}, "a", false, false},
+		{"negation re-includes", "", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"negation needs a later rule", "", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"last match wins", "", []string{"*.log", "!*.log", "debug.log"}, "debug.log", false, true},
+		{"base limits scope", "sub", []string{"*.o"}, "a.o", false, false},
+		{"base applies below", "sub", []string{"*.o"}, "sub/x/a.o", false, true},
+		{"base prefix is a directory", "sub", []string{"*.o"}, "subway/a.o", false, false},
+		{"anchored relative to base", "sub", []string{"/gen"}, "sub/gen", true, true},
+		{"anchored relative to base only", "sub", []string{"/gen"}, "sub/x/gen", true, false},
+	}
+	for _, tt := range tests {
+		if got := parseRules(tt.base, tt.lines...).ignored(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("%s: %q ignored(%q, %v) = %v; want %v", tt.name, tt.lines, tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestDescend(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		child string
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"unanchored rules carry over", []string{"*.o"}, "src", "a.o", false, true},
+		{"anchored rule moves down", []string{"/src/gen"}, "src", "gen", true, true},
+		{"anchored rule stays anchored", []string{"/src/gen"}, "src", "x/gen", true, false},
+		{"anchored rule for a sibling is dropped", []string{"/lib/gen"}, "src", "gen", true, false},
+		{"rule naming the child is dropped", []string{"/src"}, "src", "src", true, false},
+		{"wildcard first segment", []string{"/*/gen"}, "src", "gen", true, true},
+		{"double star first is kept", []string{"**/gen"}, "src", "x/gen", true, true},
+		{"double star after child", []string{"src/**/gen"}, "src", "gen", true, true},
+		{"double star after child at depth", []string{"src/**/gen"}, "src", "a/b/gen", true, true},
+		{"everything below child", []string{"src/**"}, "src", "a/b", false, true},
+		{"everything below child at the top", []string{"src/**"}, "src", "a", true, true},
+		{"everything below a grandchild", []string{"src/gen/**"}, "src", "gen", true, false},
+		{"inside a grandchild", []string{"src/gen/**"}, "src", "gen/a.go", false, true},
+		{"negation carries over", []string{"*.o", "!/src/keep.o"}, "src", "keep.o", false, false},
+	}
+	for _, tt := range tests {
+		rules := parseRules("", tt.lines...).descend(tt.child)
+		if got := rules.ignored(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("%s: %q descend(%q).ignored(%q, %v) = %v; want %v", tt.name, tt.lines, tt.child, tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestIgnoreRulesFor(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".gitignore":         "*.o\n/top\nsrc/gen/\n!src/keep.o\n",
+		"src/.gitignore":     "/local\n",
+		"src/pkg/.gitignore": "!b.o\n",
+	})
+	tests := []struct {
+		dir   string
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{".", "a.o", false, true},
+		{".", "top", true, true},
+		{".", "src/gen", true, true},
+		{"src", "a.o", false, true},
+		{"src", "gen", true, true},
+		{"src", "top", true, false},
+		{"src", "keep.o", false, false},
+		{"src", "local", true, true},
+		{"src", "x/local", true, false},
+		{"src/pkg", "a.o", false, true},
+		{"src/pkg", "b.o", false, false},
+		{"src/pkg", "local", true, false},
+	}
+	for _, tt := range tests {
+		rules := ignoreRulesFor(root, filepath.Join(root, filepath.FromSlash(tt.dir)))
+		if got := rules.ignored(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("rules for %s: ignored(%q, %v) = %v; want %v", tt.dir, tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+// writeFiles creates files under dir, with their parent directories. A name
+// ending in / creates an empty directory.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -19,15 +19,9 @@ const apiKeyLength = 32 // 32 bytes of entropy -> 44 chars Base64 (approx)
 // If `forceGenerateAndPrint` is true, it will ensure a key exists, print it, and set it.
 // If `forceGenerateAndPrint` is false, it will only attempt to load an existing key.
 func manageAPIKey(forceGenerateAndPrint bool) {
-	configDir, err := os.UserConfigDir()
+	appConfigDir, err := conduitConfigDir()
 	if err != nil {
-		log.Fatalf("Error getting user config directory: %v", err)
-	}
-	
-	appConfigDir := filepath.Join(configDir, appName)
-	// Ensure the application's config directory exists
-	if err := os.MkdirAll(appConfigDir, 0700); err != nil {
-		log.Fatalf("Error creating application config directory %s: %v", appConfigDir, err)
+		log.Fatalf("Error preparing application config directory: %v", err)
 	}
 	
 	apiKeyPath := filepath.Join(appConfigDir, apiKeyFileName)
@@ -74,6 +68,20 @@ func manageAPIKey(forceGenerateAndPrint bool) {
 	log.Fatalf("Error reading API key from %s: %v", apiKeyPath, err)
 }
 
+// conduitConfigDir returns the application's config directory, creating it
+// with owner-only permissions if it doesn't exist yet.
+func conduitConfigDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("getting user config directory: %w", err)
+	}
+	appConfigDir := filepath.Join(configDir, appName)
+	if err := os.MkdirAll(appConfigDir, 0700); err != nil {
+		return "", fmt.Errorf("creating %s: %w", appConfigDir, err)
+	}
+	return appConfigDir, nil
+}
+
 // generateAPIKey creates a cryptographically secure random Base64 string.
 func generateAPIKey() (string, error) {
 	bytes := make([]byte, apiKeyLength)
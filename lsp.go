@@ -0,0 +1,948 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// lspMaxMessage caps one JSON-RPC message in either direction.
+const lspMaxMessage = 64 << 20
+
+// lspShutdownWait is how long an idle server gets to answer "shutdown" and
+// exit before it is killed.
+const lspShutdownWait = 5 * time.Second
+
+// JSON-RPC error codes sent by the proxy itself.
+const (
+	rpcInvalidParams  = -32602
+	rpcRequestFailed  = -32803
+	rpcServerNotReady = -32002
+)
+
+// commandSettings says how to start a language server or debug adapter.
+type commandSettings struct {
+	Command []string          `json:"command"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// lspSettings is the "lsp" section of the config file.
+type lspSettings struct {
+	IdleTimeoutSeconds int                        `json:"idleTimeoutSeconds"` // how long a server outlives its last client
+	Servers            map[string]commandSettings `json:"servers,omitempty"`  // by language; added to or replacing the built-in ones
+}
+
+// defaultLanguageServers are used for languages the config doesn't mention.
+// typescript-language-server also serves JavaScript.
+var defaultLanguageServers = map[string]commandSettings{
+	"go":         {Command: []string{"gopls"}},
+	"typescript": {Command: []string{"typescript-language-server", "--stdio"}},
+	"python":     {Command: []string{"pyright-langserver", "--stdio"}},
+}
+
+func (s lspSettings) validate() error {
+	if s.IdleTimeoutSeconds < 0 {
+		return fmt.Errorf("lsp.idleTimeoutSeconds must not be negative")
+	}
+	return validateCommands("lsp.servers", s.Servers)
+}
+
+// server returns the settings for a language.
+func (s lspSettings) server(language string) (commandSettings, bool) {
+	return lookupCommand(s.Servers, defaultLanguageServers, language)
+}
+
+// languages lists the languages with a configured or built-in server.
+func (s lspSettings) languages() []string {
+	return commandNames(s.Servers, defaultLanguageServers)
+}
+
+// validateCommands checks a config section of named commands.
+func validateCommands(section string, commands map[string]commandSettings) error {
+	for name, c := range commands {
+		if name == "" {
+			return fmt.Errorf("%s has an empty name", section)
+		}
+		if len(c.Command) == 0 || c.Command[0] == "" {
+			return fmt.Errorf("%s.%s.command must name a program", section, name)
+		}
+	}
+	return nil
+}
+
+// lookupCommand returns the configured command for name, or the built-in one.
+func lookupCommand(configured, builtin map[string]commandSettings, name string) (commandSettings, bool) {
+	if c, ok := configured[name]; ok {
+		return c, true
+	}
+	c, ok := builtin[name]
+	return c, ok
+}
+
+// commandNames lists the names with a configured or built-in command.
+func commandNames(configured, builtin map[string]commandSettings) []string {
+	var names []string
+	for name := range builtin {
+		names = append(names, name)
+	}
+	for name := range configured {
+		if _, ok := builtin[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// --- Stdio Framing ---
+
+// readFramedMessage reads one message framed with a Content-Length header, as
+// language servers and debug adapters use on stdio.
+func readFramedMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("invalid Content-Length %q", value)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message has no Content-Length header")
+	}
+	if length > lspMaxMessage {
+		return nil, fmt.Errorf("message of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// writeFramedMessage writes one message with its Content-Length header.
+func writeFramedMessage(w io.Writer, body []byte) error {
+	msg := make([]byte, 0, len(body)+32)
+	msg = append(msg, "Content-Length: "...)
+	msg = strconv.AppendInt(msg, int64(len(body)), 10)
+	msg = append(msg, "\r\n\r\n"...)
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+// --- Path Translation ---
+
+// rootPaths maps between the paths clients see, slash-separated with a
+// leading / and relative to a file root, and absolute paths on this machine.
+type rootPaths struct {
+	rootName string
+	rootDir  string // symlinks resolved, as securePathIn returns it
+}
+
+func newRootPaths(rootName string) (rootPaths, error) {
+	dir, err := securePathIn(rootName, "")
+	return rootPaths{rootName: rootName, rootDir: dir}, err
+}
+
+// toLocal returns the absolute path for a client path.
+func (rp rootPaths) toLocal(clientPath string) (string, error) {
+	return securePathIn(rp.rootName, filepath.FromSlash(clientPath))
+}
+
+// toClient returns the client path for an absolute path, or false if it is
+// outside the root.
+func (rp rootPaths) toClient(abs string) (string, bool) {
+	rel, err := filepath.Rel(rp.rootDir, filepath.Clean(abs))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if rel == "." {
+		return "/", true
+	}
+	return "/" + filepath.ToSlash(rel), true
+}
+
+// uriToLocal turns a client file:// URI into one for the absolute path.
+func (rp rootPaths) uriToLocal(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", fmt.Errorf("invalid file URI %q", uri)
+	}
+	abs, err := rp.toLocal(u.Path)
+	if err != nil {
+		return "", fmt.Errorf("%s is outside the file root", uri)
+	}
+	p := filepath.ToSlash(abs)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p // file:///C:/...
+	}
+	return (&url.URL{Scheme: "file", Path: p}).String(), nil
+}
+
+// uriToClient turns a file:// URI for an absolute path into a client URI.
+// URIs outside the root, such as a standard library source file, are
+// returned unchanged.
+func (rp rootPaths) uriToClient(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" || u.Host != "" {
+		return uri
+	}
+	p := u.Path
+	if runtime.GOOS == "windows" {
+		p = strings.TrimPrefix(p, "/")
+	}
+	clientPath, ok := rp.toClient(filepath.FromSlash(p))
+	if !ok {
+		return uri
+	}
+	return (&url.URL{Scheme: "file", Path: clientPath}).String()
+}
+
+// rewriteFileURIs replaces every string value and object key in v that is a
+// file:// URI with fn's result. Rewriting whole messages rather than known
+// fields keeps up with protocol additions (workspace edits key their changes
+// by URI, for instance).
+func rewriteFileURIs(v interface{}, fn func(string) (string, error)) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "file://") {
+			return fn(v)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			rewritten, err := rewriteFileURIs(elem, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = rewritten
+		}
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			rewritten, err := rewriteFileURIs(elem, fn)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(key, "file://") {
+				if key, err = fn(key); err != nil {
+					return nil, err
+				}
+			}
+			out[key] = rewritten
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// --- JSON-RPC Messages ---
+
+// rpcMessage is a decoded JSON-RPC message. Numbers are kept as json.Number so
+// ids and other values pass through unchanged.
+type rpcMessage map[string]interface{}
+
+func decodeRPCMessage(data []byte) (rpcMessage, error) {
+	msg, err := decodeJSONObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON-RPC message")
+	}
+	return rpcMessage(msg), nil
+}
+
+// decodeJSONObject decodes a JSON object, keeping numbers as json.Number.
+func decodeJSONObject(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	return obj, nil
+}
+
+func (m rpcMessage) method() string {
+	method, _ := m["method"].(string)
+	return method
+}
+
+func (m rpcMessage) hasID() bool {
+	id, ok := m["id"]
+	return ok && id != nil
+}
+
+// idKey identifies a request id of either JSON type.
+func idKey(id interface{}) string {
+	if s, ok := id.(string); ok {
+		return "s:" + s
+	}
+	return fmt.Sprint("n:", id)
+}
+
+// params returns the message's params object, or nil.
+func (m rpcMessage) params() map[string]interface{} {
+	params, _ := m["params"].(map[string]interface{})
+	return params
+}
+
+// documentURI returns params.textDocument.uri.
+func (m rpcMessage) documentURI() string {
+	doc, _ := m.params()["textDocument"].(map[string]interface{})
+	uri, _ := doc["uri"].(string)
+	return uri
+}
+
+func rpcError(id interface{}, code int, message string) rpcMessage {
+	return rpcMessage{"jsonrpc": "2.0", "id": id, "error": map[string]interface{}{"code": code, "message": message}}
+}
+
+func rpcResult(id, result interface{}) rpcMessage {
+	return rpcMessage{"jsonrpc": "2.0", "id": id, "result": result}
+}
+
+// --- Shared Servers ---
+
+// lspKey identifies a shared server: one per workspace directory and language.
+type lspKey struct {
+	language  string
+	workspace string // absolute
+}
+
+// lspClient is one /lsp websocket.
+type lspClient struct {
+	ws   *wsConn
+	who  principal
+	open map[string]bool // server-side URIs of the documents it has open
+}
+
+// lspPending is a client request forwarded to the server.
+type lspPending struct {
+	client *lspClient
+	id     interface{} // the client's id
+	method string
+}
+
+// lspServer is a running language server and the clients sharing it. Each
+// client request is forwarded under an id unique to the server, and the
+// response is routed back with the client's own id. Notifications from the
+// server go to every client; requests from the server go to the longest
+// connected one. A document is open on the server while any client has it
+// open, but edits from several clients to it aren't merged: each didChange is
+// applied to the server's one copy as it arrives.
+type lspServer struct {
+	key   lspKey
+	paths rootPaths
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex // serialises writes to stdin
+
+	mu          sync.Mutex
+	clients     []*lspClient // in connection order
+	nextID      int64
+	pending     map[int64]lspPending  // by the id sent to the server
+	serverReqs  map[string]*lspClient // server requests awaiting a client, by idKey
+	initResult  interface{}           // result of the first initialize, for later clients
+	initWaiting []lspPending          // initialize requests waiting on the first
+	initSent    bool                  // an initialize request has been forwarded
+	initialized bool                  // the initialized notification has been forwarded
+	openDocs    map[string]int        // server-side URI → clients with it open
+	idleTimer   *time.Timer
+	exited      chan struct{}
+}
+
+// languageServers holds the running servers.
+var languageServers = struct {
+	sync.Mutex
+	byKey map[lspKey]*lspServer
+}{byKey: make(map[lspKey]*lspServer)}
+
+// acquireLanguageServer adds a client to the server for key, starting one if
+// none is running.
+func acquireLanguageServer(key lspKey, paths rootPaths, settings commandSettings, client *lspClient) (*lspServer, error) {
+	languageServers.Lock()
+	defer languageServers.Unlock()
+	s := languageServers.byKey[key]
+	if s == nil {
+		var err error
+		s, err = startLanguageServer(key, paths, settings)
+		auditEntry := auditEntry{Action: "lsp.start", Detail: key.language + ": " + strings.Join(settings.Command, " ")}
+		if rel, ok := paths.toClient(key.workspace); ok {
+			auditEntry.Path = rel
+		}
+		audit.record(auditEntry.from(client.who).withError(err))
+		if err != nil {
+			return nil, err
+		}
+		languageServers.byKey[key] = s
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients = append(s.clients, client)
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+	return s, nil
+}
+
+func startLanguageServer(key lspKey, paths rootPaths, settings commandSettings) (*lspServer, error) {
+	cmd := exec.Command(settings.Command[0], settings.Command[1:]...)
+	cmd.Dir = key.workspace
+	cmd.Env = append(os.Environ(), currentConfig().Shell.envList()...)
+	for name, value := range settings.Env {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	if debugEnabled() {
+		cmd.Stderr = &lineLogWriter{prefix: "[DEBUG] [lsp " + key.language + "] "}
+	}
+	setProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s language server: %w", key.language, err)
+	}
+	log.Printf("Started %s language server (PID: %d) for %s", key.language, cmd.Process.Pid, key.workspace)
+	s := &lspServer{
+		key:        key,
+		paths:      paths,
+		cmd:        cmd,
+		stdin:      stdin,
+		pending:    make(map[int64]lspPending),
+		serverReqs: make(map[string]*lspClient),
+		openDocs:   make(map[string]int),
+		exited:     make(chan struct{}),
+	}
+	go s.readServer(bufio.NewReaderSize(stdout, 64<<10))
+	return s, nil
+}
+
+// lineLogWriter logs a child process's output line by line.
+type lineLogWriter struct {
+	prefix string
+	buf    []byte
+}
+
+func (lw *lineLogWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Printf("%s%s", lw.prefix, bytes.TrimRight(lw.buf[:i], "\r"))
+		lw.buf = lw.buf[i+1:]
+	}
+	if len(lw.buf) > 4096 {
+		log.Printf("%s%s", lw.prefix, lw.buf)
+		lw.buf = nil
+	}
+	return len(p), nil
+}
+
+// send writes a message to the server's stdin.
+func (s *lspServer) send(msg rpcMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return writeFramedMessage(s.stdin, body)
+}
+
+// readServer relays the server's output until it exits.
+func (s *lspServer) readServer(r *bufio.Reader) {
+	defer s.exitedUnexpectedly()
+	for {
+		data, err := readFramedMessage(r)
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "file already closed") {
+				log.Printf("Reading from %s language server: %v", s.key.language, err)
+			}
+			return
+		}
+		msg, err := decodeRPCMessage(data)
+		if err != nil {
+			log.Printf("Dropping message from %s language server: %v", s.key.language, err)
+			continue
+		}
+		rewritten, _ := rewriteFileURIs(map[string]interface{}(msg), func(uri string) (string, error) {
+			return s.paths.uriToClient(uri), nil
+		})
+		s.fromServer(rpcMessage(rewritten.(map[string]interface{})))
+	}
+}
+
+// fromServer routes a message from the server to the clients.
+func (s *lspServer) fromServer(msg rpcMessage) {
+	s.mu.Lock()
+	switch {
+	case msg.method() == "" && msg.hasID():
+		// A response to a forwarded request. Ids the server makes up are
+		// dropped: only numbers were sent to it.
+		id, ok := msg["id"].(json.Number)
+		if !ok {
+			s.mu.Unlock()
+			log.Printf("Dropping response from %s language server with a non-numeric id", s.key.language)
+			return
+		}
+		n, _ := id.Int64()
+		p, ok := s.pending[n]
+		delete(s.pending, n)
+		var waiting []lspPending
+		if ok && p.method == "initialize" {
+			if _, failed := msg["error"]; failed {
+				s.initSent = false // let the next client try again
+			} else {
+				s.initResult = msg["result"]
+			}
+			waiting, s.initWaiting = s.initWaiting, nil
+		}
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+		msg["id"] = p.id
+		p.client.ws.WriteJSON(msg)
+		for _, w := range waiting {
+			reply := rpcMessage{"jsonrpc": "2.0", "id": w.id}
+			if e, failed := msg["error"]; failed {
+				reply["error"] = e
+			} else {
+				reply["result"] = msg["result"]
+			}
+			w.client.ws.WriteJSON(reply)
+		}
+	case msg.hasID():
+		// A request from the server, answered by the longest connected client.
+		if len(s.clients) == 0 {
+			s.mu.Unlock()
+			s.send(rpcError(msg["id"], rpcRequestFailed, "no client is connected"))
+			return
+		}
+		client := s.clients[0]
+		s.serverReqs[idKey(msg["id"])] = client
+		s.mu.Unlock()
+		client.ws.WriteJSON(msg)
+	default:
+		clients := append([]*lspClient(nil), s.clients...)
+		s.mu.Unlock()
+		for _, client := range clients {
+			client.ws.WriteJSON(msg)
+		}
+	}
+}
+
+// fromClient forwards a client's message to the server. The lifecycle
+// messages are handled here: the server is initialized once, and shutdown
+// and exit only end the client's own connection. It reports false when the
+// client asked to exit.
+func (s *lspServer) fromClient(client *lspClient, msg rpcMessage) bool {
+	rewritten, err := rewriteFileURIs(map[string]interface{}(msg), s.paths.uriToLocal)
+	if err != nil {
+		if msg.hasID() && msg.method() != "" {
+			client.ws.WriteJSON(rpcError(msg["id"], rpcInvalidParams, err.Error()))
+		} else if debugEnabled() {
+			log.Printf("[DEBUG] Dropping %s notification from LSP client: %v", msg.method(), err)
+		}
+		return true
+	}
+	msg = rpcMessage(rewritten.(map[string]interface{}))
+	method := msg.method()
+
+	if method == "" {
+		// A response to a server request.
+		s.mu.Lock()
+		key := idKey(msg["id"])
+		owner := s.serverReqs[key]
+		if owner == client {
+			delete(s.serverReqs, key)
+		}
+		s.mu.Unlock()
+		if owner == client {
+			s.send(msg)
+		}
+		return true
+	}
+
+	if !msg.hasID() {
+		switch method {
+		case "exit":
+			return false
+		case "initialized":
+			s.mu.Lock()
+			first := !s.initialized
+			s.initialized = true
+			s.mu.Unlock()
+			if !first {
+				return true
+			}
+		case "textDocument/didOpen":
+			uri := msg.documentURI()
+			s.mu.Lock()
+			if client.open[uri] {
+				s.mu.Unlock()
+				return true
+			}
+			client.open[uri] = true
+			s.openDocs[uri]++
+			first := s.openDocs[uri] == 1
+			s.mu.Unlock()
+			if !first {
+				return true
+			}
+		case "textDocument/didClose":
+			uri := msg.documentURI()
+			s.mu.Lock()
+			if !client.open[uri] {
+				s.mu.Unlock()
+				return true
+			}
+			last := s.closeDocument(client, uri)
+			s.mu.Unlock()
+			if !last {
+				return true
+			}
+		case "textDocument/didChange", "textDocument/didSave", "textDocument/willSave":
+			// Changes to a document the client hasn't opened would apply to
+			// another client's text.
+			uri := msg.documentURI()
+			s.mu.Lock()
+			open := client.open[uri]
+			s.mu.Unlock()
+			if !open {
+				if debugEnabled() {
+					log.Printf("[DEBUG] Dropping %s for %s, which the LSP client hasn't opened", method, uri)
+				}
+				return true
+			}
+		case "$/cancelRequest":
+			params := msg.params()
+			if params == nil {
+				return true
+			}
+			s.mu.Lock()
+			id, ok := s.serverID(client, params["id"])
+			s.mu.Unlock()
+			if !ok {
+				return true
+			}
+			params["id"] = id
+		}
+		s.send(msg)
+		return true
+	}
+
+	switch method {
+	case "shutdown":
+		client.ws.WriteJSON(rpcResult(msg["id"], nil))
+		return true
+	case "initialize":
+		if params := msg.params(); params != nil {
+			// rootPath predates rootUri and is a plain path.
+			if rootPath, ok := params["rootPath"].(string); ok {
+				if abs, err := s.paths.toLocal(rootPath); err == nil {
+					params["rootPath"] = abs
+				} else {
+					delete(params, "rootPath")
+				}
+			}
+		}
+		s.mu.Lock()
+		if s.initResult != nil {
+			result := s.initResult
+			s.mu.Unlock()
+			client.ws.WriteJSON(rpcResult(msg["id"], result))
+			return true
+		}
+		if s.initSent {
+			s.initWaiting = append(s.initWaiting, lspPending{client: client, id: msg["id"], method: method})
+			s.mu.Unlock()
+			return true
+		}
+		s.initSent = true
+		s.mu.Unlock()
+	default:
+		s.mu.Lock()
+		ready := s.initResult != nil
+		s.mu.Unlock()
+		if !ready {
+			client.ws.WriteJSON(rpcError(msg["id"], rpcServerNotReady, "server not initialized"))
+			return true
+		}
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = lspPending{client: client, id: msg["id"], method: method}
+	s.mu.Unlock()
+	msg["id"] = id
+	s.send(msg)
+	return true
+}
+
+// serverID finds the id a client request was forwarded under. s.mu must be
+// held.
+func (s *lspServer) serverID(client *lspClient, clientID interface{}) (int64, bool) {
+	key := idKey(clientID)
+	for id, p := range s.pending {
+		if p.client == client && idKey(p.id) == key {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// closeDocument drops a client's hold on a document and reports whether it
+// was the last one. s.mu must be held.
+func (s *lspServer) closeDocument(client *lspClient, uri string) bool {
+	delete(client.open, uri)
+	s.openDocs[uri]--
+	if s.openDocs[uri] > 0 {
+		return false
+	}
+	delete(s.openDocs, uri)
+	return true
+}
+
+// release removes a client: its requests are canceled, the documents only it
+// had open are closed, and requests the server sent it are failed. When the
+// last client leaves the server is stopped after the idle timeout.
+func (s *lspServer) release(client *lspClient) {
+	var notify []rpcMessage
+	s.mu.Lock()
+	for i, c := range s.clients {
+		if c == client {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	for id, p := range s.pending {
+		if p.client == client {
+			delete(s.pending, id)
+			notify = append(notify, rpcMessage{"jsonrpc": "2.0", "method": "$/cancelRequest", "params": map[string]interface{}{"id": id}})
+		}
+	}
+	for uri := range client.open {
+		if s.closeDocument(client, uri) {
+			notify = append(notify, rpcMessage{"jsonrpc": "2.0", "method": "textDocument/didClose",
+				"params": map[string]interface{}{"textDocument": map[string]interface{}{"uri": uri}}})
+		}
+	}
+	for key, owner := range s.serverReqs {
+		if owner == client {
+			delete(s.serverReqs, key)
+			var id interface{} = strings.TrimPrefix(key, "s:")
+			if strings.HasPrefix(key, "n:") {
+				id = json.Number(strings.TrimPrefix(key, "n:"))
+			}
+			notify = append(notify, rpcError(id, rpcRequestFailed, "client disconnected"))
+		}
+	}
+	if len(s.clients) == 0 {
+		idle := time.Duration(currentConfig().LSP.IdleTimeoutSeconds) * time.Second
+		s.idleTimer = time.AfterFunc(idle, s.stopIfIdle)
+	}
+	s.mu.Unlock()
+	for _, msg := range notify {
+		s.send(msg)
+	}
+}
+
+// stopIfIdle shuts the server down if no client has joined since the idle
+// timer was set.
+func (s *lspServer) stopIfIdle() {
+	languageServers.Lock()
+	s.mu.Lock()
+	idle := len(s.clients) == 0 && languageServers.byKey[s.key] == s
+	if idle {
+		delete(languageServers.byKey, s.key)
+	}
+	s.mu.Unlock()
+	languageServers.Unlock()
+	if idle {
+		log.Printf("Stopping idle %s language server for %s", s.key.language, s.key.workspace)
+		s.stop()
+	}
+}
+
+// stop asks the server to shut down and exit, killing it if it doesn't.
+func (s *lspServer) stop() {
+	s.mu.Lock()
+	initialized := s.initResult != nil
+	s.nextID++
+	id := s.nextID
+	s.mu.Unlock()
+	if initialized {
+		s.send(rpcMessage{"jsonrpc": "2.0", "id": id, "method": "shutdown"})
+		s.send(rpcMessage{"jsonrpc": "2.0", "method": "exit"})
+	}
+	s.stdin.Close()
+	select {
+	case <-s.exited:
+	case <-time.After(lspShutdownWait):
+		killProcessTree(s.cmd)
+	}
+}
+
+// exitedUnexpectedly cleans up after the server's output ends: the process
+// is reaped and, if it wasn't being stopped, its clients are disconnected so
+// they can reconnect to a new one.
+func (s *lspServer) exitedUnexpectedly() {
+	err := s.cmd.Wait()
+	close(s.exited)
+	languageServers.Lock()
+	current := languageServers.byKey[s.key] == s
+	if current {
+		delete(languageServers.byKey, s.key)
+	}
+	languageServers.Unlock()
+	if !current {
+		return
+	}
+	log.Printf("%s language server for %s exited: %v", s.key.language, s.key.workspace, err)
+	s.mu.Lock()
+	clients := append([]*lspClient(nil), s.clients...)
+	s.mu.Unlock()
+	for _, client := range clients {
+		client.ws.closeWithReason(websocket.CloseInternalServerErr, "languageServerExited")
+	}
+}
+
+// stopLanguageServers stops every language server, for shutdown.
+func stopLanguageServers() {
+	languageServers.Lock()
+	servers := make([]*lspServer, 0, len(languageServers.byKey))
+	for key, s := range languageServers.byKey {
+		servers = append(servers, s)
+		delete(languageServers.byKey, key)
+	}
+	languageServers.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *lspServer) {
+			defer wg.Done()
+			s.stop()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// runningLanguageServers counts the running servers, for /metrics.
+func runningLanguageServers() int {
+	languageServers.Lock()
+	defer languageServers.Unlock()
+	return len(languageServers.byKey)
+}
+
+// --- Handler ---
+
+// lspHandler serves the /lsp websocket:
+// ?language=go&workspace=<dir>&root=<name>. Each text message is one
+// JSON-RPC message.
+func lspHandler(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	// Authorize before looking at the filesystem, so the errors below don't
+	// tell an unauthorized caller which directories exist.
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	language := q.Get("language")
+	settings, ok := currentConfig().LSP.server(language)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No language server is configured for %q", language), http.StatusNotFound)
+		return
+	}
+	paths, err := newRootPaths(q.Get("root"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	workspace, err := paths.toLocal(q.Get("workspace"))
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if info, err := os.Stat(workspace); err != nil || !info.IsDir() {
+		http.Error(w, "workspace is not a directory", http.StatusBadRequest)
+		return
+	}
+
+	ws, err := upgradeAuthorized(w, r, "lsp")
+	if err != nil {
+		log.Printf("LSP WS upgrade failed: %v", err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(lspMaxMessage)
+	client := &lspClient{ws: ws, who: who, open: make(map[string]bool)}
+	s, err := acquireLanguageServer(lspKey{language: language, workspace: workspace}, paths, settings, client)
+	if err != nil {
+		log.Printf("LSP: %v", err)
+		ws.closeWithReason(websocket.CloseInternalServerErr, "languageServerFailed")
+		return
+	}
+	defer s.release(client)
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("LSP WS read error: %v", err)
+			}
+			return
+		}
+		msg, err := decodeRPCMessage(data)
+		if err != nil {
+			ws.WriteJSON(rpcError(nil, -32700, "parse error"))
+			continue
+		}
+		if !s.fromClient(client, msg) {
+			ws.closeWithReason(websocket.CloseNormalClosure, "")
+			return
+		}
+	}
+}
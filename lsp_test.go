@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair returns the server end of a websocket connection, and a function
+// returning the next message the client end receives, or "" after a short
+// wait.
+func wsPair(t *testing.T) (*wsConn, func() string) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	received := make(chan string, 100)
+	go func() {
+		for {
+			_, data, err := client.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- strings.TrimSpace(string(data))
+		}
+	}()
+	return newWSConn(<-conns, "lsp"), func() string { return nextMessage(received) }
+}
+
+// nextMessage returns the next message from ch, or "" after a short wait.
+func nextMessage(ch chan string) string {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(100 * time.Millisecond):
+		return ""
+	}
+}
+
+// fakeLanguageServer returns a server whose stdin is read by the test, one
+// message at a time.
+func fakeLanguageServer(t *testing.T, paths rootPaths) (*lspServer, func() string) {
+	r, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	received := make(chan string, 100)
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			data, err := readFramedMessage(br)
+			if err != nil {
+				return
+			}
+			received <- string(data)
+		}
+	}()
+	s := &lspServer{
+		key:        lspKey{language: "test"},
+		paths:      paths,
+		stdin:      w,
+		pending:    make(map[int64]lspPending),
+		serverReqs: make(map[string]*lspClient),
+		openDocs:   make(map[string]int),
+		initResult: map[string]interface{}{},
+	}
+	return s, func() string { return nextMessage(received) }
+}
+
+func rpc(t *testing.T, data string) rpcMessage {
+	t.Helper()
+	msg, err := decodeRPCMessage([]byte(data))
+	if err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	return msg
+}
+
+func TestLSPIDRemapping(t *testing.T) {
+	s, next := fakeLanguageServer(t, rootPaths{})
+	var clients [2]*lspClient
+	var ends [2]func() string
+	for i := range clients {
+		ws, end := wsPair(t)
+		clients[i], ends[i] = &lspClient{ws: ws, open: make(map[string]bool)}, end
+		s.clients = append(s.clients, clients[i])
+	}
+
+	// Requests with colliding ids go to the server under ids of its own.
+	requests := []struct {
+		client int
+		msg    string
+		want   string // as the server receives it
+	}{
+		{0, `{"jsonrpc":"2.0","id":1,"method":"textDocument/hover"}`, `{"id":1,"jsonrpc":"2.0","method":"textDocument/hover"}`},
+		{1, `{"jsonrpc":"2.0","id":1,"method":"textDocument/hover"}`, `{"id":2,"jsonrpc":"2.0","method":"textDocument/hover"}`},
+		{0, `{"jsonrpc":"2.0","id":"a","method":"textDocument/definition"}`, `{"id":3,"jsonrpc":"2.0","method":"textDocument/definition"}`},
+		{1, `{"jsonrpc":"2.0","id":7,"method":"textDocument/references"}`, `{"id":4,"jsonrpc":"2.0","method":"textDocument/references"}`},
+		{1, `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":7}}`, `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":4}}`},
+		{0, `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":99}}`, ``},
+		{1, `{"jsonrpc":"2.0","id":2,"method":"shutdown"}`, ``},
+	}
+	for i, tt := range requests {
+		s.fromClient(clients[tt.client], rpc(t, tt.msg))
+		if got := next(); got != tt.want {
+			t.Errorf("request %d: server got %s; want %s", i, got, tt.want)
+		}
+	}
+	if got, want := ends[1](), `{"id":2,"jsonrpc":"2.0","result":null}`; got != want {
+		t.Errorf("shutdown answered with %s; want %s", got, want)
+	}
+
+	// Responses go back to the client that asked, under its id.
+	responses := []struct {
+		msg    string
+		client int // -1 if dropped
+		want   string
+	}{
+		{`{"jsonrpc":"2.0","id":2,"result":"b1"}`, 1, `{"id":1,"jsonrpc":"2.0","result":"b1"}`},
+		{`{"jsonrpc":"2.0","id":3,"result":"a"}`, 0, `{"id":"a","jsonrpc":"2.0","result":"a"}`},
+		{`{"jsonrpc":"2.0","id":1,"error":{"code":-32603,"message":"x"}}`, 0, `{"error":{"code":-32603,"message":"x"},"id":1,"jsonrpc":"2.0"}`},
+		{`{"jsonrpc":"2.0","id":1,"result":"again"}`, -1, ``},
+		{`{"jsonrpc":"2.0","id":"3","result":"string id"}`, -1, ``},
+		{`{"jsonrpc":"2.0","id":99,"result":"unknown"}`, -1, ``},
+	}
+	for i, tt := range responses {
+		s.fromServer(rpc(t, tt.msg))
+		for c, end := range ends {
+			want := ""
+			if c == tt.client {
+				want = tt.want
+			}
+			if got := end(); got != want {
+				t.Errorf("response %d: client %d got %s; want %s", i, c, got, want)
+			}
+		}
+	}
+
+	// A request from the server goes to the first client, and only its
+	// answer is forwarded.
+	s.fromServer(rpc(t, `{"jsonrpc":"2.0","id":"s1","method":"workspace/configuration"}`))
+	if got := ends[0](); !strings.Contains(got, `"id":"s1"`) {
+		t.Errorf("first client got %s; want the server request", got)
+	}
+	s.fromClient(clients[1], rpc(t, `{"jsonrpc":"2.0","id":"s1","result":["wrong"]}`))
+	s.fromClient(clients[0], rpc(t, `{"jsonrpc":"2.0","id":"s1","result":["right"]}`))
+	if got, want := next(), `{"id":"s1","jsonrpc":"2.0","result":["right"]}`; got != want {
+		t.Errorf("server got %s; want %s", got, want)
+	}
+}
+
+func TestLSPDocumentCounts(t *testing.T) {
+	s, next := fakeLanguageServer(t, rootPaths{})
+	var clients [3]*lspClient
+	for i := range clients {
+		clients[i] = &lspClient{open: make(map[string]bool)}
+		s.clients = append(s.clients, clients[i])
+	}
+	const doc = `"textDocument":{"uri":"file:///a.go"}`
+	tests := []struct {
+		client    int
+		method    string
+		forwarded bool
+	}{
+		{0, "textDocument/didOpen", true},
+		{1, "textDocument/didOpen", false},
+		{0, "textDocument/didOpen", false},
+		{0, "textDocument/didChange", true},
+		{1, "textDocument/didSave", true},
+		{2, "textDocument/didChange", false},
+		{2, "textDocument/didClose", false},
+		{0, "textDocument/didClose", false},
+		{0, "textDocument/didChange", false},
+		{0, "textDocument/didClose", false},
+		{1, "textDocument/didClose", true},
+		{2, "textDocument/didOpen", true},
+	}
+	for i, tt := range tests {
+		s.fromClient(clients[tt.client], rpc(t, `{"jsonrpc":"2.0","method":"`+tt.method+`","params":{`+doc+`}}`))
+		if got := next(); (got != "") != tt.forwarded {
+			t.Errorf("%d: client %d %s forwarded %q; want forwarded %v", i, tt.client, tt.method, got, tt.forwarded)
+		}
+	}
+
+	// A client leaving closes what only it had open.
+	s.release(clients[2])
+	if got := next(); !strings.Contains(got, "didClose") {
+		t.Errorf("after release, server got %q; want didClose", got)
+	}
+}
+
+func TestRewriteFileURIs(t *testing.T) {
+	root := t.TempDir()
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	saved := fileAPIRoot
+	fileAPIRoot = root
+	defer func() { fileAPIRoot = saved }()
+	paths, err := newRootPaths("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := "file://" + filepath.ToSlash(root)
+
+	toLocal := []struct {
+		uri, want string
+		ok        bool
+	}{
+		{"file:///main.go", local + "/main.go", true},
+		{"file:///src/a%20b.go", local + "/src/a%20b.go", true},
+		{"file:///", local, true},
+		{"file:///../../etc/passwd", local + "/etc/passwd", true},
+		{"file://host/x.go", local + "/x.go", true},
+		{"https://example.com/x.go", "", false},
+		{"file://%zz", "", false},
+	}
+	for _, tt := range toLocal {
+		got, err := paths.uriToLocal(tt.uri)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("uriToLocal(%q) = %q, %v; want %q, ok %v", tt.uri, got, err, tt.want, tt.ok)
+		}
+	}
+
+	toClient := []struct {
+		uri, want string
+	}{
+		{local + "/main.go", "file:///main.go"},
+		{local + "/src/a%20b.go", "file:///src/a%20b.go"},
+		{local, "file:///"},
+		{"file:///usr/lib/go/src/fmt/print.go", "file:///usr/lib/go/src/fmt/print.go"},
+		{local + "x/main.go", local + "x/main.go"},
+		{"file://host" + filepath.ToSlash(root) + "/a.go", "file://host" + filepath.ToSlash(root) + "/a.go"},
+		{"untitled:Untitled-1", "untitled:Untitled-1"},
+	}
+	for _, tt := range toClient {
+		if got := paths.uriToClient(tt.uri); got != tt.want {
+			t.Errorf("uriToClient(%q) = %q; want %q", tt.uri, got, tt.want)
+		}
+	}
+
+	// Values and keys are rewritten at any depth; other strings are left alone.
+	msg := rpc(t, `{"method":"workspace/applyEdit","params":{"edit":{"changes":{"file:///a.go":[{"newText":"file:///b.go"}]},
+		"documentChanges":[{"textDocument":{"uri":"file:///c.go"}}]},"label":"not file:///d.go"}}`)
+	got, err := rewriteFileURIs(map[string]interface{}(msg), paths.uriToLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := rpc(t, `{"method":"workspace/applyEdit","params":{"edit":{"changes":{"`+local+`/a.go":[{"newText":"`+local+`/b.go"}]},
+		"documentChanges":[{"textDocument":{"uri":"`+local+`/c.go"}}]},"label":"not file:///d.go"}}`)
+	if !reflect.DeepEqual(got, map[string]interface{}(want)) {
+		data, _ := json.Marshal(got)
+		t.Errorf("rewrote to %s", data)
+	}
+	if _, err := rewriteFileURIs(map[string]interface{}{"uri": "file://%zz"}, paths.uriToLocal); err == nil {
+		t.Error("rewriting an invalid URI succeeded")
+	}
+}
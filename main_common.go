@@ -12,6 +12,7 @@ import (
 	"os"
 	"sync/atomic"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,6 +28,20 @@ func runConduitServer() {
 	flag.BoolVar(&uninstallFlag, "uninstall", false, "Uninstall user and/or system Conduit installations.")
 	flag.StringVar(&rootFlag, "root", "", "Set the root directory for the file API (defaults to user's home directory).")
 	flag.BoolVar(&noIdleShutdownFlag, "no-idle-shutdown", false, "Disable automatic shutdown due to inactivity. Recommended for services.")
+	flag.IntVar(&portFlag, "port", 3022, "Port to listen on.")
+	flag.IntVar(&portFallbackFlag, "port-fallback", 10, "If --port is taken, try up to this many following ports.")
+	flag.StringVar(&listenFlag, "listen", "127.0.0.1", "Address to listen on. Use 0.0.0.0 or :: to accept connections from other machines.")
+	flag.BoolVar(&strictAuthFlag, "strict-auth", false, "Require the API key for no-origin requests, even from localhost.")
+	flag.StringVar(&trustedProxiesFlag, "trusted-proxies", "", "Comma-separated IPs or CIDR ranges of reverse proxies allowed to set X-Forwarded-For.")
+	flag.StringVar(&tlsCertFlag, "tls-cert", "", "Serve https/wss using this PEM certificate file (requires --tls-key).")
+	flag.StringVar(&tlsKeyFlag, "tls-key", "", "PEM private key for --tls-cert.")
+	flag.BoolVar(&tlsSelfSignedFlag, "tls-self-signed", false, "Serve https/wss using a generated local CA and localhost certificate stored in the config directory.")
+	flag.BoolVar(&tlsFingerprintFlag, "tls-fingerprint", false, "Print the SHA-256 fingerprints of the TLS certificates, then exit.")
+	flag.StringVar(&tlsExportCAFlag, "tls-export-ca", "", "Write the generated local CA certificate to this path ('-' for stdout), then exit.")
+	flag.Var(&allowOriginFlags, "allow-origin", "Additionally allow this browser origin (repeatable). Supports https://*.example.com and http://localhost:8000-9000.")
+	flag.BoolVar(&pairFlag, "pair", false, "Review origins that were refused by the server and approve them, then exit.")
+	flag.StringVar(&pairOriginFlag, "pair-origin", "", "Approve and save an allowed origin without prompting, then exit.")
+	flag.BoolVar(&printConfigFlag, "print-config", false, "Print the effective configuration (config file plus flags), then exit.")
 	flag.Parse()
 	
 	manageAPIKey(keyFlag)
@@ -35,20 +50,61 @@ func runConduitServer() {
 		os.Exit(0)
 	}
 
+	if pairFlag || pairOriginFlag != "" {
+		var err error
+		if pairOriginFlag != "" {
+			err = approveOrigin(pairOriginFlag)
+		} else {
+			err = pairOrigins()
+		}
+		if err != nil {
+			log.Fatalf("Pairing failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	applyLaunchURL(cfg, flag.Args())
+	if printConfigFlag {
+		printConfig(cfg)
+		os.Exit(0)
+	}
+	applyStartupConfig(cfg)
+	setConfig(cfg)
+
+	if tlsFingerprintFlag {
+		if err := printTLSFingerprints(); err != nil {
+			log.Fatalf("TLS: %v", err)
+		}
+		os.Exit(0)
+	}
+	if tlsExportCAFlag != "" {
+		if err := exportLocalCA(tlsExportCAFlag); err != nil {
+			log.Fatalf("TLS: %v", err)
+		}
+		os.Exit(0)
+	}
+
 	if installUserFlag {
 		msg, err := InstallUser()
+		auditCLIAction("admin.install-user", err)
 		log.Println(msg)
 		if err != nil { os.Exit(1) }
 		os.Exit(0)
 	}
 	if installServiceFlag {
 		msg, err := InstallService()
+		auditCLIAction("admin.install-service", err)
 		log.Println(msg)
 		if err != nil { os.Exit(1) }
 		os.Exit(0)
 	}
 	if uninstallFlag {
 		msg, err := Uninstall()
+		auditCLIAction("admin.uninstall", err)
 		log.Println(msg)
 		if err != nil { os.Exit(1) }
 		os.Exit(0)
@@ -57,52 +113,92 @@ func runConduitServer() {
 		os.Exit(0)
 	}
 
-	if rootFlag != "" {
-		fileAPIRoot = rootFlag
-	} else {
-		homeDir, err := os.UserHomeDir()
-		if err == nil { fileAPIRoot = homeDir } else { fileAPIRoot = "." }
-	}
 	go fileWatcher.run()
+	go watchConfig()
+	go watchSessionPorts()
+	go watchForegroundProcesses()
 	updateLastActivity()
-	if !noIdleShutdownFlag {
-		go startIdleShutdownManager(60 * time.Minute)
-	}
+	go startIdleShutdownManager()
 	startTime = time.Now()
 	mux := http.NewServeMux()
 	log.Printf("Running as compiled build: %t", isCompiledBuild)
 	mux.HandleFunc("/terminal", terminalServer)
 	mux.HandleFunc("/up", upcheckHandler)
+	mux.HandleFunc("/capabilities", capabilitiesHandler)
 	mux.HandleFunc("/files", filesApiHandler)
+	mux.HandleFunc("/exec", execHandler)
+	mux.HandleFunc("/tasks", tasksHandler)
+	mux.HandleFunc("/git/", gitHandler)
+	mux.HandleFunc("/lsp", lspHandler)
+	mux.HandleFunc("/dap", dapHandler)
+	mux.HandleFunc("/proxy/", proxyRedirectHandler)
+	mux.HandleFunc("/tunnel", tunnelHandler)
+	mux.HandleFunc("/ports", portsHandler)
 	mux.HandleFunc("/kill", installationHandler(killHandler))
 	mux.HandleFunc("/install-service", installationHandler(InstallService))
 	mux.HandleFunc("/uninstall", installationHandler(Uninstall))
 	mux.HandleFunc("/install-user", installationHandler(InstallUser))
+	mux.HandleFunc("/audit", auditHandler)
+	mux.HandleFunc("/sessions", sessionsHandler)
+	mux.HandleFunc("/sessions/", sessionsHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/recordings", recordingsHandler)
+	mux.HandleFunc("/recordings/", recordingsHandler)
 
+	var certFile, keyFile string
+	scheme := "ws"
+	if tlsEnabled() {
+		certFile, keyFile, err = resolveTLSFiles()
+		if err != nil {
+			log.Fatalf("TLS: %v", err)
+		}
+		scheme = "wss"
+	}
+	httpScheme := strings.Replace(scheme, "ws", "http", 1)
+	listener, bound, err := listenWithFallback(listenFlag, cfg.Port, cfg.PortFallback, httpScheme)
+	if err == errAlreadyRunning {
+		log.Printf("Conduit is already running on port %d.", bound)
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	boundPort = bound
+	port = strconv.Itoa(bound)
+	listenAddr := net.JoinHostPort(listenFlag, port)
+	checkListenAddress(listenAddr)
+	writeDiscoveryFile(listenFlag, bound, httpScheme)
+	configureForwarding(listenFlag, certFile, keyFile)
 	log.Printf("File API Root: %s", fileAPIRoot)
-	log.Printf("Conduit v%s - listening for WS connections (localhost:%s)", version, port)
+	for name, dir := range cfg.Roots {
+		log.Printf("File API Root %q: %s", name, dir)
+	}
+	log.Printf("Conduit v%s - listening for %s connections (%s)", version, strings.ToUpper(scheme), listenAddr)
 	log.Println("------------------------------------------------------------")
 
-	// err := http.ListenAndServe(":"+port, activityMiddleware(mux))
-	err := http.ListenAndServe(":"+port, activityMiddleware(corsMiddleware(mux)))
-
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
-	}
+	server := &http.Server{Handler: activityMiddleware(corsMiddleware(mux))}
+	serveUntilShutdown(server, listener, certFile, keyFile)
 }
 
 // Global variables remain accessible
 const version = "0.1.1"
-const port = "3022"
-var allowedOrigins = map[string]bool{
-	"https://cadence.jakbox.dev": true,
-	"https://cadence.jakbox.net": true,
-	"https://code.jakbox.dev": true,
-	"https://code.jakbox.net": true,
-	"http://localhost:8083":  true,
-	"http://localhost":       true,
-}
+var port = "3022"
 var rootFlag string
+var allowOriginFlags stringListFlag
+var pairFlag bool
+var pairOriginFlag string
+var printConfigFlag bool
+var listenFlag string
+var portFlag int
+var portFallbackFlag int
+var boundPort int
+var tlsCertFlag string
+var tlsKeyFlag string
+var tlsSelfSignedFlag bool
+var tlsFingerprintFlag bool
+var tlsExportCAFlag string
+var strictAuthFlag bool
+var trustedProxiesFlag string
 var keyFlag bool
 var installUserFlag bool
 var installServiceFlag bool
@@ -134,10 +230,11 @@ func activityMiddleware(next http.Handler) http.Handler {
 	})
 }
 // corsMiddleware adds the necessary headers to handle CORS requests.
+// Forwarded apps, on listeners of their own, answer CORS requests themselves.
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
-		if allowedOrigins[origin] {
+		if isOriginAllowed(origin) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Conduit-Key")
@@ -150,33 +247,50 @@ func corsMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
-func startIdleShutdownManager(timeout time.Duration) {
+// stringListFlag collects the values of a flag that may be given more than once.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string { return strings.Join(*s, ",") }
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// startIdleShutdownManager exits the server once it has had no connections for
+// the configured idle timeout. The timeout is reread every tick so a config
+// reload can change or disable it.
+func startIdleShutdownManager() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 	for range ticker.C {
+		timeout := time.Duration(currentConfig().IdleTimeoutMinutes) * time.Minute
+		if timeout == 0 {
+			continue
+		}
 		if atomic.LoadInt32(&activeConnections) == 0 {
 			lastActivity := lastActivityTimestamp.Load()
 			idleDuration := time.Since(time.Unix(lastActivity, 0))
 			if idleDuration >= timeout {
 				log.Printf("Shutting down due to inactivity for over %v.", timeout)
-				os.Exit(0)
+				requestShutdown("idle timeout")
+				return
 			}
 		}
 	}
 }
 func installationHandler(handlerFunc func() (string, error)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
-		}
-		if remoteIP != "127.0.0.1" && remoteIP != "::1" {
-			log.Printf("[SECURITY] Denied installation request from remote address: %s", r.RemoteAddr)
+		// Proxied requests are resolved to their real client, so a local reverse
+		// proxy can't be used to reach these endpoints from another machine,
+		// and the Host must name this machine, so a rebound DNS name can't.
+		if !isLoopbackRequest(r) || !loopbackHost(r) {
+			log.Printf("[SECURITY] Denied installation request from remote address: %s", describeClient(r))
 			http.Error(w, "Forbidden: Installation actions are only allowed from localhost.", http.StatusForbidden)
 			return
 		}
 		msg, err := handlerFunc()
+		who := principal{Origin: r.Header.Get("Origin"), RemoteAddr: describeClient(r)}
+		audit.record(auditEntry{Action: "admin" + strings.ReplaceAll(r.URL.Path, "/", ".")}.from(who).withError(err))
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		if err != nil {
 			http.Error(w, msg, http.StatusInternalServerError)
@@ -191,6 +305,7 @@ func killHandler() (string, error) {
 		return "Kill command is disabled when running with --no-idle-shutdown.", fmt.Errorf("kill command disabled")
 	}
 	log.Println("Received /kill request. Shutting down application.")
-	go func() { time.Sleep(100 * time.Millisecond); os.Exit(0) }()
+	// The shutdown waits for this response to be written before closing the server.
+	requestShutdown("kill request")
 	return "Conduit server is shutting down.", nil
 }
\ No newline at end of file
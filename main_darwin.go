@@ -1,5 +1,6 @@
 //go:build darwin
 // +build darwin
+
 package main
 /*
 #cgo CFLAGS: -x objective-c
@@ -10,6 +11,7 @@ import "C"
 import (
 	"log"
 	"net/url"
+	"os"
 	"sync"
 )
 var (
@@ -49,10 +51,18 @@ func main() {
 	C.activateApp()
 
 	var startServerOnce sync.Once
+	// The main goroutine is parked in the Cocoa run loop, so exit explicitly
+	// once the server has shut down.
+	startServer := func() {
+		go func() {
+			runConduitServer()
+			os.Exit(0)
+		}()
+	}
 	setURLHandler(func(url *url.URL) {
 		log.Printf("Received URL via macOS protocol handler: %s", url.String())
-		startServerOnce.Do(func() { go runConduitServer() })
+		startServerOnce.Do(startServer)
 	})
-	startServerOnce.Do(func() { go runConduitServer() })
+	startServerOnce.Do(startServer)
 	registerAndRunURLHandler()
 }
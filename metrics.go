@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are exposed at /metrics in the Prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/). The format
+// is simple enough that writing it by hand is cheaper than a client library.
+
+// metricVec is a counter or histogram family with a fixed set of label names.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "histogram"
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries // keyed by label values joined with \xff
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counter value, or histogram sum
+	count       uint64   // histogram observations
+	buckets     []uint64 // histogram cumulative counts, parallel to latencyBuckets
+}
+
+// latencyBuckets are the histogram upper bounds, in seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*metricSeries)}
+	if len(labels) == 0 {
+		m.with(nil) // report unlabelled counters as 0 before their first increment
+	}
+	return m
+}
+
+func newHistogramVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: "histogram", labels: labels, series: make(map[string]*metricSeries)}
+}
+
+// with returns the series for the given label values. The caller holds m.mu.
+func (m *metricVec) with(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(latencyBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add increases a counter.
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.with(labelValues).value += v
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+// observe records a duration in a histogram.
+func (m *metricVec) observe(d time.Duration, labelValues ...string) {
+	seconds := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.with(labelValues)
+	s.value += seconds
+	s.count++
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+		}
+	}
+}
+
+// write prints the family in exposition format, series sorted by labels.
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.kind == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatValue(s.value))
+			continue
+		}
+		bucketNames := append(append([]string(nil), m.labels...), "le")
+		bucketLabels := func(le string) string {
+			return formatLabels(bucketNames, append(append([]string(nil), s.labelValues...), le))
+		}
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, bucketLabels(formatValue(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, bucketLabels("+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+// formatLabels renders {name="value",...}, escaping values as the format requires.
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf(`%s="%s"`, name, escaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return fmt.Sprintf("%g", v)
+}
+
+// writeGauge prints a single unlabelled gauge.
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatValue(value))
+}
+
+// --- Server Metrics ---
+
+var (
+	metricSessionsStarted = newCounterVec("conduit_terminal_sessions_started_total",
+		"Terminal sessions started.")
+	metricSpawnFailures = newCounterVec("conduit_pty_spawn_failures_total",
+		"Terminal sessions whose shell failed to start.")
+	metricBytes = newCounterVec("conduit_bytes_total",
+		"Bytes sent and received, by channel (terminal, files, replay, exec, lsp, dap, tunnel) and direction (in, out).", "channel", "direction")
+	metricFileOps = newCounterVec("conduit_file_operations_total",
+		"File API operations by action and outcome (ok, error, denied).", "action", "outcome")
+	metricFileOpDuration = newHistogramVec("conduit_file_operation_duration_seconds",
+		"File API operation latency by action.", "action")
+	metricAuthDenied = newCounterVec("conduit_auth_denied_total",
+		"Requests refused by authorization, by reason.", "reason")
+	metricExecs = newCounterVec("conduit_exec_processes_total",
+		"Commands run through /exec that have finished, by outcome (ok, error, timeout, canceled).", "outcome")
+	metricExecRunning atomic.Int32
+	metricGitOps      = newCounterVec("conduit_git_operations_total",
+		"/git API operations by operation and outcome (ok, error, denied).", "operation", "outcome")
+	metricGitOpDuration = newHistogramVec("conduit_git_operation_duration_seconds",
+		"Latency of successful /git API operations.", "operation")
+	metricForwards = newCounterVec("conduit_forwarded_requests_total",
+		"Proxied HTTP requests and tunnel connections by kind (http, tunnel) and outcome (ok, error, denied).", "kind", "outcome")
+)
+
+// countBytes adds to the byte counters for a channel.
+func countBytes(channel, direction string, n int) {
+	if channel != "" && n > 0 {
+		metricBytes.add(float64(n), channel, direction)
+	}
+}
+
+// observeFileOp records the outcome and latency of a file API operation.
+func observeFileOp(action, errMsg string, started time.Time) {
+	// The action comes from the client; unknown ones share a label so they
+	// can't create unlimited series.
+	known := false
+	for _, a := range fileActions {
+		if a == action {
+			known = true
+			break
+		}
+	}
+	if !known {
+		action = "unknown"
+	}
+	metricFileOps.inc(action, fileOutcome(errMsg))
+	metricFileOpDuration.observe(time.Since(started), action)
+}
+
+// fileOutcome classifies a file operation's error message.
+func fileOutcome(errMsg string) string {
+	switch errMsg {
+	case "":
+		return outcomeOK
+	case "Forbidden":
+		return outcomeDenied
+	}
+	return outcomeError
+}
+
+// metricsHandler serves GET /metrics. Scrapers without an Origin header need
+// the API key (X-Conduit-Key or ?key=) unless they connect over loopback.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkRequestAuthorization(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintf(w, "# HELP conduit_build_info Build information.\n# TYPE conduit_build_info gauge\nconduit_build_info%s 1\n",
+		formatLabels([]string{"version", "goos", "goarch"}, []string{version, runtime.GOOS, runtime.GOARCH}))
+	writeGauge(w, "conduit_uptime_seconds", "Seconds since the server started.", time.Since(startTime).Seconds())
+
+	sessions := terminalSessions.list()
+	clients, recording := 0, 0
+	for _, s := range sessions {
+		s.mu.Lock()
+		clients += len(s.clients)
+		s.mu.Unlock()
+		if s.recordingName() != "" {
+			recording++
+		}
+	}
+	writeGauge(w, "conduit_terminal_sessions", "Running terminal sessions.", float64(atomic.LoadInt32(&activeConnections)))
+	writeGauge(w, "conduit_terminal_clients", "WebSocket clients attached to terminal sessions.", float64(clients))
+	writeGauge(w, "conduit_terminal_sessions_recording", "Terminal sessions being recorded.", float64(recording))
+	writeGauge(w, "conduit_file_connections", "Open file API WebSocket connections.", float64(len(fileClients.list())))
+	writeGauge(w, "conduit_watched_paths", "Paths watched for file API clients.", float64(fileWatcher.watchedCount()))
+	writeGauge(w, "conduit_indexed_files", "Files in the quick-open indexes.", float64(indexedFileCount()))
+	writeGauge(w, "conduit_exec_processes", "Commands running through /exec.", float64(metricExecRunning.Load()))
+	writeGauge(w, "conduit_language_servers", "Language servers running for /lsp clients.", float64(runningLanguageServers()))
+	writeGauge(w, "conduit_debug_adapters", "Debug adapters running for /dap clients.", float64(runningDebugAdapters()))
+	writeGauge(w, "conduit_tunnels", "Open /tunnel connections.", float64(metricTunnelsOpen.Load()))
+
+	for _, m := range []*metricVec{metricSessionsStarted, metricSpawnFailures, metricBytes, metricFileOps, metricFileOpDuration, metricAuthDenied, metricExecs, metricGitOps, metricGitOpDuration, metricForwards} {
+		m.write(w)
+	}
+}
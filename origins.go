@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const originsFileName = "origins.json"
+const pendingOriginsFileName = "pending-origins.json"
+const maxPendingOrigins = 20
+
+// A refused origin is recorded at most once per deniedRecordInterval, and at
+// most maxTrackedDenied origins are remembered for that in memory.
+const (
+	deniedRecordInterval = time.Minute
+	maxTrackedDenied     = 1000
+)
+
+// originReloadInterval limits how often the origins file is checked for
+// changes, so an approval made with --pair reaches a running server quickly
+// without a stat on every request.
+const originReloadInterval = 2 * time.Second
+
+// defaultAllowedOrigins are always allowed, in addition to anything in the
+// origins file or given with --allow-origin.
+var defaultAllowedOrigins = []string{
+	"https://cadence.jakbox.dev",
+	"https://cadence.jakbox.net",
+	"https://code.jakbox.dev",
+	"https://code.jakbox.net",
+	"http://localhost:8083",
+	"http://localhost",
+}
+
+// --- Origin Patterns ---
+
+// originPattern is a parsed allowed-origin entry. Supported forms:
+//
+//	https://code.example.com       exact origin
+//	https://*.example.com          any subdomain of example.com
+//	http://localhost:8000-8999     a port range
+//	http://localhost:*             any port, including the default
+type originPattern struct {
+	raw      string
+	scheme   string
+	host     string // lower-case; a leading "*." matches any subdomain
+	anyPort  bool
+	portFrom int // 0 means the scheme's default port (no port in the origin)
+	portTo   int
+}
+
+// parseOriginPattern validates and parses an allowed-origin entry.
+func parseOriginPattern(raw string) (originPattern, error) {
+	p := originPattern{raw: raw}
+	raw = strings.TrimRight(strings.TrimSpace(raw), "/")
+	scheme, rest, ok := strings.Cut(raw, "://")
+	if !ok || scheme == "" || rest == "" {
+		return p, fmt.Errorf("origin %q must look like scheme://host[:port]", p.raw)
+	}
+	if strings.ContainsAny(rest, "/?#@") {
+		return p, fmt.Errorf("origin %q must not contain a path, query or credentials", p.raw)
+	}
+	p.scheme = strings.ToLower(scheme)
+
+	host, portSpec := rest, ""
+	if strings.HasPrefix(rest, "[") {
+		// IPv6 literal, e.g. http://[::1]:8080
+		end := strings.Index(rest, "]")
+		if end == -1 {
+			return p, fmt.Errorf("origin %q has an unterminated IPv6 address", p.raw)
+		}
+		host = rest[:end+1]
+		portSpec = strings.TrimPrefix(rest[end+1:], ":")
+	} else if i := strings.LastIndex(rest, ":"); i != -1 {
+		host, portSpec = rest[:i], rest[i+1:]
+	}
+	p.host = strings.ToLower(host)
+	if p.host == "" || p.host == "*." || strings.Contains(strings.TrimPrefix(p.host, "*."), "*") {
+		return p, fmt.Errorf("origin %q has an invalid host; only a leading '*.' wildcard is supported", p.raw)
+	}
+
+	switch {
+	case portSpec == "":
+	case portSpec == "*":
+		p.anyPort = true
+	case strings.Contains(portSpec, "-"):
+		from, to, _ := strings.Cut(portSpec, "-")
+		var err1, err2 error
+		p.portFrom, err1 = strconv.Atoi(from)
+		p.portTo, err2 = strconv.Atoi(to)
+		if err1 != nil || err2 != nil || p.portFrom < 1 || p.portTo > 65535 || p.portFrom > p.portTo {
+			return p, fmt.Errorf("origin %q has an invalid port range", p.raw)
+		}
+	default:
+		port, err := strconv.Atoi(portSpec)
+		if err != nil || port < 1 || port > 65535 {
+			return p, fmt.Errorf("origin %q has an invalid port", p.raw)
+		}
+		p.portFrom, p.portTo = port, port
+	}
+	return p, nil
+}
+
+// matches reports whether a browser Origin header value satisfies the pattern.
+func (p originPattern) matches(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || u.Path != "" {
+		return false
+	}
+	if strings.ToLower(u.Scheme) != p.scheme {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if strings.Contains(u.Host, "[") {
+		host = "[" + host + "]"
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		if !strings.HasSuffix(host, p.host[1:]) || len(host) <= len(p.host)-1 {
+			return false
+		}
+	} else if host != p.host {
+		return false
+	}
+	if p.anyPort {
+		return true
+	}
+	port := 0
+	if u.Port() != "" {
+		port, err = strconv.Atoi(u.Port())
+		if err != nil {
+			return false
+		}
+	}
+	if p.portFrom == 0 {
+		return port == 0
+	}
+	return port >= p.portFrom && port <= p.portTo
+}
+
+// --- Origin Policy ---
+
+// originPolicy combines the built-in, file-based and command-line origins and
+// remembers origins that were refused so they can be approved with --pair.
+type originPolicy struct {
+	mu            sync.RWMutex
+	extra         []string // from --allow-origin
+	patterns      []originPattern
+	fileModTime   time.Time
+	lastFileCheck time.Time
+	refused       map[string]time.Time // when each refused origin was last recorded
+
+	pendingMu sync.Mutex // serialises updates to the pending origins file
+}
+
+// pendingOrigin records an origin that tried to connect and was refused.
+type pendingOrigin struct {
+	Origin    string    `json:"origin"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Attempts  int       `json:"attempts"`
+	Rejected  bool      `json:"rejected,omitempty"` // declined with --pair; not asked about again
+}
+
+// Global instance of the origin policy.
+var origins = &originPolicy{refused: make(map[string]time.Time)}
+
+// isOriginAllowed reports whether a browser Origin may use the API.
+func isOriginAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	origins.reloadIfChanged()
+	origins.mu.RLock()
+	defer origins.mu.RUnlock()
+	for _, p := range origins.patterns {
+		if p.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// load rebuilds the pattern list from the defaults, the origins file and the
+// command line. Invalid entries are logged and skipped.
+func (op *originPolicy) load(extra []string) {
+	op.mu.Lock()
+	op.extra = extra
+	op.mu.Unlock()
+	op.reload(true)
+}
+
+func (op *originPolicy) reloadIfChanged() {
+	op.mu.RLock()
+	due := time.Since(op.lastFileCheck) >= originReloadInterval
+	op.mu.RUnlock()
+	if due {
+		op.reload(false)
+	}
+}
+
+func (op *originPolicy) reload(force bool) {
+	path, _ := originsFilePath()
+	var modTime time.Time
+	if stat, err := os.Stat(path); err == nil {
+		modTime = stat.ModTime()
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.lastFileCheck = time.Now()
+	if !force && modTime.Equal(op.fileModTime) {
+		return
+	}
+	op.fileModTime = modTime
+
+	saved, err := readOriginList(path)
+	if err != nil {
+		log.Printf("Error reading allowed origins from %s: %v", path, err)
+	}
+	entries := append(append(append([]string{}, defaultAllowedOrigins...), saved...), op.extra...)
+	patterns := make([]originPattern, 0, len(entries))
+	for _, entry := range entries {
+		p, err := parseOriginPattern(entry)
+		if err != nil {
+			log.Printf("Ignoring allowed origin: %v", err)
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	op.patterns = patterns
+	if !force {
+		log.Printf("Reloaded allowed origins (%d entries)", len(patterns))
+	}
+}
+
+// recordDenied remembers a refused origin so it can be approved with --pair.
+// Each origin is written to the pending file at most once a minute. When the
+// file is full, the origins seen least recently make way, so a page making up
+// origins can't keep a real one from being paired.
+func (op *originPolicy) recordDenied(origin string) {
+	if origin == "" || origin == "null" {
+		return
+	}
+	if _, err := parseOriginPattern(origin); err != nil {
+		return
+	}
+	now := time.Now()
+	op.mu.Lock()
+	if last, ok := op.refused[origin]; ok && now.Sub(last) < deniedRecordInterval {
+		op.mu.Unlock()
+		return
+	}
+	if len(op.refused) >= maxTrackedDenied {
+		oldest := ""
+		for o, t := range op.refused {
+			if oldest == "" || t.Before(op.refused[oldest]) {
+				oldest = o
+			}
+		}
+		delete(op.refused, oldest)
+	}
+	op.refused[origin] = now
+	op.mu.Unlock()
+
+	op.pendingMu.Lock()
+	defer op.pendingMu.Unlock()
+	pending, err := readPendingOrigins()
+	if err != nil {
+		log.Printf("Error reading pending origins: %v", err)
+		return
+	}
+	found := false
+	for i := range pending {
+		if pending[i].Origin == origin {
+			pending[i].LastSeen = now
+			pending[i].Attempts++
+			found = true
+			if pending[i].Rejected {
+				return
+			}
+		}
+	}
+	if !found {
+		pending = append(pending, pendingOrigin{Origin: origin, FirstSeen: now, LastSeen: now, Attempts: 1})
+		if len(pending) > maxPendingOrigins {
+			sort.Slice(pending, func(i, j int) bool { return pending[i].LastSeen.After(pending[j].LastSeen) })
+			for _, p := range pending[maxPendingOrigins:] {
+				log.Printf("[SECURITY] Too many pending origins; dropped %s", p.Origin)
+			}
+			pending = pending[:maxPendingOrigins]
+		}
+	}
+	log.Printf("[SECURITY] Origin %s is not allowed. Run 'conduit --pair' to approve it.", origin)
+	if err := writePendingOrigins(pending); err != nil {
+		log.Printf("Error saving pending origins: %v", err)
+	}
+}
+
+// --- Persistence ---
+
+func originsFilePath() (string, error) {
+	dir, err := conduitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, originsFileName), nil
+}
+
+func pendingOriginsFilePath() (string, error) {
+	dir, err := conduitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, pendingOriginsFileName), nil
+}
+
+// readOriginList reads a JSON array of origin patterns. A missing file is not an error.
+func readOriginList(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// saveApprovedOrigin adds an origin pattern to the origins file.
+func saveApprovedOrigin(origin string) error {
+	if _, err := parseOriginPattern(origin); err != nil {
+		return err
+	}
+	path, err := originsFilePath()
+	if err != nil {
+		return err
+	}
+	list, err := readOriginList(path)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	for _, existing := range list {
+		if existing == origin {
+			return nil
+		}
+	}
+	data, _ := json.MarshalIndent(append(list, origin), "", "  ")
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+func writePendingOrigins(list []pendingOrigin) error {
+	path, err := pendingOriginsFilePath()
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].FirstSeen.Before(list[j].FirstSeen) })
+	data, _ := json.MarshalIndent(list, "", "  ")
+	return ioutil.WriteFile(path, append(data, '\n'), 0600)
+}
+
+func readPendingOrigins() ([]pendingOrigin, error) {
+	path, err := pendingOriginsFilePath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []pendingOrigin
+	err = json.Unmarshal(data, &list)
+	return list, err
+}
+
+// --- Pairing CLI ---
+
+// pairOrigins handles --pair. It walks through origins that were refused by a
+// running server and asks whether each should be allowed from now on.
+func pairOrigins() error {
+	pending, err := readPendingOrigins()
+	if err != nil {
+		return fmt.Errorf("reading pending origins: %w", err)
+	}
+	waiting := 0
+	for _, p := range pending {
+		if !p.Rejected {
+			waiting++
+		}
+	}
+	if waiting == 0 {
+		fmt.Println("No origins are waiting for approval. Open the editor and try connecting, then run --pair again.")
+		return nil
+	}
+	reader := bufio.NewReader(os.Stdin)
+	var remaining []pendingOrigin
+	for _, p := range pending {
+		if p.Rejected {
+			remaining = append(remaining, p)
+			continue
+		}
+		fmt.Printf("\n%s\n  first seen %s, %d attempt(s)\nAllow this origin to control terminals and files? [y/N] ",
+			p.Origin, p.FirstSeen.Local().Format(time.RFC1123), p.Attempts)
+		answer, _ := reader.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			if err := saveApprovedOrigin(p.Origin); err != nil {
+				return err
+			}
+			fmt.Printf("Approved %s\n", p.Origin)
+		case "n", "no":
+			fmt.Printf("Rejected %s\n", p.Origin)
+			p.Rejected = true
+			remaining = append(remaining, p)
+		default:
+			fmt.Println("Skipped.")
+			remaining = append(remaining, p)
+		}
+	}
+	return writePendingOrigins(remaining)
+}
+
+// approveOrigin handles --pair-origin, saving an origin without prompting.
+func approveOrigin(origin string) error {
+	if err := saveApprovedOrigin(origin); err != nil {
+		return err
+	}
+	pending, err := readPendingOrigins()
+	if err == nil {
+		kept := pending[:0]
+		for _, p := range pending {
+			if p.Origin != origin {
+				kept = append(kept, p)
+			}
+		}
+		writePendingOrigins(kept)
+	}
+	fmt.Printf("Approved %s\n", origin)
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// pasteSettings is the "paste" section of the config file.
+type pasteSettings struct {
+	MaxBytes     int    `json:"maxBytes"`     // largest paste accepted; 0 means no limit
+	ChunkBytes   int    `json:"chunkBytes"`   // largest single write to the PTY; 0 writes a paste at once
+	ChunkDelayMs int    `json:"chunkDelayMs"` // pause between chunks
+	Confirm      string `json:"confirm"`      // which pastes wait for the client's confirmPaste
+}
+
+// Values of pasteSettings.Confirm.
+const (
+	pasteConfirmNever       = "never"
+	pasteConfirmMultiline   = "multiline"   // any paste containing a line break
+	pasteConfirmUnbracketed = "unbracketed" // such pastes when the program hasn't enabled bracketed paste
+)
+
+func (s pasteSettings) validate() error {
+	if s.MaxBytes < 0 || s.ChunkBytes < 0 || s.ChunkDelayMs < 0 {
+		return fmt.Errorf("paste.maxBytes, paste.chunkBytes and paste.chunkDelayMs must not be negative")
+	}
+	switch s.Confirm {
+	case pasteConfirmNever, pasteConfirmMultiline, pasteConfirmUnbracketed:
+	default:
+		return fmt.Errorf("paste.confirm must be %q, %q or %q, not %q", pasteConfirmNever, pasteConfirmMultiline, pasteConfirmUnbracketed, s.Confirm)
+	}
+	return nil
+}
+
+// Bracketed paste markers. A program that enables mode 2004 receives pasted
+// text between them, and so can tell it from typing: a shell inserts a pasted
+// line break instead of running the command line.
+var (
+	pasteStart = []byte("\x1b[200~")
+	pasteEnd   = []byte("\x1b[201~")
+)
+
+var pasteIdCounter int32
+
+// pendingPaste is a paste held until the client confirms it.
+type pendingPaste struct {
+	id   int32
+	text []byte
+}
+
+// --- Input ---
+
+// setMode tracks the private modes a program sets in its output. Only
+// bracketed paste matters to the server.
+func (s *terminalSession) setMode(mode int, set bool) {
+	if mode == 2004 && s.bracketedPaste.Swap(set) != set && debugEnabled() {
+		log.Printf("[DEBUG] Session #%d: bracketed paste mode set to %v", s.id, set)
+	}
+}
+
+// writeInput writes typed input to the PTY. Typing interrupts a paste in
+// progress, as Ctrl-C should: the rest of it, and any pastes waiting behind
+// it, are dropped. A bracketed paste is ended first, so the program doesn't
+// take the input as pasted.
+func (s *terminalSession) writeInput(p []byte) {
+	s.pasteGen.Add(1)
+	s.inputMu.Lock()
+	defer s.inputMu.Unlock()
+	if s.pasteOpen {
+		s.pasteOpen = false
+		if _, err := s.ptmx.Write(pasteEnd); err != nil {
+			return
+		}
+	}
+	s.ptmx.Write(p)
+}
+
+// paste handles a "paste" message. Line breaks become carriage returns, as
+// the Enter key sends. If the configuration asks for it, the paste is held and
+// the client asked to confirm it with a pasteConfirm message.
+func (s *terminalSession) paste(c *sessionClient, content string) error {
+	cfg := currentConfig().Paste
+	if cfg.MaxBytes > 0 && len(content) > cfg.MaxBytes {
+		return fmt.Errorf("paste of %d bytes exceeds the limit of %d", len(content), cfg.MaxBytes)
+	}
+	text := []byte(strings.NewReplacer("\r\n", "\r", "\n", "\r").Replace(content))
+	if len(text) == 0 {
+		return nil
+	}
+	lines := bytes.Count(text, []byte("\r"))
+	bracketed := s.bracketedPaste.Load()
+	if lines > 0 && (cfg.Confirm == pasteConfirmMultiline || cfg.Confirm == pasteConfirmUnbracketed && !bracketed) {
+		c.pendingPaste = &pendingPaste{id: atomic.AddInt32(&pasteIdCounter, 1), text: text}
+		if text[len(text)-1] != '\r' {
+			lines++
+		}
+		c.sendJSON(wsMessage{Type: "pasteConfirm", Session: s.id, PasteID: c.pendingPaste.id, Lines: lines, Bytes: len(text), Bracketed: bracketed})
+		return nil
+	}
+	s.writePaste(text, cfg)
+	return nil
+}
+
+// confirmPaste handles a "confirmPaste" message, writing or dropping the
+// client's held paste. A client has at most one: a newer paste replaces it.
+func (s *terminalSession) confirmPaste(c *sessionClient, id int32, confirmed bool) error {
+	p := c.pendingPaste
+	if p == nil || p.id != id {
+		return fmt.Errorf("paste %d is not awaiting confirmation", id)
+	}
+	c.pendingPaste = nil
+	if confirmed {
+		s.writePaste(p.text, currentConfig().Paste)
+	}
+	return nil
+}
+
+// writePaste writes pasted text to the PTY, wrapped in bracketed paste
+// markers if the program has enabled them. Large pastes are written in
+// chunks with a pause between them, so the terminal's input queue doesn't
+// overflow and programs reading slowly keep up. The paste is written by its
+// own goroutine, after any earlier paste, so the client's other messages
+// aren't held up behind it.
+func (s *terminalSession) writePaste(text []byte, cfg pasteSettings) {
+	bracketed := s.bracketedPaste.Load()
+	if bracketed {
+		// An end marker inside the text would let the rest of it run as if
+		// typed. Removing one can join the bytes around it into another.
+		if bytes.Contains(text, pasteEnd) || bytes.Contains(text, pasteStart) {
+			log.Printf("[SECURITY] Session #%d: removed bracketed paste markers from pasted text", s.id)
+			for bytes.Contains(text, pasteEnd) || bytes.Contains(text, pasteStart) {
+				text = bytes.ReplaceAll(bytes.ReplaceAll(text, pasteEnd, nil), pasteStart, nil)
+			}
+		}
+	}
+	gen := s.pasteGen.Load()
+	done := make(chan struct{})
+	s.mu.Lock()
+	prev := s.pasteDone
+	s.pasteDone = done
+	s.mu.Unlock()
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		for len(text) > 0 {
+			n := len(text)
+			if cfg.ChunkBytes > 0 && n > cfg.ChunkBytes {
+				n = cfg.ChunkBytes
+				// Don't split a UTF-8 sequence.
+				for n > 1 && !utf8.RuneStart(text[n]) {
+					n--
+				}
+			}
+			if !s.writePasteChunk(text[:n], gen, bracketed, n == len(text)) {
+				return
+			}
+			text = text[n:]
+			if len(text) > 0 && cfg.ChunkDelayMs > 0 {
+				time.Sleep(time.Duration(cfg.ChunkDelayMs) * time.Millisecond)
+			}
+		}
+	}()
+}
+
+// writePasteChunk writes part of a paste, with the start marker before the
+// first and the end marker after the last if it is bracketed. Input is held
+// only for the chunk, so typing can interrupt between chunks. It reports
+// false if the paste was cancelled or the PTY has closed.
+func (s *terminalSession) writePasteChunk(chunk []byte, gen int64, bracketed, last bool) bool {
+	s.inputMu.Lock()
+	defer s.inputMu.Unlock()
+	if s.pasteGen.Load() != gen {
+		return false
+	}
+	if bracketed && !s.pasteOpen {
+		if _, err := s.ptmx.Write(pasteStart); err != nil {
+			return false
+		}
+		s.pasteOpen = true
+	}
+	if _, err := s.ptmx.Write(chunk); err != nil {
+		return false
+	}
+	if bracketed && last {
+		s.pasteOpen = false
+		if _, err := s.ptmx.Write(pasteEnd); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePty records what is written to it. If hold is set, each write waits
+// to receive from it.
+type fakePty struct {
+	mu      sync.Mutex
+	written bytes.Buffer
+	calls   int // writes started
+	hold    chan struct{}
+}
+
+func (p *fakePty) Read([]byte) (int, error) { select {} }
+func (p *fakePty) Close() error             { return nil }
+
+func (p *fakePty) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	p.calls++
+	hold := p.hold
+	p.mu.Unlock()
+	if hold != nil {
+		<-hold
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.written.Write(b)
+}
+
+func (p *fakePty) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.written.String()
+}
+
+// waitPaste waits for the session's pastes to finish.
+func waitPaste(t *testing.T, s *terminalSession) {
+	t.Helper()
+	s.mu.Lock()
+	done := s.pasteDone
+	s.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("paste didn't finish")
+	}
+}
+
+// waitFor polls until cond holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestWritePaste(t *testing.T) {
+	tests := []struct {
+		name      string
+		bracketed bool
+		pastes    []string
+		chunk     int
+		want      string
+	}{
+		{"plain", false, []string{"ab\rcd"}, 0, "ab\rcd"},
+		{"bracketed", true, []string{"ab\rcd"}, 0, "\x1b[200~ab\rcd\x1b[201~"},
+		{"markers removed", true, []string{"a\x1b[201~b\x1b[20\x1b[201~1~c"}, 0, "\x1b[200~abc\x1b[201~"},
+		{"chunked", true, []string{"abcdefg"}, 3, "\x1b[200~abcdefg\x1b[201~"},
+		{"chunks keep UTF-8 whole", false, []string{"aé€b"}, 3, "aé€b"},
+		{"in order", true, []string{"one", "two", "three"}, 2, "\x1b[200~one\x1b[201~\x1b[200~two\x1b[201~\x1b[200~three\x1b[201~"},
+	}
+	for _, tt := range tests {
+		pty := &fakePty{}
+		s := &terminalSession{ptmx: pty}
+		s.bracketedPaste.Store(tt.bracketed)
+		for _, text := range tt.pastes {
+			s.writePaste([]byte(text), pasteSettings{ChunkBytes: tt.chunk, ChunkDelayMs: 1})
+		}
+		waitPaste(t, s)
+		if got := pty.String(); got != tt.want {
+			t.Errorf("%s: wrote %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTypingInterruptsPaste(t *testing.T) {
+	pty := &fakePty{hold: make(chan struct{})}
+	s := &terminalSession{ptmx: pty}
+	s.bracketedPaste.Store(true)
+
+	// The paste is written by its own goroutine, so a stalled PTY doesn't
+	// hold up the caller.
+	returned := make(chan struct{})
+	go func() {
+		s.writePaste([]byte(strings.Repeat("x", 100)), pasteSettings{ChunkBytes: 10, ChunkDelayMs: 1})
+		s.writePaste([]byte("queued"), pasteSettings{})
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writePaste waited for the PTY")
+	}
+
+	// Let the start marker and the first chunk through, and type while the
+	// second is stalled.
+	pty.hold <- struct{}{}
+	pty.hold <- struct{}{}
+	waitFor(t, "the second chunk", func() bool {
+		pty.mu.Lock()
+		defer pty.mu.Unlock()
+		return pty.calls == 3
+	})
+	typed := make(chan struct{})
+	go func() {
+		s.writeInput([]byte("\x03"))
+		close(typed)
+	}()
+	waitFor(t, "the input", func() bool { return s.pasteGen.Load() != 0 })
+	close(pty.hold)
+	<-typed
+	waitPaste(t, s)
+
+	// The stalled chunk is written, but the rest of the paste and the one
+	// queued behind it are dropped, and the paste is ended before the input.
+	if got, want := pty.String(), "\x1b[200~"+strings.Repeat("x", 20)+"\x1b[201~\x03"; got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+	if s.pasteOpen {
+		t.Error("paste still open after the input")
+	}
+}
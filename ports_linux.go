@@ -0,0 +1,196 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tcpListen is the socket state of a listening socket in /proc/net/tcp.
+const tcpListen = "0A"
+
+// listeningPorts reads the listening TCP sockets from /proc/net/tcp and
+// tcp6. Only sockets reachable through loopback are reported: those bound to
+// a loopback or wildcard address.
+func listeningPorts() ([]listeningPort, bool, error) {
+	byPort := make(map[int]*listeningPort)
+	inodes := make(map[string]*listeningPort)
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // no IPv6
+			}
+			return nil, true, err
+		}
+		readProcNet(f, byPort, inodes)
+		f.Close()
+	}
+	findSocketOwners(inodes)
+
+	ports := make([]listeningPort, 0, len(byPort))
+	for _, p := range byPort {
+		ports = append(ports, *p)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports, true, nil
+}
+
+// readProcNet adds the listening sockets in a /proc/net/tcp or tcp6 table to
+// byPort, and those with an inode to inodes.
+func readProcNet(r io.Reader, byPort map[int]*listeningPort, inodes map[string]*listeningPort) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		ip, port, ok := parseProcNetAddr(fields[1])
+		if !ok || !(ip.IsLoopback() || ip.IsUnspecified()) {
+			continue
+		}
+		p := byPort[port]
+		if p == nil {
+			p = &listeningPort{Port: port}
+			byPort[port] = p
+		}
+		if addr := ip.String(); !slices.Contains(p.Addresses, addr) {
+			p.Addresses = append(p.Addresses, addr)
+		}
+		if fields[9] != "0" {
+			inodes[fields[9]] = p
+		}
+	}
+}
+
+// parseProcNetAddr parses an address like "0100007F:0BB8": the IP in hex,
+// as 32-bit words in host (little-endian) order, and the port in hex.
+func parseProcNetAddr(s string) (net.IP, int, bool) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, false
+	}
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, false
+	}
+	for i := 0; i < len(raw); i += 4 {
+		raw[i], raw[i+1], raw[i+2], raw[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, 0, false
+	}
+	return net.IP(raw), int(port), true
+}
+
+// socketOwner is the process holding a socket; pid is 0 if none could be
+// found.
+type socketOwner struct {
+	pid  int
+	comm string
+}
+
+// socketOwners caches owners by socket inode. Finding them means reading
+// every process's fd directory, so that is only done when a listening
+// socket appears that hasn't been seen before.
+var socketOwners = struct {
+	sync.Mutex
+	byInode map[string]socketOwner
+}{byInode: make(map[string]socketOwner)}
+
+// findSocketOwners fills in the process owning each socket inode.
+// Processes of other users can't be read and are skipped.
+func findSocketOwners(inodes map[string]*listeningPort) {
+	socketOwners.Lock()
+	defer socketOwners.Unlock()
+	var unknown []string
+	for inode := range inodes {
+		if _, ok := socketOwners.byInode[inode]; !ok {
+			unknown = append(unknown, inode)
+		}
+	}
+	if len(unknown) > 0 {
+		found := scanSocketOwners(unknown)
+		for _, inode := range unknown {
+			socketOwners.byInode[inode] = found[inode]
+		}
+	}
+	for inode := range socketOwners.byInode {
+		if inodes[inode] == nil {
+			delete(socketOwners.byInode, inode) // closed
+		}
+	}
+	for inode, p := range inodes {
+		if owner := socketOwners.byInode[inode]; owner.pid != 0 && p.PID == 0 {
+			p.PID, p.Process = owner.pid, owner.comm
+		}
+	}
+}
+
+// scanSocketOwners looks through /proc/<pid>/fd for the given inodes.
+func scanSocketOwners(inodes []string) map[string]socketOwner {
+	want := make(map[string]bool, len(inodes))
+	for _, inode := range inodes {
+		want[inode] = true
+	}
+	found := make(map[string]socketOwner)
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return found
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			if _, seen := found[inode]; want[inode] && !seen {
+				comm, _ := os.ReadFile(filepath.Join("/proc", proc.Name(), "comm"))
+				found[inode] = socketOwner{pid: pid, comm: strings.TrimSpace(string(comm))}
+			}
+		}
+	}
+	return found
+}
+
+// parentPID returns a process's parent, or 0 if it can't be read.
+func parentPID(pid int) int {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0
+	}
+	// The command name in parentheses may contain spaces; the state and
+	// parent PID follow the last ")".
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
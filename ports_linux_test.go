@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProcNetAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		ip   string
+		port int
+		ok   bool
+	}{
+		{"0100007F:0BB8", "127.0.0.1", 3000, true},
+		{"00000000:1F90", "0.0.0.0", 8080, true},
+		{"0F02000A:0016", "10.0.2.15", 22, true},
+		{"00000000000000000000000001000000:1538", "::1", 5432, true},
+		{"00000000000000000000000000000000:0050", "::", 80, true},
+		{"0000000000000000FFFF00000100007F:0BB8", "127.0.0.1", 3000, true},
+		{"B80D0120000000000000000001000000:01BB", "2001:db8::1", 443, true},
+		{"0100007F", "", 0, false},
+		{"0100007G:0050", "", 0, false},
+		{"01007F:0050", "", 0, false},
+		{"0100007F:10000", "", 0, false},
+		{"0100007F:", "", 0, false},
+	}
+	for _, tt := range tests {
+		ip, port, ok := parseProcNetAddr(tt.addr)
+		if ok != tt.ok || ok && (ip.String() != tt.ip || port != tt.port) {
+			t.Errorf("parseProcNetAddr(%q) = %v, %d, %v; want %s, %d, %v", tt.addr, ip, port, ok, tt.ip, tt.port, tt.ok)
+		}
+	}
+}
+
+func TestReadProcNet(t *testing.T) {
+	const header = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	tcp := header +
+		"   0: 0100007F:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1001 1 0000000000000000 100 0 0 10 0\n" +
+		"   1: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1002 1 0000000000000000 100 0 0 10 0\n" +
+		"   2: 0100007F:0BB8 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 1003 1 0000000000000000 20 4 30 10 -1\n" +
+		"   3: 0F02000A:1389 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1004 1 0000000000000000 100 0 0 10 0\n"
+	tcp6 := header +
+		"   0: 00000000000000000000000001000000:1538 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 2001 1 0000000000000000 100 0 0 10 0\n" +
+		"   1: 0000000000000000FFFF00000100007F:0BB8 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 2002 1 0000000000000000 100 0 0 10 0\n" +
+		"   2: 00000000000000000000000000000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 100 0 0 10 0\n" +
+		"   3: B80D0120000000000000000001000000:01BB 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 2004 1 0000000000000000 100 0 0 10 0\n"
+
+	byPort := make(map[int]*listeningPort)
+	inodes := make(map[string]*listeningPort)
+	readProcNet(strings.NewReader(tcp), byPort, inodes)
+	readProcNet(strings.NewReader(tcp6), byPort, inodes)
+
+	// Established and non-loopback sockets are left out, and an IPv4-mapped
+	// tcp6 socket adds no second address.
+	want := map[int][]string{3000: {"127.0.0.1"}, 8080: {"0.0.0.0", "::"}, 5432: {"::1"}}
+	got := make(map[int][]string)
+	for port, p := range byPort {
+		got[port] = p.Addresses
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ports %v; want %v", got, want)
+	}
+	wantInodes := map[string]int{"1001": 3000, "1002": 8080, "2001": 5432, "2002": 3000}
+	gotInodes := make(map[string]int)
+	for inode, p := range inodes {
+		gotInodes[inode] = p.Port
+	}
+	if !reflect.DeepEqual(gotInodes, wantInodes) {
+		t.Errorf("inodes %v; want %v", gotInodes, wantInodes)
+	}
+}
+
+func TestSessionOfProcess(t *testing.T) {
+	child := exec.Command("sleep", "10")
+	if err := child.Start(); err != nil {
+		t.Skip(err)
+	}
+	defer func() {
+		child.Process.Kill()
+		child.Wait()
+	}()
+
+	sess := &terminalSession{id: 1}
+	tests := []struct {
+		name    string
+		pid     int
+		byShell map[int]*terminalSession
+		want    *terminalSession
+	}{
+		{"the shell itself", os.Getpid(), map[int]*terminalSession{os.Getpid(): sess}, sess},
+		{"a child", child.Process.Pid, map[int]*terminalSession{os.Getpid(): sess}, sess},
+		{"a grandchild", child.Process.Pid, map[int]*terminalSession{os.Getppid(): sess}, sess},
+		{"a parent", os.Getppid(), map[int]*terminalSession{os.Getpid(): sess}, nil},
+		{"init", 1, map[int]*terminalSession{1: sess}, nil},
+		{"no such process", -1, map[int]*terminalSession{os.Getpid(): sess}, nil},
+	}
+	for _, tt := range tests {
+		if got := sessionOfProcess(tt.pid, tt.byShell); got != tt.want {
+			t.Errorf("%s: %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
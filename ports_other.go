@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+// listeningPorts isn't implemented on this platform: GET /ports reports
+// supported: false, and ports can still be forwarded by number.
+func listeningPorts() ([]listeningPort, bool, error) {
+	return nil, false, nil
+}
+
+// parentPID isn't needed where ports aren't detected.
+func parentPID(pid int) int {
+	return 0
+}
@@ -4,16 +4,20 @@ package main
 
 import (
 	"io"
+	"os"
 	"os/exec"
+	"syscall"
 
 	"github.com/creack/pty"
 )
 
 // startPty returns an io.ReadWriteCloser and the *exec.Cmd for the PTY process.
-func startPty(shell string, homeDir string) (io.ReadWriteCloser, *exec.Cmd, func(cols, rows int), error) {
-	c := exec.Command(shell)
+// extraEnv entries are "NAME=value" pairs added to the shell's environment.
+func startPty(shell string, args []string, extraEnv []string, homeDir string) (io.ReadWriteCloser, *exec.Cmd, func(cols, rows int), error) {
+	c := exec.Command(shell, args...)
 	c.Dir = homeDir
 	c.Env = append(c.Env, "TERM=xterm-256color")
+	c.Env = append(c.Env, extraEnv...)
 
 	if shell == "bash" || shell == "zsh" {
 		c.Env = append(c.Env, `PROMPT_COMMAND=printf "\033]9;9;%s\033\\" "${PWD}"`)
@@ -31,3 +35,37 @@ func startPty(shell string, homeDir string) (io.ReadWriteCloser, *exec.Cmd, func
 
 	return ptmx, c, resizeFunc, nil
 }
+
+// startPtyCommand runs a program rather than a shell in a new PTY, with
+// extraEnv added to the server's environment.
+func startPtyCommand(argv []string, extraEnv []string, dir string) (io.ReadWriteCloser, *exec.Cmd, func(cols, rows int), error) {
+	c := exec.Command(argv[0], argv[1:]...)
+	c.Dir = dir
+	c.Env = append(os.Environ(), "TERM=xterm-256color")
+	c.Env = append(c.Env, extraEnv...)
+	ptmx, err := pty.Start(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	resizeFunc := func(cols, rows int) {
+		pty.Setsize(ptmx, &pty.Winsize{Cols: uint16(cols), Rows: uint16(rows)})
+	}
+	return ptmx, c, resizeFunc, nil
+}
+
+// hangupPty sends SIGHUP to the shell's process group, as the kernel would when
+// a real terminal closes, giving the shell and its jobs a chance to exit cleanly.
+// pty.Start makes the shell a session leader, so its PID is also its group ID.
+func hangupPty(c *exec.Cmd, ptmx io.Closer) {
+	if c.Process != nil {
+		syscall.Kill(-c.Process.Pid, syscall.SIGHUP)
+	}
+}
+
+// killPty forcibly ends the shell's process group and closes the PTY.
+func killPty(c *exec.Cmd, ptmx io.Closer) {
+	if c.Process != nil {
+		syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	ptmx.Close()
+}
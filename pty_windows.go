@@ -7,17 +7,23 @@ import (
 	"os/exec"
 	"log"
 	"strings"
+	"syscall"
 	"github.com/UserExistsError/conpty"
 )
 
 // startPty returns an io.ReadWriteCloser and the *exec.Cmd for the PTY process.
 // On modern Windows, this automatically uses the native ConPTY API.
-func startPty(shell string, homeDir string) (io.ReadWriteCloser, *exec.Cmd, func(cols, rows int), error) {
+// extraEnv entries are "NAME=value" pairs set in the shell once it starts.
+func startPty(shell string, args []string, extraEnv []string, homeDir string) (io.ReadWriteCloser, *exec.Cmd, func(cols, rows int), error) {
 	// We create a placeholder exec.Cmd. The conpty library starts the process,
 	// but does not expose the underlying *os.Process object.
 	// Therefore, ptyCmd.Process will be nil. This is handled in handlers.go.
-	ptyCmd := exec.Command(shell)
-	p, err := conpty.Start(shell)
+	ptyCmd := exec.Command(shell, args...)
+	commandLine := shell
+	for _, arg := range args {
+		commandLine += " " + syscall.EscapeArg(arg)
+	}
+	p, err := conpty.Start(commandLine)
 	if err != nil {
 		log.Printf("ERROR: Failed to create ConPTY: %v", err)
 		return nil, nil, nil, err
@@ -29,12 +35,48 @@ func startPty(shell string, homeDir string) (io.ReadWriteCloser, *exec.Cmd, func
 		p.Resize(cols, rows) // Call the Resize method of the *Pty object
 	}
 
-	// Workaround for starting in the correct directory.
-	if strings.HasSuffix(strings.ToLower(shell), "powershell.exe") {
+	// Workaround for starting in the correct directory and environment,
+	// since the process is started with the server's own.
+	isPowerShell := strings.HasSuffix(strings.ToLower(shell), "powershell.exe") || strings.HasSuffix(strings.ToLower(shell), "pwsh.exe")
+	for _, kv := range extraEnv {
+		name, value, _ := strings.Cut(kv, "=")
+		if isPowerShell {
+			ptmx.Write([]byte("$env:" + name + " = '" + strings.ReplaceAll(value, "'", "''") + "'\r\n"))
+		} else {
+			ptmx.Write([]byte("set \"" + name + "=" + value + "\"\r\n"))
+		}
+	}
+	if isPowerShell {
 		ptmx.Write([]byte("Set-Location -Path '" + homeDir + "'\r\n"))
 	} else { // Assume cmd.exe
 		ptmx.Write([]byte("cd /d \"" + homeDir + "\"\r\n"))
 	}
 
 	return ptmx, ptyCmd, resizeFunc, nil
-}
\ No newline at end of file
+}
+// startPtyCommand runs a program in a new PTY. ConPTY starts processes with
+// the server's own directory and environment, so the program is run from
+// cmd.exe after the same workaround as startPty, and cmd.exe exits with it.
+func startPtyCommand(argv []string, extraEnv []string, dir string) (io.ReadWriteCloser, *exec.Cmd, func(cols, rows int), error) {
+	ptmx, ptyCmd, resizeFunc, err := startPty("cmd.exe", nil, extraEnv, dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	commandLine := syscall.EscapeArg(argv[0])
+	for _, arg := range argv[1:] {
+		commandLine += " " + syscall.EscapeArg(arg)
+	}
+	ptmx.Write([]byte(commandLine + " & exit\r\n"))
+	return ptmx, ptyCmd, resizeFunc, nil
+}
+
+// hangupPty ends the shell. ConPTY has no hangup signal; closing the pseudo
+// console terminates the attached process tree.
+func hangupPty(c *exec.Cmd, ptmx io.Closer) {
+	ptmx.Close()
+}
+
+// killPty forcibly ends the shell.
+func killPty(c *exec.Cmd, ptmx io.Closer) {
+	ptmx.Close()
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Recordings are written in asciicast v2 format
+// (https://docs.asciinema.org/manual/asciicast/v2/): a JSON header line
+// followed by one [time, type, data] event per line.
+const castExtension = ".cast"
+const castVersion = 2
+const replayMaxSpeed = 100
+
+// recordingSettings configures session recording in config.json.
+type recordingSettings struct {
+	Dir           string `json:"dir,omitempty"` // defaults to recordings/ in the config directory
+	AutoStart     bool   `json:"autoStart"`     // record every new session
+	MaxBytes      int64  `json:"maxBytes"`      // a recording stops at this size; 0 means no limit
+	MaxTotalBytes int64  `json:"maxTotalBytes"` // the oldest recordings are deleted to stay under this; 0 means no limit
+}
+
+func (s recordingSettings) validate() error {
+	if s.MaxBytes < 0 || s.MaxTotalBytes < 0 {
+		return fmt.Errorf("recording.maxBytes and recording.maxTotalBytes must not be negative")
+	}
+	if s.MaxTotalBytes > 0 && (s.MaxBytes == 0 || s.MaxBytes > s.MaxTotalBytes) {
+		return fmt.Errorf("recording.maxBytes must be set, and no larger than recording.maxTotalBytes")
+	}
+	return nil
+}
+
+// recordingDir returns the directory recordings are written to, creating it
+// if needed.
+func recordingDir() (string, error) {
+	dir := currentConfig().Recording.Dir
+	if dir == "" {
+		configDir, err := conduitConfigDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(configDir, "recordings")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating %s: %w", dir, err)
+	}
+	return dir, nil
+}
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// castRecorder appends events to an open asciicast file. Only output and
+// resizes are recorded; input is left out so typed passwords never reach disk.
+type castRecorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	name    string
+	start   time.Time
+	pending []byte // incomplete UTF-8 sequence held back from the last output
+	size    int64
+	limit   int64 // recording.maxBytes when the recording started
+	full    bool  // an event didn't fit under limit
+}
+
+func newCastRecorder(name string, header castHeader) (*castRecorder, error) {
+	dir, err := recordingDir()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	line, _ := json.Marshal(header)
+	n, err := f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &castRecorder{file: f, name: name, start: time.Now(), size: int64(n), limit: currentConfig().Recording.MaxBytes}, nil
+}
+
+// event writes one event line, unless it would take the file past the limit.
+// The caller holds r.mu.
+func (r *castRecorder) event(kind, data string) {
+	if r.full {
+		return
+	}
+	elapsed := float64(time.Since(r.start).Microseconds()) / 1e6
+	line, _ := json.Marshal([]interface{}{elapsed, kind, data})
+	if r.limit > 0 && r.size+int64(len(line))+1 > r.limit {
+		r.full = true
+		return
+	}
+	n, err := r.file.Write(append(line, '\n'))
+	r.size += int64(n)
+	if err != nil {
+		log.Printf("Recording %s: write failed: %v", r.name, err)
+	}
+}
+
+// output records PTY output. Event data must be valid UTF-8, so a multi-byte
+// character split across two reads is held back until the rest arrives. It
+// reports false once the recording has reached its size limit.
+func (r *castRecorder) output(p []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.pending, p...)
+	cut := completeUTF8Len(data)
+	r.pending = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		r.event("o", string(data[:cut]))
+	}
+	return !r.full
+}
+
+// completeUTF8Len returns the length of data without any incomplete UTF-8
+// sequence at its end, so output read in chunks can be sent as valid strings.
+func completeUTF8Len(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(data)
+}
+
+func (r *castRecorder) resize(cols, rows int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.event("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *castRecorder) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.pending) > 0 {
+		r.event("o", string(r.pending))
+		r.pending = nil
+	}
+	return r.file.Close()
+}
+
+// --- Session Integration ---
+
+// startRecording begins recording the session to a new file and returns its
+// name. It does nothing if the session is already being recorded.
+func (s *terminalSession) startRecording() (string, error) {
+	if name := s.recordingName(); name != "" {
+		return name, nil
+	}
+	// Make room before taking s.recMu: it looks at every session's recording.
+	if err := makeRoomForRecording(); err != nil {
+		audit.record(auditEntry{Action: "recording.start", Session: s.id}.from(s.owner).withError(err))
+		return "", err
+	}
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	if s.rec != nil {
+		return s.rec.name, nil
+	}
+	now := time.Now()
+	name := fmt.Sprintf("session-%d-%s%s", s.id, now.Format("20060102-150405"), castExtension)
+	hostname, _ := os.Hostname()
+	rec, err := newCastRecorder(name, castHeader{
+		Version:   castVersion,
+		Width:     s.cols,
+		Height:    s.rows,
+		Timestamp: now.Unix(),
+		Title:     fmt.Sprintf("Conduit session #%d on %s", s.id, hostname),
+		Env:       map[string]string{"SHELL": s.cmd.Path, "TERM": "xterm-256color"},
+	})
+	if err != nil {
+		audit.record(auditEntry{Action: "recording.start", Session: s.id}.from(s.owner).withError(err))
+		return "", err
+	}
+	s.rec = rec
+	audit.record(auditEntry{Action: "recording.start", Session: s.id, Detail: name}.from(s.owner))
+	log.Printf("Session #%d: recording to %s", s.id, name)
+	return name, nil
+}
+
+// stopRecording finishes the session's recording, if there is one.
+func (s *terminalSession) stopRecording() {
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	if s.rec == nil {
+		return
+	}
+	err := s.rec.close()
+	audit.record(auditEntry{Action: "recording.stop", Session: s.id, Detail: s.rec.name}.from(s.owner).withError(err))
+	log.Printf("Session #%d: stopped recording %s", s.id, s.rec.name)
+	s.rec = nil
+}
+
+// errRecordingFull is reported to clients when a recording stops at
+// recording.maxBytes.
+var errRecordingFull = errors.New("the recording reached recording.maxBytes and was stopped")
+
+// recordingsMu serialises makeRoomForRecording, so recordings starting
+// together each count the others.
+var recordingsMu sync.Mutex
+
+// makeRoomForRecording deletes the oldest finished recordings until a new one
+// fits under recording.maxTotalBytes. Recordings still being written count
+// as recording.maxBytes, which they may grow to.
+func makeRoomForRecording() error {
+	cfg := currentConfig().Recording
+	if cfg.MaxTotalBytes == 0 {
+		return nil
+	}
+	recordingsMu.Lock()
+	defer recordingsMu.Unlock()
+	dir, err := recordingDir()
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	live := liveRecordings()
+	var finished []os.FileInfo
+	total := cfg.MaxBytes
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), castExtension) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if live[entry.Name()] {
+			total += max(info.Size(), cfg.MaxBytes)
+			continue
+		}
+		finished = append(finished, info)
+		total += info.Size()
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].ModTime().Before(finished[j].ModTime()) })
+	for _, info := range finished {
+		if total <= cfg.MaxTotalBytes {
+			break
+		}
+		err := os.Remove(filepath.Join(dir, info.Name()))
+		audit.record(auditEntry{Action: "recording.delete", Remote: "local", Detail: info.Name()}.withError(err))
+		if err != nil {
+			log.Printf("Could not delete recording %s: %v", info.Name(), err)
+			continue
+		}
+		log.Printf("Deleted recording %s to stay under recording.maxTotalBytes", info.Name())
+		total -= info.Size()
+	}
+	if total > cfg.MaxTotalBytes {
+		return fmt.Errorf("recordings in progress leave no room for another under recording.maxTotalBytes")
+	}
+	return nil
+}
+
+// liveRecordings returns the names of the recordings sessions are writing.
+func liveRecordings() map[string]bool {
+	live := make(map[string]bool)
+	for _, sess := range terminalSessions.list() {
+		if name := sess.recordingName(); name != "" {
+			live[name] = true
+		}
+	}
+	return live
+}
+
+// recordingName returns the file the session is being recorded to, or "".
+func (s *terminalSession) recordingName() string {
+	s.recMu.Lock()
+	defer s.recMu.Unlock()
+	if s.rec == nil {
+		return ""
+	}
+	return s.rec.name
+}
+
+// recordOutput passes PTY output to the recorder, if the session is recording.
+// A recording that reaches recording.maxBytes is stopped, and the clients told.
+func (s *terminalSession) recordOutput(p []byte) {
+	s.recMu.Lock()
+	rec := s.rec
+	s.recMu.Unlock()
+	if rec == nil || rec.output(p) {
+		return
+	}
+	log.Printf("Session #%d: recording %s reached recording.maxBytes", s.id, rec.name)
+	s.recMu.Lock()
+	current := s.rec == rec
+	s.recMu.Unlock()
+	if current {
+		s.stopRecording()
+		s.broadcastJSON(s.recordingState(errRecordingFull))
+	}
+}
+
+// setSize resizes the PTY and remembers the size for recording headers and
+// resize events.
+func (s *terminalSession) setSize(cols, rows int) {
+	if s.resize != nil {
+		s.resize(cols, rows)
+	}
+	s.recMu.Lock()
+	s.cols, s.rows = cols, rows
+	rec := s.rec
+	s.recMu.Unlock()
+	if rec != nil {
+		rec.resize(cols, rows)
+	}
+}
+
+// recordingState builds the reply to a "record" control message.
+func (s *terminalSession) recordingState(err error) wsMessage {
+	name := s.recordingName()
+	msg := wsMessage{Type: "recordingState", Enabled: name != "", File: name}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	return msg
+}
+
+// --- REST and Replay Endpoints ---
+
+// recordingInfo describes a recording in the /recordings listing.
+type recordingInfo struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"modTime"`   // Unix timestamp
+	Recording bool   `json:"recording"` // still being written by a live session
+}
+
+// recordingsHandler serves:
+//
+//	GET /recordings                 list recordings, newest first
+//	GET /recordings/<name>          download a recording
+//	GET /recordings/<name>/replay   replay a recording over a terminal websocket
+func recordingsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/recordings"), "/")
+	replay := strings.HasSuffix(name, "/replay")
+	name = strings.TrimSuffix(name, "/replay")
+
+	if replay && websocket.IsWebSocketUpgrade(r) {
+		replayHandler(w, r, name)
+		return
+	}
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if replay {
+		http.Error(w, "Replay requires a WebSocket connection", http.StatusBadRequest)
+		return
+	}
+	if name == "" {
+		listRecordings(w)
+		return
+	}
+
+	path, err := recordingPath(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.record(auditEntry{Action: "recording.download", Detail: name}.from(who))
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, stat.ModTime(), f)
+}
+
+// recordingPath validates a recording name and returns its path. Names are
+// bare file names, so they can't reach outside the recordings directory.
+func recordingPath(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`) || !strings.HasSuffix(name, castExtension) {
+		return "", fmt.Errorf("invalid recording name %q", name)
+	}
+	dir, err := recordingDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func listRecordings(w http.ResponseWriter) {
+	dir, err := recordingDir()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	live := liveRecordings()
+	list := []recordingInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), castExtension) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, recordingInfo{
+			Name:      entry.Name(),
+			Size:      info.Size(),
+			ModTime:   info.ModTime().Unix(),
+			Recording: live[entry.Name()],
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ModTime > list[j].ModTime })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// replayHandler streams a recording to a websocket using the terminal
+// protocol: output as raw text messages and resizes as "resize" control
+// messages. ?speed= scales playback (default 1) and ?idleLimit= caps pauses,
+// in seconds, before scaling.
+func replayHandler(w http.ResponseWriter, r *http.Request, name string) {
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	params := r.URL.Query()
+	speed := 1.0
+	if v := params.Get("speed"); v != "" {
+		s, err := strconv.ParseFloat(v, 64)
+		if err != nil || s <= 0 || s > replayMaxSpeed {
+			http.Error(w, fmt.Sprintf("speed must be a number between 0 and %d", replayMaxSpeed), http.StatusBadRequest)
+			return
+		}
+		speed = s
+	}
+	var idleLimit float64
+	if v := params.Get("idleLimit"); v != "" {
+		l, err := strconv.ParseFloat(v, 64)
+		if err != nil || l < 0 {
+			http.Error(w, "idleLimit must be a non-negative number of seconds", http.StatusBadRequest)
+			return
+		}
+		idleLimit = l
+	}
+	path, err := recordingPath(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	ws, err := upgradeAuthorized(w, r, "replay")
+	if err != nil {
+		log.Printf("Replay WS upgrade failed: %v", err)
+		return
+	}
+	defer ws.Close()
+	audit.record(auditEntry{Action: "recording.replay", Detail: name}.from(who))
+
+	// Client messages are ignored during replay; reading is only how we learn
+	// that the client has gone away.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := replayCast(ws, f, speed, idleLimit, done); err != nil {
+		log.Printf("Replay of %s stopped: %v", name, err)
+		ws.closeWithReason(websocket.CloseInternalServerErr, "replayFailed")
+		return
+	}
+	ws.closeWithReason(websocket.CloseNormalClosure, "replayFinished")
+}
+
+// replayCast plays the events in an asciicast file to ws until the file ends
+// or done is closed.
+func replayCast(ws *wsConn, f *os.File, speed, idleLimit float64, done <-chan struct{}) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	if !scanner.Scan() {
+		return fmt.Errorf("empty recording")
+	}
+	var header castHeader
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Version != castVersion {
+		return fmt.Errorf("not an asciicast v2 file")
+	}
+	if header.Width > 0 && header.Height > 0 {
+		ws.WriteJSON(wsMessage{Type: "resize", Cols: header.Width, Rows: header.Height})
+	}
+
+	var last float64
+	for scanner.Scan() {
+		var event []json.RawMessage
+		var at float64
+		var kind, data string
+		if json.Unmarshal(scanner.Bytes(), &event) != nil || len(event) != 3 ||
+			json.Unmarshal(event[0], &at) != nil || json.Unmarshal(event[1], &kind) != nil || json.Unmarshal(event[2], &data) != nil {
+			continue // skip malformed lines rather than abandon the replay
+		}
+		delay := at - last
+		if idleLimit > 0 && delay > idleLimit {
+			delay = idleLimit
+		}
+		last = at
+		if delay > 0 {
+			timer := time.NewTimer(time.Duration(delay / speed * float64(time.Second)))
+			select {
+			case <-timer.C:
+			case <-done:
+				timer.Stop()
+				return nil
+			}
+		}
+
+		var err error
+		switch kind {
+		case "o":
+			err = ws.WriteMessage(websocket.TextMessage, []byte(data))
+		case "r":
+			var cols, rows int
+			if _, scanErr := fmt.Sscanf(data, "%dx%d", &cols, &rows); scanErr == nil {
+				err = ws.WriteJSON(wsMessage{Type: "resize", Cols: cols, Rows: rows})
+			}
+		}
+		if err != nil {
+			return nil // the client went away
+		}
+	}
+	return scanner.Err()
+}
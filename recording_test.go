@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCastRecorderLimit(t *testing.T) {
+	dir := t.TempDir()
+	withConfig(t, func(cfg *conduitConfig) {
+		cfg.Recording = recordingSettings{Dir: dir, MaxBytes: 200}
+	})
+	rec, err := newCastRecorder("limit.cast", castHeader{Version: 2, Width: 80, Height: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := 0
+	for rec.output([]byte(strings.Repeat("x", 20))) {
+		if writes++; writes > 100 {
+			t.Fatal("output never reported the limit")
+		}
+	}
+	rec.resize(100, 30)
+	if err := rec.close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "limit.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 200 || writes == 0 {
+		t.Errorf("%d bytes after %d writes; want some, up to 200", info.Size(), writes)
+	}
+}
+
+func TestMakeRoomForRecording(t *testing.T) {
+	tests := []struct {
+		name  string
+		sizes []int64 // finished recordings, oldest first
+		total int64
+		kept  []string
+		ok    bool
+	}{
+		{"room already", []int64{100, 100}, 1000, []string{"0.cast", "1.cast"}, true},
+		{"oldest deleted", []int64{300, 300, 300}, 1000, []string{"1.cast", "2.cast"}, true},
+		{"all deleted", []int64{900, 900}, 1000, []string{}, true},
+		{"unlimited", []int64{900, 900}, 0, []string{"0.cast", "1.cast"}, true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		withConfig(t, func(cfg *conduitConfig) {
+			cfg.Recording = recordingSettings{Dir: dir, MaxBytes: 400, MaxTotalBytes: tt.total}
+		})
+		start := time.Now().Add(-time.Hour)
+		for i, size := range tt.sizes {
+			name := filepath.Join(dir, string(rune('0'+i))+".cast")
+			if err := os.WriteFile(name, make([]byte, size), 0600); err != nil {
+				t.Fatal(err)
+			}
+			os.Chtimes(name, start.Add(time.Duration(i)*time.Minute), start.Add(time.Duration(i)*time.Minute))
+		}
+		os.WriteFile(filepath.Join(dir, "notes.txt"), make([]byte, 5000), 0600)
+
+		err := makeRoomForRecording()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v; want ok %v", tt.name, err, tt.ok)
+		}
+		entries, _ := os.ReadDir(dir)
+		kept := []string{}
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), castExtension) {
+				kept = append(kept, e.Name())
+			}
+		}
+		sort.Strings(kept)
+		if !reflect.DeepEqual(kept, tt.kept) {
+			t.Errorf("%s: kept %q; want %q", tt.name, kept, tt.kept)
+		}
+	}
+}
+
+func TestRecordingSettingsValidate(t *testing.T) {
+	tests := []struct {
+		settings recordingSettings
+		ok       bool
+	}{
+		{recordingSettings{}, true},
+		{recordingSettings{MaxBytes: 100}, true},
+		{recordingSettings{MaxBytes: 100, MaxTotalBytes: 1000}, true},
+		{recordingSettings{MaxBytes: -1}, false},
+		{recordingSettings{MaxBytes: 100, MaxTotalBytes: -1}, false},
+		{recordingSettings{MaxTotalBytes: 1000}, false},
+		{recordingSettings{MaxBytes: 2000, MaxTotalBytes: 1000}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.settings.validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: error %v; want ok %v", tt.settings, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// scrollbackSettings is the "scrollback" section of the config file.
+type scrollbackSettings struct {
+	MaxBytes int  `json:"maxBytes"` // raw output kept per session; 0 keeps none
+	Snapshot bool `json:"snapshot"` // emulate the screen, and replay it instead of raw output
+}
+
+// --- Scrollback Buffer ---
+
+// ringBuffer keeps the last len(data) bytes written to it.
+type ringBuffer struct {
+	data    []byte
+	start   int   // index of the oldest byte
+	size    int   // bytes held
+	wrapped bool  // older output has been dropped
+	written int64 // bytes ever written
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{data: make([]byte, capacity)}
+}
+
+func (rb *ringBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	rb.written += int64(n)
+	if len(p) >= len(rb.data) {
+		p = p[len(p)-len(rb.data):]
+		copy(rb.data, p)
+		rb.start, rb.size, rb.wrapped = 0, len(rb.data), true
+		return n, nil
+	}
+	end := (rb.start + rb.size) % len(rb.data)
+	copied := copy(rb.data[end:], p)
+	copy(rb.data, p[copied:])
+	rb.size += len(p)
+	if over := rb.size - len(rb.data); over > 0 {
+		rb.start = (rb.start + over) % len(rb.data)
+		rb.size = len(rb.data)
+		rb.wrapped = true
+	}
+	return n, nil
+}
+
+// Bytes returns the buffered output, oldest first. Once older output has been
+// dropped, the buffer may begin in the middle of a line or escape sequence,
+// so the first partial line is left out.
+func (rb *ringBuffer) Bytes() []byte {
+	out := make([]byte, 0, rb.size)
+	first := rb.data[rb.start:min(rb.start+rb.size, len(rb.data))]
+	out = append(out, first...)
+	out = append(out, rb.data[:rb.size-len(first)]...)
+	if rb.wrapped {
+		if i := bytes.IndexByte(out, '\n'); i >= 0 {
+			out = out[i+1:]
+		}
+	}
+	return out
+}
+
+// --- Session History ---
+
+// setupHistory prepares the session's scrollback according to the config.
+func (s *terminalSession) setupHistory(cfg scrollbackSettings) {
+	if cfg.MaxBytes > 0 {
+		s.scrollback = newRingBuffer(cfg.MaxBytes)
+	}
+	if cfg.Snapshot {
+		s.screen = newVTEmulator(s.cols, s.rows, vtHistoryLines)
+	}
+}
+
+// keepOutput adds PTY output to the session's history. The caller holds s.mu.
+func (s *terminalSession) keepOutput(p []byte) {
+	if s.scrollback != nil {
+		s.scrollback.Write(p)
+	}
+	if s.screen != nil {
+		s.screen.Write(p)
+	}
+}
+
+// replay returns what to send a client attaching to the session so its
+// terminal shows what the others do, and whether it is a "snapshot" or raw
+// "scrollback". The caller holds s.mu.
+func (s *terminalSession) replay() ([]byte, string) {
+	if s.screen != nil {
+		return s.screen.snapshot(), "snapshot"
+	}
+	if s.scrollback != nil && s.scrollback.size > 0 {
+		return s.scrollback.Bytes(), "scrollback"
+	}
+	return nil, ""
+}
+
+// sendReplay queues the session's history for a client as output. The
+// caller holds s.mu, so no live output is queued for the client before it.
+func (s *terminalSession) sendReplay(c *sessionClient, data []byte) {
+	if len(data) > 0 {
+		c.send(websocket.TextMessage, data)
+	}
+}
+
+// --- Detached Sessions ---
+
+// endWhenDetached ends a session that has no clients left: at once, or
+// after the configured grace period so a client can reconnect, e.g. after a
+// page reload.
+func (s *terminalSession) endWhenDetached() {
+	grace := time.Duration(currentConfig().DetachGraceSeconds) * time.Second
+	if grace <= 0 || isShuttingDown() {
+		s.end()
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended || len(s.clients) > 0 {
+		return
+	}
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+	}
+	log.Printf("Session #%d has no clients; ending it in %s unless one attaches", s.id, grace)
+	s.detachTimer = time.AfterFunc(grace, func() {
+		s.mu.Lock()
+		idle := len(s.clients) == 0
+		s.mu.Unlock()
+		if idle {
+			s.end()
+		}
+	})
+}
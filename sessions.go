@@ -0,0 +1,780 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- WebSocket Connections ---
+
+// wsWriteTimeout bounds a single websocket write, so a peer that stops
+// reading can't block its writer forever.
+const wsWriteTimeout = 10 * time.Second
+
+// wsConn serialises writes to a websocket connection. gorilla/websocket allows
+// only one concurrent writer, and several goroutines (PTY output, control
+// replies, file notifications, shutdown notices) may write to the same socket.
+// It also counts the bytes sent and received for the /metrics endpoint.
+type wsConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+	channel string // metrics label: "terminal", "files" or "replay"
+}
+
+func newWSConn(c *websocket.Conn, channel string) *wsConn {
+	return &wsConn{Conn: c, channel: channel}
+}
+
+func (c *wsConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// Keep the trailing newline websocket.Conn.WriteJSON would send.
+	return c.WriteMessage(websocket.TextMessage, append(data, '\n'))
+}
+
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	err := c.Conn.WriteMessage(messageType, data)
+	if err == nil {
+		countBytes(c.channel, "out", len(data))
+	}
+	return err
+}
+
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	messageType, data, err := c.Conn.ReadMessage()
+	countBytes(c.channel, "in", len(data))
+	return messageType, data, err
+}
+
+func (c *wsConn) ReadJSON(v interface{}) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// closeWithReason sends a close frame and closes the connection.
+func (c *wsConn) closeWithReason(code int, reason string) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	c.Close()
+}
+
+// connSet tracks open websocket connections of one kind, so they can all be
+// notified when the server shuts down.
+type connSet struct {
+	mu    sync.Mutex
+	conns map[*wsConn]bool
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[*wsConn]bool)}
+}
+
+func (cs *connSet) add(c *wsConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.conns[c] = true
+}
+
+func (cs *connSet) remove(c *wsConn) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.conns, c)
+}
+
+func (cs *connSet) list() []*wsConn {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list := make([]*wsConn, 0, len(cs.conns))
+	for c := range cs.conns {
+		list = append(list, c)
+	}
+	return list
+}
+
+// --- Terminal Sessions ---
+
+// terminalSession is a running shell. It owns the PTY and fans its output out
+// to every attached client.
+type terminalSession struct {
+	id      int32
+	ptmx    io.ReadWriteCloser
+	cmd     *exec.Cmd
+	resize  func(cols, rows int)
+	started time.Time
+	owner   principal      // who opened the session
+	cwd     string         // the shell's initial working directory
+	output  *outputScanner // used only by writePump
+
+	// Shell integration state, used only by writePump.
+	shellNonce string        // carried by the integration script's C and D marks; "" without one
+	shellCwd   string        // last directory the shell reported
+	running    *shellCommand // the command running, between OSC 133 C and D
+
+	bracketedPaste atomic.Bool   // the program enabled mode 2004 (CSI ?2004h)
+	inputMu        sync.Mutex    // serialises writes to the PTY, so a paste isn't interleaved with other input
+	pasteOpen      bool          // a paste's start marker is written but not its end; guarded by inputMu
+	pasteGen       atomic.Int64  // advanced by typed input, which cancels the pastes before it
+	pasteDone      chan struct{} // closed once the latest paste is written or cancelled; guarded by mu
+
+	mu          sync.Mutex
+	clients     map[int32]*sessionClient
+	inputPolicy string                // inputFromAll or inputFromDriver
+	ports       map[int]listeningPort // ports the session's processes listen on
+	title       string                // set by the program with OSC 0 or 2
+	process     *foregroundProcess    // nil until known
+	scrollback  *ringBuffer           // recent raw output
+	screen      *vtEmulator           // the emulated screen, with scrollback.snapshot
+	detachTimer *time.Timer           // ends the session once it has had no clients for a while
+	ended       bool
+	endOnce     sync.Once
+
+	recMu      sync.Mutex
+	rec        *castRecorder // nil unless the session is being recorded
+	cols, rows int           // effective PTY size
+
+	searchMu      sync.Mutex
+	searchTexts   []string // the transcript's lines, as last searched
+	searchWritten int64    // scrollback.written when searchTexts was made
+}
+
+// pid returns the shell's process ID, or -1 where it isn't available (Windows).
+func (s *terminalSession) pid() int {
+	if s.cmd != nil && s.cmd.Process != nil {
+		return s.cmd.Process.Pid
+	}
+	return -1
+}
+
+// hangup asks the shell and everything started from it to exit, as closing a
+// real terminal would.
+func (s *terminalSession) hangup() {
+	hangupPty(s.cmd, s.ptmx)
+}
+
+// kill forcibly ends the shell's process group.
+func (s *terminalSession) kill() {
+	killPty(s.cmd, s.ptmx)
+}
+
+// end tears the session down once: the shell is killed, the PTY closed and
+// every client disconnected. It runs when the shell exits, when the last
+// client leaves, or during shutdown.
+func (s *terminalSession) end() {
+	s.endOnce.Do(func() {
+		s.mu.Lock()
+		s.ended = true
+		clients := s.clientList()
+		s.mu.Unlock()
+
+		terminalSessions.remove(s.id)
+		s.stopRecording()
+		// On Windows, s.cmd.Process can be nil because the conpty library
+		// doesn't expose it; closing the PTY ends the process there.
+		if s.cmd.Process != nil {
+			s.cmd.Process.Kill()
+		}
+		s.ptmx.Close()
+		if isShuttingDown() {
+			closeClients(clients, websocket.CloseGoingAway, "serverShutdown")
+		} else {
+			closeClients(clients, 0, "")
+		}
+
+		active := atomic.AddInt32(&activeConnections, -1)
+		audit.record(auditEntry{Action: "session.end", Session: s.id, Detail: time.Since(s.started).Round(time.Second).String()}.from(s.owner))
+		log.Printf("[%s] Session #%d (PID: %d) ended (active: %d)", time.Now().UTC().Format(time.RFC3339), s.id, s.pid(), active)
+	})
+}
+
+// --- Session Clients ---
+
+// Client modes. The driver is the client in charge of the session; there is at
+// most one. Read-only clients see output but can't type or change settings.
+const (
+	modeDriver      = "driver"
+	modeInteractive = "interactive"
+	modeReadOnly    = "readonly"
+)
+
+// Input policies decide which clients may type into the shell.
+const (
+	inputFromAll    = "all"    // every client except read-only ones
+	inputFromDriver = "driver" // only the driver
+)
+
+var clientIdCounter int32
+
+// clientQueueLength bounds the messages waiting to be sent to a session
+// client. A client that falls this far behind, e.g. on a stalled connection,
+// is disconnected rather than holding up the PTY and the other clients.
+const clientQueueLength = 256
+
+// clientFlushTimeout bounds how long a session that ends waits for its
+// clients to be sent what was queued for them.
+const clientFlushTimeout = time.Second
+
+// sessionClient is one websocket attached to a terminal session. Everything
+// the session sends it goes through its queue, so sending never blocks.
+type sessionClient struct {
+	id     int32
+	ws     *wsConn
+	who    principal
+	mode   string
+	joined time.Time
+
+	queue    chan queuedMessage
+	stop     chan struct{} // closed when the client detaches
+	done     chan struct{} // closed when writeLoop returns
+	stopOnce sync.Once
+	dropOnce sync.Once
+
+	// Guarded by the session's mu.
+	cols, rows         int // size the client asked for; 0 until it sends a resize
+	viewCols, viewRows int // size the client currently believes the PTY has
+
+	pendingPaste *pendingPaste // awaiting the client's confirmPaste; used only by its readPump
+}
+
+func newSessionClient(ws *wsConn, who principal, mode string) *sessionClient {
+	return &sessionClient{
+		id:     atomic.AddInt32(&clientIdCounter, 1),
+		ws:     ws,
+		who:    who,
+		mode:   mode,
+		joined: time.Now(),
+		queue:  make(chan queuedMessage, clientQueueLength),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+type queuedMessage struct {
+	messageType int
+	data        []byte
+	flushed     chan struct{} // if set, closed by writeLoop instead of writing
+}
+
+// send queues a message for the client. If the queue is full the client is
+// disconnected; its read loop then detaches it.
+func (c *sessionClient) send(messageType int, data []byte) {
+	select {
+	case c.queue <- queuedMessage{messageType: messageType, data: data}:
+	default:
+		c.dropOnce.Do(func() {
+			log.Printf("Client %d is not keeping up with its messages; disconnecting it", c.id)
+			c.ws.Close()
+		})
+	}
+}
+
+// sendJSON queues a control message for the client.
+func (c *sessionClient) sendJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	c.send(websocket.TextMessage, append(data, '\n'))
+}
+
+// flush waits until the messages queued so far have been written, the client
+// stops being written to, or timeout passes.
+func (c *sessionClient) flush(timeout time.Duration) {
+	flushed := make(chan struct{})
+	select {
+	case c.queue <- queuedMessage{flushed: flushed}:
+	default:
+		return // the queue is full, and the client being dropped
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-flushed:
+	case <-c.done:
+	case <-timer.C:
+	}
+}
+
+// closeClients closes the clients' websockets, with a close frame giving
+// reason if it isn't empty. Each client is first sent what was queued for it,
+// such as the shell's last output or the serverShutdown notice, for up to
+// clientFlushTimeout.
+func closeClients(clients []*sessionClient, code int, reason string) {
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *sessionClient) {
+			defer wg.Done()
+			c.flush(clientFlushTimeout)
+			if reason != "" {
+				c.ws.closeWithReason(code, reason)
+			} else {
+				c.ws.Close()
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+// writeLoop writes queued messages to the client's websocket until the client
+// detaches or a write fails.
+func (c *sessionClient) writeLoop() {
+	defer close(c.done)
+	for {
+		select {
+		case m := <-c.queue:
+			if m.flushed != nil {
+				close(m.flushed)
+				continue
+			}
+			if err := c.ws.WriteMessage(m.messageType, m.data); err != nil {
+				c.ws.Close()
+				return
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// clientInfo describes a client in presence messages.
+type clientInfo struct {
+	ID     int32     `json:"id"`
+	Mode   string    `json:"mode"`
+	Origin string    `json:"origin,omitempty"`
+	Remote string    `json:"remote,omitempty"`
+	Key    string    `json:"key,omitempty"`
+	Joined time.Time `json:"joined"`
+}
+
+func (c *sessionClient) info() clientInfo {
+	return clientInfo{ID: c.id, Mode: c.mode, Origin: c.who.Origin, Remote: c.who.RemoteAddr, Key: c.who.KeyName, Joined: c.joined}
+}
+
+// clientList returns the attached clients ordered by ID, oldest first. The
+// caller holds s.mu.
+func (s *terminalSession) clientList() []*sessionClient {
+	list := make([]*sessionClient, 0, len(s.clients))
+	for _, c := range s.clients {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+// clientInfos returns presence information for every attached client. The
+// caller holds s.mu.
+func (s *terminalSession) clientInfos() []clientInfo {
+	infos := []clientInfo{}
+	for _, c := range s.clientList() {
+		infos = append(infos, c.info())
+	}
+	return infos
+}
+
+// ensureDriver promotes the oldest interactive client if the session has no
+// driver. It reports whether the driver changed. The caller holds s.mu.
+func (s *terminalSession) ensureDriver() bool {
+	for _, c := range s.clients {
+		if c.mode == modeDriver {
+			return false
+		}
+	}
+	for _, c := range s.clientList() {
+		if c.mode == modeInteractive {
+			c.mode = modeDriver
+			return true
+		}
+	}
+	return false
+}
+
+// attach adds a client to the session, sends it the terminalInfo message and
+// the session's history, and tells the others it joined. A client attaching
+// as driver while the session has one joins as interactive. It returns false
+// if the session has already ended.
+func (s *terminalSession) attach(c *sessionClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return false
+	}
+	if s.detachTimer != nil {
+		s.detachTimer.Stop()
+		s.detachTimer = nil
+	}
+	if c.mode == modeDriver && s.driver() != nil {
+		c.mode = modeInteractive
+	}
+	others := s.clientList()
+	s.clients[c.id] = c
+	go c.writeLoop()
+	s.ensureDriver()
+	replay, kind := s.replay()
+	c.sendJSON(s.info(c, kind))
+	s.sendReplay(c, replay)
+	info := c.info()
+	joined := wsMessage{Type: "clientJoined", Session: s.id, Client: &info}
+	// The new client learns the state from its terminalInfo message.
+	state := s.state()
+	for _, other := range others {
+		other.sendJSON(joined)
+		other.sendJSON(state)
+	}
+	return true
+}
+
+// mayDrive reports whether a client may attach to the session as driver, which
+// it may only when the session has none. Otherwise the role changes hands only
+// when the driver hands it over, e.g. in answer to requestDriver.
+func (s *terminalSession) mayDrive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.driver() == nil
+}
+
+// driver returns the session's driver, or nil. The caller holds s.mu.
+func (s *terminalSession) driver() *sessionClient {
+	for _, c := range s.clients {
+		if c.mode == modeDriver {
+			return c
+		}
+	}
+	return nil
+}
+
+// detach removes a client, telling the others it left, and returns how many
+// clients remain.
+func (s *terminalSession) detach(c *sessionClient) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[c.id]; !ok {
+		return len(s.clients)
+	}
+	delete(s.clients, c.id)
+	c.stopOnce.Do(func() { close(c.stop) })
+	s.ensureDriver()
+	info := c.info()
+	left := wsMessage{Type: "clientLeft", Session: s.id, Client: &info}
+	for _, other := range s.clients {
+		other.sendJSON(left)
+	}
+	if len(s.clients) > 0 {
+		s.broadcastState()
+		s.negotiateSize()
+	}
+	return len(s.clients)
+}
+
+// state describes the session's clients and input policy. The caller holds s.mu.
+func (s *terminalSession) state() wsMessage {
+	return wsMessage{Type: "sessionState", Session: s.id, InputPolicy: s.inputPolicy, Clients: s.clientInfos()}
+}
+
+// broadcastState sends the session state to every client. The caller holds s.mu.
+func (s *terminalSession) broadcastState() {
+	state := s.state()
+	for _, c := range s.clients {
+		c.sendJSON(state)
+	}
+}
+
+// broadcastJSON sends a control message to every attached client.
+func (s *terminalSession) broadcastJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clientList() {
+		c.send(websocket.TextMessage, data)
+	}
+}
+
+// broadcastOutput keeps PTY output in the session's history and queues it for
+// every attached client. Queuing under s.mu keeps it in order with the
+// history a client attaching meanwhile is sent.
+func (s *terminalSession) broadcastOutput(p []byte) {
+	// The read buffer is reused, and the queues hold on to what they're given.
+	p = append([]byte(nil), p...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepOutput(p)
+	for _, c := range s.clientList() {
+		// Use TextMessage for compatibility with clients not expecting binary frames.
+		c.send(websocket.TextMessage, p)
+	}
+}
+
+// canWrite reports whether a client's input reaches the shell.
+func (s *terminalSession) canWrite(c *sessionClient) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return c.mode == modeDriver || c.mode == modeInteractive && s.inputPolicy == inputFromAll
+}
+
+// maxTermCols and maxTermRows bound the size a client may ask for. The PTY
+// size is 16 bits, and the screen emulator holds every cell of it.
+const (
+	maxTermCols = 1000
+	maxTermRows = 500
+)
+
+// clientResized records the size a client asked for and renegotiates the PTY
+// size. Read-only clients only watch: their size doesn't change the PTY, but
+// they are told when their view differs from it.
+func (s *terminalSession) clientResized(c *sessionClient, cols, rows int) {
+	if cols < 1 || rows < 1 {
+		return
+	}
+	cols, rows = min(cols, maxTermCols), min(rows, maxTermRows)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.mode != modeReadOnly {
+		c.cols, c.rows = cols, rows
+	}
+	c.viewCols, c.viewRows = cols, rows
+	s.negotiateSize()
+}
+
+// negotiateSize sizes the PTY to the smallest width and height among the
+// clients that may type, so output fits every screen, and sends a "resize"
+// message to each client whose view differs from the result. The caller holds
+// s.mu.
+func (s *terminalSession) negotiateSize() {
+	cols, rows := 0, 0
+	for _, c := range s.clients {
+		if c.cols == 0 {
+			continue
+		}
+		if cols == 0 || c.cols < cols {
+			cols = c.cols
+		}
+		if rows == 0 || c.rows < rows {
+			rows = c.rows
+		}
+	}
+	if cols == 0 {
+		s.recMu.Lock()
+		cols, rows = s.cols, s.rows
+		s.recMu.Unlock()
+	}
+	s.recMu.Lock()
+	changed := cols != s.cols || rows != s.rows
+	s.recMu.Unlock()
+	if changed {
+		s.setSize(cols, rows)
+		if s.screen != nil {
+			s.screen.resize(cols, rows)
+		}
+	}
+	for _, c := range s.clients {
+		if c.viewCols != 0 && (c.viewCols != cols || c.viewRows != rows) {
+			c.viewCols, c.viewRows = cols, rows
+			c.sendJSON(wsMessage{Type: "resize", Session: s.id, Cols: cols, Rows: rows})
+		}
+	}
+}
+
+// setInputPolicy changes who may type. Only the driver may change it.
+func (s *terminalSession) setInputPolicy(c *sessionClient, policy string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.mode != modeDriver {
+		return fmt.Errorf("only the driver can change the input policy")
+	}
+	if policy != inputFromAll && policy != inputFromDriver {
+		return fmt.Errorf("input policy must be %q or %q", inputFromAll, inputFromDriver)
+	}
+	s.inputPolicy = policy
+	s.broadcastState()
+	return nil
+}
+
+// setDriver hands the driver role to another interactive client. Only the
+// driver may hand it over.
+func (s *terminalSession) setDriver(c *sessionClient, id int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.mode != modeDriver {
+		return fmt.Errorf("only the driver can hand over control")
+	}
+	next, ok := s.clients[id]
+	if !ok {
+		return fmt.Errorf("client %d is not attached", id)
+	}
+	if next.mode == modeReadOnly {
+		return fmt.Errorf("client %d is read-only", id)
+	}
+	c.mode = modeInteractive
+	next.mode = modeDriver
+	s.broadcastState()
+	return nil
+}
+
+// requestDriver asks the driver to hand the role over to c. The driver gets a
+// driverRequested message and decides with setDriver.
+func (s *terminalSession) requestDriver(c *sessionClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch c.mode {
+	case modeDriver:
+		return fmt.Errorf("client %d is already the driver", c.id)
+	case modeReadOnly:
+		return fmt.Errorf("client %d is read-only", c.id)
+	}
+	driver := s.driver()
+	if driver == nil {
+		// Only read-only clients can be left without a driver.
+		c.mode = modeDriver
+		s.broadcastState()
+		return nil
+	}
+	driver.sendJSON(wsMessage{Type: "driverRequested", Session: s.id, ClientID: c.id})
+	return nil
+}
+
+// sessionRegistry tracks running terminal sessions by ID.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[int32]*terminalSession
+}
+
+// Global registry of terminal sessions.
+var terminalSessions = &sessionRegistry{sessions: make(map[int32]*terminalSession)}
+
+func (sr *sessionRegistry) add(s *terminalSession) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.sessions[s.id] = s
+}
+
+func (sr *sessionRegistry) remove(id int32) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	delete(sr.sessions, id)
+}
+
+func (sr *sessionRegistry) get(id int32) *terminalSession {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.sessions[id]
+}
+
+// list returns the running sessions ordered by ID.
+func (sr *sessionRegistry) list() []*terminalSession {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	list := make([]*terminalSession, 0, len(sr.sessions))
+	for _, s := range sr.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	return list
+}
+
+func (sr *sessionRegistry) count() int {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return len(sr.sessions)
+}
+
+// sessionSummary describes a running session in the /sessions listing.
+type sessionSummary struct {
+	ID          int32              `json:"id"`
+	PID         int                `json:"pid"`
+	Started     time.Time          `json:"started"`
+	Cols        int                `json:"cols"`
+	Rows        int                `json:"rows"`
+	InputPolicy string             `json:"inputPolicy"`
+	Recording   string             `json:"recording,omitempty"`
+	Clients     []clientInfo       `json:"clients"`
+	Title       string             `json:"title,omitempty"`
+	Process     *foregroundProcess `json:"process,omitempty"`
+}
+
+// sessionFromPath looks up the session named in a /sessions/<id> path,
+// replying with an error if there is none.
+func sessionFromPath(w http.ResponseWriter, idParam string) *terminalSession {
+	id, err := strconv.ParseInt(idParam, 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return nil
+	}
+	sess := terminalSessions.get(int32(id))
+	if sess == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+	}
+	return sess
+}
+
+// sessionsHandler serves GET /sessions, listing running terminal sessions so a
+// client can pick one to attach to, DELETE /sessions/<id>, and the search and
+// export endpoints under it.
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/"); rest != "" {
+		id, action, _ := strings.Cut(rest, "/")
+		switch action {
+		case "":
+			closeSessionHandler(w, r, id)
+		case "search":
+			searchSessionHandler(w, r, id)
+		case "export":
+			exportSessionHandler(w, r, id)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if !checkRequestAuthorization(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := []sessionSummary{}
+	for _, s := range terminalSessions.list() {
+		s.recMu.Lock()
+		cols, rows := s.cols, s.rows
+		s.recMu.Unlock()
+		s.mu.Lock()
+		summary := sessionSummary{
+			ID:          s.id,
+			PID:         s.pid(),
+			Started:     s.started.UTC(),
+			Cols:        cols,
+			Rows:        rows,
+			InputPolicy: s.inputPolicy,
+			Clients:     s.clientInfos(),
+			Title:       s.title,
+			Process:     s.process,
+		}
+		s.mu.Unlock()
+		summary.Recording = s.recordingName()
+		list = append(list, summary)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
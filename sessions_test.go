@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// queued decodes the control messages waiting in the client's queue.
+func queued(c *sessionClient) []wsMessage {
+	var msgs []wsMessage
+	for {
+		select {
+		case m := <-c.queue:
+			var msg wsMessage
+			if json.Unmarshal(m.data, &msg) == nil {
+				msgs = append(msgs, msg)
+			}
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestDriverHandover(t *testing.T) {
+	owner := principal{Origin: "https://editor.example.com", Admin: true}
+	driver := newSessionClient(nil, owner, modeDriver)
+	tab := newSessionClient(nil, owner, modeInteractive)
+	viewer := newSessionClient(nil, owner, modeReadOnly)
+	s := &terminalSession{id: 1, owner: owner, inputPolicy: inputFromAll, clients: map[int32]*sessionClient{
+		driver.id: driver, tab.id: tab, viewer.id: viewer,
+	}}
+
+	// A second tab of the same principal doesn't get the role by asking.
+	if s.mayDrive() {
+		t.Error("mayDrive with a driver attached")
+	}
+	if err := s.requestDriver(tab); err != nil {
+		t.Fatal(err)
+	}
+	if tab.mode != modeInteractive || driver.mode != modeDriver {
+		t.Errorf("after requestDriver: tab %s, driver %s", tab.mode, driver.mode)
+	}
+	var asked bool
+	for _, msg := range queued(driver) {
+		asked = asked || msg.Type == "driverRequested" && msg.ClientID == tab.id
+	}
+	if !asked {
+		t.Error("the driver wasn't sent driverRequested")
+	}
+	if err := s.requestDriver(viewer); err == nil {
+		t.Error("a read-only client requested the role")
+	}
+	if err := s.setDriver(tab, tab.id); err == nil {
+		t.Error("a client that isn't driver handed over the role")
+	}
+
+	// The driver hands it over.
+	if err := s.setDriver(driver, tab.id); err != nil {
+		t.Fatal(err)
+	}
+	if tab.mode != modeDriver || driver.mode != modeInteractive {
+		t.Errorf("after setDriver: tab %s, old driver %s", tab.mode, driver.mode)
+	}
+
+	// With only read-only clients left, the role is free.
+	delete(s.clients, tab.id)
+	delete(s.clients, driver.id)
+	if !s.mayDrive() {
+		t.Error("no mayDrive without a driver")
+	}
+}
@@ -0,0 +1,94 @@
+# Conduit shell integration for bash. Conduit starts bash with
+# --rcfile pointing here, so this loads the usual ~/.bashrc first.
+#
+# Marks emitted (OSC 133, as in FinalTerm):
+#   A  prompt starts        B  prompt ends, input starts
+#   C  command runs, with cmdline_url=<percent-encoded command line>
+#   D  command finished, with its exit status
+# and OSC 9;9 with the working directory after each command. C and D also
+# carry nonce=<CONDUIT_SHELL_NONCE>, so that Conduit can tell them from marks
+# printed by programs. The nonce is kept out of their environment.
+__conduit_nonce="$CONDUIT_SHELL_NONCE"
+unset CONDUIT_SHELL_NONCE
+
+# The environment's PROMPT_COMMAND only reports the directory, which
+# __conduit_precmd does too.
+unset PROMPT_COMMAND
+
+if [ -r /etc/bash.bashrc ]; then . /etc/bash.bashrc; fi
+if [ -r ~/.bashrc ]; then . ~/.bashrc; fi
+
+__conduit_urlencode() {
+	local LC_ALL=C s="$1" out="" c i
+	for (( i = 0; i < ${#s}; i++ )); do
+		c="${s:i:1}"
+		case "$c" in
+			[a-zA-Z0-9._~/-]) out+="$c" ;;
+			*) printf -v c '%%%02X' "'$c"; out+="$c" ;;
+		esac
+	done
+	printf '%s' "$out"
+}
+
+# __conduit_history prints the last history entry, without its number, and
+# sets __conduit_histnum to the number.
+__conduit_history() {
+	local entry
+	entry="$(HISTTIMEFORMAT= builtin history 1)"
+	entry="${entry#"${entry%%[![:space:]]*}"}" # leading spaces
+	__conduit_histnum="${entry%%[![:digit:]]*}"
+	entry="${entry#"$__conduit_histnum"}"
+	entry="${entry#\*}"                         # modified entries are starred
+	__conduit_cmd="${entry#"${entry%%[![:space:]]*}"}"
+}
+
+# Runs from the DEBUG trap before the first command after a prompt. The
+# command line is read from history when the shell recorded it there, which
+# it doesn't under HISTCONTROL=ignorespace or HISTIGNORE, nor for a repeat
+# under ignoredups. Then $BASH_COMMAND, the first simple command with
+# aliases expanded, is the best there is.
+__conduit_preexec() {
+	local seen="$__conduit_histnum"
+	__conduit_history
+	if [[ -z "$__conduit_histnum" || "$__conduit_histnum" == "$seen" ]]; then
+		__conduit_cmd="$1"
+	fi
+	printf '\033]133;C;cmdline_url=%s;nonce=%s\007' "$(__conduit_urlencode "$__conduit_cmd")" "$__conduit_nonce"
+}
+
+__conduit_precmd() {
+	local status=$?
+	__conduit_at_prompt=
+	printf '\033]133;D;%s;nonce=%s\007' "$status" "$__conduit_nonce"
+	printf '\033]9;9;%s\033\\' "$PWD"
+	__conduit_history
+	# Prompts set by the user's configuration are wrapped once.
+	if [[ "$PS1" != *'133;A'* ]]; then
+		PS1='\[\033]133;A\007\]'"$PS1"'\[\033]133;B\007\]'
+	fi
+	return $status
+}
+
+# A DEBUG trap set by the user's configuration still runs, before ours.
+__conduit_trap_command() { [[ $# -eq 4 ]] && printf '%s' "$3"; }
+__conduit_user_debug="$(eval "__conduit_trap_command $(trap -p DEBUG)")"
+
+# The trap fires before every simple command, including those of
+# PROMPT_COMMAND and completion functions. Only the first one run for a
+# command line counts. "$_" is passed last so that $_ survives the trap.
+__conduit_debug() {
+	if [[ -n "$__conduit_user_debug" ]]; then
+		: "$1"
+		eval "$__conduit_user_debug"
+	fi
+	if [[ -z "$__conduit_at_prompt" || -n "${COMP_LINE-}" || -n "${READLINE_LINE+set}" || "$BASH_COMMAND" == __conduit_precmd* ]]; then
+		return 0
+	fi
+	__conduit_at_prompt=
+	__conduit_preexec "$BASH_COMMAND"
+}
+
+if [[ "$PROMPT_COMMAND" != *__conduit_precmd* ]]; then
+	PROMPT_COMMAND="__conduit_precmd${PROMPT_COMMAND:+; $PROMPT_COMMAND}; __conduit_at_prompt=1"
+fi
+trap '__conduit_debug "$_"' DEBUG
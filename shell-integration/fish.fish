@@ -0,0 +1,25 @@
+# Conduit shell integration for fish, loaded with --init-command after the
+# user's configuration: OSC 133 marks (A prompt, B input, C command with
+# cmdline_url, D exit status, both with the session's nonce) and OSC 9;9
+# with the working directory. See bash.sh for the details.
+
+set -g __conduit_nonce $CONDUIT_SHELL_NONCE
+set -e CONDUIT_SHELL_NONCE
+
+function __conduit_preexec --on-event fish_preexec
+    printf '\e]133;C;cmdline_url=%s;nonce=%s\a' (string escape --style=url -- $argv[1]) $__conduit_nonce
+end
+
+function __conduit_postexec --on-event fish_postexec
+    printf '\e]133;D;%s;nonce=%s\a' $status $__conduit_nonce
+end
+
+if functions -q fish_prompt; and not functions -q __conduit_original_prompt
+    functions -c fish_prompt __conduit_original_prompt
+    function fish_prompt
+        printf '\e]9;9;%s\e\\' $PWD
+        printf '\e]133;A\a'
+        __conduit_original_prompt
+        printf '\e]133;B\a'
+    end
+end
@@ -0,0 +1,32 @@
+# Conduit shell integration for PowerShell, dot-sourced after the user's
+# profile: OSC 133 marks (A prompt, B input, C command with cmdline_url,
+# D exit status, both with the session's nonce) and OSC 9;9 with the working
+# directory. See bash.sh for the details.
+
+if (-not $global:__ConduitOriginalPrompt) {
+    $global:__ConduitOriginalPrompt = $function:prompt
+    $global:__ConduitEsc = [char]0x1b
+    $global:__ConduitBel = [char]0x07
+    $global:__ConduitNonce = $env:CONDUIT_SHELL_NONCE
+    Remove-Item Env:CONDUIT_SHELL_NONCE -ErrorAction SilentlyContinue
+
+    function global:prompt {
+        $succeeded = $?
+        $exitCode = 0
+        if (-not $succeeded) {
+            $exitCode = if ($global:LASTEXITCODE) { $global:LASTEXITCODE } else { 1 }
+        }
+        $e, $a = $global:__ConduitEsc, $global:__ConduitBel
+        $marks = "$e]133;D;$exitCode;nonce=$($global:__ConduitNonce)$a$e]9;9;$($executionContext.SessionState.Path.CurrentLocation.ProviderPath)$e\$e]133;A$a"
+        $marks + (& $global:__ConduitOriginalPrompt) + "$e]133;B$a"
+    }
+
+    if (Get-Command PSConsoleHostReadLine -ErrorAction SilentlyContinue) {
+        $global:__ConduitOriginalReadLine = $function:PSConsoleHostReadLine
+        function global:PSConsoleHostReadLine {
+            $line = & $global:__ConduitOriginalReadLine
+            [Console]::Write("$($global:__ConduitEsc)]133;C;cmdline_url=$([Uri]::EscapeDataString($line));nonce=$($global:__ConduitNonce)$($global:__ConduitBel)")
+            $line
+        }
+    }
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// shellIntegrationFiles are the scripts that make shells mark prompts and
+// commands with OSC 133. See the scripts themselves for what they emit.
+//
+//go:embed shell-integration
+var shellIntegrationFiles embed.FS
+
+// shellIntegrationLayout maps each embedded script to where it is installed.
+// zsh only reads its startup files under their dotted names.
+var shellIntegrationLayout = map[string]string{
+	"bash.sh":         "bash.sh",
+	"fish.fish":       "fish.fish",
+	"powershell.ps1":  "powershell.ps1",
+	"zsh/zshenv":      "zsh/.zshenv",
+	"zsh/zprofile":    "zsh/.zprofile",
+	"zsh/zshrc":       "zsh/.zshrc",
+	"zsh/conduit.zsh": "zsh/conduit.zsh",
+}
+
+var (
+	shellIntegrationOnce sync.Once
+	shellIntegrationDir  string // "" if the scripts couldn't be installed
+)
+
+// installShellIntegration writes the scripts to the runtime directory, or
+// the config directory where there is none, once per server run so they
+// always match this build.
+func installShellIntegration() string {
+	shellIntegrationOnce.Do(func() {
+		base := ""
+		if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+			base = filepath.Join(runtimeDir, appName)
+		} else if dir, err := conduitConfigDir(); err == nil {
+			base = dir
+		} else {
+			log.Printf("Shell integration disabled: %v", err)
+			return
+		}
+		dir := filepath.Join(base, "shell-integration")
+		for src, dst := range shellIntegrationLayout {
+			data, err := shellIntegrationFiles.ReadFile("shell-integration/" + src)
+			if err == nil {
+				path := filepath.Join(dir, filepath.FromSlash(dst))
+				if err = os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+					err = os.WriteFile(path, data, 0600)
+				}
+			}
+			if err != nil {
+				log.Printf("Shell integration disabled: writing %s: %v", dst, err)
+				return
+			}
+		}
+		shellIntegrationDir = dir
+	})
+	return shellIntegrationDir
+}
+
+// newShellNonce returns a secret for a session's integration script to add
+// to its command marks. Programs running in the session don't know it, so
+// they can't print marks that report commands of their own making.
+func newShellNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withShellIntegration adds what it takes for shell to load its integration
+// script to its arguments and environment, including the session's nonce.
+// Shells without a script, and bash with arguments of its own (--rcfile
+// can't be combined with a login shell), are started unchanged.
+func withShellIntegration(shell string, args []string, env []string, nonce string) ([]string, []string) {
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(shell)), ".exe")
+	switch name {
+	case "bash", "zsh", "fish", "pwsh", "powershell":
+	default:
+		return args, env
+	}
+	if name == "bash" && len(args) > 0 {
+		return args, env
+	}
+	dir := installShellIntegration()
+	if dir == "" {
+		return args, env
+	}
+	env = append(env, "CONDUIT_SHELL_INTEGRATION=1", "CONDUIT_SHELL_NONCE="+nonce)
+	switch name {
+	case "bash":
+		args = []string{"--rcfile", filepath.Join(dir, "bash.sh")}
+	case "zsh":
+		userDir := os.Getenv("ZDOTDIR")
+		for _, kv := range env {
+			if v, ok := strings.CutPrefix(kv, "ZDOTDIR="); ok {
+				userDir = v
+			}
+		}
+		if userDir == "" {
+			userDir = os.Getenv("HOME")
+		}
+		env = append(env, "CONDUIT_USER_ZDOTDIR="+userDir, "ZDOTDIR="+filepath.Join(dir, "zsh"))
+	case "fish":
+		args = append(append([]string{}, args...), "--init-command", "source "+shellQuote(filepath.Join(dir, "fish.fish")))
+	case "pwsh", "powershell":
+		script := "'" + strings.ReplaceAll(filepath.Join(dir, "powershell.ps1"), "'", "''") + "'"
+		args = append(append([]string{}, args...), "-NoExit", "-Command", ". "+script)
+	}
+	return args, env
+}
+
+// shellQuote quotes s for a POSIX-style shell (and fish).
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownRequests carries the reason for the first shutdown request; the idle
+// timer, /kill and OS signals all feed into it.
+var shutdownRequests = make(chan string, 1)
+var shuttingDown atomic.Bool
+
+// requestShutdown asks the server to shut down gracefully. It returns
+// immediately; later requests are ignored once one is pending.
+func requestShutdown(reason string) {
+	select {
+	case shutdownRequests <- reason:
+	default:
+	}
+}
+
+// isShuttingDown reports whether a graceful shutdown is in progress, so new
+// sessions can be refused.
+func isShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// serveUntilShutdown serves HTTP on listener until a shutdown is requested or
+// SIGINT/SIGTERM arrives, then shuts down gracefully.
+func serveUntilShutdown(server *http.Server, listener net.Listener, certFile, keyFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			serveErr <- server.ServeTLS(listener, certFile, keyFile)
+		} else {
+			serveErr <- server.Serve(listener)
+		}
+	}()
+
+	var reason string
+	select {
+	case err := <-serveErr:
+		if err != http.ErrServerClosed {
+			log.Printf("Server error: %v", err)
+		}
+		reason = "server stopped"
+	case sig := <-signals:
+		reason = "received " + sig.String()
+	case reason = <-shutdownRequests:
+	}
+	signal.Stop(signals)
+	shutdownGracefully(server, reason)
+}
+
+// shutdownGracefully stops accepting connections, tells every client why the
+// server is going away, hangs up running shells and waits for them to exit
+// before closing the file watcher and removing the discovery file.
+func shutdownGracefully(server *http.Server, reason string) {
+	shuttingDown.Store(true)
+	grace := time.Duration(currentConfig().ShutdownGraceSeconds) * time.Second
+	log.Printf("Shutting down (%s). Waiting up to %v for sessions to end.", reason, grace)
+
+	// Stop accepting new connections. Websockets are hijacked, so Shutdown does
+	// not wait for them; it does let in-flight REST requests such as /kill finish.
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	forwards.shutdown(ctx)
+
+	notice := wsMessage{Type: "serverShutdown", Reason: reason}
+	for _, sess := range terminalSessions.list() {
+		sess.broadcastJSON(notice)
+		sess.hangup()
+	}
+	for _, ws := range fileClients.list() {
+		ws.WriteJSON(fileResponse{Action: "serverShutdown", Data: reason})
+		ws.closeWithReason(websocket.CloseGoingAway, "serverShutdown")
+	}
+
+	// Shells normally exit on SIGHUP, which closes their websockets. Anything
+	// still running when the grace period ends is killed.
+	deadline := time.Now().Add(grace)
+	for terminalSessions.count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, sess := range terminalSessions.list() {
+		log.Printf("Session #%d (PID: %d) did not exit after hangup; killing it.", sess.id, sess.pid())
+		sess.kill()
+		sess.end()
+	}
+
+	stopAllExecs()
+	stopLanguageServers()
+	stopDebugAdapters()
+	fileWatcher.close()
+	removeDiscoveryFile()
+	audit.record(auditEntry{Action: "server.shutdown", Remote: "local", Detail: reason})
+	audit.close()
+	log.Println("Shutdown complete.")
+}
@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Tasks are named commands (build, test, lint...) defined per project in
+// .conduit/tasks.json under a file root. Their output is parsed by problem
+// matchers, modelled on VS Code's, into diagnostics that are pushed to
+// subscribed /exec clients, so editors don't have to parse compiler output.
+
+// tasksFileName is where a root's task definitions live.
+const tasksFileName = ".conduit/tasks.json"
+
+// taskMaxDiagnostics caps the diagnostics kept for one task run.
+const taskMaxDiagnostics = 1000
+
+// taskMaxLine caps how much of one output line is matched; the rest of a
+// longer line is dropped.
+const taskMaxLine = 64 << 10
+
+// tasksFile is the content of .conduit/tasks.json.
+type tasksFile struct {
+	Tasks           []taskDef                  `json:"tasks"`
+	ProblemMatchers map[string]*problemMatcher `json:"problemMatchers,omitempty"`
+}
+
+// taskDef is one named task.
+type taskDef struct {
+	Name           string            `json:"name"`
+	Description    string            `json:"description,omitempty"`
+	Group          string            `json:"group,omitempty"` // free-form, e.g. "build" or "test"
+	Argv           []string          `json:"argv"`
+	Cwd            string            `json:"cwd,omitempty"` // relative to the file root
+	Env            map[string]string `json:"env,omitempty"`
+	TimeoutSeconds float64           `json:"timeoutSeconds,omitempty"`
+	ProblemMatcher matcherNames      `json:"problemMatcher,omitempty"`
+}
+
+// matcherNames accepts either a single matcher name or a list of them.
+type matcherNames []string
+
+func (m *matcherNames) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*m = matcherNames{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("problemMatcher must be a name or a list of names")
+	}
+	*m = names
+	return nil
+}
+
+// problemMatcher turns output lines matching Pattern into diagnostics. The
+// other fields are capture group numbers; 0 means the value isn't captured.
+type problemMatcher struct {
+	Pattern         string `json:"pattern"`
+	File            int    `json:"file"`
+	Line            int    `json:"line,omitempty"`
+	Column          int    `json:"column,omitempty"`
+	Severity        int    `json:"severity,omitempty"`
+	Code            int    `json:"code,omitempty"`
+	Message         int    `json:"message"`
+	DefaultSeverity string `json:"defaultSeverity,omitempty"` // used when Severity isn't captured; "error" if unset
+
+	re *regexp.Regexp
+}
+
+// builtinMatchers are available to every task without being defined.
+var builtinMatchers = map[string]*problemMatcher{
+	// go build, go vet and go test: "./main.go:10:2: undefined: x"
+	"go": {Pattern: `^\s*(?:vet: )?([^\s:][^:]*\.go):(\d+)(?::(\d+))?: (.*)$`, File: 1, Line: 2, Column: 3, Message: 4},
+	// tsc: "src/app.ts(3,7): error TS2322: Type ..."
+	"tsc": {Pattern: `^(.+?)\((\d+),(\d+)\): (error|warning|info) (TS\d+): (.*)$`, File: 1, Line: 2, Column: 3, Severity: 4, Code: 5, Message: 6},
+	// gcc and clang: "main.c:4:5: warning: unused variable"
+	"gcc": {Pattern: `^(.+?):(\d+):(\d+): (?:fatal )?(error|warning|note): (.*)$`, File: 1, Line: 2, Column: 3, Severity: 4, Message: 5},
+	// eslint -f compact: "/src/a.js: line 1, col 5, Error - Missing semicolon. (semi)"
+	"eslint-compact": {Pattern: `^(.+?): line (\d+), col (\d+), (Error|Warning|Info) - (.*?)(?: \(([^()]+)\))?$`, File: 1, Line: 2, Column: 3, Severity: 4, Message: 5, Code: 6},
+}
+
+func init() {
+	for name, m := range builtinMatchers {
+		if err := m.compile(); err != nil {
+			panic(fmt.Sprintf("built-in problem matcher %s: %v", name, err))
+		}
+	}
+}
+
+// compile checks the pattern and group numbers.
+func (m *problemMatcher) compile() error {
+	re, err := regexp.Compile(m.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	if m.File <= 0 || m.Message <= 0 {
+		return fmt.Errorf("file and message groups are required")
+	}
+	for _, group := range []int{m.File, m.Line, m.Column, m.Severity, m.Code, m.Message} {
+		if group < 0 || group > re.NumSubexp() {
+			return fmt.Errorf("group %d is not in the pattern", group)
+		}
+	}
+	if m.DefaultSeverity != "" && normalizeSeverity(m.DefaultSeverity, "") == "" {
+		return fmt.Errorf("unknown defaultSeverity %q", m.DefaultSeverity)
+	}
+	m.re = re
+	return nil
+}
+
+// diagnostic is one problem found in task output.
+type diagnostic struct {
+	File     string `json:"file"` // relative to the file root, slash-separated; absolute if outside it
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"` // "error", "warning" or "info"
+	Message  string `json:"message"`
+	Code     string `json:"code,omitempty"`
+	Source   string `json:"source"` // matcher name
+}
+
+// match parses a line, reporting whether it was a problem.
+func (m *problemMatcher) match(line string) (diagnostic, bool) {
+	groups := m.re.FindStringSubmatch(line)
+	if groups == nil {
+		return diagnostic{}, false
+	}
+	group := func(n int) string {
+		if n == 0 {
+			return ""
+		}
+		return strings.TrimSpace(groups[n])
+	}
+	number := func(n int) int {
+		var v int
+		fmt.Sscan(group(n), &v)
+		return v
+	}
+	d := diagnostic{
+		File:    group(m.File),
+		Line:    number(m.Line),
+		Column:  number(m.Column),
+		Message: group(m.Message),
+		Code:    group(m.Code),
+	}
+	d.Severity = normalizeSeverity(group(m.Severity), m.DefaultSeverity)
+	if d.Severity == "" {
+		d.Severity = "error"
+	}
+	return d, d.File != "" && d.Message != ""
+}
+
+// normalizeSeverity maps the spellings tools use onto error, warning and
+// info, falling back to def.
+func normalizeSeverity(s, def string) string {
+	switch strings.ToLower(s) {
+	case "error", "err", "fatal", "e":
+		return "error"
+	case "warning", "warn", "w":
+		return "warning"
+	case "info", "information", "note", "hint", "i":
+		return "info"
+	}
+	if def != "" {
+		return normalizeSeverity(def, "")
+	}
+	return ""
+}
+
+// loadTasks reads a root's task definitions. A root without a tasks file has
+// no tasks.
+func loadTasks(root string) (*tasksFile, error) {
+	path, err := securePathIn(root, tasksFileName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &tasksFile{Tasks: []taskDef{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tf tasksFile
+	if err := json.Unmarshal(data, &tf); err != nil {
+		return nil, fmt.Errorf("%s: %v", tasksFileName, err)
+	}
+	if err := tf.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", tasksFileName, err)
+	}
+	return &tf, nil
+}
+
+func (tf *tasksFile) validate() error {
+	if tf.Tasks == nil {
+		tf.Tasks = []taskDef{}
+	}
+	for name, m := range tf.ProblemMatchers {
+		if m == nil {
+			return fmt.Errorf("problem matcher %q is empty", name)
+		}
+		if err := m.compile(); err != nil {
+			return fmt.Errorf("problem matcher %q: %v", name, err)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, t := range tf.Tasks {
+		if t.Name == "" {
+			return fmt.Errorf("every task needs a name")
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("task %q is defined twice", t.Name)
+		}
+		seen[t.Name] = true
+		if len(t.Argv) == 0 || t.Argv[0] == "" {
+			return fmt.Errorf("task %q: argv must name a program", t.Name)
+		}
+		for _, name := range t.ProblemMatcher {
+			if tf.matcher(name) == nil {
+				return fmt.Errorf("task %q: unknown problem matcher %q", t.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// matcher looks a matcher up in the file, then among the built-ins.
+func (tf *tasksFile) matcher(name string) *problemMatcher {
+	if m, ok := tf.ProblemMatchers[name]; ok {
+		return m
+	}
+	return builtinMatchers[name]
+}
+
+func (tf *tasksFile) find(name string) *taskDef {
+	for i := range tf.Tasks {
+		if tf.Tasks[i].Name == name {
+			return &tf.Tasks[i]
+		}
+	}
+	return nil
+}
+
+// --- Task Runs ---
+
+// taskRun collects the diagnostics of one run of a task and publishes them.
+type taskRun struct {
+	root, task, id string
+	rootDir, cwd   string // absolute, for making reported paths root-relative
+	matchers       []*problemMatcher
+	names          []string
+
+	mu          sync.Mutex
+	diagnostics []diagnostic
+	published   bool // the first publish resets the task's diagnostics
+}
+
+// newTaskRun prepares to run a task and returns the request that starts it.
+func (tf *tasksFile) newTaskRun(t *taskDef, root, id string) (*taskRun, execRequest, error) {
+	rootDir, err := securePathIn(root, "")
+	if err != nil {
+		return nil, execRequest{}, err
+	}
+	cwd, err := securePathIn(root, t.Cwd)
+	if err != nil {
+		return nil, execRequest{}, fmt.Errorf("cwd is outside the file root")
+	}
+	run := &taskRun{root: root, task: t.Name, id: id, rootDir: rootDir, cwd: cwd, names: t.ProblemMatcher}
+	for _, name := range t.ProblemMatcher {
+		run.matchers = append(run.matchers, tf.matcher(name))
+	}
+	req := execRequest{
+		ID:             id,
+		Task:           t.Name,
+		Argv:           t.Argv,
+		Cwd:            t.Cwd,
+		Root:           root,
+		Env:            t.Env,
+		TimeoutSeconds: t.TimeoutSeconds,
+	}
+	return run, req, nil
+}
+
+// collector returns a writer that parses one output stream line by line.
+func (run *taskRun) collector() *problemCollector {
+	return &problemCollector{run: run}
+}
+
+// match matches one line of output against the task's matchers.
+func (run *taskRun) match(text string) (diagnostic, bool) {
+	text = strings.TrimRight(ansiEscape.ReplaceAllString(text, ""), "\r")
+	for i, m := range run.matchers {
+		d, ok := m.match(text)
+		if !ok {
+			continue
+		}
+		d.Source = run.names[i]
+		d.File = run.relativePath(d.File)
+		return d, true
+	}
+	return diagnostic{}, false
+}
+
+// add keeps and publishes diagnostics found in the run's output, up to
+// taskMaxDiagnostics.
+func (run *taskRun) add(found []diagnostic) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	found = found[:min(len(found), taskMaxDiagnostics-len(run.diagnostics))]
+	if len(found) == 0 {
+		return
+	}
+	run.diagnostics = append(run.diagnostics, found...)
+	diagnostics.publish(run, found)
+}
+
+// relativePath resolves a reported file against the task's working
+// directory and makes it relative to the file root.
+func (run *taskRun) relativePath(file string) string {
+	abs := filepath.FromSlash(file)
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(run.cwd, abs)
+	}
+	rel, err := filepath.Rel(run.rootDir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return file
+	}
+	return filepath.ToSlash(rel)
+}
+
+// finish publishes the run's result; a run that found nothing still clears
+// the diagnostics of the previous run.
+func (run *taskRun) finish(result execResult) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if !run.published {
+		diagnostics.publish(run, []diagnostic{})
+	}
+	count := len(run.diagnostics)
+	diagnostics.broadcast(diagnosticsMessage{
+		Type:   "taskFinished",
+		Root:   run.root,
+		Task:   run.task,
+		ID:     run.id,
+		Count:  &count,
+		Result: &result,
+	})
+}
+
+// ansiEscape matches CSI and OSC escape sequences, which compilers emit when
+// they think they are writing to a terminal.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)`)
+
+// problemCollector splits one output stream into lines for a taskRun. Lines
+// are matched as they complete, and what one write finds is published
+// together; a final unterminated line is matched by flush.
+type problemCollector struct {
+	run   *taskRun
+	buf   []byte
+	skip  bool // discarding the rest of an over-long line
+	found []diagnostic
+}
+
+func (pc *problemCollector) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if !pc.skip {
+				pc.buf = append(pc.buf, p...)
+				if len(pc.buf) > taskMaxLine {
+					pc.line(pc.buf[:taskMaxLine])
+					pc.buf, pc.skip = nil, true
+				}
+			}
+			break
+		}
+		if !pc.skip {
+			pc.buf = append(pc.buf, p[:i]...)
+			pc.line(pc.buf[:min(len(pc.buf), taskMaxLine)])
+		}
+		pc.buf, pc.skip = pc.buf[:0], false
+		p = p[i+1:]
+	}
+	pc.publish()
+	return n, nil
+}
+
+func (pc *problemCollector) flush() {
+	if len(pc.buf) > 0 && !pc.skip {
+		pc.line(pc.buf)
+	}
+	pc.buf = nil
+	pc.publish()
+}
+
+func (pc *problemCollector) line(text []byte) {
+	if d, ok := pc.run.match(string(text)); ok {
+		pc.found = append(pc.found, d)
+	}
+}
+
+func (pc *problemCollector) publish() {
+	if len(pc.found) > 0 {
+		pc.run.add(pc.found)
+		pc.found = nil
+	}
+}
+
+// --- Diagnostics ---
+
+// diagnosticsMessage is pushed to /exec clients that sent
+// subscribeDiagnostics. A "diagnostics" message with reset set replaces the
+// task's diagnostics; without it, it adds to them.
+type diagnosticsMessage struct {
+	Type        string       `json:"type"` // "diagnostics" or "taskFinished"
+	Root        string       `json:"root"`
+	Task        string       `json:"task"`
+	ID          string       `json:"id,omitempty"` // the run's exec ID
+	Reset       bool         `json:"reset,omitempty"`
+	Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+	Count       *int         `json:"count,omitempty"` // "taskFinished": diagnostics found
+	Result      *execResult  `json:"result,omitempty"`
+}
+
+// diagnosticsHub keeps the latest diagnostics of every task and fans new
+// ones out to subscribers. Each subscriber has a queue like a session
+// client's, so a slow one holds up neither the task nor the others; messages
+// are queued under mu, so every subscriber sees them in the same order.
+type diagnosticsHub struct {
+	mu          sync.Mutex
+	subscribers map[*wsConn]*sessionClient
+	latest      map[string]*diagnosticsMessage // by root and task
+}
+
+var diagnostics = &diagnosticsHub{subscribers: make(map[*wsConn]*sessionClient), latest: make(map[string]*diagnosticsMessage)}
+
+// publish sends new diagnostics of a run. The caller holds run.mu.
+func (h *diagnosticsHub) publish(run *taskRun, found []diagnostic) {
+	msg := diagnosticsMessage{Type: "diagnostics", Root: run.root, Task: run.task, ID: run.id, Reset: !run.published, Diagnostics: found}
+	run.published = true
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := run.root + "\xff" + run.task
+	if msg.Reset || h.latest[key] == nil {
+		h.latest[key] = &diagnosticsMessage{Type: "diagnostics", Root: run.root, Task: run.task, Reset: true}
+	}
+	latest := h.latest[key]
+	latest.ID = run.id
+	latest.Diagnostics = append(latest.Diagnostics, found...)
+	h.queue(msg)
+}
+
+// broadcast queues a message for every subscriber.
+func (h *diagnosticsHub) broadcast(msg diagnosticsMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queue(msg)
+}
+
+// queue queues msg for every subscriber. The caller holds h.mu.
+func (h *diagnosticsHub) queue(msg diagnosticsMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+	for _, c := range h.subscribers {
+		c.send(websocket.TextMessage, data)
+	}
+}
+
+// subscribe adds a client and sends it the latest diagnostics of every task.
+func (h *diagnosticsHub) subscribe(ws *wsConn, who principal) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[ws] != nil {
+		return
+	}
+	c := newSessionClient(ws, who, modeReadOnly)
+	h.subscribers[ws] = c
+	go c.writeLoop()
+	for _, latest := range h.latest {
+		msg := *latest
+		if msg.Diagnostics == nil {
+			msg.Diagnostics = []diagnostic{}
+		}
+		c.sendJSON(msg)
+	}
+}
+
+func (h *diagnosticsHub) unsubscribe(ws *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c := h.subscribers[ws]; c != nil {
+		delete(h.subscribers, ws)
+		c.stopOnce.Do(func() { close(c.stop) })
+	}
+}
+
+// --- Handlers ---
+
+// listTasks answers a "listTasks" message on /exec.
+func (ec *execConn) listTasks(req execRequest) {
+	tf, err := loadTasks(req.Root)
+	if err != nil {
+		ec.ws.WriteJSON(execMessage{Type: "error", ID: req.ID, Error: err.Error()})
+		return
+	}
+	ec.ws.WriteJSON(execMessage{Type: "tasks", ID: req.ID, Tasks: tf})
+}
+
+// runTask starts a task on /exec. Its output streams like any command's;
+// diagnostics go to subscribers, including this client if it subscribed.
+func (ec *execConn) runTask(req execRequest) {
+	tf, err := loadTasks(req.Root)
+	if err != nil {
+		ec.ws.WriteJSON(execMessage{Type: "error", ID: req.ID, Error: err.Error()})
+		return
+	}
+	t := tf.find(req.Task)
+	if t == nil {
+		ec.ws.WriteJSON(execMessage{Type: "error", ID: req.ID, Error: fmt.Sprintf("unknown task %q", req.Task)})
+		return
+	}
+	run, taskReq, err := tf.newTaskRun(t, req.Root, req.ID)
+	if err != nil {
+		ec.ws.WriteJSON(execMessage{Type: "error", ID: req.ID, Error: err.Error()})
+		return
+	}
+	var collectors []*problemCollector
+	tap := func(stream string) io.Writer {
+		pc := run.collector()
+		collectors = append(collectors, pc)
+		return pc
+	}
+	ec.start(taskReq, tap, func(result execResult) {
+		for _, pc := range collectors {
+			pc.flush()
+		}
+		run.finish(result)
+	})
+}
+
+// taskRunResponse is returned by POST /tasks.
+type taskRunResponse struct {
+	Result      execResult   `json:"result"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+// tasksHandler serves /tasks: GET lists a root's tasks, POST ?name= runs one
+// to completion and returns its output and diagnostics.
+func tasksHandler(w http.ResponseWriter, r *http.Request) {
+	if isShuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	root := r.URL.Query().Get("root")
+	tf, err := loadTasks(root)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(tf)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	t := tf.find(name)
+	if t == nil {
+		http.Error(w, fmt.Sprintf("unknown task %q", name), http.StatusNotFound)
+		return
+	}
+	run, req, err := tf.newTaskRun(t, root, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var stdout, stderr cappedBuffer
+	outTap, errTap := run.collector(), run.collector()
+	p, err := startExec(req, io.MultiWriter(&stdout, outTap), io.MultiWriter(&stderr, errTap))
+	auditExec(req, who, err)
+	if err != nil {
+		result := execResult{ExitCode: -1, Error: err.Error()}
+		run.finish(result)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(taskRunResponse{Result: result, Diagnostics: []diagnostic{}})
+		return
+	}
+	go func() {
+		select {
+		case <-r.Context().Done():
+			p.cancel()
+		case <-p.done:
+		}
+	}()
+	result := p.wait()
+	outTap.flush()
+	errTap.flush()
+	run.finish(result)
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	countBytes("exec", "out", len(result.Stdout)+len(result.Stderr))
+
+	run.mu.Lock()
+	found := append([]diagnostic{}, run.diagnostics...)
+	run.mu.Unlock()
+	if err := json.NewEncoder(w).Encode(taskRunResponse{Result: result, Diagnostics: found}); err != nil {
+		log.Printf("Task %s: writing response: %v", name, err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinMatchers(t *testing.T) {
+	tests := []struct {
+		matcher string
+		line    string
+		want    diagnostic
+		ok      bool
+	}{
+		{"go", "./main.go:10:2: undefined: x", diagnostic{File: "./main.go", Line: 10, Column: 2, Severity: "error", Message: "undefined: x"}, true},
+		{"go", "cmd/a.go:7: missing return", diagnostic{File: "cmd/a.go", Line: 7, Severity: "error", Message: "missing return"}, true},
+		{"go", "vet: pkg/b.go:3:1: unreachable code", diagnostic{File: "pkg/b.go", Line: 3, Column: 1, Severity: "error", Message: "unreachable code"}, true},
+		{"go", "    x_test.go:12: got 1, want 2", diagnostic{File: "x_test.go", Line: 12, Severity: "error", Message: "got 1, want 2"}, true},
+		{"go", "ok  	example.com/pkg	0.01s", diagnostic{}, false},
+		{"go", "main.c:4:5: warning: unused", diagnostic{}, false},
+		{"tsc", "src/app.ts(3,7): error TS2322: Type 'string' is not assignable", diagnostic{File: "src/app.ts", Line: 3, Column: 7, Severity: "error", Code: "TS2322", Message: "Type 'string' is not assignable"}, true},
+		{"tsc", "a.ts(1,1): warning TS6133: 'x' is declared", diagnostic{File: "a.ts", Line: 1, Column: 1, Severity: "warning", Code: "TS6133", Message: "'x' is declared"}, true},
+		{"tsc", "Found 2 errors.", diagnostic{}, false},
+		{"gcc", "main.c:4:5: warning: unused variable 'x'", diagnostic{File: "main.c", Line: 4, Column: 5, Severity: "warning", Message: "unused variable 'x'"}, true},
+		{"gcc", "lib/u.h:1:10: fatal error: no such file", diagnostic{File: "lib/u.h", Line: 1, Column: 10, Severity: "error", Message: "no such file"}, true},
+		{"gcc", "main.c:9:1: note: declared here", diagnostic{File: "main.c", Line: 9, Column: 1, Severity: "info", Message: "declared here"}, true},
+		{"gcc", "main.c: In function 'main':", diagnostic{}, false},
+		{"eslint-compact", "/src/a.js: line 1, col 5, Error - Missing semicolon. (semi)", diagnostic{File: "/src/a.js", Line: 1, Column: 5, Severity: "error", Code: "semi", Message: "Missing semicolon."}, true},
+		{"eslint-compact", "b.js: line 2, col 1, Warning - Unexpected console statement.", diagnostic{File: "b.js", Line: 2, Column: 1, Severity: "warning", Message: "Unexpected console statement."}, true},
+		{"eslint-compact", "2 problems", diagnostic{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := builtinMatchers[tt.matcher].match(tt.line)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("%s %q: %+v, %v; want %+v, %v", tt.matcher, tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNormalizeSeverity(t *testing.T) {
+	tests := []struct {
+		s, def, want string
+	}{
+		{"error", "", "error"},
+		{"Error", "", "error"},
+		{"ERR", "", "error"},
+		{"fatal", "", "error"},
+		{"E", "", "error"},
+		{"warning", "", "warning"},
+		{"Warn", "", "warning"},
+		{"w", "", "warning"},
+		{"info", "", "info"},
+		{"Information", "", "info"},
+		{"note", "", "info"},
+		{"hint", "", "info"},
+		{"", "warning", "warning"},
+		{"bogus", "info", "info"},
+		{"bogus", "", ""},
+		{"bogus", "bogus", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeSeverity(tt.s, tt.def); got != tt.want {
+			t.Errorf("normalizeSeverity(%q, %q) = %q; want %q", tt.s, tt.def, got, tt.want)
+		}
+	}
+}
+
+func TestRelativePath(t *testing.T) {
+	root := filepath.FromSlash("/work/project")
+	run := &taskRun{rootDir: root, cwd: filepath.Join(root, "web")}
+	tests := []struct {
+		file, want string
+	}{
+		{"src/app.ts", "web/src/app.ts"},
+		{"./src/app.ts", "web/src/app.ts"},
+		{"../cmd/main.go", "cmd/main.go"},
+		{"/work/project/cmd/main.go", "cmd/main.go"},
+		{"/work/project", "."},
+		{"../../other/x.go", "../../other/x.go"},
+		{"/usr/include/stdio.h", "/usr/include/stdio.h"},
+		{"/work/projectx/a.go", "/work/projectx/a.go"},
+	}
+	for _, tt := range tests {
+		if got := run.relativePath(tt.file); got != tt.want {
+			t.Errorf("relativePath(%q) = %q; want %q", tt.file, got, tt.want)
+		}
+	}
+}
+
+// subscriber adds a subscriber to the diagnostics hub whose queue is read by
+// the test instead of being written to a websocket. The hub's diagnostics are
+// restored when the test ends.
+func subscriber(t *testing.T) *sessionClient {
+	c := newSessionClient(nil, principal{}, modeReadOnly)
+	ws := &wsConn{}
+	diagnostics.mu.Lock()
+	diagnostics.subscribers[ws] = c
+	saved := diagnostics.latest
+	diagnostics.latest = make(map[string]*diagnosticsMessage)
+	diagnostics.mu.Unlock()
+	t.Cleanup(func() {
+		diagnostics.mu.Lock()
+		delete(diagnostics.subscribers, ws)
+		diagnostics.latest = saved
+		diagnostics.mu.Unlock()
+	})
+	return c
+}
+
+// received decodes the diagnostics messages waiting in the client's queue.
+func received(c *sessionClient) []diagnosticsMessage {
+	var msgs []diagnosticsMessage
+	for {
+		select {
+		case m := <-c.queue:
+			var msg diagnosticsMessage
+			if json.Unmarshal(m.data, &msg) == nil {
+				msgs = append(msgs, msg)
+			}
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestProblemCollector(t *testing.T) {
+	long := strings.Repeat("x", taskMaxLine)
+	tests := []struct {
+		name   string
+		writes []string
+		found  [][]string // messages of the diagnostics in each published batch
+	}{
+		{"one line", []string{"a.go:1: one\n"}, [][]string{{"one"}}},
+		{"one batch per write", []string{"a.go:1: one\na.go:2: two\nok\n", "a.go:3: three\n"}, [][]string{{"one", "two"}, {"three"}}},
+		{"split across writes", []string{"a.g", "o:1: sp", "lit\n"}, [][]string{{"split"}}},
+		{"CRLF and colors", []string{"\x1b[31ma.go:1: red\x1b[0m\r\n"}, [][]string{{"red"}}},
+		{"unterminated last line", []string{"a.go:1: one\na.go:2: last"}, [][]string{{"one"}, {"last"}}},
+		{"over-long line cut", []string{"a.go:1: " + long + "\n"}, [][]string{{long[:taskMaxLine-len("a.go:1: ")]}}},
+		{"rest of an over-long line dropped", []string{long, long, "a.go:1: hidden\na.go:2: next\n"}, [][]string{{"next"}}},
+		{"no problems", []string{"building\n", "done\n"}, nil},
+	}
+	for _, tt := range tests {
+		c := subscriber(t)
+		run := &taskRun{root: "", task: "test-" + tt.name, id: "1", rootDir: "/work", cwd: "/work", matchers: []*problemMatcher{builtinMatchers["go"]}, names: []string{"go"}}
+		pc := run.collector()
+		for _, w := range tt.writes {
+			pc.Write([]byte(w))
+		}
+		pc.flush()
+		var got [][]string
+		for i, msg := range received(c) {
+			if msg.Type != "diagnostics" || msg.Reset != (i == 0) {
+				t.Errorf("%s: message %d is %s, reset %v", tt.name, i, msg.Type, msg.Reset)
+			}
+			var batch []string
+			for _, d := range msg.Diagnostics {
+				batch = append(batch, d.Message)
+			}
+			got = append(got, batch)
+		}
+		if !reflect.DeepEqual(got, tt.found) {
+			t.Errorf("%s: published %q; want %q", tt.name, got, tt.found)
+		}
+	}
+}
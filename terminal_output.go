@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxOSCLength bounds the payload of an OSC sequence kept while scanning
+// output; longer ones (such as inline images) are skipped.
+const maxOSCLength = 4096
+
+// maxCSILength bounds the parameters of a CSI sequence kept while scanning
+// output.
+const maxCSILength = 32
+
+// maxTitleLength bounds a session title, in bytes.
+const maxTitleLength = 256
+
+// Scanner states.
+const (
+	scanGround = iota
+	scanEscape // after ESC
+	scanOSC    // in ESC ] ... until BEL or ST
+	scanOSCEsc // ESC inside an OSC, possibly the start of ST (ESC \)
+	scanCSI    // in ESC [ ... until a final byte
+)
+
+// outputScanner picks the escape sequences Conduit cares about out of PTY
+// output. Sequences may be split across reads, so it keeps its state between
+// calls. It only observes: output is passed on to clients unchanged.
+type outputScanner struct {
+	state    int
+	osc      []byte
+	csi      []byte
+	overflow bool // the current OSC or CSI exceeded its limit
+
+	onOSC  func(payload string)     // called with e.g. "2;title"
+	onMode func(mode int, set bool) // called for each private mode set with CSI ? ... h or reset with l
+}
+
+func (sc *outputScanner) scan(p []byte) {
+	for _, b := range p {
+		switch sc.state {
+		case scanGround:
+			if b == 0x1b {
+				sc.state = scanEscape
+			}
+		case scanEscape:
+			switch b {
+			case ']':
+				sc.state = scanOSC
+				sc.osc, sc.overflow = sc.osc[:0], false
+			case '[':
+				sc.state = scanCSI
+				sc.csi, sc.overflow = sc.csi[:0], false
+			case 0x1b:
+			default:
+				sc.state = scanGround
+			}
+		case scanCSI:
+			switch {
+			case b >= 0x40 && b <= 0x7e: // final byte
+				sc.endCSI(b)
+			case b == 0x1b:
+				sc.state = scanEscape
+			case b == 0x18 || b == 0x1a:
+				sc.state = scanGround
+			case b < 0x20: // C0 controls are executed within a sequence
+			case len(sc.csi) < maxCSILength:
+				sc.csi = append(sc.csi, b)
+			default:
+				sc.overflow = true
+			}
+		case scanOSC:
+			switch b {
+			case 0x07: // BEL
+				sc.endOSC()
+			case 0x1b:
+				sc.state = scanOSCEsc
+			case 0x18, 0x1a: // CAN and SUB abort the sequence
+				sc.state = scanGround
+			default:
+				if len(sc.osc) < maxOSCLength {
+					sc.osc = append(sc.osc, b)
+				} else {
+					sc.overflow = true
+				}
+			}
+		case scanOSCEsc:
+			if b == '\\' {
+				sc.endOSC()
+			} else {
+				// Not ST: the OSC is abandoned and a new sequence begins.
+				sc.state = scanEscape
+				if b == ']' {
+					sc.state = scanOSC
+					sc.osc, sc.overflow = sc.osc[:0], false
+				}
+			}
+		}
+	}
+}
+
+func (sc *outputScanner) endOSC() {
+	sc.state = scanGround
+	if !sc.overflow && sc.onOSC != nil {
+		sc.onOSC(string(sc.osc))
+	}
+}
+
+// endCSI reports the private modes a CSI ? ... h or l sequence changes.
+// Other CSI sequences are of no interest.
+func (sc *outputScanner) endCSI(final byte) {
+	sc.state = scanGround
+	if sc.overflow || sc.onMode == nil || final != 'h' && final != 'l' {
+		return
+	}
+	params, ok := bytes.CutPrefix(sc.csi, []byte("?"))
+	if !ok {
+		return
+	}
+	for _, p := range bytes.Split(params, []byte(";")) {
+		if mode, err := strconv.Atoi(string(p)); err == nil {
+			sc.onMode(mode, final == 'h')
+		}
+	}
+}
+
+// handleOSC acts on an OSC sequence from the session's output.
+func (s *terminalSession) handleOSC(payload string) {
+	code, text, _ := strings.Cut(payload, ";")
+	switch code {
+	case "0", "2": // icon name and window title, or window title
+		s.setTitle(text)
+	case "9": // ConEmu-style; "9;9;<dir>" reports the working directory
+		if dir, ok := strings.CutPrefix(text, "9;"); ok {
+			s.shellCwd = dir
+		}
+	case "133":
+		s.shellMark(text)
+	}
+}
+
+// setTitle records the title a program set and tells the clients if it
+// changed.
+func (s *terminalSession) setTitle(title string) {
+	if len(title) > maxTitleLength {
+		title = title[:maxTitleLength]
+	}
+	s.mu.Lock()
+	if title == s.title {
+		s.mu.Unlock()
+		return
+	}
+	s.title = title
+	s.mu.Unlock()
+	s.broadcastJSON(wsMessage{Type: "titleChanged", Session: s.id, Title: title})
+}
+
+// shellCommand is a command line the shell ran, as reported by shell
+// integration.
+type shellCommand struct {
+	CommandLine string    `json:"commandLine"`
+	Cwd         string    `json:"cwd,omitempty"` // where it ran, if the shell reported it
+	Started     time.Time `json:"started"`
+	ExitCode    *int      `json:"exitCode,omitempty"`   // set in commandFinished, if the shell reported it
+	DurationMs  *int64    `json:"durationMs,omitempty"` // set in commandFinished
+}
+
+// shellMark handles an OSC 133 (FinalTerm) mark. Prompt marks (A and B)
+// need no action; C starts a command and D finishes it. A D without a
+// preceding C, as shells send for an empty command line, is ignored. C and D
+// count only with the nonce given to the session's integration script: any
+// program can print marks.
+func (s *terminalSession) shellMark(mark string) {
+	kind, params, _ := strings.Cut(mark, ";")
+	if kind != "C" && kind != "D" {
+		return
+	}
+	if s.shellNonce == "" || !slices.Contains(strings.Split(params, ";"), "nonce="+s.shellNonce) {
+		if debugEnabled() {
+			log.Printf("[DEBUG] Session #%d: ignored an OSC 133 %s mark without the session's nonce", s.id, kind)
+		}
+		return
+	}
+	switch kind {
+	case "C":
+		cmd := &shellCommand{Cwd: s.shellCwd, Started: time.Now().UTC()}
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(param, "cmdline_url="); ok {
+				if decoded, err := url.PathUnescape(v); err == nil {
+					cmd.CommandLine = decoded
+				}
+			} else if v, ok := strings.CutPrefix(param, "cmdline="); ok {
+				cmd.CommandLine = v
+			}
+		}
+		s.running = cmd
+		s.broadcastJSON(wsMessage{Type: "commandStarted", Session: s.id, Command: cmd})
+	case "D":
+		cmd := s.running
+		if cmd == nil {
+			return
+		}
+		s.running = nil
+		exit, _, _ := strings.Cut(params, ";")
+		if code, err := strconv.Atoi(exit); err == nil {
+			cmd.ExitCode = &code
+		}
+		duration := time.Since(cmd.Started).Milliseconds()
+		cmd.DurationMs = &duration
+		s.broadcastJSON(wsMessage{Type: "commandFinished", Session: s.id, Command: cmd})
+	}
+}
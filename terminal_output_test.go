@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestShellMarkNonce(t *testing.T) {
+	tests := []struct {
+		name    string
+		nonce   string
+		marks   []string
+		running bool   // a command is running afterwards
+		line    string // its command line
+	}{
+		{"with nonce", "n1", []string{"C;cmdline_url=make%20test;nonce=n1"}, true, "make test"},
+		{"nonce first", "n1", []string{"C;nonce=n1;cmdline_url=ls"}, true, "ls"},
+		{"without nonce", "n1", []string{"C;cmdline_url=rm%20-rf"}, false, ""},
+		{"wrong nonce", "n1", []string{"C;cmdline_url=rm;nonce=n2"}, false, ""},
+		{"nonce prefix", "n1", []string{"C;cmdline_url=rm;nonce=n"}, false, ""},
+		{"nonce in the command line", "n1", []string{"C;cmdline_url=nonce=n1"}, false, ""},
+		{"no integration", "", []string{"C;cmdline_url=ls;nonce="}, false, ""},
+		{"finished", "n1", []string{"C;cmdline_url=ls;nonce=n1", "D;0;nonce=n1"}, false, ""},
+		{"forged finish", "n1", []string{"C;cmdline_url=ls;nonce=n1", "D;0"}, true, "ls"},
+		{"prompt marks", "n1", []string{"A", "B"}, false, ""},
+	}
+	for _, tt := range tests {
+		s := &terminalSession{shellNonce: tt.nonce, clients: make(map[int32]*sessionClient)}
+		for _, mark := range tt.marks {
+			s.shellMark(mark)
+		}
+		if (s.running != nil) != tt.running {
+			t.Errorf("%s: running = %v; want %v", tt.name, s.running != nil, tt.running)
+		} else if s.running != nil && s.running.CommandLine != tt.line {
+			t.Errorf("%s: command line %q; want %q", tt.name, s.running.CommandLine, tt.line)
+		}
+	}
+}
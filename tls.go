@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const tlsDirName = "tls"
+const caCertFileName = "ca.pem"
+const caKeyFileName = "ca-key.pem"
+const leafCertFileName = "localhost.pem"
+const leafKeyFileName = "localhost-key.pem"
+
+// Leaf certificates are kept under 825 days, the longest validity macOS and iOS
+// will accept for a TLS server certificate, and renewed a month before expiry.
+const caValidity = 10 * 365 * 24 * time.Hour
+const leafValidity = 825 * 24 * time.Hour
+const leafRenewBefore = 30 * 24 * time.Hour
+
+// tlsEnabled reports whether the server should serve https:// and wss://.
+func tlsEnabled() bool {
+	return tlsSelfSignedFlag || tlsCertFlag != "" || tlsKeyFlag != ""
+}
+
+// resolveTLSFiles returns the certificate and key files to serve with. Files
+// given on the command line take priority; otherwise the local CA and a
+// localhost certificate are generated (or reused) in the config directory.
+func resolveTLSFiles() (certFile, keyFile string, err error) {
+	if tlsCertFlag != "" || tlsKeyFlag != "" {
+		if tlsCertFlag == "" || tlsKeyFlag == "" {
+			return "", "", fmt.Errorf("--tls-cert and --tls-key must be given together")
+		}
+		return tlsCertFlag, tlsKeyFlag, nil
+	}
+	dir, err := tlsConfigDir()
+	if err != nil {
+		return "", "", err
+	}
+	caCert, caKey, err := ensureLocalCA(dir)
+	if err != nil {
+		return "", "", err
+	}
+	certFile = filepath.Join(dir, leafCertFileName)
+	keyFile = filepath.Join(dir, leafKeyFileName)
+	if err := ensureLeafCertificate(certFile, keyFile, caCert, caKey); err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
+
+// tlsConfigDir returns the directory holding generated TLS material.
+func tlsConfigDir() (string, error) {
+	appConfigDir, err := conduitConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(appConfigDir, tlsDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating %s: %w", dir, err)
+	}
+	return dir, nil
+}
+
+// ensureLocalCA loads the local certificate authority, creating it on first use.
+// Once the CA exists it is never replaced here: the user has installed it in
+// their trust store, and a new one would silently stop being trusted.
+func ensureLocalCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(dir, caCertFileName)
+	keyPath := filepath.Join(dir, caKeyFileName)
+	redo := fmt.Sprintf("remove %s and run with --tls-self-signed again to create a new CA, then trust it with --tls-export-ca", dir)
+
+	cert, err := readCertificate(certPath)
+	if err == nil {
+		key, err := readPrivateKey(keyPath)
+		switch {
+		case err != nil:
+			return nil, nil, fmt.Errorf("can't use the local CA key: %v; %s", err, redo)
+		case !key.PublicKey.Equal(cert.PublicKey):
+			return nil, nil, fmt.Errorf("the local CA key %s doesn't belong to %s; %s", keyPath, certPath, redo)
+		case time.Now().After(cert.NotAfter):
+			return nil, nil, fmt.Errorf("the local CA %s expired on %s; %s", certPath, cert.NotAfter.Format("2006-01-02"), redo)
+		}
+		return cert, key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("reading %s: %w", certPath, err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generating CA key: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{Organization: []string{"Conduit"}, CommonName: fmt.Sprintf("Conduit Local CA (%s)", hostname)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating CA certificate: %w", err)
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", mustMarshalECKey(key), 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return nil, nil, err
+	}
+	cert, _ = x509.ParseCertificate(der)
+	log.Printf("Generated local certificate authority at %s. Run with --tls-export-ca to trust it.", certPath)
+	return cert, key, nil
+}
+
+// ensureLeafCertificate (re)issues the localhost server certificate when it is
+// missing, close to expiry, signed by a different CA or doesn't cover this host
+// and the address Conduit listens on.
+func ensureLeafCertificate(certPath, keyPath string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	hostname, _ := os.Hostname()
+	dnsNames := []string{"localhost"}
+	if hostname != "" && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+	for _, ip := range listenIPs(listenFlag) {
+		if !ip.IsLoopback() {
+			ips = append(ips, ip)
+		}
+	}
+	if listenFlag != "" && net.ParseIP(listenFlag) == nil && listenFlag != "localhost" && listenFlag != hostname {
+		dnsNames = append(dnsNames, listenFlag)
+	}
+
+	if cert, err := readCertificate(certPath); err == nil {
+		_, keyErr := readPrivateKey(keyPath)
+		fresh := time.Now().Add(leafRenewBefore).Before(cert.NotAfter)
+		if keyErr == nil && fresh && cert.CheckSignatureFrom(caCert) == nil && coversNames(cert, dnsNames) && coversIPs(cert, ips) {
+			return nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating server key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{Organization: []string{"Conduit"}, CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("creating server certificate: %w", err)
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", mustMarshalECKey(key), 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	log.Printf("Issued localhost certificate at %s (valid until %s)", certPath, template.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+// coversNames reports whether the certificate is valid for every name given.
+func coversNames(cert *x509.Certificate, names []string) bool {
+	for _, name := range names {
+		if cert.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// coversIPs reports whether the certificate is valid for every address given.
+func coversIPs(cert *x509.Certificate, ips []net.IP) bool {
+	for _, ip := range ips {
+		if cert.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// listenIPs returns the addresses clients may reach Conduit at when it listens
+// on addr: the address itself, or every interface address for 0.0.0.0 and ::.
+func listenIPs(addr string) []net.IP {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	if !ip.IsUnspecified() {
+		return []net.IP{ip}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips
+}
+
+// printTLSFingerprints handles --tls-fingerprint, printing the SHA-256
+// fingerprints of the certificates Conduit would serve with.
+func printTLSFingerprints() error {
+	if tlsCertFlag != "" {
+		cert, err := readCertificate(tlsCertFlag)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", tlsCertFlag, err)
+		}
+		fmt.Printf("Certificate (%s):\n  SHA-256 %s\n", tlsCertFlag, certFingerprint(cert))
+		return nil
+	}
+	certFile, _, err := resolveTLSFiles()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(certFile)
+	caCert, err := readCertificate(filepath.Join(dir, caCertFileName))
+	if err != nil {
+		return err
+	}
+	leaf, err := readCertificate(certFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Local CA (%s):\n  SHA-256 %s\n", filepath.Join(dir, caCertFileName), certFingerprint(caCert))
+	fmt.Printf("Server certificate (%s):\n  SHA-256 %s\n  Valid until %s\n", certFile, certFingerprint(leaf), leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// exportLocalCA handles --tls-export-ca, writing the local CA certificate to
+// dest ("-" for stdout) so it can be imported into a browser or OS trust store.
+func exportLocalCA(dest string) error {
+	if _, _, err := resolveTLSFiles(); err != nil {
+		return err
+	}
+	dir, err := tlsConfigDir()
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, caCertFileName))
+	if err != nil {
+		return err
+	}
+	if dest == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := ioutil.WriteFile(dest, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Exported Conduit local CA certificate to %s\n", dest)
+	return nil
+}
+
+// certFingerprint formats the SHA-256 digest of a certificate as colon-separated hex.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// --- PEM Helpers ---
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM key", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	return nil
+}
+
+func mustMarshalECKey(key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		// Only fails for unsupported curves, and we always use P-256.
+		panic(err)
+	}
+	return der
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return big.NewInt(time.Now().UnixNano())
+	}
+	return serial
+}
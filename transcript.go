@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// transcriptWidth is the line width used when turning output into lines.
+// Longer lines wrap.
+const transcriptWidth = 1000
+
+// Search limits.
+const (
+	maxSearchMatches = 200
+	maxSearchContext = 10
+)
+
+var errNoScrollback = errors.New("the session keeps no scrollback (scrollback.maxBytes is 0)")
+
+// --- Transcript ---
+
+// transcript turns the session's scrollback into lines, as a terminal would
+// show them: escape sequences are applied rather than kept, carriage returns
+// overwrite (so progress bars leave only their last state), and what
+// full-screen programs draw on the alternate screen is left out.
+func (s *terminalSession) transcript() ([][]vtCell, []byte, error) {
+	s.mu.Lock()
+	if s.scrollback == nil {
+		s.mu.Unlock()
+		return nil, nil, errNoScrollback
+	}
+	raw := s.scrollback.Bytes()
+	s.mu.Unlock()
+
+	vt := newVTEmulator(transcriptWidth, 1, 0)
+	vt.Write(raw)
+	lines := append(vt.history, vt.main[0])
+	// The last line is the one being written, usually the prompt; an empty
+	// one isn't part of the output.
+	if len(lines) > 0 && isBlankLine(lines[len(lines)-1]) {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, raw, nil
+}
+
+// transcriptTexts returns the text of the transcript's lines. It is kept
+// until more output arrives, so the searches of a client refining its query
+// don't replay the whole scrollback each time.
+func (s *terminalSession) transcriptTexts() ([]string, error) {
+	s.searchMu.Lock()
+	defer s.searchMu.Unlock()
+	s.mu.Lock()
+	if s.scrollback == nil {
+		s.mu.Unlock()
+		return nil, errNoScrollback
+	}
+	written := s.scrollback.written
+	s.mu.Unlock()
+	if s.searchTexts != nil && s.searchWritten == written {
+		return s.searchTexts, nil
+	}
+
+	lines, _, err := s.transcript()
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = lineText(line)
+	}
+	s.searchTexts, s.searchWritten = texts, written
+	return texts, nil
+}
+
+func isBlankLine(line []vtCell) bool {
+	for _, c := range line {
+		if c.r != 0 && c.r != ' ' {
+			return false
+		}
+	}
+	return true
+}
+
+// lineText returns a line's characters without trailing blanks.
+func lineText(line []vtCell) string {
+	var b strings.Builder
+	for _, c := range line {
+		switch c.r {
+		case wideTail:
+		case 0:
+			b.WriteByte(' ')
+		default:
+			b.WriteRune(c.r)
+		}
+	}
+	return strings.TrimRight(b.String(), " ")
+}
+
+// --- Search ---
+
+// searchRequest is a search of a session's scrollback, from a "search"
+// message or GET /sessions/<id>/search.
+type searchRequest struct {
+	Query      string
+	Regex      bool
+	IgnoreCase bool
+	Context    int // lines before and after each match
+}
+
+// searchMatch is one match. Lines are numbered from 1 at the start of the
+// kept output; columns count characters from 1.
+type searchMatch struct {
+	Line   int      `json:"line"`
+	Column int      `json:"column"`
+	Length int      `json:"length"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// searchResults is the reply to a search.
+type searchResults struct {
+	Matches   []searchMatch `json:"matches"`
+	Truncated bool          `json:"truncated,omitempty"` // more than maxSearchMatches matched
+}
+
+func (req searchRequest) pattern() (*regexp.Regexp, error) {
+	if req.Query == "" {
+		return nil, fmt.Errorf("query is required")
+	}
+	expr := req.Query
+	if !req.Regex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if req.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression: %v", err)
+	}
+	return re, nil
+}
+
+// search finds matches in the session's scrollback, with escape sequences
+// removed.
+func (s *terminalSession) search(req searchRequest) (*searchResults, error) {
+	re, err := req.pattern()
+	if err != nil {
+		return nil, err
+	}
+	texts, err := s.transcriptTexts()
+	if err != nil {
+		return nil, err
+	}
+	context := max(0, min(req.Context, maxSearchContext))
+	results := &searchResults{Matches: []searchMatch{}}
+	for i, text := range texts {
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			if loc[0] == loc[1] {
+				continue // empty matches, e.g. of "^"
+			}
+			if len(results.Matches) == maxSearchMatches {
+				results.Truncated = true
+				return results, nil
+			}
+			results.Matches = append(results.Matches, searchMatch{
+				Line:   i + 1,
+				Column: utf8.RuneCountInString(text[:loc[0]]) + 1,
+				Length: utf8.RuneCountInString(text[loc[0]:loc[1]]),
+				Text:   text,
+				Before: texts[max(0, i-context):i],
+				After:  texts[i+1 : min(len(texts), i+1+context)],
+			})
+		}
+	}
+	return results, nil
+}
+
+// searchSessionHandler serves GET /sessions/<id>/search?q=<query>, with
+// optional regex=true, ignoreCase=true and context=<lines>.
+func searchSessionHandler(w http.ResponseWriter, r *http.Request, idParam string) {
+	if _, ok := authorizeRequest(r); !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sess := sessionFromPath(w, idParam)
+	if sess == nil {
+		return
+	}
+	q := r.URL.Query()
+	req := searchRequest{Query: q.Get("q")}
+	req.Regex, _ = strconv.ParseBool(q.Get("regex"))
+	req.IgnoreCase, _ = strconv.ParseBool(q.Get("ignoreCase"))
+	if c := q.Get("context"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil {
+			http.Error(w, "context must be a number", http.StatusBadRequest)
+			return
+		}
+		req.Context = n
+	}
+	results, err := sess.search(req)
+	if err == errNoScrollback {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// --- Export ---
+
+// exportSessionHandler serves GET /sessions/<id>/export?format=text|ansi|html,
+// downloading the scrollback as plain text, as the raw output with its escape
+// sequences, or as an HTML page keeping the colors.
+func exportSessionHandler(w http.ResponseWriter, r *http.Request, idParam string) {
+	who, ok := authorizeRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sess := sessionFromPath(w, idParam)
+	if sess == nil {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	var contentType, ext string
+	switch format {
+	case "", "text":
+		format, contentType, ext = "text", "text/plain; charset=utf-8", "txt"
+	case "ansi":
+		contentType, ext = "text/plain; charset=utf-8", "ansi"
+	case "html":
+		contentType, ext = "text/html; charset=utf-8", "html"
+	default:
+		http.Error(w, "format must be text, ansi or html", http.StatusBadRequest)
+		return
+	}
+	lines, raw, err := sess.transcript()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	audit.record(auditEntry{Action: "session.export", Session: sess.id, Detail: format}.from(who))
+
+	name := fmt.Sprintf("session-%d.%s", sess.id, ext)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	switch format {
+	case "text":
+		var b strings.Builder
+		for _, line := range lines {
+			b.WriteString(lineText(line))
+			b.WriteByte('\n')
+		}
+		w.Write([]byte(b.String()))
+	case "ansi":
+		w.Write(raw)
+	case "html":
+		w.Write(transcriptHTML(fmt.Sprintf("Session #%d", sess.id), lines))
+	}
+}
+
+// transcriptHTML renders lines as a standalone page, with the colors and
+// attributes of the output as inline styles.
+func transcriptHTML(title string, lines [][]vtCell) []byte {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>")
+	b.WriteString(html.EscapeString(title))
+	b.WriteString("</title></head>\n<body style=\"margin:0\">")
+	b.WriteString("<pre style=\"margin:0;padding:1em;background:#1e1e1e;color:#d4d4d4;font-family:monospace\">")
+	for _, line := range lines {
+		n := len(line)
+		for n > 0 && line[n-1] == (vtCell{}) {
+			n--
+		}
+		pen := vtPen{}
+		for _, c := range line[:n] {
+			if c.r == wideTail {
+				continue
+			}
+			if c.pen != pen {
+				if pen != (vtPen{}) {
+					b.WriteString("</span>")
+				}
+				if c.pen != (vtPen{}) {
+					b.WriteString(`<span style="` + penStyle(c.pen) + `">`)
+				}
+				pen = c.pen
+			}
+			if c.r == 0 {
+				b.WriteByte(' ')
+			} else {
+				b.WriteString(html.EscapeString(string(c.r)))
+			}
+		}
+		if pen != (vtPen{}) {
+			b.WriteString("</span>")
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("</pre></body></html>\n")
+	return []byte(b.String())
+}
+
+// penStyle returns the CSS for a pen.
+func penStyle(pen vtPen) string {
+	fg, bg := cssColor(pen.fg, "#d4d4d4"), cssColor(pen.bg, "#1e1e1e")
+	if pen.attrs&attrBold != 0 && pen.fg&colorKind == colorPalette && pen.fg&0xff < 8 {
+		fg = cssColor(pen.fg+8, "") // bold shows the bright color, as in xterm
+	}
+	if pen.attrs&attrInverse != 0 {
+		fg, bg = bg, fg
+	}
+	var style []string
+	if pen.fg != colorDefault || pen.attrs&attrInverse != 0 {
+		style = append(style, "color:"+fg)
+	}
+	if pen.bg != colorDefault || pen.attrs&attrInverse != 0 {
+		style = append(style, "background:"+bg)
+	}
+	if pen.attrs&attrBold != 0 {
+		style = append(style, "font-weight:bold")
+	}
+	if pen.attrs&attrFaint != 0 {
+		style = append(style, "opacity:0.6")
+	}
+	if pen.attrs&attrItalic != 0 {
+		style = append(style, "font-style:italic")
+	}
+	var decoration []string
+	if pen.attrs&attrUnderline != 0 {
+		decoration = append(decoration, "underline")
+	}
+	if pen.attrs&attrStrike != 0 {
+		decoration = append(decoration, "line-through")
+	}
+	if len(decoration) > 0 {
+		style = append(style, "text-decoration:"+strings.Join(decoration, " "))
+	}
+	if pen.attrs&attrHidden != 0 {
+		style = append(style, "visibility:hidden")
+	}
+	return strings.Join(style, ";")
+}
+
+// ansiColors are the first 16 palette colors (xterm's defaults).
+var ansiColors = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+// cssColor returns the CSS color for c, or def for the default color.
+func cssColor(c vtColor, def string) string {
+	switch c & colorKind {
+	case colorRGB:
+		return fmt.Sprintf("#%06x", uint32(c&0xffffff))
+	case colorPalette:
+		i := int(c & 0xff)
+		switch {
+		case i < 16:
+			return ansiColors[i]
+		case i < 232: // 6x6x6 color cube
+			i -= 16
+			level := func(v int) int {
+				if v == 0 {
+					return 0
+				}
+				return 55 + v*40
+			}
+			return fmt.Sprintf("#%02x%02x%02x", level(i/36), level(i/6%6), level(i%6))
+		default: // grayscale ramp
+			v := 8 + (i-232)*10
+			return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+		}
+	}
+	return def
+}
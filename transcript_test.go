@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	const huge = "9223372036854775807"
+	tests := []struct {
+		name   string
+		output string
+		want   []string
+	}{
+		{"lines", "one\r\ntwo\r\n$ ", []string{"one", "two", "$"}},
+		{"trailing empty line dropped", "one\r\n", []string{"one"}},
+		{"carriage return overwrites", "10%\r50%\r100%\r\n", []string{"100%"}},
+		{"colors removed", "\x1b[1;31merror\x1b[0m: x\r\n", []string{"error: x"}},
+		{"alternate screen left out", "a\r\n\x1b[?1049hvim\x1b[?1049lb\r\n", []string{"a", "b"}},
+		{"huge cursor moves", "ab\x1b[" + huge + "Dc\x1b[" + huge + "Bd\x1b[" + huge + "E\r\n", []string{"cd"}},
+		{"huge parameters", "abc\x1b[2G\x1b[" + huge + "P\r\nxyz\x1b[" + huge + "D\x1b[" + huge + "Xw\r\n", []string{"a", "w"}},
+		{"overlong parameters", "p\x1b[99999999999999999999999999999999Aq\r\n", []string{"pq"}},
+	}
+	for _, tt := range tests {
+		s := &terminalSession{scrollback: newRingBuffer(1 << 16)}
+		s.scrollback.Write([]byte(tt.output))
+		lines, _, err := s.transcript()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got := []string{}
+		for _, line := range lines {
+			got = append(got, lineText(line))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: lines %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, _, err := (&terminalSession{}).transcript(); err != errNoScrollback {
+		t.Errorf("without scrollback: %v; want %v", err, errNoScrollback)
+	}
+}
+
+func TestSearchCache(t *testing.T) {
+	s := &terminalSession{scrollback: newRingBuffer(1 << 16)}
+	s.scrollback.Write([]byte("error: one\r\nok\r\n"))
+	search := func(query string) int {
+		t.Helper()
+		results, err := s.search(searchRequest{Query: query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(results.Matches)
+	}
+
+	// Searches reuse the lines until more output arrives.
+	if n := search("error"); n != 1 {
+		t.Errorf("%d matches; want 1", n)
+	}
+	cached := s.searchTexts
+	if n := search("ok"); n != 1 || &s.searchTexts[0] != &cached[0] {
+		t.Errorf("%d matches, lines reused %v", n, &s.searchTexts[0] == &cached[0])
+	}
+	s.scrollback.Write([]byte("error: two\r\n"))
+	if n := search("error"); n != 2 {
+		t.Errorf("after more output, %d matches; want 2", n)
+	}
+}
@@ -0,0 +1,993 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// --- Headless Terminal Emulator ---
+//
+// vtEmulator keeps the screen a client would show for a session: the grid of
+// characters with their colors, the cursor and the modes programs set. A
+// client attaching to a running session is sent a rendering of it instead of
+// the raw output, so full-screen programs look right straight away. It
+// implements the xterm sequences programs commonly use; anything else is
+// ignored.
+
+// vtHistoryLines bounds the lines kept above the screen of a session.
+const vtHistoryLines = 1000
+
+// vtMaxParam is the largest CSI parameter, as in xterm. Larger ones are
+// taken as this, so that cursor arithmetic can't overflow.
+const vtMaxParam = 65535
+
+// Cell attributes.
+const (
+	attrBold = 1 << iota
+	attrFaint
+	attrItalic
+	attrUnderline
+	attrBlink
+	attrInverse
+	attrHidden
+	attrStrike
+)
+
+// vtColor is a default, palette or RGB color.
+type vtColor uint32
+
+const (
+	colorDefault vtColor = 0
+	colorPalette vtColor = 1 << 24 // low byte is the index
+	colorRGB     vtColor = 2 << 24 // low 24 bits are the color
+	colorKind    vtColor = 3 << 24
+)
+
+type vtPen struct {
+	fg, bg vtColor
+	attrs  uint16
+}
+
+// wideTail marks the cell covered by the right half of a wide character.
+const wideTail rune = -1
+
+type vtCell struct {
+	r   rune // 0 for a blank cell
+	pen vtPen
+}
+
+type vtCursor struct {
+	x, y int
+	pen  vtPen
+}
+
+// Parser states.
+const (
+	vtGround = iota
+	vtEscape
+	vtEscapeSkip // ESC ( and the like take one more byte
+	vtCSI
+	vtString    // OSC, DCS, APC, PM or SOS, until BEL or ST
+	vtStringEsc // ESC inside a string
+)
+
+// vtPassModes are the private modes that only need restoring on the client:
+// cursor keys, mouse reporting, focus events and bracketed paste.
+var vtPassModes = []int{1, 1000, 1002, 1003, 1004, 1005, 1006, 1015, 2004}
+
+type vtEmulator struct {
+	cols, rows int
+	main, alt  [][]vtCell
+	altActive  bool
+	history    [][]vtCell // lines scrolled off the top of the main screen
+	maxHistory int        // 0 keeps every line
+
+	cur         vtCursor
+	wrapPending bool
+	saved       [2]vtCursor // main and alternate screen
+	top, bottom int         // scroll region
+	tabs        []bool
+
+	autowrap      bool
+	cursorVisible bool
+	origin        bool
+	insert        bool
+	appKeypad     bool
+	modes         map[int]bool // vtPassModes that are set
+
+	state   int
+	params  []byte // CSI parameters and intermediates
+	utf8buf []byte
+	last    rune // last printed character, for REP
+}
+
+func newVTEmulator(cols, rows, maxHistory int) *vtEmulator {
+	vt := &vtEmulator{maxHistory: maxHistory}
+	vt.reset(cols, rows)
+	return vt
+}
+
+func (vt *vtEmulator) reset(cols, rows int) {
+	*vt = vtEmulator{
+		cols:          cols,
+		rows:          rows,
+		main:          newVTGrid(cols, rows),
+		alt:           newVTGrid(cols, rows),
+		history:       vt.history,
+		maxHistory:    vt.maxHistory,
+		bottom:        rows - 1,
+		autowrap:      true,
+		cursorVisible: true,
+		modes:         make(map[int]bool),
+	}
+	vt.resetTabs()
+}
+
+func newVTGrid(cols, rows int) [][]vtCell {
+	grid := make([][]vtCell, rows)
+	for i := range grid {
+		grid[i] = make([]vtCell, cols)
+	}
+	return grid
+}
+
+func (vt *vtEmulator) resetTabs() {
+	vt.tabs = make([]bool, vt.cols)
+	for i := 8; i < vt.cols; i += 8 {
+		vt.tabs[i] = true
+	}
+}
+
+func (vt *vtEmulator) screen() [][]vtCell {
+	if vt.altActive {
+		return vt.alt
+	}
+	return vt.main
+}
+
+// resize changes the screen size. Lines that no longer fit above the cursor
+// move into the history.
+func (vt *vtEmulator) resize(cols, rows int) {
+	if cols < 1 || rows < 1 || cols == vt.cols && rows == vt.rows {
+		return
+	}
+	// fit resizes a grid. On the active screen, lines above the cursor are
+	// dropped to keep it on screen, into the history for the main screen.
+	fit := func(grid [][]vtCell, active, toHistory bool) [][]vtCell {
+		if drop := vt.cur.y - rows + 1; active && drop > 0 {
+			if toHistory {
+				for _, line := range grid[:drop] {
+					vt.pushHistory(line)
+				}
+			}
+			grid = grid[drop:]
+		}
+		if len(grid) > rows {
+			grid = grid[:rows]
+		}
+		for len(grid) < rows {
+			grid = append(grid, make([]vtCell, cols))
+		}
+		for i, line := range grid {
+			if len(line) > cols {
+				line = line[:cols]
+			}
+			for len(line) < cols {
+				line = append(line, vtCell{})
+			}
+			grid[i] = line
+		}
+		return grid
+	}
+	y := vt.cur.y
+	vt.main = fit(vt.main, !vt.altActive, true)
+	vt.alt = fit(vt.alt, vt.altActive, false)
+	if y >= rows {
+		y = rows - 1
+	}
+	vt.cols, vt.rows = cols, rows
+	vt.cur.y = y
+	vt.cur.x = min(vt.cur.x, cols-1)
+	vt.top, vt.bottom = 0, rows-1
+	vt.wrapPending = false
+	vt.resetTabs()
+}
+
+func (vt *vtEmulator) pushHistory(line []vtCell) {
+	// Trailing blanks take space and carry nothing.
+	n := len(line)
+	for n > 0 && line[n-1] == (vtCell{}) {
+		n--
+	}
+	vt.history = append(vt.history, append([]vtCell(nil), line[:n]...))
+	if over := len(vt.history) - vt.maxHistory; vt.maxHistory > 0 && over > 0 {
+		vt.history = append(vt.history[:0], vt.history[over:]...)
+	}
+}
+
+// Write feeds output from the PTY to the emulator.
+func (vt *vtEmulator) Write(p []byte) (int, error) {
+	for _, b := range p {
+		vt.feed(b)
+	}
+	return len(p), nil
+}
+
+func (vt *vtEmulator) feed(b byte) {
+	switch vt.state {
+	case vtString:
+		switch b {
+		case 0x07:
+			vt.state = vtGround
+		case 0x1b:
+			vt.state = vtStringEsc
+		case 0x18, 0x1a:
+			vt.state = vtGround
+		}
+		return
+	case vtStringEsc:
+		if b == '\\' {
+			vt.state = vtGround
+			return
+		}
+		vt.state = vtEscape
+		vt.escape(b)
+		return
+	case vtEscapeSkip:
+		vt.state = vtGround
+		return
+	}
+
+	// C0 controls act in every other state, even inside a CSI sequence.
+	if b < 0x20 || b == 0x7f {
+		vt.utf8buf = vt.utf8buf[:0]
+		switch b {
+		case 0x1b:
+			vt.state = vtEscape
+		case 0x18, 0x1a:
+			vt.state = vtGround
+		default:
+			vt.control(b)
+		}
+		return
+	}
+	switch vt.state {
+	case vtEscape:
+		vt.escape(b)
+	case vtCSI:
+		if b >= 0x40 && b <= 0x7e {
+			vt.state = vtGround
+			vt.csi(b)
+		} else if len(vt.params) < 64 {
+			vt.params = append(vt.params, b)
+		}
+	default:
+		vt.text(b)
+	}
+}
+
+// text handles a printable byte, decoding UTF-8.
+func (vt *vtEmulator) text(b byte) {
+	if b < 0x80 && len(vt.utf8buf) == 0 {
+		vt.print(rune(b))
+		return
+	}
+	vt.utf8buf = append(vt.utf8buf, b)
+	if !utf8.FullRune(vt.utf8buf) {
+		return
+	}
+	r, size := utf8.DecodeRune(vt.utf8buf)
+	rest := append([]byte(nil), vt.utf8buf[size:]...)
+	vt.utf8buf = vt.utf8buf[:0]
+	vt.print(r)
+	for _, b := range rest {
+		vt.text(b)
+	}
+}
+
+func (vt *vtEmulator) control(b byte) {
+	switch b {
+	case '\b':
+		vt.wrapPending = false
+		if vt.cur.x > 0 {
+			vt.cur.x--
+		}
+	case '\t':
+		vt.tab(1)
+	case '\n', '\v', '\f':
+		vt.lineFeed()
+	case '\r':
+		vt.wrapPending = false
+		vt.cur.x = 0
+	}
+}
+
+func (vt *vtEmulator) escape(b byte) {
+	vt.state = vtGround
+	switch b {
+	case '[':
+		vt.state = vtCSI
+		vt.params = vt.params[:0]
+	case ']', 'P', '_', '^', 'X':
+		vt.state = vtString
+	case '(', ')', '*', '+', '-', '.', '/', '#', '%', ' ':
+		vt.state = vtEscapeSkip
+	case '7':
+		vt.saveCursor()
+	case '8':
+		vt.restoreCursor()
+	case 'D':
+		vt.lineFeed()
+	case 'E':
+		vt.cur.x = 0
+		vt.lineFeed()
+	case 'M':
+		vt.reverseIndex()
+	case 'H':
+		vt.tabs[vt.cur.x] = true
+	case '=':
+		vt.appKeypad = true
+	case '>':
+		vt.appKeypad = false
+	case 'c':
+		vt.reset(vt.cols, vt.rows)
+	}
+}
+
+// print puts a character at the cursor and advances it.
+func (vt *vtEmulator) print(r rune) {
+	w := runeWidth(r)
+	if w == 0 {
+		return // combining marks are dropped
+	}
+	if w > vt.cols {
+		return
+	}
+	if vt.wrapPending && vt.autowrap {
+		vt.cur.x = 0
+		vt.lineFeed()
+	}
+	vt.wrapPending = false
+	if vt.cur.x+w > vt.cols {
+		if vt.autowrap {
+			vt.cur.x = 0
+			vt.lineFeed()
+		} else {
+			vt.cur.x = vt.cols - w
+		}
+	}
+	line := vt.screen()[vt.cur.y]
+	if vt.insert {
+		copy(line[vt.cur.x+w:], line[vt.cur.x:])
+	}
+	vt.clearWide(line, vt.cur.x, vt.cur.x+w)
+	line[vt.cur.x] = vtCell{r: r, pen: vt.cur.pen}
+	if w == 2 {
+		line[vt.cur.x+1] = vtCell{r: wideTail, pen: vt.cur.pen}
+	}
+	vt.last = r
+	vt.cur.x += w
+	if vt.cur.x >= vt.cols {
+		vt.cur.x = vt.cols - 1
+		vt.wrapPending = true
+	}
+}
+
+// clearWide blanks the halves of wide characters cut by overwriting cells
+// [from, to).
+func (vt *vtEmulator) clearWide(line []vtCell, from, to int) {
+	if from > 0 && from < len(line) && line[from].r == wideTail {
+		line[from-1] = vtCell{pen: line[from-1].pen}
+	}
+	if to < len(line) && line[to].r == wideTail {
+		line[to] = vtCell{pen: line[to].pen}
+	}
+}
+
+func (vt *vtEmulator) blank() vtCell {
+	return vtCell{pen: vtPen{bg: vt.cur.pen.bg}}
+}
+
+func (vt *vtEmulator) lineFeed() {
+	vt.wrapPending = false
+	if vt.cur.y == vt.bottom {
+		vt.scrollUp(1)
+	} else if vt.cur.y < vt.rows-1 {
+		vt.cur.y++
+	}
+}
+
+func (vt *vtEmulator) reverseIndex() {
+	vt.wrapPending = false
+	if vt.cur.y == vt.top {
+		vt.scrollDown(1)
+	} else if vt.cur.y > 0 {
+		vt.cur.y--
+	}
+}
+
+// scrollUp moves the lines of the scroll region up by n. Lines leaving the
+// top of the whole main screen go into the history.
+func (vt *vtEmulator) scrollUp(n int) {
+	vt.scrollLinesUp(n, vt.top == 0 && !vt.altActive)
+}
+
+func (vt *vtEmulator) scrollLinesUp(n int, toHistory bool) {
+	grid := vt.screen()
+	n = min(n, vt.bottom-vt.top+1)
+	for i := 0; i < n; i++ {
+		if toHistory {
+			vt.pushHistory(grid[0])
+		}
+		line := grid[vt.top]
+		copy(grid[vt.top:vt.bottom], grid[vt.top+1:vt.bottom+1])
+		vt.fill(line, 0, vt.cols)
+		grid[vt.bottom] = line
+	}
+}
+
+func (vt *vtEmulator) scrollDown(n int) {
+	grid := vt.screen()
+	n = min(n, vt.bottom-vt.top+1)
+	for i := 0; i < n; i++ {
+		line := grid[vt.bottom]
+		copy(grid[vt.top+1:vt.bottom+1], grid[vt.top:vt.bottom])
+		vt.fill(line, 0, vt.cols)
+		grid[vt.top] = line
+	}
+}
+
+func (vt *vtEmulator) fill(line []vtCell, from, to int) {
+	from, to = max(from, 0), min(to, len(line))
+	if from >= to {
+		return
+	}
+	vt.clearWide(line, from, to)
+	blank := vt.blank()
+	for i := from; i < to; i++ {
+		line[i] = blank
+	}
+}
+
+func (vt *vtEmulator) tab(n int) {
+	for ; n > 0 && vt.cur.x < vt.cols-1; n-- {
+		vt.cur.x++
+		for vt.cur.x < vt.cols-1 && !vt.tabs[vt.cur.x] {
+			vt.cur.x++
+		}
+	}
+}
+
+func (vt *vtEmulator) saveCursor() {
+	i := 0
+	if vt.altActive {
+		i = 1
+	}
+	vt.saved[i] = vt.cur
+}
+
+func (vt *vtEmulator) restoreCursor() {
+	i := 0
+	if vt.altActive {
+		i = 1
+	}
+	vt.cur = vt.saved[i]
+	vt.cur.x = min(vt.cur.x, vt.cols-1)
+	vt.cur.y = min(vt.cur.y, vt.rows-1)
+	vt.wrapPending = false
+}
+
+func (vt *vtEmulator) moveTo(x, y int) {
+	minY, maxY := 0, vt.rows-1
+	if vt.origin {
+		y += vt.top
+		minY, maxY = vt.top, vt.bottom
+	}
+	vt.cur.x = max(0, min(x, vt.cols-1))
+	vt.cur.y = max(minY, min(y, maxY))
+	vt.wrapPending = false
+}
+
+// csiParams splits "1;2:3" style parameters; sub-parameters after ':' are
+// kept with their parameter. Omitted and malformed ones are -1; the rest are
+// capped at vtMaxParam.
+func csiParams(raw []byte) [][]int {
+	var params [][]int
+	for _, group := range bytes.Split(raw, []byte(";")) {
+		var p []int
+		for _, sub := range bytes.Split(group, []byte(":")) {
+			n, err := strconv.ParseUint(string(sub), 10, 16)
+			switch {
+			case err == nil:
+			case errors.Is(err, strconv.ErrRange):
+				n = vtMaxParam
+			default:
+				p = append(p, -1)
+				continue
+			}
+			p = append(p, int(n))
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+func (vt *vtEmulator) csi(final byte) {
+	raw := vt.params
+	private := byte(0)
+	if len(raw) > 0 && raw[0] >= '<' && raw[0] <= '?' {
+		private, raw = raw[0], raw[1:]
+	}
+	var inter []byte
+	for len(raw) > 0 && raw[len(raw)-1] >= 0x20 && raw[len(raw)-1] <= 0x2f {
+		inter = append(inter, raw[len(raw)-1])
+		raw = raw[:len(raw)-1]
+	}
+	params := csiParams(raw)
+	// arg returns parameter i, or def if it is omitted or zero.
+	arg := func(i, def int) int {
+		if i < len(params) && params[i][0] > 0 {
+			return params[i][0]
+		}
+		return def
+	}
+	if len(inter) > 0 {
+		if string(inter) == "!" && final == 'p' { // DECSTR soft reset
+			vt.cur.pen = vtPen{}
+			vt.top, vt.bottom = 0, vt.rows-1
+			vt.autowrap, vt.cursorVisible, vt.origin, vt.insert = true, true, false, false
+		}
+		return
+	}
+	if private != 0 && private != '?' {
+		return
+	}
+	if private == '?' {
+		if final == 'h' || final == 'l' {
+			for i := range params {
+				vt.setPrivateMode(params[i][0], final == 'h')
+			}
+		}
+		return
+	}
+
+	grid := vt.screen()
+	line := grid[vt.cur.y]
+	switch final {
+	case '@': // ICH
+		n := min(arg(0, 1), vt.cols-vt.cur.x)
+		vt.clearWide(line, vt.cur.x, vt.cur.x)
+		copy(line[vt.cur.x+n:], line[vt.cur.x:])
+		vt.fill(line, vt.cur.x, vt.cur.x+n)
+	case 'A': // CUU
+		minY := 0
+		if vt.cur.y >= vt.top {
+			minY = vt.top
+		}
+		vt.cur.y = max(vt.cur.y-arg(0, 1), minY)
+		vt.wrapPending = false
+	case 'B', 'e': // CUD, VPR
+		maxY := vt.rows - 1
+		if vt.cur.y <= vt.bottom {
+			maxY = vt.bottom
+		}
+		vt.cur.y = min(vt.cur.y+min(arg(0, 1), vt.rows), maxY)
+		vt.wrapPending = false
+	case 'C', 'a': // CUF, HPR
+		vt.cur.x = min(vt.cur.x+min(arg(0, 1), vt.cols), vt.cols-1)
+		vt.wrapPending = false
+	case 'D': // CUB
+		vt.cur.x = max(vt.cur.x-arg(0, 1), 0)
+		vt.wrapPending = false
+	case 'E': // CNL
+		vt.cur.y = min(vt.cur.y+min(arg(0, 1), vt.rows), vt.rows-1)
+		vt.cur.x = 0
+		vt.wrapPending = false
+	case 'F': // CPL
+		vt.cur.y = max(vt.cur.y-arg(0, 1), 0)
+		vt.cur.x = 0
+		vt.wrapPending = false
+	case 'G', '`': // CHA, HPA
+		vt.cur.x = max(0, min(arg(0, 1)-1, vt.cols-1))
+		vt.wrapPending = false
+	case 'H', 'f': // CUP, HVP
+		vt.moveTo(arg(1, 1)-1, arg(0, 1)-1)
+	case 'I': // CHT
+		vt.tab(arg(0, 1))
+	case 'Z': // CBT
+		for n := arg(0, 1); n > 0 && vt.cur.x > 0; n-- {
+			vt.cur.x--
+			for vt.cur.x > 0 && !vt.tabs[vt.cur.x] {
+				vt.cur.x--
+			}
+		}
+	case 'J': // ED
+		switch arg(0, 0) {
+		case 0:
+			vt.fill(line, vt.cur.x, vt.cols)
+			for _, l := range grid[vt.cur.y+1:] {
+				vt.fill(l, 0, vt.cols)
+			}
+		case 1:
+			vt.fill(line, 0, vt.cur.x+1)
+			for _, l := range grid[:vt.cur.y] {
+				vt.fill(l, 0, vt.cols)
+			}
+		case 2:
+			for _, l := range grid {
+				vt.fill(l, 0, vt.cols)
+			}
+		case 3:
+			vt.history = nil
+		}
+	case 'K': // EL
+		switch arg(0, 0) {
+		case 0:
+			vt.fill(line, vt.cur.x, vt.cols)
+		case 1:
+			vt.fill(line, 0, vt.cur.x+1)
+		case 2:
+			vt.fill(line, 0, vt.cols)
+		}
+	case 'L', 'M': // IL, DL
+		if vt.cur.y < vt.top || vt.cur.y > vt.bottom {
+			return
+		}
+		top := vt.top
+		vt.top = vt.cur.y
+		if final == 'L' {
+			vt.scrollDown(arg(0, 1))
+		} else {
+			vt.scrollLinesUp(arg(0, 1), false) // deleted lines aren't history
+		}
+		vt.top = top
+		vt.cur.x = 0
+		vt.wrapPending = false
+	case 'P': // DCH
+		n := min(arg(0, 1), vt.cols-vt.cur.x)
+		vt.clearWide(line, vt.cur.x, vt.cur.x+n)
+		copy(line[vt.cur.x:], line[vt.cur.x+n:])
+		vt.fill(line, vt.cols-n, vt.cols)
+	case 'S': // SU
+		vt.scrollUp(arg(0, 1))
+	case 'T': // SD
+		if len(params) <= 1 {
+			vt.scrollDown(arg(0, 1))
+		}
+	case 'X': // ECH
+		vt.fill(line, vt.cur.x, vt.cur.x+min(arg(0, 1), vt.cols))
+	case 'b': // REP
+		if vt.last != 0 {
+			for n := min(arg(0, 1), vt.cols*vt.rows); n > 0; n-- {
+				vt.print(vt.last)
+			}
+		}
+	case 'd': // VPA
+		vt.moveTo(vt.cur.x, arg(0, 1)-1)
+	case 'g': // TBC
+		switch arg(0, 0) {
+		case 0:
+			vt.tabs[vt.cur.x] = false
+		case 3:
+			vt.tabs = make([]bool, vt.cols)
+		}
+	case 'h', 'l':
+		for i := range params {
+			if params[i][0] == 4 { // IRM
+				vt.insert = final == 'h'
+			}
+		}
+	case 'm':
+		vt.sgr(params)
+	case 'r': // DECSTBM
+		top, bottom := arg(0, 1)-1, arg(1, vt.rows)-1
+		if bottom >= vt.rows {
+			bottom = vt.rows - 1
+		}
+		if top < bottom {
+			vt.top, vt.bottom = top, bottom
+			vt.moveTo(0, 0)
+		}
+	case 's':
+		if len(raw) == 0 {
+			vt.saveCursor()
+		}
+	case 'u':
+		vt.restoreCursor()
+	}
+}
+
+func (vt *vtEmulator) setPrivateMode(mode int, on bool) {
+	switch mode {
+	case 6:
+		vt.origin = on
+		vt.moveTo(0, 0)
+	case 7:
+		vt.autowrap = on
+	case 25:
+		vt.cursorVisible = on
+	case 47, 1047, 1049:
+		if on == vt.altActive {
+			return
+		}
+		if on && mode == 1049 {
+			vt.saveCursor()
+		}
+		vt.altActive = on
+		if on && mode != 47 {
+			for _, l := range vt.alt {
+				vt.fill(l, 0, vt.cols)
+			}
+		}
+		if !on && mode == 1049 {
+			vt.restoreCursor()
+		}
+		vt.wrapPending = false
+	default:
+		for _, m := range vtPassModes {
+			if m == mode {
+				vt.modes[mode] = on
+			}
+		}
+	}
+}
+
+// sgr applies Select Graphic Rendition parameters to the pen.
+func (vt *vtEmulator) sgr(params [][]int) {
+	pen := &vt.cur.pen
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		code := max(p[0], 0)
+		switch {
+		case code == 0:
+			*pen = vtPen{}
+		case code == 1:
+			pen.attrs |= attrBold
+		case code == 2:
+			pen.attrs |= attrFaint
+		case code == 3:
+			pen.attrs |= attrItalic
+		case code == 4:
+			if len(p) > 1 && p[1] == 0 {
+				pen.attrs &^= attrUnderline
+			} else {
+				pen.attrs |= attrUnderline
+			}
+		case code == 5 || code == 6:
+			pen.attrs |= attrBlink
+		case code == 7:
+			pen.attrs |= attrInverse
+		case code == 8:
+			pen.attrs |= attrHidden
+		case code == 9:
+			pen.attrs |= attrStrike
+		case code == 21:
+			pen.attrs |= attrUnderline
+		case code == 22:
+			pen.attrs &^= attrBold | attrFaint
+		case code == 23:
+			pen.attrs &^= attrItalic
+		case code == 24:
+			pen.attrs &^= attrUnderline
+		case code == 25:
+			pen.attrs &^= attrBlink
+		case code == 27:
+			pen.attrs &^= attrInverse
+		case code == 28:
+			pen.attrs &^= attrHidden
+		case code == 29:
+			pen.attrs &^= attrStrike
+		case code >= 30 && code <= 37:
+			pen.fg = colorPalette | vtColor(code-30)
+		case code == 38 || code == 48:
+			var c vtColor
+			var ok bool
+			if len(p) > 1 {
+				c, ok = extendedColor(p[1:])
+			} else {
+				var used int
+				c, ok, used = extendedColorArgs(params[i+1:])
+				i += used
+			}
+			if ok && code == 38 {
+				pen.fg = c
+			} else if ok {
+				pen.bg = c
+			}
+		case code == 39:
+			pen.fg = colorDefault
+		case code >= 40 && code <= 47:
+			pen.bg = colorPalette | vtColor(code-40)
+		case code == 49:
+			pen.bg = colorDefault
+		case code >= 90 && code <= 97:
+			pen.fg = colorPalette | vtColor(code-90+8)
+		case code >= 100 && code <= 107:
+			pen.bg = colorPalette | vtColor(code-100+8)
+		}
+	}
+}
+
+// extendedColor parses the sub-parameters of 38:5:n or 38:2:[space]:r:g:b.
+func extendedColor(sub []int) (vtColor, bool) {
+	switch sub[0] {
+	case 5:
+		if len(sub) >= 2 && sub[1] >= 0 && sub[1] < 256 {
+			return colorPalette | vtColor(sub[1]), true
+		}
+	case 2:
+		rgb := sub[1:]
+		if len(rgb) >= 4 {
+			rgb = rgb[1:] // color space ID
+		}
+		if len(rgb) == 3 {
+			return rgbColor(rgb[0], rgb[1], rgb[2]), true
+		}
+	}
+	return 0, false
+}
+
+// extendedColorArgs parses 38;5;n or 38;2;r;g;b, returning how many of the
+// following parameters it used.
+func extendedColorArgs(rest [][]int) (vtColor, bool, int) {
+	if len(rest) == 0 {
+		return 0, false, 0
+	}
+	switch rest[0][0] {
+	case 5:
+		if len(rest) >= 2 && rest[1][0] >= 0 && rest[1][0] < 256 {
+			return colorPalette | vtColor(rest[1][0]), true, 2
+		}
+		return 0, false, len(rest)
+	case 2:
+		if len(rest) >= 4 {
+			return rgbColor(rest[1][0], rest[2][0], rest[3][0]), true, 4
+		}
+		return 0, false, len(rest)
+	}
+	return 0, false, 1
+}
+
+func rgbColor(r, g, b int) vtColor {
+	clamp := func(v int) vtColor { return vtColor(max(0, min(v, 255))) }
+	return colorRGB | clamp(r)<<16 | clamp(g)<<8 | clamp(b)
+}
+
+// runeWidth returns how many cells a character takes: 0 for combining marks
+// and format characters, 2 for East Asian wide characters and most emoji.
+func runeWidth(r rune) int {
+	switch {
+	case r < 0x300:
+		return 1
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0xa4cf && r != 0x303f,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f,
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
+
+// --- Snapshot ---
+
+// snapshot renders the history and screen as output that recreates them on
+// a freshly opened terminal of the same size: the main screen's lines are
+// printed so they scroll into the client's own scrollback, then the
+// alternate screen, cursor, colors and modes are restored.
+func (vt *vtEmulator) snapshot() []byte {
+	var b bytes.Buffer
+	b.WriteString("\x1b[0m")
+	lines := append(append([][]vtCell{}, vt.history...), vt.main...)
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		writeVTLine(&b, line)
+	}
+	// The cursor is on the main screen's last line. Moving relative to it
+	// works even if the client's screen is taller.
+	mainCur := vt.cur
+	if vt.altActive {
+		mainCur = vt.saved[0]
+	}
+	if up := vt.rows - 1 - mainCur.y; up > 0 {
+		b.WriteString("\x1b[" + strconv.Itoa(up) + "A")
+	}
+	b.WriteString("\r")
+	if mainCur.x > 0 {
+		b.WriteString("\x1b[" + strconv.Itoa(mainCur.x) + "C")
+	}
+	if vt.altActive {
+		b.WriteString("\x1b[?1049h")
+		for y, line := range vt.alt {
+			b.WriteString("\x1b[" + strconv.Itoa(y+1) + ";1H")
+			writeVTLine(&b, line)
+		}
+	}
+	if vt.top != 0 || vt.bottom != vt.rows-1 {
+		b.WriteString("\x1b[" + strconv.Itoa(vt.top+1) + ";" + strconv.Itoa(vt.bottom+1) + "r")
+	}
+	if vt.altActive || vt.top != 0 || vt.bottom != vt.rows-1 {
+		b.WriteString("\x1b[" + strconv.Itoa(vt.cur.y+1) + ";" + strconv.Itoa(vt.cur.x+1) + "H")
+	}
+	b.WriteString(sgrSequence(vt.cur.pen))
+	for _, m := range vtPassModes {
+		if vt.modes[m] {
+			b.WriteString("\x1b[?" + strconv.Itoa(m) + "h")
+		}
+	}
+	if !vt.autowrap {
+		b.WriteString("\x1b[?7l")
+	}
+	if !vt.cursorVisible {
+		b.WriteString("\x1b[?25l")
+	}
+	if vt.insert {
+		b.WriteString("\x1b[4h")
+	}
+	if vt.appKeypad {
+		b.WriteString("\x1b=")
+	}
+	return b.Bytes()
+}
+
+// writeVTLine renders a line up to its last non-blank cell, ending with the
+// default pen.
+func writeVTLine(b *bytes.Buffer, line []vtCell) {
+	n := len(line)
+	for n > 0 && line[n-1] == (vtCell{}) {
+		n--
+	}
+	pen := vtPen{}
+	for _, c := range line[:n] {
+		if c.r == wideTail {
+			continue
+		}
+		if c.pen != pen {
+			b.WriteString(sgrSequence(c.pen))
+			pen = c.pen
+		}
+		if c.r == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteRune(c.r)
+		}
+	}
+	if pen != (vtPen{}) {
+		b.WriteString("\x1b[0m")
+	}
+}
+
+// sgrSequence returns the SGR sequence that sets exactly pen.
+func sgrSequence(pen vtPen) string {
+	s := "\x1b[0"
+	for i, code := range []string{"1", "2", "3", "4", "5", "7", "8", "9"} {
+		if pen.attrs&(1<<i) != 0 {
+			s += ";" + code
+		}
+	}
+	s += sgrColor(pen.fg, "38")
+	s += sgrColor(pen.bg, "48")
+	return s + "m"
+}
+
+func sgrColor(c vtColor, base string) string {
+	switch c & colorKind {
+	case colorPalette:
+		return ";" + base + ";5;" + strconv.Itoa(int(c&0xff))
+	case colorRGB:
+		return ";" + base + ";2;" + strconv.Itoa(int(c>>16&0xff)) + ";" + strconv.Itoa(int(c>>8&0xff)) + ";" + strconv.Itoa(int(c&0xff))
+	}
+	return ""
+}
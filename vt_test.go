@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCSIParams(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want [][]int
+	}{
+		{"", [][]int{{-1}}},
+		{"5", [][]int{{5}}},
+		{"1;2", [][]int{{1}, {2}}},
+		{";7", [][]int{{-1}, {7}}},
+		{"38:2::1:2:3", [][]int{{38, 2, -1, 1, 2, 3}}},
+		{"65535", [][]int{{65535}}},
+		{"65536", [][]int{{vtMaxParam}}},
+		{"9223372036854775807", [][]int{{vtMaxParam}}},
+		{"99999999999999999999999999999999", [][]int{{vtMaxParam}}},
+		{"+5", [][]int{{-1}}},
+		{"-5", [][]int{{-1}}},
+		{"1x", [][]int{{-1}}},
+	}
+	for _, tt := range tests {
+		if got := csiParams([]byte(tt.raw)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("csiParams(%q) = %v; want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestCSICursor(t *testing.T) {
+	const huge = "9223372036854775807"
+	tests := []struct {
+		name   string
+		input  string
+		x, y   int
+		origin bool
+	}{
+		{"CUP", "\x1b[3;4H", 3, 2, false},
+		{"CUP defaults", "\x1b[3;4H\x1b[H", 0, 0, false},
+		{"CUP clamps", "\x1b[99;99H", 9, 4, false},
+		{"CUP huge", "\x1b[" + huge + ";" + huge + "H", 9, 4, false},
+		{"CUU", "\x1b[4;1H\x1b[2A", 0, 1, false},
+		{"CUU huge", "\x1b[4;1H\x1b[" + huge + "A", 0, 0, false},
+		{"CUD", "\x1b[2B", 0, 2, false},
+		{"CUD huge", "\x1b[" + huge + "B", 0, 4, false},
+		{"CUD overflowing", "\x1b[3;1H\x1b[99999999999999999999B", 0, 4, false},
+		{"VPR huge", "\x1b[" + huge + "e", 0, 4, false},
+		{"CUD stops at the scroll region", "\x1b[2;3r\x1b[" + huge + "B", 0, 2, false},
+		{"CUD below the scroll region", "\x1b[1;2r\x1b[4;1H\x1b[" + huge + "B", 0, 4, false},
+		{"CUF", "\x1b[3C", 3, 0, false},
+		{"CUF huge", "\x1b[5G\x1b[" + huge + "C", 9, 0, false},
+		{"HPR huge", "\x1b[" + huge + "a", 9, 0, false},
+		{"CUB", "\x1b[6G\x1b[2D", 3, 0, false},
+		{"CUB huge", "\x1b[6G\x1b[" + huge + "D", 0, 0, false},
+		{"CNL", "\x1b[5G\x1b[2E", 0, 2, false},
+		{"CNL huge", "\x1b[2;5H\x1b[" + huge + "E", 0, 4, false},
+		{"CPL huge", "\x1b[4;5H\x1b[" + huge + "F", 0, 0, false},
+		{"CHA", "\x1b[7G", 6, 0, false},
+		{"CHA huge", "\x1b[" + huge + "G", 9, 0, false},
+		{"HPA huge", "\x1b[" + huge + "`", 9, 0, false},
+		{"VPA", "\x1b[3d", 0, 2, false},
+		{"VPA huge", "\x1b[" + huge + "d", 0, 4, false},
+		{"CHT", "\x1b[I", 8, 0, false},
+		{"CHT huge", "\x1b[" + huge + "I", 9, 0, false},
+		{"CBT huge", "\x1b[10G\x1b[" + huge + "Z", 0, 0, false},
+		{"origin mode CUP", "\x1b[2;4r\x1b[?6h\x1b[2;1H", 0, 2, true},
+		{"origin mode CUP huge", "\x1b[2;4r\x1b[?6h\x1b[" + huge + ";" + huge + "H", 9, 3, true},
+		{"DECSTBM huge", "\x1b[" + huge + ";" + huge + "r\x1b[" + huge + "B", 0, 4, false},
+	}
+	for _, tt := range tests {
+		vt := newVTEmulator(10, 5, 0)
+		vt.Write([]byte(tt.input))
+		if vt.cur.x != tt.x || vt.cur.y != tt.y || vt.origin != tt.origin {
+			t.Errorf("%s: cursor at %d,%d (origin %v); want %d,%d (origin %v)", tt.name, vt.cur.x, vt.cur.y, vt.origin, tt.x, tt.y, tt.origin)
+		}
+	}
+}
+
+func TestCSIEdit(t *testing.T) {
+	const huge = "9223372036854775807"
+	tests := []struct {
+		name  string
+		input string
+		line  string
+	}{
+		{"ICH", "\x1b[3G\x1b[2@", "ab  cdefgh"},
+		{"ICH huge", "\x1b[3G\x1b[" + huge + "@", "ab"},
+		{"DCH", "\x1b[3G\x1b[2P", "abefghij"},
+		{"DCH huge", "\x1b[3G\x1b[" + huge + "P", "ab"},
+		{"ECH", "\x1b[3G\x1b[2X", "ab  efghij"},
+		{"ECH huge", "\x1b[3G\x1b[" + huge + "X", "ab"},
+		{"EL to end", "\x1b[3G\x1b[K", "ab"},
+		{"EL to start", "\x1b[3G\x1b[1K", "   defghij"},
+		{"EL all", "\x1b[2K", ""},
+		{"REP", "\x1b[3G\x1b[2b", "abjjefghij"},
+		{"REP huge wraps and scrolls", "\x1b[3G\x1b[" + huge + "b", "jjjjjjjjjj"},
+		{"ED", "\x1b[J", ""},
+		{"wide character split by ECH", "\x1b[H世\x1b[2G\x1b[X", "  cdefghij"},
+	}
+	for _, tt := range tests {
+		vt := newVTEmulator(10, 3, 0)
+		vt.Write([]byte("abcdefghij\x1b[H" + tt.input))
+		if got := lineText(vt.screen()[0]); got != tt.line {
+			t.Errorf("%s: line %q; want %q", tt.name, got, tt.line)
+		}
+	}
+}
+
+func TestCSIScroll(t *testing.T) {
+	const huge = "9223372036854775807"
+	tests := []struct {
+		name  string
+		input string
+		lines []string
+	}{
+		{"SU", "\x1b[S", []string{"2", "3", ""}},
+		{"SU huge", "\x1b[" + huge + "S", []string{"", "", ""}},
+		{"SD", "\x1b[T", []string{"", "1", "2"}},
+		{"SD huge", "\x1b[" + huge + "T", []string{"", "", ""}},
+		{"IL", "\x1b[2;1H\x1b[L", []string{"1", "", "2"}},
+		{"IL huge", "\x1b[2;1H\x1b[" + huge + "L", []string{"1", "", ""}},
+		{"DL", "\x1b[1;1H\x1b[M", []string{"2", "3", ""}},
+		{"DL huge", "\x1b[2;1H\x1b[" + huge + "M", []string{"1", "", ""}},
+		{"scroll region", "\x1b[1;2r\x1b[S", []string{"2", "", "3"}},
+	}
+	for _, tt := range tests {
+		vt := newVTEmulator(1, 3, 0)
+		vt.Write([]byte("1\r\n2\r\n3\x1b[H" + tt.input))
+		var got []string
+		for y := 0; y < 3; y++ {
+			got = append(got, lineText(vt.screen()[y]))
+		}
+		if !reflect.DeepEqual(got, tt.lines) {
+			t.Errorf("%s: lines %q; want %q", tt.name, got, tt.lines)
+		}
+	}
+}
+
+// TestCSIExtremeParams sends every CSI final byte with extreme parameters in
+// various states. None may panic or leave the cursor off the screen.
+func TestCSIExtremeParams(t *testing.T) {
+	params := []string{"", "0", "1", "65535", "65536", "2147483648", "9223372036854775807", "99999999999999999999", "1;9223372036854775807", "9223372036854775807;9223372036854775807", "?9223372036854775807", "38;2;9223372036854775807;1;1", "38:5:9223372036854775807"}
+	states := []string{"", "\x1b[2;3r", "\x1b[2;3r\x1b[?6h", "\x1b[?1049h", "\x1b[3;5H世"}
+	for _, state := range states {
+		for _, param := range params {
+			for final := byte(0x40); final <= 0x7e; final++ {
+				vt := newVTEmulator(6, 4, 10)
+				seq := fmt.Sprintf("%s\x1b[%s%c", state, param, final)
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("%q panicked: %v", seq, r)
+						}
+					}()
+					vt.Write([]byte(seq + "x"))
+					vt.snapshot()
+				}()
+				if vt.cur.x < 0 || vt.cur.x >= vt.cols || vt.cur.y < 0 || vt.cur.y >= vt.rows {
+					t.Errorf("%q: cursor at %d,%d", seq, vt.cur.x, vt.cur.y)
+				}
+			}
+		}
+	}
+}